@@ -1,50 +1,95 @@
 package main
 
 import (
-	"crypto/rand"
+	"bufio"
 	"fmt"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/identity"
 	"github.com/Fybrk/fybrk/internal/network"
+	"github.com/Fybrk/fybrk/internal/pairing"
+	"github.com/Fybrk/fybrk/internal/protocol"
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/internal/sync"
 	"github.com/Fybrk/fybrk/pkg/fybrk"
+	"github.com/Fybrk/fybrk/pkg/types"
 )
 
+// drainTimeout bounds how long shutdown waits for transfers in progress
+const drainTimeout = 30 * time.Second
+
 func main() {
 	if len(os.Args) < 2 {
 		showUsage()
 		os.Exit(1)
 	}
 
+	// Commands that work on the daemon and its folders rather than one path
+	switch os.Args[1] {
+	case "folder":
+		runFolder(os.Args[2:])
+		return
+	case "daemon":
+		runDaemon(os.Args[2:])
+		return
+	case "status":
+		runStatus(os.Args[2:])
+		return
+	case "pause", "resume":
+		runPauseResume(os.Args[1], os.Args[2:])
+		return
+	}
+
 	var syncPath, command string
+	var commandArgs []string
 
 	// Parse arguments - support multiple formats:
-	// fybrk /path command
+	// fybrk /path command [args...]
 	// fybrk command /path
-	// fybrk command (defaults to current directory)
-	// fybrk pair-with <qr-data>
+	// fybrk command [args...] (defaults to current directory)
+	// fybrk pair-with <pair-url> [path]
 	if len(os.Args) >= 2 && os.Args[1] == "pair-with" {
 		// Handle pair-with command specially
-		if len(os.Args) < 3 {
-			fmt.Println("Error: QR code data required")
-			fmt.Println("Usage: fybrk pair-with '<QR-CODE-DATA>'")
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			fmt.Println("Error: pair URL required")
+			fmt.Println("Usage: fybrk pair-with '<PAIR-URL>' [path]")
 			os.Exit(1)
 		}
-		qrData := os.Args[2]
-		runPairWith(qrData)
+		syncPath = "."
+		if len(os.Args) == 4 {
+			syncPath = os.Args[3]
+		}
+		runPairWith(os.Args[2], syncPath)
 		return
-	} else if len(os.Args) == 3 {
+	} else if len(os.Args) >= 3 {
 		arg1, arg2 := os.Args[1], os.Args[2]
 
 		// Check if first arg is a command
 		if isValidCommand(arg1) {
 			command = arg1
-			syncPath = arg2
+			syncPath = "."
+			if takesArgs(command) {
+				commandArgs = os.Args[2:]
+			} else if len(os.Args) == 3 {
+				syncPath = arg2
+			} else {
+				showUsage()
+				os.Exit(1)
+			}
 		} else {
 			// Assume first arg is path, second is command
 			syncPath = arg1
 			command = arg2
+			commandArgs = os.Args[3:]
 		}
 	} else if len(os.Args) == 2 {
 		// Single argument - could be help request, command, or path
@@ -61,13 +106,10 @@ func main() {
 			syncPath = arg
 			command = "sync"
 		}
-	} else if len(os.Args) == 1 {
+	} else {
 		// No arguments - default to current directory and sync
 		syncPath = "."
 		command = "sync"
-	} else {
-		showUsage()
-		os.Exit(1)
 	}
 
 	// Validate command
@@ -76,6 +118,11 @@ func main() {
 		showUsage()
 		os.Exit(1)
 	}
+	if len(commandArgs) > 0 && !takesArgs(command) {
+		fmt.Printf("Error: '%s' takes no arguments\n\n", command)
+		showUsage()
+		os.Exit(1)
+	}
 
 	// Convert to absolute path
 	absPath, err := filepath.Abs(syncPath)
@@ -91,6 +138,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	// A running daemon holds the folder open, so ask it instead
+	if command == "list" || command == "pair" || command == "sync" {
+		if daemon := daemonSyncing(syncPath); daemon != nil {
+			runWithDaemon(daemon, command, syncPath)
+			return
+		}
+	}
+
 	// Setup database path
 	dbPath := filepath.Join(syncPath, ".fybrk", "metadata.db")
 
@@ -101,39 +156,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Generate or load encryption key
-	key := make([]byte, 32)
+	// Generate the folder key on first use
 	keyPath := filepath.Join(fybrDir, "key")
 	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		// Generate new key
-		if _, err := rand.Read(key); err != nil {
+		if _, err := storage.LoadOrCreateKeyRing(fybrDir, nil); err != nil {
 			fmt.Printf("Error generating encryption key: %v\n", err)
 			os.Exit(1)
 		}
-		if err := os.WriteFile(keyPath, key, 0600); err != nil {
-			fmt.Printf("Error saving encryption key: %v\n", err)
-			os.Exit(1)
-		}
 		fmt.Println("Generated new encryption key")
-	} else {
-		// Load existing key
-		key, err = os.ReadFile(keyPath)
-		if err != nil {
-			fmt.Printf("Error loading encryption key: %v\n", err)
-			os.Exit(1)
-		}
 	}
 
-	// Create Fybrk client
-	config := &fybrk.Config{
-		SyncPath:  syncPath,
-		DBPath:    dbPath,
-		DeviceID:  "local-device",
-		ChunkSize: 1024 * 1024, // 1MB chunks
-		Key:       key,
+	// The device identity is per user, shared by all synced folders
+	id, err := config.LoadOrCreateIdentity()
+	if err != nil {
+		fmt.Printf("Error loading device identity: %v\n", err)
+		os.Exit(1)
 	}
 
-	client, err := fybrk.NewClient(config)
+	// Create Fybrk client
+	client, err := fybrk.NewClient(newClientConfig(syncPath, id))
 	if err != nil {
 		fmt.Printf("Error initializing Fybrk client: %v\n", err)
 		os.Exit(1)
@@ -150,11 +191,56 @@ func main() {
 		runList(client)
 	case "pair":
 		runPair(client, syncPath)
+	case "rotate-key":
+		runRotateKey(client, commandArgs)
+	case "passwd":
+		runPasswd(client)
+	case "devices":
+		runDevices(client, commandArgs)
+	case "conflicts":
+		runConflicts(client, commandArgs)
+	case "history":
+		runHistory(client, syncPath, commandArgs)
+	case "restore":
+		runRestore(client, syncPath, commandArgs)
+	case "trash":
+		runTrash(client, syncPath, commandArgs)
 	}
 }
 
+// newClientConfig returns the configuration of the folder at syncPath
+func newClientConfig(syncPath string, id *identity.Identity) *fybrk.Config {
+	fybrDir := filepath.Join(syncPath, ".fybrk")
+	clientConfig := &fybrk.Config{
+		SyncPath:   syncPath,
+		DBPath:     filepath.Join(fybrDir, "metadata.db"),
+		Identity:   id,
+		ChunkSize:  1024 * 1024, // 1MB chunks
+		KeyDir:     fybrDir,
+		Passphrase: storage.PassphraseFromEnvOrTerminal("Passphrase for " + syncPath + ": "),
+	}
+
+	// Settings from ~/.fybrk/config.json apply to every folder
+	if cfg, err := config.LoadConfig(); err != nil {
+		fmt.Printf("Warning: ignoring config.json: %v\n", err)
+	} else {
+		clientConfig.VersionRetention = cfg.VersionRetention
+		clientConfig.TrashRetention = cfg.TrashRetention()
+	}
+
+	// Folders registered with the daemon keep their conflict policies
+	if configDir, err := config.GetConfigDir(); err == nil {
+		folders, _ := config.LoadFolders(configDir)
+		if folder := config.FindFolder(folders, syncPath); folder != nil {
+			clientConfig.ConflictPolicy = folder.ConflictPolicy
+			clientConfig.ConflictRules = folder.ConflictRules
+		}
+	}
+	return clientConfig
+}
+
 func isValidCommand(cmd string) bool {
-	validCommands := []string{"sync", "init", "list", "pair", "pair-with"}
+	validCommands := []string{"sync", "init", "list", "pair", "pair-with", "rotate-key", "passwd", "devices", "conflicts", "history", "restore", "trash"}
 	for _, valid := range validCommands {
 		if cmd == valid {
 			return true
@@ -163,6 +249,16 @@ func isValidCommand(cmd string) bool {
 	return false
 }
 
+// takesArgs reports whether a command accepts arguments after its name, in
+// which case the sync path can only be given before the command
+func takesArgs(cmd string) bool {
+	switch cmd {
+	case "rotate-key", "devices", "conflicts", "history", "restore", "trash":
+		return true
+	}
+	return false
+}
+
 func showUsage() {
 	fmt.Println("Fybrk - Secure Peer-to-Peer File Synchronization")
 	fmt.Println()
@@ -177,7 +273,26 @@ func showUsage() {
 	fmt.Println("  sync      Start real-time synchronization (default)")
 	fmt.Println("  list      List all tracked files and their status")
 	fmt.Println("  pair      Generate QR code to pair with other devices")
-	fmt.Println("  pair-with Join sync network from QR code")
+	fmt.Println("  pair-with <url> [path]")
+	fmt.Println("            Join a folder from a pair URL")
+	fmt.Println("  rotate-key [device...]")
+	fmt.Println("            Rotate the folder key, revoking the listed devices")
+	fmt.Println("  passwd    Set, change or remove the passphrase protecting the key")
+	fmt.Println("  devices [list|rename|revoke|trust]")
+	fmt.Println("            Manage the devices allowed to sync this folder")
+	fmt.Println("  conflicts [list|resolve <id> current|copy|both]")
+	fmt.Println("            List files edited on two devices at once and resolve them")
+	fmt.Println("  history <file>, restore <file> --version <id>")
+	fmt.Println("            List the past versions kept of a file and bring one back")
+	fmt.Println("  trash [list|restore <id|file>|empty]")
+	fmt.Println("            Recover files deleted on other devices")
+	fmt.Println("  folder [list|add|remove|policy]")
+	fmt.Println("            Manage the folders the daemon syncs")
+	fmt.Println("  daemon [start|stop|--foreground]")
+	fmt.Println("            Sync every added folder from one background process")
+	fmt.Println("  status    Show the running daemon and its folders")
+	fmt.Println("  pause [folder], resume [folder]")
+	fmt.Println("            Pause or resume syncing one folder, or all of them")
 	fmt.Println()
 	fmt.Println("WORKFLOW:")
 	fmt.Println("  Device A:")
@@ -185,15 +300,27 @@ func showUsage() {
 	fmt.Println("    2. fybrk pair                    # Generate QR code")
 	fmt.Println("    3. fybrk sync                    # Start syncing")
 	fmt.Println("  Device B:")
-	fmt.Println("    1. fybrk pair-with '<QR-DATA>'   # Join from QR code")
+	fmt.Println("    1. fybrk pair-with '<PAIR-URL>'  # Join from QR code")
 	fmt.Println("    2. fybrk sync                    # Start syncing")
 	fmt.Println()
 	fmt.Println("WHAT EACH COMMAND DOES:")
 	fmt.Println("  init      - Creates .fybrk folder, generates encryption key, scans files")
-	fmt.Println("  pair      - Creates internet rendezvous point, shows QR code")
-	fmt.Println("  pair-with - Joins sync network from QR code (works over internet)")
+	fmt.Println("  pair      - Shows a one-time pair URL and waits for a device to use it")
+	fmt.Println("  pair-with - Pairs with the inviting device and receives the folder key")
 	fmt.Println("  sync      - Monitors for file changes and syncs with paired devices")
 	fmt.Println("  list      - Shows all files being tracked with version info")
+	fmt.Println("  rotate-key - Starts a new key epoch; removed devices cannot read new data")
+	fmt.Println("  passwd    - Seals .fybrk/key with a passphrase (empty to remove it)")
+	fmt.Println("  devices   - Lists paired devices; rename, revoke or re-trust one by ID prefix")
+	fmt.Println("  conflicts - The losing edit is kept as name.sync-conflict-<date>-<device>.ext;")
+	fmt.Println("              resolve keeps the current version, the copy, or both files")
+	fmt.Println("  trash     - Files other devices delete are moved to .fybrk/trash and kept")
+	fmt.Println("              for 30 days by default; restoring one syncs it back to every device")
+	fmt.Println("  folder    - Adds or removes folders by path or folder ID; each keeps its own key")
+	fmt.Println("  folder policy - Settles conflicts by merge (default), newest-mtime, largest,")
+	fmt.Println("              keep-both or prefer-device:<id>, for a folder or matching files")
+	fmt.Println("  daemon    - Syncs all added folders, sharing one port between them;")
+	fmt.Println("              'list', 'pair' and 'folder' go through it while it runs")
 	fmt.Println()
 	fmt.Println("EXAMPLES:")
 	fmt.Println("  fybrk init                     # Initialize current directory")
@@ -201,6 +328,13 @@ func showUsage() {
 	fmt.Println("  fybrk                          # Sync current directory")
 	fmt.Println("  fybrk ~/Documents              # Sync ~/Documents")
 	fmt.Println("  fybrk list                     # List files in current directory")
+	fmt.Println("  fybrk rotate-key old-laptop    # Rotate key and revoke a device")
+	fmt.Println("  fybrk devices rename 3f2a Work # Rename a paired device")
+	fmt.Println("  fybrk devices revoke 3f2a      # Refuse a lost device")
+	fmt.Println("  fybrk conflicts resolve 3 copy # Keep the conflicting copy instead")
+	fmt.Println("  fybrk folder add ~/Photos      # Sync ~/Photos from the daemon")
+	fmt.Println("  fybrk pause ~/Photos           # Stop syncing ~/Photos for now")
+	fmt.Println("  fybrk folder policy ~/Art keep-both '*.psd'")
 	fmt.Println()
 	fmt.Println("OPTIONS:")
 	fmt.Println("  help, -h, --help              Show this help message")
@@ -210,6 +344,26 @@ func showUsage() {
 	fmt.Println("  This creates a .fybrk folder with:")
 	fmt.Println("  - metadata.db (SQLite database with file info)")
 	fmt.Println("  - key (32-byte encryption key)")
+	fmt.Println("  - keyring.json (earlier keys, once the key has been rotated)")
+	fmt.Println()
+	fmt.Println("PASSPHRASE PROTECTION:")
+	fmt.Println("  After 'fybrk passwd' the key file is sealed with a passphrase-derived")
+	fmt.Println("  key (Argon2id). fybrk asks for it at startup, or reads it from the")
+	fmt.Println("  FYBRK_PASSPHRASE environment variable. 'passwd' takes the new")
+	fmt.Println("  passphrase from FYBRK_NEW_PASSPHRASE or FYBRK_PASSPHRASE when set.")
+	fmt.Println()
+	fmt.Println("CONFIGURATION:")
+	fmt.Println("  ~/.fybrk/config.json applies to every folder. Past versions of files")
+	fmt.Println("  are kept for 'history' and 'restore': by default the last 10 and one")
+	fmt.Println("  a day for 30 days. Change that with")
+	fmt.Println("    \"version_retention\": {\"keep_last\": 20, \"keep_daily\": 90}")
+	fmt.Println("  Files other devices delete stay in the trash for 30 days, or")
+	fmt.Println("    \"trash_retention_days\": 7")
+	fmt.Println("  A running 'sync' or daemon applies changes on SIGHUP.")
+	fmt.Println()
+	fmt.Println("DAEMON CONTROL API:")
+	fmt.Println("  While 'fybrk daemon' runs it serves a REST API on the Unix socket")
+	fmt.Println("  ~/.fybrk/daemon.sock and records its pid in ~/.fybrk/daemon.pid.")
 	fmt.Println()
 	fmt.Println("MULTI-DEVICE SYNC:")
 	fmt.Println("  After initializing, run 'sync' on each device.")
@@ -218,15 +372,69 @@ func showUsage() {
 
 func runSync(client *fybrk.Client, syncPath string) {
 	fmt.Printf("Starting Fybrk sync for: %s\n", syncPath)
-	fmt.Println("Press Ctrl+C to stop...")
 
 	// Initial scan
 	if err := client.ScanDirectory(); err != nil {
 		fmt.Printf("Error during initial scan: %v\n", err)
 	}
 
-	// Keep running to watch for changes
-	select {} // Block forever
+	// Peers reach a single folder on the port the daemon would use
+	if err := client.EnableMultiDeviceSync(fybrk.DefaultDaemonPort); err != nil {
+		fmt.Printf("Error starting peer network: %v\n", err)
+		fmt.Println("If a daemon is running, add the folder to it with 'fybrk folder add'")
+		os.Exit(1)
+	}
+	fmt.Printf("Listening for devices on port %d\n", fybrk.DefaultDaemonPort)
+	fmt.Println("Press Ctrl+C to stop; send SIGHUP after editing config.json")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadConfig(client.SetRetention)
+	}
+	if err := shutdownSync(signals, client.Shutdown); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// reloadConfig re-reads ~/.fybrk/config.json and applies its retention
+// settings through setRetention
+func reloadConfig(setRetention func(*storage.VersionRetention, time.Duration)) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Printf("Error reloading config.json: %v\n", err)
+		return
+	}
+	setRetention(cfg.VersionRetention, cfg.TrashRetention())
+	fmt.Println("Reloaded config.json")
+}
+
+// shutdownSync stops syncing after a signal, giving transfers in progress
+// up to drainTimeout to finish, and prints a summary. Another interrupt
+// exits at once.
+func shutdownSync(signals <-chan os.Signal, shutdown func(time.Duration) (*fybrk.ShutdownSummary, error)) error {
+	fmt.Println()
+	fmt.Println("Shutting down, finishing transfers in progress (Ctrl+C again to force)...")
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				fmt.Println("Forced exit")
+				os.Exit(1)
+			}
+		}
+	}()
+
+	summary, err := shutdown(drainTimeout)
+	fmt.Printf("Stopped. Sent %d and received %d files with %d connected devices.\n",
+		summary.FilesSent, summary.FilesReceived, summary.Peers)
+	if summary.Interrupted > 0 {
+		fmt.Printf("%d transfers were interrupted and will resume on the next sync.\n", summary.Interrupted)
+	}
+	return err
 }
 
 func runScan(client *fybrk.Client, syncPath string) {
@@ -252,7 +460,10 @@ func runList(client *fybrk.Client) {
 		fmt.Printf("Error listing files: %v\n", err)
 		os.Exit(1)
 	}
+	printFiles(files)
+}
 
+func printFiles(files []*types.FileMetadata) {
 	if len(files) == 0 {
 		fmt.Println("No files found")
 		return
@@ -265,90 +476,1029 @@ func runList(client *fybrk.Client) {
 	}
 }
 
-func runPair(client *fybrk.Client, syncPath string) {
-	fmt.Printf("Generating internet-capable pairing QR code for: %s\n", syncPath)
+func runRotateKey(client *fybrk.Client, revoke []string) {
+	epoch, err := client.RotateKey(revoke...)
+	if err != nil {
+		fmt.Printf("Error rotating key: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Rotated folder key to epoch %d\n", epoch)
+	for _, device := range revoke {
+		fmt.Printf("  Revoked: %s\n", device)
+	}
 	fmt.Println()
+	fmt.Println("Existing chunks were re-encrypted with the new key. Your other")
+	fmt.Println("devices receive it the next time they connect; revoked devices")
+	fmt.Println("keep only what they already had.")
+}
 
-	// Check if directory is initialized
-	keyPath := filepath.Join(syncPath, ".fybrk", "key")
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		fmt.Println("Error: Directory not initialized. Run 'init' first.")
+func runPasswd(client *fybrk.Client) {
+	passphrase, err := storage.ReadNewPassphrase()
+	if err != nil {
+		fmt.Printf("Error reading passphrase: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := client.ChangePassphrase(passphrase); err != nil {
+		fmt.Printf("Error changing passphrase: %v\n", err)
+		os.Exit(1)
+	}
+
+	if passphrase == "" {
+		fmt.Println("Passphrase removed; the folder key is stored unprotected")
+	} else {
+		fmt.Println("Folder key is now protected by the new passphrase")
+	}
+}
+
+func runDevices(client *fybrk.Client, args []string) {
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+
+	switch subcommand {
+	case "list":
+		listDevices(client)
 		return
+	case "rename":
+		if len(args) < 2 {
+			fmt.Println("Usage: fybrk devices rename <device> <name>")
+			os.Exit(1)
+		}
+	case "revoke":
+		if len(args) != 1 {
+			fmt.Println("Usage: fybrk devices revoke <device>")
+			os.Exit(1)
+		}
+	case "trust":
+		if len(args) < 1 || len(args) > 2 {
+			fmt.Println("Usage: fybrk devices trust <device> [level]")
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Error: Unknown devices command '%s'\n", subcommand)
+		fmt.Println("Usage: fybrk devices [list|rename|revoke|trust]")
+		os.Exit(1)
 	}
 
-	// Read encryption key
-	key, err := os.ReadFile(keyPath)
+	deviceID, err := resolveDevice(client, args[0])
 	if err != nil {
-		fmt.Printf("Error reading encryption key: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch subcommand {
+	case "rename":
+		name := strings.Join(args[1:], " ")
+		err = client.RenameDevice(deviceID, name)
+		if err == nil {
+			fmt.Printf("Renamed %s to %q\n", deviceID, name)
+		}
+	case "revoke":
+		err = client.RevokeDevice(deviceID)
+		if err == nil {
+			fmt.Printf("Revoked %s; it can no longer connect\n", deviceID)
+			fmt.Println("It still holds the folder key. Run 'fybrk rotate-key " + deviceID + "'")
+			fmt.Println("so it cannot read anything written from now on.")
+		}
+	case "trust":
+		level := pairing.TrustLevelTrusted
+		if len(args) == 2 {
+			level, err = strconv.Atoi(args[1])
+			if err != nil || level < pairing.TrustLevelBasic || level > pairing.TrustLevelOwner {
+				fmt.Printf("Error: Trust level must be %d (basic), %d (trusted) or %d (owner)\n",
+					pairing.TrustLevelBasic, pairing.TrustLevelTrusted, pairing.TrustLevelOwner)
+				os.Exit(1)
+			}
+		}
+		err = client.TrustDevice(deviceID, level)
+		if err == nil {
+			fmt.Printf("Set trust level of %s to %d\n", deviceID, level)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error updating device: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runConflicts(client *fybrk.Client, args []string) {
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+
+	switch subcommand {
+	case "list":
+		all := len(args) == 1 && args[0] == "--all"
+		if len(args) > 0 && !all {
+			fmt.Println("Usage: fybrk conflicts list [--all]")
+			os.Exit(1)
+		}
+		listConflicts(client, all)
+	case "resolve":
+		if len(args) != 2 {
+			fmt.Println("Usage: fybrk conflicts resolve <id> current|copy|both")
+			os.Exit(1)
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			fmt.Printf("Error: Invalid conflict ID '%s'\n", args[0])
+			os.Exit(1)
+		}
+		if err := client.ResolveConflict(id, args[1]); err != nil {
+			fmt.Printf("Error resolving conflict: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Resolved conflict %d, keeping %s\n", id, args[1])
+	default:
+		fmt.Printf("Error: Unknown conflicts command '%s'\n", subcommand)
+		fmt.Println("Usage: fybrk conflicts [list|resolve]")
+		os.Exit(1)
+	}
+}
+
+func listConflicts(client *fybrk.Client, all bool) {
+	conflicts, err := client.ListConflicts(all)
+	if err != nil {
+		fmt.Printf("Error listing conflicts: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(conflicts) == 0 {
+		fmt.Println("No conflicts")
 		return
 	}
 
-	fmt.Println("Creating rendezvous point for internet pairing...")
+	fmt.Printf("Found %d conflicts:\n", len(conflicts))
+	for _, conflict := range conflicts {
+		state := "open"
+		if conflict.Resolved() {
+			state = "resolved (" + conflict.Resolution + ")"
+		}
+		fmt.Printf("  %d  %s  %s\n", conflict.ID, conflict.Path, state)
+		if conflict.Resolution == protocol.ResolutionMerge {
+			fmt.Printf("      merged; our side of the conflicting lines kept in %s\n", conflict.CopyPath)
+		} else if conflict.CopyPath != "" {
+			fmt.Printf("      our version kept as %s\n", conflict.CopyPath)
+		} else {
+			fmt.Println("      our version was replaced by the conflict policy")
+		}
+		fmt.Printf("      lost to %s on %s\n", conflict.DeviceID, conflict.DetectedAt.Format("2006-01-02 15:04"))
+	}
+}
 
-	// Create pairing data with real QR code generation
-	pairingData := map[string]interface{}{
-		"version":        1,
-		"sync_path":      syncPath,
-		"encryption_key": fmt.Sprintf("%x", key),
-		"expires_at":     time.Now().Add(10 * time.Minute).Unix(),
-		"created_at":     time.Now().Unix(),
-		"device_id":      "temp-device-id", // TODO: Get from client
+func runHistory(client *fybrk.Client, syncPath string, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: fybrk history <file>")
+		os.Exit(1)
 	}
+	relPath := folderPath(syncPath, args[0])
 
-	// Generate QR code using real library
-	qrGen := network.NewQRGenerator()
-	qrData, err := qrGen.GenerateQRCode(pairingData)
+	versions, err := client.FileHistory(relPath)
+	if err != nil {
+		fmt.Printf("Error reading history: %v\n", err)
+		os.Exit(1)
+	}
+
+	var current *types.FileMetadata
+	files, err := client.GetSyncedFiles()
+	if err != nil {
+		fmt.Printf("Error listing files: %v\n", err)
+		os.Exit(1)
+	}
+	for _, file := range files {
+		if file.Path == relPath {
+			current = file
+		}
+	}
+
+	if current == nil && len(versions) == 0 {
+		fmt.Printf("No history kept for %s\n", relPath)
+		return
+	}
+
+	names := map[string]string{client.DeviceID(): "this device"}
+	if devices, err := client.ListDevices(); err == nil {
+		for _, device := range devices {
+			names[device.ID] = device.Name
+		}
+	}
+	deviceName := func(id string) string {
+		if name, ok := names[id]; ok {
+			return name
+		}
+		if id == "" {
+			return "unknown device"
+		}
+		return id
+	}
+
+	fmt.Printf("History of %s:\n", relPath)
+	if current != nil {
+		fmt.Printf("  current  %s  %d bytes  by %s\n",
+			current.ModTime.Format("2006-01-02 15:04"), current.Size, deviceName(current.ModifiedBy))
+	} else {
+		fmt.Println("  (deleted)")
+	}
+	for _, version := range versions {
+		fmt.Printf("  %-7d  %s  %d bytes  by %s, replaced %s\n",
+			version.ID, version.ModTime.Format("2006-01-02 15:04"), version.Size,
+			deviceName(version.ModifiedBy), version.ReplacedAt.Format("2006-01-02 15:04"))
+	}
+	if len(versions) > 0 {
+		fmt.Printf("Restore one with: fybrk restore %s --version <id>\n", args[0])
+	}
+}
+
+func runRestore(client *fybrk.Client, syncPath string, args []string) {
+	var files []string
+	var versionArg string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--version" && i+1 < len(args) {
+			versionArg = args[i+1]
+			i++
+		} else if value, ok := strings.CutPrefix(args[i], "--version="); ok {
+			versionArg = value
+		} else {
+			files = append(files, args[i])
+		}
+	}
+	if len(files) != 1 || versionArg == "" {
+		fmt.Println("Usage: fybrk restore <file> --version <id>")
+		fmt.Println("       See 'fybrk history <file>' for the versions kept")
+		os.Exit(1)
+	}
+
+	id, err := strconv.ParseInt(versionArg, 10, 64)
+	if err != nil {
+		fmt.Printf("Error: Invalid version '%s'\n", versionArg)
+		os.Exit(1)
+	}
+
+	relPath := folderPath(syncPath, files[0])
+	if err := client.RestoreVersion(relPath, id); err != nil {
+		fmt.Printf("Error restoring %s: %v\n", relPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored version %d of %s\n", id, relPath)
+	fmt.Println("The version it replaced is kept in its history")
+}
+
+func runTrash(client *fybrk.Client, syncPath string, args []string) {
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+
+	switch subcommand {
+	case "list":
+		if len(args) > 0 {
+			fmt.Println("Usage: fybrk trash list")
+			os.Exit(1)
+		}
+		listTrash(client)
+	case "restore":
+		if len(args) != 1 {
+			fmt.Println("Usage: fybrk trash restore <id|file>")
+			os.Exit(1)
+		}
+		id, err := findTrashEntry(client, syncPath, args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		entry, err := client.RestoreFromTrash(id)
+		if err != nil {
+			fmt.Printf("Error restoring from the trash: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %s\n", entry.Path)
+	case "empty":
+		if len(args) > 0 {
+			fmt.Println("Usage: fybrk trash empty")
+			os.Exit(1)
+		}
+		count, err := client.EmptyTrash()
+		if err != nil {
+			fmt.Printf("Error emptying the trash: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted %d files from the trash\n", count)
+	default:
+		fmt.Printf("Error: Unknown trash command '%s'\n", subcommand)
+		fmt.Println("Usage: fybrk trash [list|restore|empty]")
+		os.Exit(1)
+	}
+}
+
+func listTrash(client *fybrk.Client) {
+	entries, err := client.ListTrash()
+	if err != nil {
+		fmt.Printf("Error listing the trash: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("The trash is empty")
+		return
+	}
+
+	names := map[string]string{}
+	if devices, err := client.ListDevices(); err == nil {
+		for _, device := range devices {
+			names[device.ID] = device.Name
+		}
+	}
+
+	fmt.Printf("Found %d files in the trash:\n", len(entries))
+	for _, entry := range entries {
+		deletedBy := entry.DeletedBy
+		if name, ok := names[deletedBy]; ok {
+			deletedBy = name
+		}
+		size := fmt.Sprintf("%d bytes", entry.Size)
+		if entry.IsDir {
+			size = "folder"
+		}
+		fmt.Printf("  %s  %s  %s\n", entry.ID, entry.Path, size)
+		fmt.Printf("      deleted by %s on %s\n", deletedBy, entry.DeletedAt.Format("2006-01-02 15:04"))
+	}
+}
+
+// findTrashEntry returns the ID of the trash entry idOrFile names: an
+// entry ID, or the path a file was deleted from, its latest deletion
+func findTrashEntry(client *fybrk.Client, syncPath, idOrFile string) (string, error) {
+	entries, err := client.ListTrash()
+	if err != nil {
+		return "", err
+	}
+	relPath := folderPath(syncPath, idOrFile)
+	for _, entry := range entries {
+		if entry.ID == idOrFile || entry.Path == relPath {
+			return entry.ID, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in the trash", idOrFile)
+}
+
+// folderPath returns the path of file within the sync folder. A path that
+// leads into the folder from the current directory is used as such;
+// anything else is taken as relative to the folder.
+func folderPath(syncPath, file string) string {
+	if absPath, err := filepath.Abs(file); err == nil {
+		rel, err := filepath.Rel(syncPath, absPath)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return rel
+		}
+	}
+	return filepath.Clean(file)
+}
+
+func listDevices(client *fybrk.Client) {
+	devices, err := client.ListDevices()
+	if err != nil {
+		fmt.Printf("Error listing devices: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("No paired devices")
+		return
+	}
+
+	connected := make(map[string]bool)
+	for _, id := range client.GetConnectedDevices() {
+		connected[id] = true
+	}
+
+	fmt.Printf("Found %d devices:\n", len(devices))
+	for _, device := range devices {
+		status := "offline"
+		if device.Revoked {
+			status = "revoked"
+		} else if connected[device.ID] {
+			status = "online"
+		}
+		fmt.Printf("  %s  %-20s trust %d  %s (last seen %s)\n",
+			device.ID, device.Name, device.TrustLevel, status, device.LastSeen.Format("2006-01-02 15:04"))
+	}
+}
+
+// resolveDevice finds the device whose ID starts with prefix
+func resolveDevice(client *fybrk.Client, prefix string) (string, error) {
+	devices, err := client.ListDevices()
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, device := range devices {
+		if device.ID == prefix {
+			return device.ID, nil
+		}
+		if strings.HasPrefix(device.ID, prefix) {
+			matches = append(matches, device.ID)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no paired device matches '%s'", prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("'%s' matches %d devices; use more of the ID", prefix, len(matches))
+	}
+}
+
+func runFolder(args []string) {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	action := "list"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	// A running daemon starts or stops the folder at once
+	daemon, _ := fybrk.DialDaemon(configDir)
+
+	switch {
+	case action == "list" && len(args) == 0:
+		listFolders(configDir, daemon)
+	case action == "add" && len(args) == 1:
+		var folder *config.Folder
+		if daemon != nil {
+			folder, err = daemon.AddFolder(args[0])
+		} else {
+			folder, err = config.AddFolder(configDir, args[0])
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Added folder %s: %s\n", folder.ID, folder.Path)
+		if daemon == nil {
+			fmt.Println("It is synced by 'fybrk daemon'")
+		}
+	case action == "remove" && len(args) == 1:
+		var folder *config.Folder
+		if daemon != nil {
+			folder, err = daemon.RemoveFolder(args[0])
+		} else {
+			folder, err = config.RemoveFolder(configDir, args[0])
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed folder %s: %s\n", folder.ID, folder.Path)
+		fmt.Println("Its files and .fybrk data were left in place")
+	case action == "policy" && (len(args) == 2 || len(args) == 3):
+		setConflictPolicy(configDir, daemon, args)
+	default:
+		fmt.Println("Usage: fybrk folder [list]")
+		fmt.Println("       fybrk folder add <path>")
+		fmt.Println("       fybrk folder remove <folder-id|path>")
+		fmt.Println("       fybrk folder policy <folder-id|path> <policy|default> [pattern]")
+		os.Exit(1)
+	}
+}
+
+// setConflictPolicy sets how conflicts are settled in a folder, or in the
+// files matching a pattern
+func setConflictPolicy(configDir string, daemon *fybrk.ControlClient, args []string) {
+	policy := args[1]
+	if policy == "default" {
+		policy = ""
+	} else if _, err := sync.NewConflictResolver(policy); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Policies: merge, newest-mtime, largest, keep-both, prefer-device:<device-id>")
+		os.Exit(1)
+	}
+
+	var pattern string
+	if len(args) == 3 {
+		pattern = args[2]
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Printf("Error: Invalid pattern '%s'\n", pattern)
+			os.Exit(1)
+		}
+	}
+
+	folder, err := config.SetConflictPolicy(configDir, args[0], pattern, policy)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The daemon reads the policy when it opens the folder
+	if daemon != nil && !folder.Paused {
+		if err := daemon.Pause(folder.ID); err == nil {
+			err = daemon.Resume(folder.ID)
+		}
+		if err != nil {
+			fmt.Printf("Error restarting folder: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	defaultPolicy := folder.ConflictPolicy
+	if defaultPolicy == "" {
+		defaultPolicy = sync.DefaultConflictPolicy
+	}
+	fmt.Printf("Conflicts in %s: %s\n", folder.Path, defaultPolicy)
+	for _, rule := range folder.ConflictRules {
+		fmt.Printf("  %-20s %s\n", rule.Pattern, rule.Policy)
+	}
+}
+
+func listFolders(configDir string, daemon *fybrk.ControlClient) {
+	if daemon != nil {
+		folders, err := daemon.Folders()
+		if err != nil {
+			fmt.Printf("Error listing folders: %v\n", err)
+			os.Exit(1)
+		}
+		printFolderStatus(folders)
+		return
+	}
+
+	folders, err := config.LoadFolders(configDir)
+	if err != nil {
+		fmt.Printf("Error listing folders: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(folders) == 0 {
+		fmt.Println("No folders added. Use 'fybrk folder add <path>'.")
+		return
+	}
+
+	fmt.Printf("%-16s  %-10s  %s\n", "FOLDER ID", "ADDED", "PATH")
+	for _, folder := range folders {
+		fmt.Printf("%-16s  %-10s  %s\n", folder.ID, folder.AddedAt.Format("2006-01-02"), folder.Path)
+	}
+}
+
+func printFolderStatus(folders []*fybrk.FolderStatus) {
+	if len(folders) == 0 {
+		fmt.Println("No folders added. Use 'fybrk folder add <path>'.")
+		return
+	}
+
+	fmt.Printf("%-16s  %-8s  %-7s  %s\n", "FOLDER ID", "STATE", "DEVICES", "PATH")
+	for _, folder := range folders {
+		state := "syncing"
+		switch {
+		case folder.Paused:
+			state = "paused"
+		case folder.Error != "":
+			state = "failed"
+		case !folder.Running:
+			state = "stopped"
+		}
+		fmt.Printf("%-16s  %-8s  %-7d  %s\n", folder.ID, state, len(folder.ConnectedDevices), folder.Path)
+		if folder.Error != "" {
+			fmt.Printf("%-16s  %s\n", "", folder.Error)
+		}
+	}
+}
+
+func runDaemon(args []string) {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	action := "start"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch {
+	case action == "start" && len(args) <= 1:
+		startDaemon(configDir)
+	case action == "--foreground" && len(args) == 1:
+		runDaemonForeground(configDir)
+	case action == "stop" && len(args) == 1:
+		stopDaemon(configDir)
+	default:
+		fmt.Println("Usage: fybrk daemon [start]")
+		fmt.Println("       fybrk daemon stop")
+		fmt.Println("       fybrk daemon --foreground")
+		os.Exit(1)
+	}
+}
+
+// startDaemon runs the daemon in a detached process and waits until its
+// control socket answers, so scripts can use it as soon as this returns
+func startDaemon(configDir string) {
+	if _, err := fybrk.DialDaemon(configDir); err == nil {
+		fmt.Println("Fybrk daemon is already running")
+		return
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	logPath := filepath.Join(configDir, "daemon.log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Printf("Error opening daemon log: %v\n", err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(executable, "daemon", "--foreground")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("Error starting daemon: %v\n", err)
+		os.Exit(1)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case <-exited:
+			fmt.Printf("Error: daemon exited during startup; see %s\n", logPath)
+			os.Exit(1)
+		case <-deadline:
+			fmt.Printf("Error: daemon did not answer in time; see %s\n", logPath)
+			os.Exit(1)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if _, err := fybrk.DialDaemon(configDir); err == nil {
+			fmt.Printf("Fybrk daemon started (pid %d)\n", cmd.Process.Pid)
+			fmt.Printf("Logging to %s\n", logPath)
+			return
+		}
+	}
+}
+
+func runDaemonForeground(configDir string) {
+	id, err := config.LoadOrCreateIdentity()
+	if err != nil {
+		fmt.Printf("Error loading device identity: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Printf("Warning: ignoring config.json: %v\n", err)
+	}
+
+	daemon := fybrk.NewDaemon(fybrk.DaemonConfig{
+		ConfigDir: configDir,
+		Identity:  id,
+		Port:      fybrk.DefaultDaemonPort,
+		Passphrase: func(syncPath string) storage.PassphraseFunc {
+			return storage.PassphraseFromEnvOrTerminal("Passphrase for " + syncPath + ": ")
+		},
+		VersionRetention: cfg.VersionRetention,
+		TrashRetention:   cfg.TrashRetention(),
+	})
+	if err := daemon.Start(); err != nil {
+		fmt.Printf("Error starting daemon: %v\n", err)
+		os.Exit(1)
+	}
+	defer daemon.Close()
+
+	control, err := fybrk.ServeControl(daemon)
+	if err != nil {
+		fmt.Printf("Error starting control API: %v\n", err)
+		daemon.Close()
+		os.Exit(1)
+	}
+	defer control.Close()
+
+	folders, err := daemon.Folders()
+	if err != nil {
+		fmt.Printf("Error listing folders: %v\n", err)
+		return
+	}
+	fmt.Printf("Fybrk daemon listening on port %d\n", daemon.Port())
+	for _, folder := range folders {
+		switch {
+		case folder.Running:
+			fmt.Printf("  syncing %s\n", folder.Path)
+		case folder.Paused:
+			fmt.Printf("  paused  %s\n", folder.Path)
+		default:
+			fmt.Printf("  failed  %s: %s\n", folder.Path, folder.Error)
+		}
+	}
+	if len(folders) == 0 {
+		fmt.Println("No folders added yet. Use 'fybrk folder add <path>'.")
+	}
+	fmt.Println("Stop with 'fybrk daemon stop' or Ctrl+C")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for waiting := true; waiting; {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				waiting = false
+				break
+			}
+			// Apply config.json and pick up folders added, removed or
+			// paused in folders.json
+			reloadConfig(daemon.SetRetention)
+			started, stopped, err := daemon.Reload()
+			if err != nil {
+				fmt.Printf("Error reloading folders: %v\n", err)
+				continue
+			}
+			fmt.Printf("Reloaded folders: %d started, %d stopped\n", started, stopped)
+		case <-control.ShutdownRequested():
+			waiting = false
+		}
+	}
+
+	folders, _ = daemon.Folders()
+	running := 0
+	for _, folder := range folders {
+		if folder.Running {
+			running++
+		}
+	}
+	if err := shutdownSync(signals, daemon.Shutdown); err != nil {
+		fmt.Printf("Error stopping folders: %v\n", err)
+	}
+	fmt.Printf("Fybrk daemon stopped after syncing %d folders\n", running)
+}
+
+func stopDaemon(configDir string) {
+	daemon := dialDaemonOrExit(configDir)
+	if err := daemon.Shutdown(); err != nil {
+		fmt.Printf("Error stopping daemon: %v\n", err)
+		os.Exit(1)
+	}
+
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if _, err := fybrk.DialDaemon(configDir); err == fybrk.ErrDaemonNotRunning {
+			fmt.Println("Fybrk daemon stopped")
+			return
+		}
+	}
+	fmt.Println("Error: daemon is still running")
+	os.Exit(1)
+}
+
+func runStatus(args []string) {
+	if len(args) > 0 {
+		fmt.Println("Usage: fybrk status")
+		os.Exit(1)
+	}
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	status, err := dialDaemonOrExit(configDir).Status()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Fybrk daemon running (pid %d), listening on port %d\n", status.PID, status.Port)
+	fmt.Printf("Up since %s\n", status.StartedAt.Format("2006-01-02 15:04:05"))
+	fmt.Println()
+	printFolderStatus(status.Folders)
+}
+
+func runPauseResume(action string, args []string) {
+	if len(args) > 1 {
+		fmt.Printf("Usage: fybrk %s [folder-id|path]\n", action)
+		os.Exit(1)
+	}
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Without a folder, every folder is paused or resumed
+	var folder string
+	if len(args) == 1 {
+		folder = args[0]
+	}
+
+	daemon := dialDaemonOrExit(configDir)
+	if action == "pause" {
+		err = daemon.Pause(folder)
+	} else {
+		err = daemon.Resume(folder)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case folder == "" && action == "pause":
+		fmt.Println("Paused all folders")
+	case folder == "":
+		fmt.Println("Resumed all folders")
+	case action == "pause":
+		fmt.Printf("Paused %s\n", folder)
+	default:
+		fmt.Printf("Resumed %s\n", folder)
+	}
+}
+
+func dialDaemonOrExit(configDir string) *fybrk.ControlClient {
+	daemon, err := fybrk.DialDaemon(configDir)
+	if err == fybrk.ErrDaemonNotRunning {
+		fmt.Println("Fybrk daemon is not running. Start it with 'fybrk daemon'.")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return daemon
+}
+
+// daemonSyncing returns a connection to the running daemon if it syncs
+// syncPath, or nil
+func daemonSyncing(syncPath string) *fybrk.ControlClient {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		return nil
+	}
+	folders, err := config.LoadFolders(configDir)
+	if err != nil || config.FindFolder(folders, syncPath) == nil {
+		return nil
+	}
+	daemon, err := fybrk.DialDaemon(configDir)
+	if err != nil {
+		return nil
+	}
+	return daemon
+}
+
+func runWithDaemon(daemon *fybrk.ControlClient, command, syncPath string) {
+	switch command {
+	case "sync":
+		fmt.Printf("%s is already synced by the running daemon; see 'fybrk status'\n", syncPath)
+	case "list":
+		files, err := daemon.Files(syncPath)
+		if err != nil {
+			fmt.Printf("Error listing files: %v\n", err)
+			os.Exit(1)
+		}
+		printFiles(files)
+	case "pair":
+		fmt.Printf("Generating internet-capable pairing QR code for: %s\n", syncPath)
+		fmt.Println()
+		inv, err := daemon.Invite(syncPath)
+		if err != nil {
+			fmt.Printf("Error generating QR code: %v\n", err)
+			os.Exit(1)
+		}
+		showPairingURL(inv.URL)
+		waitForDaemonPairing(daemon, syncPath)
+	}
+}
+
+// waitForDaemonPairing follows the invitation the daemon opened, asking the
+// user to compare codes when the other device shows up
+func waitForDaemonPairing(daemon *fybrk.ControlClient, syncPath string) {
+	fmt.Println("Waiting for the other device...")
+	answered := false
+	for {
+		status, err := daemon.InvitationStatus(syncPath)
+		if err != nil {
+			fmt.Printf("Pairing failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		switch status.State {
+		case fybrk.InvitationConfirming:
+			if answered {
+				break
+			}
+			answered = true
+			accept, err := confirmPairing(status.Code, status.Device)
+			if err != nil {
+				accept = false
+			}
+			if err := daemon.ConfirmPairing(syncPath, accept); err != nil {
+				fmt.Printf("Pairing failed: %v\n", err)
+				os.Exit(1)
+			}
+			if !accept {
+				fmt.Println("Pairing refused")
+				os.Exit(1)
+			}
+		case fybrk.InvitationPaired:
+			fmt.Printf("Paired with %s\n", status.Device)
+			return
+		case fybrk.InvitationFailed:
+			fmt.Printf("Pairing failed: %s\n", status.Error)
+			os.Exit(1)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func runPair(client *fybrk.Client, syncPath string) {
+	fmt.Printf("Generating pairing QR code for: %s\n", syncPath)
+	fmt.Println()
+
+	inv, err := client.Invite(confirmPairing)
 	if err != nil {
 		fmt.Printf("Error generating QR code: %v\n", err)
 		return
 	}
+	showPairingURL(inv.URL)
+
+	fmt.Println("Waiting for the other device...")
+	if err := inv.Wait(); err != nil {
+		fmt.Printf("Pairing failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Paired with %s\n", inv.Status().Device)
+}
 
+func showPairingURL(pairURL string) {
 	// Display QR code in terminal
-	err = qrGen.DisplayQRCode(qrData, true) // Save to file as well
-	if err != nil {
+	qrGen := network.NewQRGenerator()
+	if err := qrGen.DisplayQRCode(pairURL, true); err != nil { // Save to file as well
 		fmt.Printf("Error displaying QR code: %v\n", err)
 		return
 	}
 
 	fmt.Println()
 	fmt.Println("PAIRING INSTRUCTIONS:")
-	fmt.Println("1. On the other device: fybrk pair-with '<QR-CODE-DATA>'")
-	fmt.Println("2. Devices will connect over the internet automatically")
-	fmt.Println("3. Files will sync in real-time")
-	fmt.Println()
-	fmt.Println("FEATURES:")
-	fmt.Println("- Works over the internet (not just local network)")
-	fmt.Println("- Automatic NAT traversal and hole punching")
-	fmt.Println("- Secure end-to-end encryption")
-	fmt.Println("- No manual IP configuration needed")
+	fmt.Println("1. On the other device: fybrk pair-with '<PAIR-URL>' [path]")
+	fmt.Println("2. Check that both devices show the same six digit code")
+	fmt.Println("3. Run 'fybrk sync' on both devices")
 	fmt.Println()
-	fmt.Println("This QR code expires in 10 minutes for security.")
+	fmt.Println("The pair URL holds a one-time secret, not the folder key. The key is")
+	fmt.Println("sent over an encrypted channel once the codes match. The URL works")
+	fmt.Println("once and expires in 10 minutes.")
 }
 
-func runPairWith(qrData string) {
-	fmt.Printf("Joining sync network from QR code...\n")
+func runPairWith(pairURL, syncPath string) {
+	fmt.Printf("Joining sync folder from pair URL...\n")
 	fmt.Println()
 
-	if qrData == "" {
-		fmt.Println("Error: QR code data required")
-		fmt.Println("Usage: fybrk pair-with '<QR-CODE-DATA>'")
-		return
+	absPath, err := filepath.Abs(syncPath)
+	if err != nil {
+		fmt.Printf("Error: Invalid path '%s': %v\n", syncPath, err)
+		os.Exit(1)
+	}
+	syncPath = absPath
+	if err := os.MkdirAll(filepath.Join(syncPath, ".fybrk"), 0755); err != nil {
+		fmt.Printf("Error creating .fybrk directory: %v\n", err)
+		os.Exit(1)
 	}
 
-	// TODO: Implement actual QR code parsing and network joining
-	// For now, show the concept
-	fmt.Printf("QR Data: %s\n", qrData)
-	fmt.Println()
-	fmt.Println("NEXT STEPS:")
-	fmt.Println("1. Parsing rendezvous information...")
-	fmt.Println("2. Connecting to bootstrap network...")
-	fmt.Println("3. Establishing direct P2P connection...")
-	fmt.Println("4. Exchanging encryption keys...")
-	fmt.Println("5. Starting file synchronization...")
-	fmt.Println()
-	fmt.Println("NOTE: Full implementation coming soon!")
-	fmt.Println("This will automatically:")
-	fmt.Println("- Connect over the internet")
-	fmt.Println("- Handle NAT traversal")
-	fmt.Println("- Set up secure sync folder")
+	id, err := config.LoadOrCreateIdentity()
+	if err != nil {
+		fmt.Printf("Error loading device identity: %v\n", err)
+		os.Exit(1)
+	}
+
+	client, err := fybrk.JoinFolder(pairURL, newClientConfig(syncPath, id), confirmPairing)
+	if err != nil {
+		fmt.Printf("Error joining folder: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	fmt.Printf("Joined. Run 'fybrk %s sync' to start syncing.\n", syncPath)
+}
+
+// confirmPairing asks whether the other device shows the same code
+func confirmPairing(code, deviceName string) (bool, error) {
+	fmt.Printf("Pairing with %s. Does it show the code %s? [y/N] ", deviceName, code)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
 }
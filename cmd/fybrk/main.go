@@ -1,24 +1,62 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Fybrk/fybrk/pkg/core"
 	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/storage"
 )
 
 // Version is set at build time via ldflags
 var Version = "dev"
 
+// drainTimeout bounds how long shutdown waits for transfers in progress
+const drainTimeout = 30 * time.Second
+
+// deviceIdentity is this machine's device identity, loaded at startup
+var deviceIdentity *identity.Identity
+
+// appConfig is ~/.fybrk/config.json, loaded at startup
+var appConfig = &config.DefaultConfig
+
 func main() {
 	// Initialize config on first run
 	cfg, err := config.LoadConfig()
 	if err != nil {
 		fmt.Printf("Warning: Could not load config: %v\n", err)
 	}
+	if cfg != nil {
+		appConfig = cfg
+	}
+	deviceIdentity, err = config.LoadOrCreateIdentity()
+	if err != nil {
+		fmt.Printf("Warning: Could not load device identity: %v\n", err)
+	}
 	
+	// Commands that work on the daemon and its folders rather than one path
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "folder":
+			runFolder(os.Args[2:])
+			return
+		case "daemon":
+			runDaemon()
+			return
+		case "trash":
+			runTrash(".", os.Args[2:])
+			return
+		}
+	}
+
 	// Parse arguments with simple logic
 	var target string
 
@@ -51,6 +89,12 @@ func main() {
 			showConfig(cfg)
 			return
 		}
+
+		// Handle passphrase change request
+		if target == "passwd" {
+			runPasswd(".")
+			return
+		}
 	} else {
 		fmt.Println("Error: Too many arguments")
 		showUsage()
@@ -71,8 +115,7 @@ func runStart(syncPath string) {
 	fmt.Printf("Starting Fybrk sync in: %s\n", syncPath)
 
 	// Create Fybrk instance (auto-initializes everything)
-	config := core.Config{SyncPath: syncPath}
-	fybrk, err := core.New(config)
+	fybrk, err := core.New(coreConfig(syncPath))
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
@@ -100,8 +143,7 @@ func runStart(syncPath string) {
 	fmt.Println("Syncing files in real-time...")
 	fmt.Println("Press Ctrl+C to stop")
 
-	// Keep running
-	select {}
+	runUntilSignalled(fybrk, func() { reloadConfig(fybrk.SetTrashRetention) })
 }
 
 func runJoin(pairURL string) {
@@ -111,40 +153,38 @@ func runJoin(pairURL string) {
 	localPath, _ := os.Getwd()
 	localPath = filepath.Join(localPath, "fybrk-sync")
 
-	// Join the sync
-	fybrk, err := core.JoinFromPairData(pairURL, localPath)
+	// Pair, fetch the folder and keep syncing
+	fybrk, err := core.JoinFromPairData(pairURL, coreConfig(localPath))
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 	defer fybrk.Close()
 
-	// Start sync engine
-	if err := fybrk.StartSync(); err != nil {
-		fmt.Printf("Error starting sync: %v\n", err)
-		os.Exit(1)
-	}
-
 	fmt.Printf("Syncing to: %s\n", fybrk.GetSyncPath())
 	fmt.Println("Connected! Syncing files in real-time...")
 	fmt.Println("Press Ctrl+C to stop")
 
-	// Keep running
-	select {}
+	runUntilSignalled(fybrk, func() { reloadConfig(fybrk.SetTrashRetention) })
 }
 
 func showPairURL(syncPath string) {
 	fmt.Printf("Getting pair URL for: %s\n", syncPath)
 
 	// Create Fybrk instance (auto-initializes everything)
-	config := core.Config{SyncPath: syncPath}
-	fybrk, err := core.New(config)
+	fybrk, err := core.New(coreConfig(syncPath))
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
 	defer fybrk.Close()
 
+	// The joining device fetches the folder from us, so serve it
+	if err := fybrk.StartSync(); err != nil {
+		fmt.Printf("Error starting sync: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Generate pairing information
 	pairData, err := fybrk.GeneratePairData()
 	if err != nil {
@@ -156,7 +196,339 @@ func showPairURL(syncPath string) {
 	fmt.Printf("Pair with: %s\n", pairData.URL)
 	fmt.Printf("Expires: %s\n", pairData.ExpiresAt.Format("15:04:05"))
 	fmt.Println()
-	fmt.Println("Share this URL with other devices to sync files.")
+	fmt.Println("Share this URL with the other device. It works once.")
+	fmt.Println("Waiting for the other device...")
+
+	if err := pairData.Wait(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Syncing files in real-time...")
+	fmt.Println("Press Ctrl+C to stop")
+
+	runUntilSignalled(fybrk, func() { reloadConfig(fybrk.SetTrashRetention) })
+}
+
+// syncProcess is a folder or a daemon syncing many of them
+type syncProcess interface {
+	Shutdown(timeout time.Duration) (*core.ShutdownSummary, error)
+}
+
+// runUntilSignalled keeps syncing until SIGINT or SIGTERM, then shuts down
+// cleanly and exits with a summary. SIGHUP calls reload. A second interrupt
+// during shutdown exits at once.
+func runUntilSignalled(fybrk syncProcess, reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reload()
+	}
+
+	fmt.Println()
+	fmt.Println("Shutting down, finishing transfers in progress (Ctrl+C again to force)...")
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				fmt.Println("Forced exit")
+				os.Exit(1)
+			}
+		}
+	}()
+
+	summary, err := fybrk.Shutdown(drainTimeout)
+	fmt.Printf("Stopped. Sent %d and received %d files with %d connected devices.\n",
+		summary.FilesSent, summary.FilesReceived, summary.Peers)
+	if summary.Interrupted > 0 {
+		fmt.Printf("%d transfers were interrupted and will resume on the next sync.\n", summary.Interrupted)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// reloadConfig re-reads ~/.fybrk/config.json and applies its trash
+// retention through setTrashRetention
+func reloadConfig(setTrashRetention func(time.Duration)) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Printf("Error reloading config: %v\n", err)
+		return
+	}
+	appConfig = cfg
+	setTrashRetention(cfg.TrashRetention())
+
+	trashDays := cfg.TrashRetentionDays
+	if trashDays == 0 {
+		trashDays = int(storage.DefaultTrashRetention / (24 * time.Hour))
+	}
+	fmt.Printf("Reloaded configuration: relay enabled: %t, %d relay servers, trash kept for %d days\n",
+		cfg.EnableRelay, len(cfg.RelayServers), trashDays)
+}
+
+// runDaemon syncs every folder in the registry over one port until
+// signalled. SIGHUP also applies config.json and picks up folders added or
+// removed since.
+func runDaemon() {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	daemon := core.NewDaemon(core.DaemonConfig{
+		ConfigDir:      configDir,
+		Identity:       deviceIdentity,
+		Passphrase:     unlockPrompt,
+		ConfirmPairing: confirmPairing,
+		TrashRetention: appConfig.TrashRetention(),
+	})
+	if err := daemon.Start(); err != nil {
+		fmt.Printf("Error starting daemon: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Fybrk daemon listening on port %d\n", daemon.Port())
+	showFolders(daemon)
+	fmt.Println("Syncing files in real-time...")
+	fmt.Println("Press Ctrl+C to stop; send SIGHUP after editing config.json or 'fybrk folder add' or 'remove'")
+
+	runUntilSignalled(daemon, func() {
+		reloadConfig(daemon.SetTrashRetention)
+		started, stopped, err := daemon.Reload()
+		if err != nil {
+			fmt.Printf("Error reloading folders: %v\n", err)
+			return
+		}
+		fmt.Printf("Reloaded folders: %d started, %d stopped\n", started, stopped)
+	})
+}
+
+func runFolder(args []string) {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	action := "list"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	switch {
+	case action == "list" && len(args) == 0:
+		showFolders(core.NewDaemon(core.DaemonConfig{ConfigDir: configDir}))
+	case action == "add" && len(args) == 1:
+		folder, err := config.AddFolder(configDir, args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Added folder %s: %s\n", folder.ID, folder.Path)
+		fmt.Println("It is synced by 'fybrk daemon'; a running daemon picks it up on SIGHUP")
+	case action == "remove" && len(args) == 1 && args[0] != "":
+		folder, err := config.RemoveFolder(configDir, args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed folder %s: %s\n", folder.ID, folder.Path)
+		fmt.Println("Its files and .fybrk data were left in place")
+	default:
+		fmt.Println("Usage: fybrk folder [list]")
+		fmt.Println("       fybrk folder add <path>")
+		fmt.Println("       fybrk folder remove <folder-id|path>")
+		os.Exit(1)
+	}
+}
+
+// showFolders lists the registered folders and, for a running daemon,
+// whether each is syncing
+func showFolders(daemon *core.Daemon) {
+	statuses, err := daemon.Folders()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(statuses) == 0 {
+		fmt.Println("No folders added yet; use 'fybrk folder add <path>'")
+		return
+	}
+
+	for _, status := range statuses {
+		state := ""
+		switch {
+		case status.Error != nil:
+			state = fmt.Sprintf("  (error: %v)", status.Error)
+		case status.Paused:
+			state = "  (paused)"
+		case status.Running:
+			state = fmt.Sprintf("  (%d connected devices)", status.Peers)
+		}
+		fmt.Printf("%s  %s%s\n", status.ID, status.Path, state)
+	}
+}
+
+func runPasswd(syncPath string) {
+	config := core.Config{SyncPath: syncPath, Passphrase: unlockPrompt(syncPath)}
+	fybrk, err := core.New(config)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer fybrk.Close()
+
+	passphrase, err := storage.ReadNewPassphrase()
+	if err != nil {
+		fmt.Printf("Error reading passphrase: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := fybrk.ChangePassphrase(passphrase); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if passphrase == "" {
+		fmt.Println("Passphrase removed; the folder key is stored unprotected")
+	} else {
+		fmt.Println("Folder key is now protected by the new passphrase")
+	}
+}
+
+// coreConfig builds the configuration for a folder, using this machine's
+// device identity and asking on the terminal to confirm pairing codes
+func coreConfig(syncPath string) core.Config {
+	cfg := core.Config{
+		SyncPath:       syncPath,
+		Passphrase:     unlockPrompt(syncPath),
+		ConfirmPairing: confirmPairing,
+		TrashRetention: appConfig.TrashRetention(),
+	}
+
+	cfg.Identity = deviceIdentity
+	return cfg
+}
+
+func runTrash(syncPath string, args []string) {
+	subcommand := "list"
+	if len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+
+	usage := map[string]string{
+		"list":    "Usage: fybrk trash list",
+		"restore": "Usage: fybrk trash restore <id|file>",
+		"empty":   "Usage: fybrk trash empty",
+	}
+	if _, ok := usage[subcommand]; !ok {
+		fmt.Printf("Error: Unknown trash command '%s'\n", subcommand)
+		fmt.Println("Usage: fybrk trash [list|restore|empty]")
+		os.Exit(1)
+	}
+	wantArgs := 0
+	if subcommand == "restore" {
+		wantArgs = 1
+	}
+	if len(args) != wantArgs {
+		fmt.Println(usage[subcommand])
+		os.Exit(1)
+	}
+
+	fybrk, err := core.New(coreConfig(syncPath))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer fybrk.Close()
+
+	switch subcommand {
+	case "list":
+		listTrash(fybrk)
+	case "restore":
+		id, err := findTrashEntry(fybrk, args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		entry, err := fybrk.RestoreFromTrash(id)
+		if err != nil {
+			fmt.Printf("Error restoring from the trash: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %s\n", entry.Path)
+		fmt.Println("It syncs back to the other devices the next time fybrk runs here")
+	case "empty":
+		count, err := fybrk.EmptyTrash()
+		if err != nil {
+			fmt.Printf("Error emptying the trash: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted %d files from the trash\n", count)
+	}
+}
+
+func listTrash(fybrk *core.Fybrk) {
+	entries, err := fybrk.ListTrash()
+	if err != nil {
+		fmt.Printf("Error listing the trash: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("The trash is empty")
+		return
+	}
+
+	fmt.Printf("Found %d files in the trash:\n", len(entries))
+	for _, entry := range entries {
+		size := fmt.Sprintf("%d bytes", entry.Size)
+		if entry.IsDir {
+			size = "folder"
+		}
+		fmt.Printf("  %s  %s  %s\n", entry.ID, entry.Path, size)
+		fmt.Printf("      deleted by %s on %s\n", entry.DeletedBy, entry.DeletedAt.Format("2006-01-02 15:04"))
+	}
+}
+
+// findTrashEntry returns the ID of the trash entry idOrFile names: an
+// entry ID, or the path a file was deleted from, its latest deletion
+func findTrashEntry(fybrk *core.Fybrk, idOrFile string) (string, error) {
+	entries, err := fybrk.ListTrash()
+	if err != nil {
+		return "", err
+	}
+	relPath := filepath.Clean(idOrFile)
+	for _, entry := range entries {
+		if entry.ID == idOrFile || entry.Path == relPath {
+			return entry.ID, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in the trash", idOrFile)
+}
+
+// confirmPairing asks the user to compare the code shown on both devices
+func confirmPairing(code, deviceName string) (bool, error) {
+	fmt.Printf("Pairing with %s. Does it show the code %s? [y/N] ", deviceName, code)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// unlockPrompt asks for the passphrase of a protected folder key, reading
+// FYBRK_PASSPHRASE first so fybrk can run unattended
+func unlockPrompt(syncPath string) func() (string, error) {
+	return storage.PassphraseFromEnvOrTerminal(fmt.Sprintf("Passphrase for %s: ", syncPath))
 }
 
 func showUsage() {
@@ -168,6 +540,10 @@ func showUsage() {
 	fmt.Println("  fybrk fybrk://pair?data=...    # Join existing sync")
 	fmt.Println("  fybrk pair                     # Get pair URL for current directory")
 	fmt.Println("  fybrk config                   # Show current configuration")
+	fmt.Println("  fybrk passwd                   # Protect the folder key with a passphrase")
+	fmt.Println("  fybrk folder [list|add|remove] # Manage the folders the daemon syncs")
+	fmt.Println("  fybrk daemon                   # Sync every added folder over one port")
+	fmt.Println("  fybrk trash [list|restore|empty] # Files other devices deleted from here")
 	fmt.Println("  fybrk version                  # Show version")
 	fmt.Println("  fybrk help                     # Show this help")
 	fmt.Println()
@@ -179,8 +555,9 @@ func showUsage() {
 	fmt.Println("    3. Send URL to Device 2 (text, email, etc.)")
 	fmt.Println()
 	fmt.Println("  Device 2 (wants to receive files):")
-	fmt.Println("    1. fybrk 'fybrk://pair?key=...'  # Paste the URL from Device 1")
-	fmt.Println("    2. Files sync automatically!")
+	fmt.Println("    1. fybrk 'fybrk://pair?v=2&...'  # Paste the URL from Device 1")
+	fmt.Println("    2. Check both devices show the same 6-digit code")
+	fmt.Println("    3. Files sync automatically!")
 	fmt.Println()
 	fmt.Println("EXAMPLES:")
 	fmt.Println("  fybrk                          # Sync current directory")
@@ -188,7 +565,8 @@ func showUsage() {
 	fmt.Println("  fybrk ~/Photos                 # Sync Photos folder")
 	fmt.Println("  fybrk pair                     # Get pair URL for current directory")
 	fmt.Println("  fybrk version                  # Show version info")
-	fmt.Println("  fybrk 'fybrk://pair?key=abc'   # Join from pair URL")
+	fmt.Println("  fybrk 'fybrk://pair?v=2&...'   # Join from pair URL")
+	fmt.Println("  fybrk folder add ~/Photos      # Sync ~/Photos from the daemon")
 	fmt.Println()
 	fmt.Println("WHAT HAPPENS WHEN YOU RUN FYBRK:")
 	fmt.Println("  1. Fybrk scans files and starts watching for changes")
@@ -209,6 +587,9 @@ func showUsage() {
 	fmt.Println("  - Files not syncing? Check both devices are running fybrk")
 	fmt.Println("  - Connection issues? Relay servers provide internet fallback")
 	fmt.Println("  - Custom relay? Edit ~/.fybrk/config.json")
+	fmt.Println("  - Deleted by another device? 'fybrk trash restore <file>' within 30 days,")
+	fmt.Println("    or set \"trash_retention_days\" in ~/.fybrk/config.json to keep files longer")
+	fmt.Println("  - Running unattended with a passphrase? Set FYBRK_PASSPHRASE")
 	fmt.Println("  - Need help? Visit https://github.com/Fybrk/fybrk/issues")
 }
 
@@ -217,11 +598,13 @@ func showConfig(cfg *config.Config) {
 	fmt.Printf("Fybrk Configuration\n")
 	fmt.Printf("===================\n")
 	fmt.Printf("Config file: %s/config.json\n", configDir)
-	fmt.Printf("Device ID: %s\n", cfg.DeviceID)
+	if deviceIdentity != nil {
+		fmt.Printf("Device ID: %s\n", deviceIdentity.DeviceID())
+	}
 	fmt.Printf("Relay enabled: %t\n", cfg.EnableRelay)
 	fmt.Printf("Relay servers:\n")
 	for _, server := range cfg.RelayServers {
 		fmt.Printf("  - %s\n", server)
 	}
-	fmt.Printf("\nTo customize, edit the config file and restart fybrk.\n")
+	fmt.Printf("\nTo customize, edit the config file and restart fybrk or send it SIGHUP.\n")
 }
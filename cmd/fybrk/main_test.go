@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -20,9 +21,8 @@ func TestShowUsage_Output(t *testing.T) {
 	os.Stdout = oldStdout
 
 	// Read captured output
-	buf := make([]byte, 2048)
-	n, _ := r.Read(buf)
-	output := string(buf[:n])
+	buf, _ := io.ReadAll(r)
+	output := string(buf)
 
 	// Verify key sections are present
 	expectedSections := []string{
@@ -54,9 +54,8 @@ func TestShowUsage_Commands(t *testing.T) {
 	w.Close()
 	os.Stdout = oldStdout
 
-	buf := make([]byte, 2048)
-	n, _ := r.Read(buf)
-	output := string(buf[:n])
+	buf, _ := io.ReadAll(r)
+	output := string(buf)
 
 	// Verify all command examples are present
 	expectedCommands := []string{
@@ -104,7 +103,7 @@ func TestRunStart_ValidDirectory(t *testing.T) {
 
 func TestRunJoin_ValidPairURL(t *testing.T) {
 	tempDir := t.TempDir()
-	pairURL := "fybrk://pair?key=abc123&path=/test&expires=123456"
+	accept := func(code, deviceName string) (bool, error) { return true, nil }
 
 	// Test that runJoin can create a fybrk instance without panicking
 	defer func() {
@@ -113,8 +112,21 @@ func TestRunJoin_ValidPairURL(t *testing.T) {
 		}
 	}()
 
+	inviter, err := core.New(core.Config{SyncPath: t.TempDir(), ConfirmPairing: accept})
+	if err != nil {
+		t.Fatalf("Expected no error creating inviter: %v", err)
+	}
+	defer inviter.Close()
+	if err := inviter.StartSync(); err != nil {
+		t.Fatalf("Expected no error starting inviter: %v", err)
+	}
+	pairData, err := inviter.GeneratePairData()
+	if err != nil {
+		t.Fatalf("Expected no error generating pair data: %v", err)
+	}
+
 	// Test the core functionality that runJoin uses
-	fybrk, err := core.JoinFromPairData(pairURL, tempDir)
+	fybrk, err := core.JoinFromPairData(pairData.URL, core.Config{SyncPath: tempDir, ConfirmPairing: accept})
 	if err != nil {
 		t.Fatalf("Expected no error joining from pair data: %v", err)
 	}
@@ -2,14 +2,34 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/storage"
 )
 
 type Config struct {
 	RelayServers []string `json:"relay_servers"`
-	DeviceID     string   `json:"device_id"`
+	DeviceID     string   `json:"device_id"` // Follows the identity, see LoadOrCreateIdentity
 	EnableRelay  bool     `json:"enable_relay"`
+
+	// VersionRetention decides which past versions of files are kept, for
+	// every folder. Unset means storage.DefaultVersionRetention.
+	VersionRetention *storage.VersionRetention `json:"version_retention,omitempty"`
+
+	// TrashRetentionDays is how many days files deleted by peers are kept
+	// in each folder's .fybrk/trash. Zero means
+	// storage.DefaultTrashRetention.
+	TrashRetentionDays int `json:"trash_retention_days,omitempty"`
+}
+
+// TrashRetention returns how long files deleted by peers are kept in the
+// trash, or zero for the default
+func (c *Config) TrashRetention() time.Duration {
+	return time.Duration(c.TrashRetentionDays) * 24 * time.Hour
 }
 
 var DefaultConfig = Config{
@@ -51,6 +71,12 @@ func LoadConfig() (*Config, error) {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return &DefaultConfig, err
 	}
+	if r := config.VersionRetention; r != nil && (r.KeepLast < 0 || r.KeepDaily < 0) {
+		return &DefaultConfig, fmt.Errorf("invalid version_retention in %s: counts cannot be negative", configPath)
+	}
+	if config.TrashRetentionDays < 0 {
+		return &DefaultConfig, fmt.Errorf("invalid trash_retention_days in %s: cannot be negative", configPath)
+	}
 	
 	return &config, nil
 }
@@ -62,8 +88,6 @@ func CreateDefaultConfig() (*Config, error) {
 	}
 	
 	config := DefaultConfig
-	config.DeviceID = generateDeviceID()
-	
 	data, _ := json.MarshalIndent(config, "", "  ")
 	configPath := filepath.Join(configDir, "config.json")
 	
@@ -71,17 +95,13 @@ func CreateDefaultConfig() (*Config, error) {
 	return &config, nil
 }
 
-func generateDeviceID() string {
-	// Simple device ID generation
-	hostname, _ := os.Hostname()
-	return hostname + "-" + randomString(8)
-}
-
-func randomString(n int) string {
-	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = chars[len(chars)/2] // Simplified for minimal code
+// LoadOrCreateIdentity loads this device's identity from the config
+// directory, generating it on first use. Call it once at startup; the
+// device ID is derived from it.
+func LoadOrCreateIdentity() (*identity.Identity, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return nil, err
 	}
-	return string(b)
+	return identity.LoadOrCreate(configDir)
 }
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FoldersFileName is the folder registry in the config directory
+const FoldersFileName = "folders.json"
+
+// foldersMu serializes updates of the registry within the process, so
+// concurrent changes do not overwrite each other
+var foldersMu sync.Mutex
+
+var (
+	ErrFolderNotFound = errors.New("folder not found")
+	ErrFolderExists   = errors.New("folder is already synced")
+)
+
+// Folder is a sync folder managed by the daemon. Each folder keeps its own
+// key and database in Path/.fybrk.
+type Folder struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	AddedAt time.Time `json:"added_at"`
+	Paused  bool      `json:"paused,omitempty"`
+
+	// How concurrent edits are settled: the folder's default policy, and
+	// policies for files matching glob patterns, first match first
+	ConflictPolicy string         `json:"conflict_policy,omitempty"`
+	ConflictRules  []ConflictRule `json:"conflict_rules,omitempty"`
+}
+
+// ConflictRule applies a conflict policy to files matching a glob pattern.
+// Patterns without a slash match the file name in any directory, e.g.
+// *.psd; others match the path from the folder root, e.g. docs/*.md.
+type ConflictRule struct {
+	Pattern string `json:"pattern"`
+	Policy  string `json:"policy"`
+}
+
+// LoadFolders reads the folder registry in configDir
+func LoadFolders(configDir string) ([]*Folder, error) {
+	data, err := os.ReadFile(filepath.Join(configDir, FoldersFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []*Folder
+	if err := json.Unmarshal(data, &folders); err != nil {
+		return nil, fmt.Errorf("invalid folder registry: %v", err)
+	}
+	return folders, nil
+}
+
+// SaveFolders writes the folder registry to configDir
+func SaveFolders(configDir string, folders []*Folder) error {
+	data, err := json.MarshalIndent(folders, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(configDir, FoldersFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(configDir, FoldersFileName))
+}
+
+// AddFolder registers the directory at path under a new folder ID
+func AddFolder(configDir, path string) (*Folder, error) {
+	foldersMu.Lock()
+	defer foldersMu.Unlock()
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", absPath)
+	}
+
+	folders, err := LoadFolders(configDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, folder := range folders {
+		if folder.Path == absPath {
+			return nil, ErrFolderExists
+		}
+		if strings.HasPrefix(absPath, folder.Path+string(filepath.Separator)) ||
+			strings.HasPrefix(folder.Path, absPath+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s overlaps with synced folder %s", absPath, folder.Path)
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	folder := &Folder{
+		ID:      hex.EncodeToString(id),
+		Path:    absPath,
+		AddedAt: time.Now(),
+	}
+
+	if err := SaveFolders(configDir, append(folders, folder)); err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// RemoveFolder unregisters the folder with the given ID or path. The
+// directory and its .fybrk data are left in place.
+func RemoveFolder(configDir, idOrPath string) (*Folder, error) {
+	foldersMu.Lock()
+	defer foldersMu.Unlock()
+
+	folders, err := LoadFolders(configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	folder := FindFolder(folders, idOrPath)
+	if folder == nil {
+		return nil, ErrFolderNotFound
+	}
+
+	remaining := make([]*Folder, 0, len(folders)-1)
+	for _, other := range folders {
+		if other != folder {
+			remaining = append(remaining, other)
+		}
+	}
+	if err := SaveFolders(configDir, remaining); err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// SetFolderPaused records whether the folder with the given ID or path is
+// paused, so it stays that way across restarts
+func SetFolderPaused(configDir, idOrPath string, paused bool) (*Folder, error) {
+	foldersMu.Lock()
+	defer foldersMu.Unlock()
+
+	folders, err := LoadFolders(configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	folder := FindFolder(folders, idOrPath)
+	if folder == nil {
+		return nil, ErrFolderNotFound
+	}
+	folder.Paused = paused
+
+	if err := SaveFolders(configDir, folders); err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// SetConflictPolicy sets the conflict policy of a folder, or for the files
+// in it matching pattern if one is given. An empty policy removes the rule
+// for pattern, or restores the default policy.
+func SetConflictPolicy(configDir, idOrPath, pattern, policy string) (*Folder, error) {
+	foldersMu.Lock()
+	defer foldersMu.Unlock()
+
+	folders, err := LoadFolders(configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	folder := FindFolder(folders, idOrPath)
+	if folder == nil {
+		return nil, ErrFolderNotFound
+	}
+
+	if pattern == "" {
+		folder.ConflictPolicy = policy
+	} else {
+		rules := make([]ConflictRule, 0, len(folder.ConflictRules)+1)
+		replaced := false
+		for _, rule := range folder.ConflictRules {
+			if rule.Pattern == pattern {
+				replaced = true
+				if policy == "" {
+					continue
+				}
+				rule.Policy = policy
+			}
+			rules = append(rules, rule)
+		}
+		if !replaced && policy != "" {
+			rules = append(rules, ConflictRule{Pattern: pattern, Policy: policy})
+		}
+		folder.ConflictRules = rules
+	}
+
+	if err := SaveFolders(configDir, folders); err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// FindFolder returns the folder with the given ID or path, or nil. An empty
+// idOrPath matches nothing rather than the working directory.
+func FindFolder(folders []*Folder, idOrPath string) *Folder {
+	if idOrPath == "" {
+		return nil
+	}
+	absPath, _ := filepath.Abs(idOrPath)
+	for _, folder := range folders {
+		if folder.ID == idOrPath || folder.Path == idOrPath || folder.Path == absPath {
+			return folder
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Package identity manages the long-lived Ed25519 key pair that identifies
+// a device. The device ID is derived from the public key, so anyone holding
+// a device's public key can check its ID and verify what it signed.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// KeyFileName is the file the private key is stored in, inside the
+// per-user config directory (~/.fybrk)
+const KeyFileName = "identity.key"
+
+var (
+	ErrInvalidPublicKey = errors.New("invalid device public key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrDeviceIDMismatch = errors.New("device ID does not match public key")
+)
+
+// Identity is a device's signing key pair
+type Identity struct {
+	privateKey ed25519.PrivateKey
+}
+
+// Generate creates a new random identity
+func Generate() (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{privateKey: priv}, nil
+}
+
+// LoadOrCreate loads the identity stored in dir, generating and saving a
+// new one on first use
+func LoadOrCreate(dir string) (*Identity, error) {
+	keyPath := filepath.Join(dir, KeyFileName)
+
+	data, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		id, err := Generate()
+		if err != nil {
+			return nil, err
+		}
+		if err := id.save(keyPath); os.IsExist(err) {
+			return LoadOrCreate(dir) // Another process won the race
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to save device identity: %v", err)
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("invalid device identity file %s", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device identity file %s: %v", keyPath, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("device identity in %s is not an Ed25519 key", keyPath)
+	}
+
+	return &Identity{privateKey: priv}, nil
+}
+
+func (id *Identity) save(keyPath string) error {
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(id.privateKey)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// O_EXCL so two processes starting at once cannot overwrite each other
+	file, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(keyPath)
+		return err
+	}
+	return file.Close()
+}
+
+// PublicKey returns the device's public key
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.privateKey.Public().(ed25519.PublicKey)
+}
+
+// PublicKeyString returns the public key in the text form used on the wire
+func (id *Identity) PublicKeyString() string {
+	return base64.RawURLEncoding.EncodeToString(id.PublicKey())
+}
+
+// PrivateKey returns the signing key, e.g. for a TLS certificate
+func (id *Identity) PrivateKey() ed25519.PrivateKey {
+	return id.privateKey
+}
+
+// DeviceID returns the ID derived from the public key
+func (id *Identity) DeviceID() string {
+	return DeviceIDFromPublicKey(id.PublicKey())
+}
+
+// Sign signs msg with the device key
+func (id *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(id.privateKey, msg)
+}
+
+// DeviceIDFromPublicKey derives a device ID: the first 16 bytes of the
+// SHA-256 of the public key, hex encoded
+func DeviceIDFromPublicKey(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// ParsePublicKey decodes a public key produced by PublicKeyString
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrInvalidPublicKey
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// VerifyDeviceID checks that deviceID was derived from publicKey
+func VerifyDeviceID(deviceID, publicKey string) error {
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if DeviceIDFromPublicKey(key) != deviceID {
+		return ErrDeviceIDMismatch
+	}
+	return nil
+}
+
+// Verify checks a signature made by the device owning publicKey
+func Verify(publicKey string, msg, signature []byte) error {
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, msg, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
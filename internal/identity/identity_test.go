@@ -0,0 +1,63 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	dir := t.TempDir()
+
+	id, err := LoadOrCreate(dir)
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(dir, KeyFileName))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The same identity comes back on the next run
+	loaded, err := LoadOrCreate(dir)
+	require.NoError(t, err)
+	assert.Equal(t, id.DeviceID(), loaded.DeviceID())
+	assert.Equal(t, id.PublicKeyString(), loaded.PublicKeyString())
+}
+
+func TestLoadOrCreateRejectsCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, KeyFileName), []byte("garbage"), 0600))
+
+	_, err := LoadOrCreate(dir)
+	assert.Error(t, err)
+}
+
+func TestDeviceIDIsDerivedFromPublicKey(t *testing.T) {
+	id1, err := Generate()
+	require.NoError(t, err)
+	id2, err := Generate()
+	require.NoError(t, err)
+
+	assert.Len(t, id1.DeviceID(), 32)
+	assert.NotEqual(t, id1.DeviceID(), id2.DeviceID())
+
+	assert.NoError(t, VerifyDeviceID(id1.DeviceID(), id1.PublicKeyString()))
+	assert.ErrorIs(t, VerifyDeviceID(id2.DeviceID(), id1.PublicKeyString()), ErrDeviceIDMismatch)
+	assert.ErrorIs(t, VerifyDeviceID(id1.DeviceID(), "not-a-key"), ErrInvalidPublicKey)
+}
+
+func TestSignAndVerify(t *testing.T) {
+	id, err := Generate()
+	require.NoError(t, err)
+	other, err := Generate()
+	require.NoError(t, err)
+
+	msg := []byte("announcement")
+	signature := id.Sign(msg)
+
+	assert.NoError(t, Verify(id.PublicKeyString(), msg, signature))
+	assert.ErrorIs(t, Verify(id.PublicKeyString(), []byte("tampered"), signature), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(other.PublicKeyString(), msg, signature), ErrInvalidSignature)
+}
@@ -22,6 +22,10 @@ type BootstrapService struct {
 	dht        *DHTService
 	mu         sync.RWMutex
 	stats      BootstrapStats
+
+	// Rendezvous points this device registered, by ID, with the node
+	// holding each; they are withdrawn on Close
+	registered map[string]string
 }
 
 // BootstrapStats tracks service performance
@@ -66,6 +70,7 @@ func NewBootstrapService() *BootstrapService {
 		retryCount: 3,
 		retryDelay: 2 * time.Second,
 		dht:        dht,
+		registered: make(map[string]string),
 	}
 
 	// Start DHT service as fallback
@@ -110,6 +115,7 @@ func (bs *BootstrapService) CreateRendezvous(deviceID, publicKey, networkInfo st
 		if err := bs.registerRendezvousWithRetry(node, rendezvous); err == nil {
 			bs.mu.Lock()
 			bs.stats.SuccessfulReqs++
+			bs.registered[rendezvous.ID] = node
 			bs.mu.Unlock()
 			return rendezvous, nil
 		} else {
@@ -356,8 +362,55 @@ func (bs *BootstrapService) GetStats() BootstrapStats {
 	return stats
 }
 
-// Close shuts down the bootstrap service
+// RemoveRendezvous withdraws a rendezvous point this device registered, so
+// it cannot be looked up after the device stops waiting on it
+func (bs *BootstrapService) RemoveRendezvous(rendezvousID string) error {
+	bs.mu.Lock()
+	node, ok := bs.registered[rendezvousID]
+	delete(bs.registered, rendezvousID)
+	bs.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", node+"/rendezvous/"+rendezvousID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "Fybrk/1.0")
+
+	resp, err := bs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("bootstrap node returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close withdraws the rendezvous points this device registered and shuts
+// down the bootstrap service
 func (bs *BootstrapService) Close() error {
+	bs.mu.RLock()
+	ids := make([]string, 0, len(bs.registered))
+	for id := range bs.registered {
+		ids = append(ids, id)
+	}
+	bs.mu.RUnlock()
+
+	for _, id := range ids {
+		if err := bs.RemoveRendezvous(id); err != nil {
+			fmt.Printf("Warning: could not remove rendezvous %s: %v\n", id, err)
+		}
+	}
+
 	if bs.dht != nil {
 		return bs.dht.Stop()
 	}
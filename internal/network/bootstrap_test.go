@@ -0,0 +1,43 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapCloseRemovesRendezvous(t *testing.T) {
+	var mu sync.Mutex
+	rendezvous := make(map[string]bool)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		id := strings.TrimPrefix(r.URL.Path, "/rendezvous/")
+		switch r.Method {
+		case http.MethodPost:
+			rendezvous["registered"] = true
+		case http.MethodDelete:
+			delete(rendezvous, "registered")
+			rendezvous["removed:"+id] = true
+		}
+	}))
+	defer node.Close()
+
+	bs := NewBootstrapService()
+	bs.nodes = []string{node.URL}
+
+	info, err := bs.CreateRendezvous("device", "key", "127.0.0.1:7823")
+	require.NoError(t, err)
+
+	require.NoError(t, bs.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.False(t, rendezvous["registered"])
+	assert.True(t, rendezvous["removed:"+info.ID])
+}
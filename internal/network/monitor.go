@@ -15,6 +15,7 @@ type ConnectionMonitor struct {
 	cancel       context.CancelFunc
 	onReconnect  func(deviceID string, conn net.Conn)
 	onDisconnect func(deviceID string)
+	dial         func(address string) (net.Conn, error)
 }
 
 // ConnectionInfo tracks individual connection metrics
@@ -107,6 +108,13 @@ func (cm *ConnectionMonitor) SetReconnectHandler(handler func(deviceID string, c
 	cm.onReconnect = handler
 }
 
+// SetDialer sets how a lost connection is re-established. Reconnections go
+// through it so they are authenticated like the first connection; without
+// one, lost connections are given up.
+func (cm *ConnectionMonitor) SetDialer(dial func(address string) (net.Conn, error)) {
+	cm.dial = dial
+}
+
 // SetDisconnectHandler sets the callback for disconnection events
 func (cm *ConnectionMonitor) SetDisconnectHandler(handler func(deviceID string)) {
 	cm.onDisconnect = handler
@@ -245,13 +253,13 @@ func (cm *ConnectionMonitor) attemptReconnection(deviceID string, info *Connecti
 	maxRetries := 5
 	baseDelay := 2 * time.Second
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
+	for attempt := 0; attempt < maxRetries && cm.dial != nil; attempt++ {
 		// Exponential backoff
 		delay := baseDelay * time.Duration(1<<attempt)
 		time.Sleep(delay)
 
 		// Try to reconnect
-		conn, err := net.DialTimeout("tcp", info.Address, 10*time.Second)
+		conn, err := cm.dial(info.Address)
 		if err != nil {
 			continue
 		}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/protocol"
+	"github.com/Fybrk/fybrk/internal/transport"
 	"github.com/Fybrk/fybrk/pkg/types"
 )
 
@@ -27,6 +31,78 @@ type PeerNetwork struct {
 	dht         *DHTService        // DHT service for decentralized discovery
 	monitor     *ConnectionMonitor // Connection quality monitoring
 	qrGen       *QRGenerator       // QR code generation
+	secret      []byte             // Folder secret peers must prove they hold
+	earlier     [][]byte           // Secrets of earlier key epochs, newest first
+	onStale     func(deviceID string)
+	identity    *identity.Identity // Device identity used to sign announcements
+	registry    DeviceRegistry     // Devices allowed to connect, if set
+	mux         *transport.Mux     // Shared listener, if this folder has no port of its own
+	folderID    string             // Name of this folder on mux
+}
+
+// DeviceRegistry looks up paired devices. storage.MetadataStore implements it.
+type DeviceRegistry interface {
+	GetDevice(id string) (*types.Device, error)
+}
+
+// ErrNoDevicesPaired is returned by a DeviceRegistry that lets every
+// verified peer in because no device has been paired yet
+var ErrNoDevicesPaired = errors.New("no devices have been paired")
+
+// PeerNetworkOption configures optional PeerNetwork behaviour
+type PeerNetworkOption func(*PeerNetwork)
+
+// WithFolderSecret sets the secret that authenticates peers. Connections
+// are encrypted and only peers holding the same secret are accepted;
+// without it no connection can be established.
+func WithFolderSecret(secret []byte) PeerNetworkOption {
+	return func(pn *PeerNetwork) {
+		pn.secret = secret
+	}
+}
+
+// WithEarlierSecrets also accepts peers proving the folder secret of an
+// earlier key epoch, and dials with them when the current one is refused,
+// so devices that missed a key rotation can be handed the new key. Such
+// peers are only let in as trusted devices of the registry, as revoked
+// devices hold the earlier secrets too.
+func WithEarlierSecrets(secrets [][]byte) PeerNetworkOption {
+	return func(pn *PeerNetwork) {
+		pn.earlier = secrets
+	}
+}
+
+// WithIdentity makes the network announce itself with a signed device
+// announcement and require one from every peer. The device ID becomes the
+// one derived from id, and messages are only accepted under the device ID
+// the peer proved on that connection.
+func WithIdentity(id *identity.Identity) PeerNetworkOption {
+	return func(pn *PeerNetwork) {
+		pn.identity = id
+		pn.deviceID = id.DeviceID()
+	}
+}
+
+// WithDeviceRegistry refuses peers that are not trusted devices in
+// registry, such as unknown or revoked ones, unless the registry answers
+// with ErrNoDevicesPaired. Peers holding only an earlier secret must be in
+// the registry either way. It needs WithIdentity, since peers can only be
+// looked up once they have proven their device ID.
+func WithDeviceRegistry(registry DeviceRegistry) PeerNetworkOption {
+	return func(pn *PeerNetwork) {
+		pn.registry = registry
+	}
+}
+
+// WithMux accepts peers through a listener shared with other folders
+// instead of opening a port. Peers are routed to this network by the folder
+// secret they prove; folderID names the folder on mux.
+func WithMux(mux *transport.Mux, folderID string) PeerNetworkOption {
+	return func(pn *PeerNetwork) {
+		pn.mux = mux
+		pn.folderID = folderID
+		pn.port = mux.Port()
+	}
 }
 
 type Peer struct {
@@ -53,7 +129,7 @@ type FileResponse struct {
 	Chunks []types.Chunk `json:"chunks"`
 }
 
-func NewPeerNetwork(deviceID string, port int) *PeerNetwork {
+func NewPeerNetwork(deviceID string, port int, opts ...PeerNetworkOption) *PeerNetwork {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	pn := &PeerNetwork{
@@ -68,9 +144,14 @@ func NewPeerNetwork(deviceID string, port int) *PeerNetwork {
 		monitor:     NewConnectionMonitor(),
 		qrGen:       NewQRGenerator(),
 	}
+	for _, opt := range opts {
+		opt(pn)
+	}
+	deviceID = pn.deviceID
 
 	// Set up connection monitoring callbacks
 	pn.monitor.SetReconnectHandler(pn.handleReconnection)
+	pn.monitor.SetDialer(pn.connect)
 	pn.monitor.SetDisconnectHandler(pn.handleDisconnection)
 
 	// Start DHT service
@@ -85,7 +166,52 @@ func NewPeerNetwork(deviceID string, port int) *PeerNetwork {
 	return pn
 }
 
+// SetStalePeerHandler sets the function called once a trusted peer has
+// connected with the folder secret of an earlier key epoch
+func (pn *PeerNetwork) SetStalePeerHandler(handler func(deviceID string)) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	pn.onStale = handler
+}
+
+// SetSecrets replaces the folder secrets after the key changed. Connected
+// peers stay connected.
+func (pn *PeerNetwork) SetSecrets(secret []byte, earlier [][]byte) error {
+	pn.mu.Lock()
+	pn.secret = secret
+	pn.earlier = earlier
+	pn.mu.Unlock()
+
+	if pn.mux != nil && pn.ctx.Err() == nil {
+		return pn.registerMux()
+	}
+	return nil
+}
+
+// secrets returns the current folder secret followed by the earlier ones
+func (pn *PeerNetwork) secrets() [][]byte {
+	pn.mu.RLock()
+	defer pn.mu.RUnlock()
+	return append([][]byte{pn.secret}, pn.earlier...)
+}
+
+// registerMux routes this folder's peers from the shared listener
+func (pn *PeerNetwork) registerMux() error {
+	return pn.mux.RegisterEpochs(pn.folderID, pn.secrets(), func(conn net.Conn, secret int) {
+		pn.handleConnection(conn, false, secret > 0)
+	})
+}
+
 func (pn *PeerNetwork) Start() error {
+	if pn.mux != nil {
+		// The owner of the shared listener takes care of port mappings
+		if err := pn.registerMux(); err != nil {
+			return err
+		}
+		go pn.discoverPeers()
+		return nil
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", pn.port))
 	if err != nil {
 		return err
@@ -108,9 +234,24 @@ func (pn *PeerNetwork) Start() error {
 	return nil
 }
 
+// StopAccepting stops taking new peers. Peers already connected keep
+// syncing until Stop.
+func (pn *PeerNetwork) StopAccepting() {
+	if pn.mux != nil {
+		pn.mux.Unregister(pn.folderID)
+	}
+	if pn.listener != nil {
+		pn.listener.Close()
+	}
+}
+
 func (pn *PeerNetwork) Stop() error {
 	pn.cancel()
 
+	if pn.mux != nil {
+		pn.mux.Unregister(pn.folderID)
+	}
+
 	// Clean up UPnP port forwarding
 	if pn.upnp != nil && pn.listener != nil {
 		actualPort := pn.listener.Addr().(*net.TCPAddr).Port
@@ -139,19 +280,45 @@ func (pn *PeerNetwork) acceptConnections() {
 			return
 		default:
 			conn, err := pn.listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				continue
 			}
 
-			go pn.handleConnection(conn)
+			go pn.acceptConnection(conn)
+		}
+	}
+}
+
+// acceptConnection authenticates an inbound connection before reading
+// any messages from it
+func (pn *PeerNetwork) acceptConnection(conn net.Conn) {
+	secureConn, secret, err := transport.ServerEpochs(conn, pn.secrets())
+	if err != nil {
+		if err == transport.ErrPeerNotAuthorized {
+			fmt.Printf("Rejected peer %s: %v\n", conn.RemoteAddr(), err)
 		}
+		return
 	}
+
+	pn.handleConnection(secureConn, false, secret > 0)
 }
 
-func (pn *PeerNetwork) handleConnection(conn net.Conn) {
+// handleConnection reads messages from conn until it closes. announced
+// says whether this side already sent its discovery message, stale
+// whether the connection was made with an earlier folder secret.
+func (pn *PeerNetwork) handleConnection(conn net.Conn, announced, stale bool) {
 	defer conn.Close()
 
+	if stale && (pn.identity == nil || pn.registry == nil) {
+		fmt.Printf("Rejected peer %s: earlier folder secrets need a device registry\n", conn.RemoteAddr())
+		return
+	}
+
 	decoder := json.NewDecoder(conn)
+	verifiedID := ""
 
 	for {
 		select {
@@ -163,6 +330,40 @@ func (pn *PeerNetwork) handleConnection(conn net.Conn) {
 				return
 			}
 
+			if pn.identity == nil && pn.registry != nil {
+				fmt.Printf("Rejected peer %s: device registry requires an identity\n", conn.RemoteAddr())
+				return
+			}
+			if pn.identity != nil {
+				if verifiedID == "" {
+					// The first message must prove who the peer is
+					deviceID, err := pn.verifyDiscovery(conn, &msg, stale)
+					if err != nil {
+						fmt.Printf("Rejected peer %s: %v\n", conn.RemoteAddr(), err)
+						return
+					}
+					if !announced {
+						if err := pn.sendDiscovery(conn); err != nil {
+							return
+						}
+						announced = true
+					}
+					verifiedID = deviceID
+
+					if stale {
+						pn.updatePeer(deviceID, conn.RemoteAddr().String(), conn)
+						pn.mu.RLock()
+						onStale := pn.onStale
+						pn.mu.RUnlock()
+						if onStale != nil {
+							onStale(deviceID)
+						}
+					}
+				} else if msg.DeviceID != verifiedID {
+					continue // Not sent by the device this connection belongs to
+				}
+			}
+
 			pn.updatePeer(msg.DeviceID, conn.RemoteAddr().String(), conn)
 
 			if pn.onMessage != nil {
@@ -221,22 +422,145 @@ func (pn *PeerNetwork) broadcastDiscovery() {
 }
 
 func (pn *PeerNetwork) tryConnect(addr string) {
-	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	pn.connect(addr)
+}
+
+// connect opens an authenticated connection to addr, introduces this
+// device and serves the connection like an accepted one. With an identity,
+// the peer is only added once it has proven who it is.
+func (pn *PeerNetwork) connect(addr string) (net.Conn, error) {
+	conn, stale, err := pn.dial(addr)
 	if err != nil {
-		return
+		return nil, err
+	}
+
+	if err := pn.sendDiscovery(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go pn.handleConnection(conn, true, stale)
+	return conn, nil
+}
+
+// dial opens an authenticated connection to addr with the current folder
+// secret. A peer that refuses it is tried with the earlier ones, in case it
+// missed a key rotation; stale reports if one of those was used.
+func (pn *PeerNetwork) dial(addr string) (conn net.Conn, stale bool, err error) {
+	for i, secret := range pn.secrets() {
+		rawConn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err != nil {
+			return nil, false, err
+		}
+
+		conn, err := transport.Client(rawConn, secret)
+		if err == nil {
+			return conn, i > 0, nil
+		}
+		if err != transport.ErrPeerNotAuthorized || (pn.identity == nil || pn.registry == nil) {
+			return nil, false, err
+		}
 	}
+	return nil, false, transport.ErrPeerNotAuthorized
+}
 
-	// Send discovery message
+// sendDiscovery introduces this device on conn. With an identity, the
+// message carries an announcement signed over the connection's channel
+// binding.
+func (pn *PeerNetwork) sendDiscovery(conn net.Conn) error {
 	msg := Message{
 		Type:      "discovery",
 		DeviceID:  pn.deviceID,
 		Timestamp: time.Now(),
 	}
 
-	encoder := json.NewEncoder(conn)
-	encoder.Encode(msg)
+	if pn.identity != nil {
+		binding, err := transport.ChannelBinding(conn)
+		if err != nil {
+			return err
+		}
+		announcement := &protocol.DeviceAnnouncement{}
+		if err := announcement.Sign(pn.identity, binding); err != nil {
+			return err
+		}
+		msg.Data = announcement
+	}
 
-	go pn.handleConnection(conn)
+	return json.NewEncoder(conn).Encode(msg)
+}
+
+// verifyDiscovery checks a peer's discovery message and returns the device
+// ID it proved ownership of. stale says whether it connected with an
+// earlier folder secret.
+func (pn *PeerNetwork) verifyDiscovery(conn net.Conn, msg *Message, stale bool) (string, error) {
+	if msg.Type != "discovery" {
+		return "", fmt.Errorf("expected discovery message, got %q", msg.Type)
+	}
+
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return "", err
+	}
+	var announcement protocol.DeviceAnnouncement
+	if err := json.Unmarshal(data, &announcement); err != nil {
+		return "", fmt.Errorf("invalid device announcement: %v", err)
+	}
+
+	binding, err := transport.ChannelBinding(conn)
+	if err != nil {
+		return "", err
+	}
+	if err := announcement.Verify(binding); err != nil {
+		return "", err
+	}
+	if announcement.DeviceID != msg.DeviceID {
+		return "", identity.ErrDeviceIDMismatch
+	}
+	if err := pn.checkRegistry(&announcement, stale); err != nil {
+		return "", err
+	}
+
+	return announcement.DeviceID, nil
+}
+
+// checkRegistry makes sure a verified peer is a trusted device. A peer
+// holding an earlier secret is handed the current one, so it must be a
+// paired device even while the registry lets any peer in: a device revoked
+// from the folder could otherwise come back under a new identity.
+func (pn *PeerNetwork) checkRegistry(announcement *protocol.DeviceAnnouncement, stale bool) error {
+	if pn.registry == nil {
+		return nil
+	}
+
+	device, err := pn.registry.GetDevice(announcement.DeviceID)
+	if errors.Is(err, ErrNoDevicesPaired) && !stale {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unknown device %s", announcement.DeviceID)
+	}
+	if device.Revoked {
+		return fmt.Errorf("device %s has been revoked", announcement.DeviceID)
+	}
+	if !device.Trusted() {
+		return fmt.Errorf("device %s is not trusted", announcement.DeviceID)
+	}
+	if device.PublicKey != announcement.PublicKey {
+		return fmt.Errorf("device %s presented a different key than it paired with", announcement.DeviceID)
+	}
+	return nil
+}
+
+// DisconnectPeer closes the connection to a peer, e.g. after it was revoked
+func (pn *PeerNetwork) DisconnectPeer(deviceID string) {
+	pn.mu.Lock()
+	peer, exists := pn.peers[deviceID]
+	delete(pn.peers, deviceID)
+	pn.mu.Unlock()
+
+	if exists && peer.Conn != nil {
+		peer.Conn.Close()
+	}
 }
 
 func (pn *PeerNetwork) updatePeer(deviceID, address string, conn net.Conn) {
@@ -306,7 +630,10 @@ func (pn *PeerNetwork) CreatePairingQR(syncPath, encryptionKey string) (string,
 
 	// Create rendezvous point
 	networkInfo := fmt.Sprintf("%s:%d", stunResp.PublicIP, stunResp.PublicPort)
-	rendezvous, err := pn.bootstrap.CreateRendezvous(pn.deviceID, "temp-public-key", networkInfo)
+	if pn.identity == nil {
+		return "", fmt.Errorf("no device identity configured")
+	}
+	rendezvous, err := pn.bootstrap.CreateRendezvous(pn.deviceID, pn.identity.PublicKeyString(), networkInfo)
 	if err != nil {
 		return "", fmt.Errorf("failed to create rendezvous: %v", err)
 	}
@@ -416,8 +743,15 @@ func (pn *PeerNetwork) tryHolePunchConnection(rendezvous *RendezvousInfo) error
 	return nil
 }
 
-// handleReconnection handles successful reconnection events
+// handleReconnection handles successful reconnection events. conn went
+// through the same handshake as the first connection. A peer with an
+// identity is reinstated by handleConnection once it has proven it again,
+// as whoever answers at the old address may be another device.
 func (pn *PeerNetwork) handleReconnection(deviceID string, conn net.Conn) {
+	if pn.identity != nil {
+		return
+	}
+
 	pn.mu.Lock()
 	defer pn.mu.Unlock()
 
@@ -2,10 +2,14 @@ package network
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/transport"
+	"github.com/Fybrk/fybrk/pkg/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -187,6 +191,217 @@ func TestPeerNetworkIntegration(t *testing.T) {
 	pn1.BroadcastMessage(msg)
 }
 
+func TestPeerNetworkVerifiesIdentity(t *testing.T) {
+	secret := []byte("folder secret")
+	id1, err := identity.Generate()
+	require.NoError(t, err)
+	id2, err := identity.Generate()
+	require.NoError(t, err)
+
+	pn1 := NewPeerNetwork("ignored", 0, WithFolderSecret(secret), WithIdentity(id1))
+	pn2 := NewPeerNetwork("ignored", 0, WithFolderSecret(secret), WithIdentity(id2))
+	assert.Equal(t, id1.DeviceID(), pn1.deviceID)
+
+	received := make(chan *Message, 4)
+	pn1.SetMessageHandler(func(deviceID string, msg *Message) {
+		received <- msg
+	})
+
+	require.NoError(t, pn1.Start())
+	defer pn1.Stop()
+
+	pn2.tryConnect(pn1.listener.Addr().String())
+
+	// Both sides learn the other's key-derived device ID
+	require.Eventually(t, func() bool {
+		return len(pn1.GetPeers()) == 1 && len(pn2.GetPeers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{id2.DeviceID()}, pn1.GetPeers())
+	assert.Equal(t, []string{id1.DeviceID()}, pn2.GetPeers())
+
+	discovery := <-received
+	assert.Equal(t, id2.DeviceID(), discovery.DeviceID)
+
+	// A message claiming another device ID on this connection is dropped
+	require.NoError(t, pn2.SendMessage(id1.DeviceID(), &Message{Type: "test", DeviceID: "someone-else"}))
+	require.NoError(t, pn2.SendMessage(id1.DeviceID(), &Message{Type: "test", DeviceID: id2.DeviceID()}))
+
+	msg := <-received
+	assert.Equal(t, id2.DeviceID(), msg.DeviceID)
+	assert.Equal(t, []string{id2.DeviceID()}, pn1.GetPeers())
+}
+
+// mapRegistry is an in-memory DeviceRegistry
+type mapRegistry map[string]*types.Device
+
+func (r mapRegistry) GetDevice(id string) (*types.Device, error) {
+	device, ok := r[id]
+	if !ok {
+		return nil, fmt.Errorf("device not found")
+	}
+	return device, nil
+}
+
+func TestPeerNetworkRefusesUntrustedDevices(t *testing.T) {
+	secret := []byte("folder secret")
+	serverID, err := identity.Generate()
+	require.NoError(t, err)
+
+	registry := mapRegistry{}
+	server := NewPeerNetwork("", 0, WithFolderSecret(secret), WithIdentity(serverID), WithDeviceRegistry(registry))
+	require.NoError(t, server.Start())
+	defer server.Stop()
+	addr := server.listener.Addr().String()
+
+	connect := func(id *identity.Identity) *PeerNetwork {
+		client := NewPeerNetwork("", 0, WithFolderSecret(secret), WithIdentity(id))
+		client.tryConnect(addr)
+		return client
+	}
+
+	// Unknown device
+	unknown, err := identity.Generate()
+	require.NoError(t, err)
+	connect(unknown)
+
+	// Revoked device
+	revoked, err := identity.Generate()
+	require.NoError(t, err)
+	registry[revoked.DeviceID()] = &types.Device{ID: revoked.DeviceID(), PublicKey: revoked.PublicKeyString(), TrustLevel: 2, Revoked: true}
+	connect(revoked)
+
+	assert.Never(t, func() bool { return len(server.GetPeers()) > 0 }, 300*time.Millisecond, 10*time.Millisecond)
+
+	// Trusted device
+	trusted, err := identity.Generate()
+	require.NoError(t, err)
+	registry[trusted.DeviceID()] = &types.Device{ID: trusted.DeviceID(), PublicKey: trusted.PublicKeyString(), TrustLevel: 2}
+	client := connect(trusted)
+
+	require.Eventually(t, func() bool { return len(client.GetPeers()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{trusted.DeviceID()}, server.GetPeers())
+
+	server.DisconnectPeer(trusted.DeviceID())
+	assert.Empty(t, server.GetPeers())
+}
+
+func TestPeerNetworkEarlierSecrets(t *testing.T) {
+	current, earlier := []byte("folder secret 2"), []byte("folder secret 1")
+	serverID, err := identity.Generate()
+	require.NoError(t, err)
+
+	registry := mapRegistry{}
+	server := NewPeerNetwork("", 0, WithFolderSecret(current), WithEarlierSecrets([][]byte{earlier}),
+		WithIdentity(serverID), WithDeviceRegistry(registry))
+	stale := make(chan string, 4)
+	server.SetStalePeerHandler(func(deviceID string) { stale <- deviceID })
+	require.NoError(t, server.Start())
+	defer server.Stop()
+	addr := server.listener.Addr().String()
+
+	// A device that missed the rotation, trusted or revoked
+	missedRotation := func(revoked bool) *PeerNetwork {
+		id, err := identity.Generate()
+		require.NoError(t, err)
+		registry[id.DeviceID()] = &types.Device{ID: id.DeviceID(), PublicKey: id.PublicKeyString(), TrustLevel: 2, Revoked: revoked}
+		client := NewPeerNetwork("", 0, WithFolderSecret(earlier), WithIdentity(id))
+		client.tryConnect(addr)
+		return client
+	}
+
+	missedRotation(true)
+	assert.Never(t, func() bool { return len(server.GetPeers()) > 0 }, 300*time.Millisecond, 10*time.Millisecond)
+
+	client := missedRotation(false)
+	require.Eventually(t, func() bool { return len(client.GetPeers()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, client.deviceID, <-stale)
+
+	// Without a registry to tell revoked devices apart, earlier secrets
+	// are refused
+	open := NewPeerNetwork("", 0, WithFolderSecret(current), WithEarlierSecrets([][]byte{earlier}), WithIdentity(serverID))
+	require.NoError(t, open.Start())
+	defer open.Stop()
+	otherID, err := identity.Generate()
+	require.NoError(t, err)
+	other := NewPeerNetwork("", 0, WithFolderSecret(earlier), WithIdentity(otherID))
+	other.tryConnect(open.listener.Addr().String())
+	assert.Never(t, func() bool { return len(open.GetPeers()) > 0 }, 300*time.Millisecond, 10*time.Millisecond)
+}
+
+// unpairedRegistry is a mapRegistry for a folder nobody has paired with
+// yet, which lets in any device it does not know
+type unpairedRegistry struct{ mapRegistry }
+
+func (r unpairedRegistry) GetDevice(id string) (*types.Device, error) {
+	if device, ok := r.mapRegistry[id]; ok {
+		return device, nil
+	}
+	return nil, ErrNoDevicesPaired
+}
+
+func TestPeerNetworkEarlierSecretsNeedPairedDevice(t *testing.T) {
+	current, earlier := []byte("folder secret 2"), []byte("folder secret 1")
+	serverID, err := identity.Generate()
+	require.NoError(t, err)
+	revokedID, err := identity.Generate()
+	require.NoError(t, err)
+
+	registry := unpairedRegistry{mapRegistry{
+		revokedID.DeviceID(): {ID: revokedID.DeviceID(), PublicKey: revokedID.PublicKeyString(), Revoked: true},
+	}}
+	server := NewPeerNetwork("", 0, WithFolderSecret(current), WithEarlierSecrets([][]byte{earlier}),
+		WithIdentity(serverID), WithDeviceRegistry(registry))
+	stale := make(chan string, 4)
+	server.SetStalePeerHandler(func(deviceID string) { stale <- deviceID })
+	require.NoError(t, server.Start())
+	defer server.Stop()
+	addr := server.listener.Addr().String()
+
+	// The revoked device comes back under a new identity with the secret
+	// it was revoked from, and is not handed the current one
+	newID, err := identity.Generate()
+	require.NoError(t, err)
+	client := NewPeerNetwork("", 0, WithFolderSecret(earlier), WithIdentity(newID))
+	client.tryConnect(addr)
+	assert.Never(t, func() bool { return len(server.GetPeers()) > 0 || len(stale) > 0 }, 300*time.Millisecond, 10*time.Millisecond)
+
+	// Holding the current secret, any device is let in until one is paired
+	client = NewPeerNetwork("", 0, WithFolderSecret(current), WithIdentity(newID))
+	client.tryConnect(addr)
+	require.Eventually(t, func() bool { return len(client.GetPeers()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{newID.DeviceID()}, server.GetPeers())
+	assert.Empty(t, stale)
+}
+
+func TestReconnectAuthenticates(t *testing.T) {
+	secret := []byte("folder secret")
+	serverID, err := identity.Generate()
+	require.NoError(t, err)
+	clientID, err := identity.Generate()
+	require.NoError(t, err)
+
+	server := NewPeerNetwork("", 0, WithFolderSecret(secret), WithIdentity(serverID))
+	require.NoError(t, server.Start())
+	defer server.Stop()
+	addr := server.listener.Addr().String()
+
+	// The monitor reconnects through the folder secret handshake and the
+	// peer proves its identity again
+	client := NewPeerNetwork("", 0, WithFolderSecret(secret), WithIdentity(clientID))
+	conn, err := client.monitor.dial(addr)
+	require.NoError(t, err)
+	_, err = transport.ChannelBinding(conn)
+	assert.NoError(t, err, "reconnections are encrypted")
+	require.Eventually(t, func() bool { return len(server.GetPeers()) == 1 && len(client.GetPeers()) == 1 },
+		5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{clientID.DeviceID()}, server.GetPeers())
+
+	// Without the secret there is nothing to reconnect to
+	outsider := NewPeerNetwork("", 0, WithFolderSecret([]byte("another folder")), WithIdentity(clientID))
+	_, err = outsider.monitor.dial(addr)
+	assert.ErrorIs(t, err, transport.ErrPeerNotAuthorized)
+}
+
 func TestMessageSerialization(t *testing.T) {
 	msg := &Message{
 		Type:      "test",
@@ -5,17 +5,45 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/pkg/types"
 	"github.com/skip2/go-qrcode"
 )
 
+// Trust levels of a paired device
+const (
+	TrustLevelBasic   = 1
+	TrustLevelTrusted = 2
+	TrustLevelOwner   = 3
+)
+
+var ErrNoPairingPending = errors.New("no pairing code is waiting to be used")
+
+// DeviceStore persists paired devices
+type DeviceStore interface {
+	StoreDevice(device *types.Device) error
+}
+
 // DevicePairingManager handles secure device pairing with QR codes
 type DevicePairingManager struct {
+	identity   *identity.Identity
 	deviceID   string
 	deviceName string
 	onPaired   func(device *PairedDevice) error
+	confirm    ConfirmFunc
+	store      DeviceStore
+
+	// The secret from the last QR code shown, until it is used or expires
+	mu             sync.Mutex
+	pendingSecret  []byte
+	pendingExpires time.Time
 }
 
 // PairingRequest represents a device pairing request
@@ -50,9 +78,10 @@ type QRPairingData struct {
 	Expires     int64  `json:"exp"`
 }
 
-func NewDevicePairingManager(deviceID, deviceName string) *DevicePairingManager {
+func NewDevicePairingManager(id *identity.Identity, deviceName string) *DevicePairingManager {
 	return &DevicePairingManager{
-		deviceID:   deviceID,
+		identity:   id,
+		deviceID:   id.DeviceID(),
 		deviceName: deviceName,
 	}
 }
@@ -60,27 +89,19 @@ func NewDevicePairingManager(deviceID, deviceName string) *DevicePairingManager
 // GeneratePairingQR creates a QR code for device pairing
 func (dpm *DevicePairingManager) GeneratePairingQR(networkAddr string) ([]byte, string, error) {
 	// Generate challenge for security
-	challenge := make([]byte, 32)
-	if _, err := rand.Read(challenge); err != nil {
-		return nil, "", err
-	}
-	challengeStr := base64.URLEncoding.EncodeToString(challenge)
-
-	// Generate temporary public key for this pairing session
-	pubKey := make([]byte, 32)
-	if _, err := rand.Read(pubKey); err != nil {
+	challengeStr, expires, err := dpm.NewPairingSecret(5 * time.Minute)
+	if err != nil {
 		return nil, "", err
 	}
-	pubKeyStr := base64.URLEncoding.EncodeToString(pubKey)
 
 	qrData := QRPairingData{
 		Version:     1,
 		DeviceID:    dpm.deviceID,
 		DeviceName:  dpm.deviceName,
 		NetworkAddr: networkAddr,
-		PublicKey:   pubKeyStr,
+		PublicKey:   dpm.identity.PublicKeyString(),
 		Challenge:   challengeStr,
-		Expires:     time.Now().Add(5 * time.Minute).Unix(),
+		Expires:     expires.Unix(),
 	}
 
 	jsonData, err := json.Marshal(qrData)
@@ -97,6 +118,25 @@ func (dpm *DevicePairingManager) GeneratePairingQR(networkAddr string) ([]byte,
 	return qrCode, challengeStr, nil
 }
 
+// NewPairingSecret creates the one-time secret a device must know to pair
+// with this one, replacing any earlier secret. It is valid for ttl or until
+// the first pairing attempt, whichever comes first.
+func (dpm *DevicePairingManager) NewPairingSecret(ttl time.Duration) (string, time.Time, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(ttl)
+
+	// Only the newest secret can be used to pair with this device
+	dpm.mu.Lock()
+	dpm.pendingSecret = secret
+	dpm.pendingExpires = expires
+	dpm.mu.Unlock()
+
+	return base64.URLEncoding.EncodeToString(secret), expires, nil
+}
+
 // ParsePairingQR parses a QR code and extracts pairing data
 func (dpm *DevicePairingManager) ParsePairingQR(qrData string) (*QRPairingData, error) {
 	var pairingData QRPairingData
@@ -114,43 +154,134 @@ func (dpm *DevicePairingManager) ParsePairingQR(qrData string) (*QRPairingData,
 		return nil, fmt.Errorf("unsupported QR code version: %d", pairingData.Version)
 	}
 
+	// The device ID must belong to the advertised identity key
+	if err := identity.VerifyDeviceID(pairingData.DeviceID, pairingData.PublicKey); err != nil {
+		return nil, fmt.Errorf("invalid pairing QR code: %v", err)
+	}
+
 	return &pairingData, nil
 }
 
-// InitiatePairing starts the pairing process with another device
+// InitiatePairing connects to the device in qrData and pairs with it. The
+// challenge from the QR code seeds a SPAKE2 exchange, both users confirm the
+// same short authentication string, and the device is stored as trusted.
 func (dpm *DevicePairingManager) InitiatePairing(qrData *QRPairingData) (*PairedDevice, error) {
-	// Create pairing request
-	request := PairingRequest{
-		DeviceID:    dpm.deviceID,
-		DeviceName:  dpm.deviceName,
-		PublicKey:   generateTempPublicKey(),
-		Timestamp:   time.Now(),
-		NetworkInfo: "local", // Will be enhanced with actual network info
-		Challenge:   qrData.Challenge,
+	conn, err := net.DialTimeout("tcp", qrData.NetworkAddr, HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %v", qrData.NetworkAddr, err)
+	}
+
+	session, err := dpm.Initiate(conn, qrData)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return session.Device, nil
+}
+
+// Initiate runs the initiator side of pairing over conn and returns the
+// pairing channel. conn is closed if pairing fails.
+func (dpm *DevicePairingManager) Initiate(conn net.Conn, qrData *QRPairingData) (*Session, error) {
+	secret, err := base64.URLEncoding.DecodeString(qrData.Challenge)
+	if err != nil || len(secret) == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("invalid pairing challenge")
+	}
+
+	session, err := dpm.handshake(conn, secret, roleInitiator, qrData.DeviceID)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("pairing failed: %w", err)
 	}
 
-	// Use the request for validation
-	_ = request
+	if err := dpm.completePairing(session.Device); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
 
-	// In a real implementation, this would send the request over the network
-	// For now, we simulate successful pairing
-	device := &PairedDevice{
-		ID:           qrData.DeviceID,
-		Name:         qrData.DeviceName,
-		PublicKey:    qrData.PublicKey,
-		LastSeen:     time.Now(),
-		TrustLevel:   1, // Basic trust initially
-		DeviceType:   detectDeviceType(),
-		Capabilities: []string{"sync", "storage"},
+// AcceptPairing answers a pairing attempt made with the last QR code this
+// device generated
+func (dpm *DevicePairingManager) AcceptPairing(conn net.Conn) (*PairedDevice, error) {
+	session, err := dpm.Accept(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return session.Device, nil
+}
+
+// Accept runs the responder side of pairing over conn and returns the
+// pairing channel. The pending QR secret is used up by the attempt whether
+// or not it succeeds, so each code allows a single guess. conn is closed if
+// pairing fails.
+func (dpm *DevicePairingManager) Accept(conn net.Conn) (*Session, error) {
+	dpm.mu.Lock()
+	secret, expires := dpm.pendingSecret, dpm.pendingExpires
+	dpm.pendingSecret = nil
+	dpm.mu.Unlock()
+
+	if secret == nil || time.Now().After(expires) {
+		conn.Close()
+		return nil, ErrNoPairingPending
+	}
+
+	session, err := dpm.handshake(conn, secret, roleResponder, "")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("pairing failed: %w", err)
+	}
+
+	if err := dpm.completePairing(session.Device); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// completePairing records a confirmed device and notifies the callback
+func (dpm *DevicePairingManager) completePairing(device *PairedDevice) error {
+	if dpm.store != nil {
+		if err := dpm.store.StoreDevice(device.ToDevice()); err != nil {
+			return fmt.Errorf("failed to save paired device: %v", err)
+		}
 	}
 
 	if dpm.onPaired != nil {
 		if err := dpm.onPaired(device); err != nil {
-			return nil, fmt.Errorf("pairing callback failed: %v", err)
+			return fmt.Errorf("pairing callback failed: %v", err)
 		}
 	}
 
-	return device, nil
+	return nil
+}
+
+// ToDevice converts a paired device to the form kept in the metadata store
+func (d *PairedDevice) ToDevice() *types.Device {
+	return &types.Device{
+		ID:           d.ID,
+		Name:         d.Name,
+		Profile:      types.FullReplica,
+		LastSeen:     d.LastSeen,
+		PublicKey:    d.PublicKey,
+		TrustLevel:   d.TrustLevel,
+		DeviceType:   d.DeviceType,
+		Capabilities: d.Capabilities,
+	}
+}
+
+// SetConfirmCallback sets the function that shows the short authentication
+// string and asks the user to confirm it. Pairing fails without one.
+func (dpm *DevicePairingManager) SetConfirmCallback(confirm ConfirmFunc) {
+	dpm.confirm = confirm
+}
+
+// SetDeviceStore sets where paired devices are persisted
+func (dpm *DevicePairingManager) SetDeviceStore(store DeviceStore) {
+	dpm.store = store
 }
 
 // SetPairingCallback sets the callback for when a device is successfully paired
@@ -158,20 +289,25 @@ func (dpm *DevicePairingManager) SetPairingCallback(callback func(device *Paired
 	dpm.onPaired = callback
 }
 
-// GenerateDeviceFingerprint creates a unique fingerprint for device verification
+// GenerateDeviceFingerprint creates a unique fingerprint for device verification.
+// It is derived from the identity key, so it stays the same across runs and
+// can be compared out of band.
 func (dpm *DevicePairingManager) GenerateDeviceFingerprint() string {
-	data := fmt.Sprintf("%s:%s:%d", dpm.deviceID, dpm.deviceName, time.Now().Unix())
-	hash := sha256.Sum256([]byte(data))
+	hash := sha256.Sum256(dpm.identity.PublicKey())
 	return base64.URLEncoding.EncodeToString(hash[:8]) // Short fingerprint for display
 }
 
-// Helper functions
-func generateTempPublicKey() string {
-	key := make([]byte, 32)
-	rand.Read(key)
-	return base64.URLEncoding.EncodeToString(key)
+// DefaultDeviceName is the name shown to devices this one pairs with
+func DefaultDeviceName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "fybrk device"
+	}
+	return name
 }
 
+// Helper functions
+
 func detectDeviceType() string {
 	// This would detect the actual device type
 	// For now, return a default
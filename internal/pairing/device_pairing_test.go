@@ -2,23 +2,34 @@ package pairing
 
 import (
 	"encoding/json"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+func newTestIdentity(t *testing.T) *identity.Identity {
+	id, err := identity.Generate()
+	require.NoError(t, err)
+	return id
+}
+
 func TestDevicePairingManager(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	id := newTestIdentity(t)
+	dpm := NewDevicePairingManager(id, "Test Device")
 
-	assert.Equal(t, "device-123", dpm.deviceID)
+	assert.Equal(t, id.DeviceID(), dpm.deviceID)
 	assert.Equal(t, "Test Device", dpm.deviceName)
 	assert.Equal(t, "Test Device", dpm.GetDeviceName())
 }
 
 func TestGeneratePairingQR(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
 
 	qrImage, challenge, err := dpm.GeneratePairingQR("192.168.1.100:8080")
 	require.NoError(t, err)
@@ -29,15 +40,16 @@ func TestGeneratePairingQR(t *testing.T) {
 }
 
 func TestParsePairingQR(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
 
 	// Create test QR data
+	remote := newTestIdentity(t)
 	qrData := QRPairingData{
 		Version:     1,
-		DeviceID:    "device-456",
+		DeviceID:    remote.DeviceID(),
 		DeviceName:  "Remote Device",
 		NetworkAddr: "192.168.1.200:8080",
-		PublicKey:   "test-public-key",
+		PublicKey:   remote.PublicKeyString(),
 		Challenge:   "test-challenge",
 		Expires:     time.Now().Add(5 * time.Minute).Unix(),
 	}
@@ -52,18 +64,27 @@ func TestParsePairingQR(t *testing.T) {
 	assert.Equal(t, qrData.DeviceID, parsed.DeviceID)
 	assert.Equal(t, qrData.DeviceName, parsed.DeviceName)
 	assert.Equal(t, qrData.NetworkAddr, parsed.NetworkAddr)
+
+	// A device ID that does not belong to the public key is rejected
+	qrData.DeviceID = newTestIdentity(t).DeviceID()
+	jsonData, err = json.Marshal(qrData)
+	require.NoError(t, err)
+
+	_, err = dpm.ParsePairingQR(string(jsonData))
+	assert.Error(t, err)
 }
 
 func TestParsePairingQRExpired(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
 
 	// Create expired QR data
+	remote := newTestIdentity(t)
 	qrData := QRPairingData{
 		Version:     1,
-		DeviceID:    "device-456",
+		DeviceID:    remote.DeviceID(),
 		DeviceName:  "Remote Device",
 		NetworkAddr: "192.168.1.200:8080",
-		PublicKey:   "test-public-key",
+		PublicKey:   remote.PublicKeyString(),
 		Challenge:   "test-challenge",
 		Expires:     time.Now().Add(-1 * time.Minute).Unix(), // Expired
 	}
@@ -77,8 +98,55 @@ func TestParsePairingQRExpired(t *testing.T) {
 	assert.Contains(t, err.Error(), "expired")
 }
 
+// confirmWith returns a SAS callback that records the code it was shown
+func confirmWith(accept bool, shown *string) ConfirmFunc {
+	return func(sas string, device *PairedDevice) (bool, error) {
+		*shown = sas
+		return accept, nil
+	}
+}
+
+// newPairingCode generates a QR code on dpm and returns what scanning it yields
+func newPairingCode(t *testing.T, dpm *DevicePairingManager, addr string) *QRPairingData {
+	_, challenge, err := dpm.GeneratePairingQR(addr)
+	require.NoError(t, err)
+	return &QRPairingData{
+		Version:     1,
+		DeviceID:    dpm.deviceID,
+		DeviceName:  dpm.deviceName,
+		NetworkAddr: addr,
+		PublicKey:   dpm.identity.PublicKeyString(),
+		Challenge:   challenge,
+		Expires:     time.Now().Add(5 * time.Minute).Unix(),
+	}
+}
+
+// acceptOnce serves a single pairing attempt on a loopback listener
+func acceptOnce(t *testing.T, dpm *DevicePairingManager) (string, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		_, err = dpm.AcceptPairing(conn)
+		result <- err
+	}()
+	return listener.Addr().String(), result
+}
+
 func TestInitiatePairing(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
+	remote := NewDevicePairingManager(newTestIdentity(t), "Remote Device")
+
+	var localSAS, remoteSAS string
+	dpm.SetConfirmCallback(confirmWith(true, &localSAS))
+	remote.SetConfirmCallback(confirmWith(true, &remoteSAS))
 
 	// Set up pairing callback
 	var pairedDevice *PairedDevice
@@ -87,41 +155,134 @@ func TestInitiatePairing(t *testing.T) {
 		return nil
 	})
 
-	qrData := &QRPairingData{
-		Version:     1,
-		DeviceID:    "device-456",
-		DeviceName:  "Remote Device",
-		NetworkAddr: "192.168.1.200:8080",
-		PublicKey:   "test-public-key",
-		Challenge:   "test-challenge",
-		Expires:     time.Now().Add(5 * time.Minute).Unix(),
-	}
+	addr, accepted := acceptOnce(t, remote)
+	qrData := newPairingCode(t, remote, addr)
 
 	device, err := dpm.InitiatePairing(qrData)
 	require.NoError(t, err)
+	require.NoError(t, <-accepted)
 
 	assert.Equal(t, qrData.DeviceID, device.ID)
 	assert.Equal(t, qrData.DeviceName, device.Name)
-	assert.Equal(t, 1, device.TrustLevel)
+	assert.Equal(t, qrData.PublicKey, device.PublicKey)
+	assert.Equal(t, TrustLevelTrusted, device.TrustLevel)
 	assert.NotNil(t, pairedDevice)
 	assert.Equal(t, device.ID, pairedDevice.ID)
+
+	// Both devices show the same six digit code
+	assert.Len(t, localSAS, 6)
+	assert.Equal(t, localSAS, remoteSAS)
+}
+
+func TestPairingPersistsDevice(t *testing.T) {
+	store, err := storage.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
+	remote := NewDevicePairingManager(newTestIdentity(t), "Remote Device")
+	var sas, remoteSAS string
+	dpm.SetConfirmCallback(confirmWith(true, &sas))
+	remote.SetConfirmCallback(confirmWith(true, &remoteSAS))
+	dpm.SetDeviceStore(store)
+
+	addr, accepted := acceptOnce(t, remote)
+	qrData := newPairingCode(t, remote, addr)
+
+	_, err = dpm.InitiatePairing(qrData)
+	require.NoError(t, err)
+	require.NoError(t, <-accepted)
+
+	stored, err := store.GetDevice(qrData.DeviceID)
+	require.NoError(t, err)
+	assert.Equal(t, "Remote Device", stored.Name)
+	assert.Equal(t, qrData.PublicKey, stored.PublicKey)
+	assert.Equal(t, TrustLevelTrusted, stored.TrustLevel)
+}
+
+func TestPairingRejectedSAS(t *testing.T) {
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
+	remote := NewDevicePairingManager(newTestIdentity(t), "Remote Device")
+
+	var paired bool
+	dpm.SetPairingCallback(func(device *PairedDevice) error {
+		paired = true
+		return nil
+	})
+
+	// The remote user says the codes differ
+	var sas, remoteSAS string
+	dpm.SetConfirmCallback(confirmWith(true, &sas))
+	remote.SetConfirmCallback(confirmWith(false, &remoteSAS))
+
+	addr, accepted := acceptOnce(t, remote)
+	qrData := newPairingCode(t, remote, addr)
+
+	_, err := dpm.InitiatePairing(qrData)
+	assert.ErrorIs(t, err, ErrSASRejected)
+	assert.ErrorIs(t, <-accepted, ErrSASRejected)
+	assert.False(t, paired)
+}
+
+func TestPairingWrongSecret(t *testing.T) {
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
+	remote := NewDevicePairingManager(newTestIdentity(t), "Remote Device")
+	var sas, remoteSAS string
+	dpm.SetConfirmCallback(confirmWith(true, &sas))
+	remote.SetConfirmCallback(confirmWith(true, &remoteSAS))
+
+	addr, accepted := acceptOnce(t, remote)
+	qrData := newPairingCode(t, remote, addr)
+	qrData.Challenge = "Z3Vlc3NlZC1zZWNyZXQ="
+
+	_, err := dpm.InitiatePairing(qrData)
+	assert.ErrorIs(t, err, ErrPAKEConfirmation)
+	assert.Error(t, <-accepted)
+	assert.Empty(t, sas)
+	assert.Empty(t, remoteSAS)
+
+	// The attempt used up the code, so the real secret no longer works
+	addr2, accepted2 := acceptOnce(t, remote)
+	qrData.NetworkAddr = addr2
+	qrData.Challenge = "unused"
+	_, err = dpm.InitiatePairing(qrData)
+	assert.Error(t, err)
+	assert.ErrorIs(t, <-accepted2, ErrNoPairingPending)
+}
+
+func TestPairingWrongDevice(t *testing.T) {
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
+	remote := NewDevicePairingManager(newTestIdentity(t), "Remote Device")
+	var sas, remoteSAS string
+	dpm.SetConfirmCallback(confirmWith(true, &sas))
+	remote.SetConfirmCallback(confirmWith(true, &remoteSAS))
+
+	addr, accepted := acceptOnce(t, remote)
+	qrData := newPairingCode(t, remote, addr)
+	qrData.DeviceID = newTestIdentity(t).DeviceID()
+
+	_, err := dpm.InitiatePairing(qrData)
+	assert.ErrorIs(t, err, ErrUnexpectedDevice)
+	assert.Error(t, <-accepted)
+	assert.Empty(t, sas) // Never asked to confirm the wrong device
 }
 
 func TestGenerateDeviceFingerprint(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
 
 	fingerprint := dpm.GenerateDeviceFingerprint()
 	assert.NotEmpty(t, fingerprint)
 	assert.Greater(t, len(fingerprint), 8) // Should be substantial
+	assert.Equal(t, fingerprint, dpm.GenerateDeviceFingerprint())
 
 	// Generate another fingerprint with different device - should be different
-	dpm2 := NewDevicePairingManager("device-456", "Different Device")
+	dpm2 := NewDevicePairingManager(newTestIdentity(t), "Different Device")
 	fingerprint2 := dpm2.GenerateDeviceFingerprint()
 	assert.NotEqual(t, fingerprint, fingerprint2)
 }
 
 func TestGetCapabilities(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
 
 	capabilities := dpm.GetCapabilities()
 	assert.True(t, capabilities.CanSync)
@@ -133,7 +294,7 @@ func TestGetCapabilities(t *testing.T) {
 }
 
 func TestQRPairingDataValidation(t *testing.T) {
-	dpm := NewDevicePairingManager("device-123", "Test Device")
+	dpm := NewDevicePairingManager(newTestIdentity(t), "Test Device")
 
 	// Test invalid JSON
 	_, err := dpm.ParsePairingQR("invalid json")
@@ -0,0 +1,320 @@
+package pairing
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/identity"
+)
+
+const (
+	// HandshakeTimeout bounds the key exchange part of pairing
+	HandshakeTimeout = 10 * time.Second
+	// ConfirmTimeout is how long the user has to compare the SAS
+	ConfirmTimeout = 2 * time.Minute
+
+	maxFrameSize = 64 * 1024
+)
+
+var (
+	ErrNoConfirmHandler = errors.New("no SAS confirmation handler set")
+	ErrSASRejected      = errors.New("pairing was not confirmed")
+	ErrUnexpectedDevice = errors.New("device is not the one in the pairing code")
+)
+
+// ConfirmFunc shows the short authentication string to the user together
+// with the device being paired and reports whether they confirmed that the
+// other device shows the same code
+type ConfirmFunc func(sas string, device *PairedDevice) (bool, error)
+
+// pairingHello introduces a device once the channel is encrypted. The
+// signature over the channel binding proves the sender holds the identity
+// key it claims.
+type pairingHello struct {
+	DeviceID     string   `json:"device_id"`
+	DeviceName   string   `json:"device_name"`
+	DeviceType   string   `json:"device_type"`
+	PublicKey    string   `json:"public_key"`
+	Capabilities []string `json:"capabilities"`
+	Signature    string   `json:"signature"`
+}
+
+// pairingConfirm carries a user's answer to the SAS comparison
+type pairingConfirm struct {
+	Accepted bool `json:"accepted"`
+}
+
+// Session is an encrypted pairing channel to a device that has completed
+// the handshake. Further setup, such as handing over the folder key, can be
+// sent over it.
+type Session struct {
+	conn    net.Conn
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+	binding []byte
+	Device  *PairedDevice
+	SAS     string
+}
+
+// newSession derives the channel keys and SAS from the SPAKE2 session key
+func newSession(conn net.Conn, sessionKey []byte, role int) (*Session, error) {
+	derive := func(label string, size int) ([]byte, error) {
+		return hkdf.Key(sha256.New, sessionKey, nil, label, size)
+	}
+
+	toResponder, err := derive("fybrk pairing initiator to responder", 32)
+	if err != nil {
+		return nil, err
+	}
+	toInitiator, err := derive("fybrk pairing responder to initiator", 32)
+	if err != nil {
+		return nil, err
+	}
+	binding, err := derive("fybrk pairing binding", 32)
+	if err != nil {
+		return nil, err
+	}
+	sasBytes, err := derive("fybrk pairing sas", 4)
+	if err != nil {
+		return nil, err
+	}
+
+	sendKey, recvKey := toResponder, toInitiator
+	if role == roleResponder {
+		sendKey, recvKey = toInitiator, toResponder
+	}
+	send, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		conn:    conn,
+		send:    send,
+		recv:    recv,
+		binding: binding,
+		SAS:     fmt.Sprintf("%06d", binary.BigEndian.Uint32(sasBytes)%1000000),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Send encrypts v as JSON and writes it to the peer
+func (s *Session) Send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.send.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.sendSeq)
+	s.sendSeq++
+	return writeFrame(s.conn, s.send.Seal(nil, nonce, data, nil))
+}
+
+// Receive reads the next message from the peer into v
+func (s *Session) Receive(v interface{}) error {
+	frame, err := readFrame(s.conn)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.recv.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.recvSeq)
+	s.recvSeq++
+	data, err := s.recv.Open(nil, nonce, frame, nil)
+	if err != nil {
+		return fmt.Errorf("pairing channel corrupted: %v", err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Close closes the underlying connection
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// writeFrame writes a length-prefixed message
+func writeFrame(conn net.Conn, data []byte) error {
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	_, err := conn.Write(append(frame, data...))
+	return err
+}
+
+// readFrame reads a length-prefixed message
+func readFrame(conn net.Conn) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("pairing message too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// handshake runs SPAKE2 on secret, then exchanges signed device details and
+// the users' SAS confirmations. It returns once both users accepted. If
+// expectedID is set, the peer must prove it owns that device ID.
+func (dpm *DevicePairingManager) handshake(conn net.Conn, secret []byte, role int, expectedID string) (*Session, error) {
+	if dpm.confirm == nil {
+		return nil, ErrNoConfirmHandler
+	}
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+
+	pake, err := newSPAKE2(role, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys *spakeKeys
+	if role == roleInitiator {
+		// -> share, <- share | confirmation, -> confirmation
+		if err := writeFrame(conn, pake.Share()); err != nil {
+			return nil, err
+		}
+		reply, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) < sha256.Size {
+			return nil, errInvalidPAKEShare
+		}
+		peerShare, peerConfirm := reply[:len(reply)-sha256.Size], reply[len(reply)-sha256.Size:]
+		if keys, err = pake.Finish(peerShare); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(peerConfirm, keys.confirmB) {
+			return nil, ErrPAKEConfirmation
+		}
+		if err := writeFrame(conn, keys.confirmA); err != nil {
+			return nil, err
+		}
+	} else {
+		peerShare, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if keys, err = pake.Finish(peerShare); err != nil {
+			return nil, err
+		}
+		if err := writeFrame(conn, append(pake.Share(), keys.confirmB...)); err != nil {
+			return nil, err
+		}
+		peerConfirm, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(peerConfirm, keys.confirmA) {
+			return nil, ErrPAKEConfirmation
+		}
+	}
+
+	session, err := newSession(conn, keys.sessionKey, role)
+	if err != nil {
+		return nil, err
+	}
+
+	// Introduce ourselves and check the peer proves its identity
+	if err := session.Send(dpm.hello(session.binding)); err != nil {
+		return nil, err
+	}
+	var hello pairingHello
+	if err := session.Receive(&hello); err != nil {
+		return nil, err
+	}
+	if err := hello.verify(session.binding); err != nil {
+		return nil, err
+	}
+	if expectedID != "" && hello.DeviceID != expectedID {
+		return nil, ErrUnexpectedDevice
+	}
+
+	session.Device = &PairedDevice{
+		ID:           hello.DeviceID,
+		Name:         hello.DeviceName,
+		PublicKey:    hello.PublicKey,
+		LastSeen:     time.Now(),
+		TrustLevel:   TrustLevelTrusted,
+		DeviceType:   hello.DeviceType,
+		Capabilities: hello.Capabilities,
+	}
+
+	// Both users compare the SAS; either can abort
+	conn.SetDeadline(time.Now().Add(ConfirmTimeout))
+	accepted, err := dpm.confirm(session.SAS, session.Device)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.Send(pairingConfirm{Accepted: accepted}); err != nil {
+		return nil, err
+	}
+	var peerConfirm pairingConfirm
+	if err := session.Receive(&peerConfirm); err != nil {
+		return nil, err
+	}
+	if !accepted || !peerConfirm.Accepted {
+		return nil, ErrSASRejected
+	}
+
+	conn.SetDeadline(time.Time{})
+	return session, nil
+}
+
+// hello builds our signed introduction for a channel
+func (dpm *DevicePairingManager) hello(binding []byte) *pairingHello {
+	hello := &pairingHello{
+		DeviceID:     dpm.deviceID,
+		DeviceName:   dpm.deviceName,
+		DeviceType:   detectDeviceType(),
+		PublicKey:    dpm.identity.PublicKeyString(),
+		Capabilities: []string{"sync", "storage"},
+	}
+	hello.Signature = base64.RawURLEncoding.EncodeToString(dpm.identity.Sign(hello.signedBytes(binding)))
+	return hello
+}
+
+func (h *pairingHello) signedBytes(binding []byte) []byte {
+	data := append([]byte("fybrk pairing hello"), binding...)
+	data = append(data, h.DeviceID...)
+	return append(data, h.PublicKey...)
+}
+
+// verify checks the hello was signed for this channel by the device it names
+func (h *pairingHello) verify(binding []byte) error {
+	if err := identity.VerifyDeviceID(h.DeviceID, h.PublicKey); err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(h.Signature)
+	if err != nil {
+		return identity.ErrInvalidSignature
+	}
+	return identity.Verify(h.PublicKey, h.signedBytes(binding), signature)
+}
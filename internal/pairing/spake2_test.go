@@ -0,0 +1,67 @@
+package pairing
+
+import (
+	"testing"
+
+	"filippo.io/edwards25519"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runSPAKE2(t *testing.T, secretA, secretB []byte) (a, b *spakeKeys) {
+	initiator, err := newSPAKE2(roleInitiator, secretA)
+	require.NoError(t, err)
+	responder, err := newSPAKE2(roleResponder, secretB)
+	require.NoError(t, err)
+
+	a, err = initiator.Finish(responder.Share())
+	require.NoError(t, err)
+	b, err = responder.Finish(initiator.Share())
+	require.NoError(t, err)
+	return a, b
+}
+
+func TestSPAKE2SharedKey(t *testing.T) {
+	secret := []byte("pairing secret")
+
+	a, b := runSPAKE2(t, secret, secret)
+	assert.Equal(t, a.sessionKey, b.sessionKey)
+	assert.Equal(t, a.confirmA, b.confirmA)
+	assert.Equal(t, a.confirmB, b.confirmB)
+
+	// Every run gives a fresh key
+	c, _ := runSPAKE2(t, secret, secret)
+	assert.NotEqual(t, a.sessionKey, c.sessionKey)
+}
+
+func TestSPAKE2Share(t *testing.T) {
+	// The share is x*G + w*M for the initiator and x*G + w*N for the
+	// responder, checked against the library's own double multiplication
+	for role, blind := range map[int]*edwards25519.Point{roleInitiator: spakeM, roleResponder: spakeN} {
+		s, err := newSPAKE2(role, []byte("pairing secret"))
+		require.NoError(t, err)
+
+		want := new(edwards25519.Point).VarTimeDoubleScalarBaseMult(s.w, blind, s.x)
+		assert.Equal(t, want.Bytes(), s.Share())
+	}
+}
+
+func TestSPAKE2WrongSecret(t *testing.T) {
+	a, b := runSPAKE2(t, []byte("pairing secret"), []byte("a guess"))
+	assert.NotEqual(t, a.sessionKey, b.sessionKey)
+	assert.NotEqual(t, a.confirmB, b.confirmB)
+}
+
+func TestSPAKE2RejectsInvalidShare(t *testing.T) {
+	s, err := newSPAKE2(roleInitiator, []byte("pairing secret"))
+	require.NoError(t, err)
+
+	_, err = s.Finish([]byte("not a point"))
+	assert.Error(t, err)
+
+	// A share that cancels out the blinding would make the key known to
+	// anyone watching
+	blinding := new(edwards25519.Point).ScalarMult(s.w, spakeN)
+	_, err = s.Finish(blinding.Bytes())
+	assert.Error(t, err)
+}
@@ -0,0 +1,136 @@
+package pairing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pairURLPrefix   = "fybrk://pair?"
+	maxAddressHints = 4
+)
+
+var (
+	ErrPairTokenExpired = errors.New("pair URL has expired")
+	ErrLegacyPairURL    = errors.New("pair URL is from an older version of fybrk; generate a new one")
+)
+
+// PairToken is what a pair URL carries: a one-time secret for the pairing
+// handshake, the inviting device's ID and the addresses it waits on. The
+// folder key is not part of it; it is sent over the pairing channel once
+// both devices have proven they know the secret, so a URL that leaks into a
+// chat log or shell history is useless after its first use or expiry.
+type PairToken struct {
+	DeviceID  string
+	Secret    string
+	Addresses []string
+	ExpiresAt time.Time
+}
+
+// URL encodes the token as a fybrk://pair URL
+func (t *PairToken) URL() string {
+	values := url.Values{}
+	values.Set("v", "2")
+	values.Set("id", t.DeviceID)
+	values.Set("secret", t.Secret)
+	for _, addr := range t.Addresses {
+		values.Add("addr", addr)
+	}
+	values.Set("expires", strconv.FormatInt(t.ExpiresAt.Unix(), 10))
+	return pairURLPrefix + values.Encode()
+}
+
+// pairingData is the form Initiate takes the token's details in
+func (t *PairToken) pairingData(addr string) *QRPairingData {
+	return &QRPairingData{
+		DeviceID:    t.DeviceID,
+		NetworkAddr: addr,
+		Challenge:   t.Secret,
+	}
+}
+
+// IsValidPairURL checks if a string is a valid pairing URL
+func IsValidPairURL(s string) bool {
+	return strings.HasPrefix(s, pairURLPrefix)
+}
+
+// ParsePairURL decodes a pair URL and checks it has not expired
+func ParsePairURL(pairURL string) (*PairToken, error) {
+	if !IsValidPairURL(pairURL) {
+		return nil, fmt.Errorf("invalid pairing URL format")
+	}
+
+	values, err := url.ParseQuery(strings.TrimPrefix(pairURL, pairURLPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pairing URL format: %w", err)
+	}
+	if values.Has("key") {
+		return nil, ErrLegacyPairURL
+	}
+	if values.Get("v") != "2" {
+		return nil, fmt.Errorf("unsupported pairing URL version %q", values.Get("v"))
+	}
+
+	expires, err := strconv.ParseInt(values.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pairing URL expiry: %w", err)
+	}
+
+	token := &PairToken{
+		DeviceID:  values.Get("id"),
+		Secret:    values.Get("secret"),
+		Addresses: values["addr"],
+		ExpiresAt: time.Unix(expires, 0),
+	}
+	if token.DeviceID == "" || token.Secret == "" || len(token.Addresses) == 0 {
+		return nil, fmt.Errorf("pairing URL is incomplete")
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, ErrPairTokenExpired
+	}
+
+	return token, nil
+}
+
+// InitiateToken runs the initiator side of pairing with the device in
+// token, trying its addresses in turn. Only the first address that answers
+// gets an attempt, since the inviting device spends the token on it.
+func (dpm *DevicePairingManager) InitiateToken(token *PairToken) (*Session, error) {
+	var lastErr error
+	for _, addr := range token.Addresses {
+		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return dpm.Initiate(conn, token.pairingData(addr))
+	}
+	return nil, fmt.Errorf("could not reach the inviting device: %w", lastErr)
+}
+
+// AddressHints lists the addresses other devices may reach port on, most
+// useful first
+func AddressHints(port int) []string {
+	var hints []string
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			hints = append(hints, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+			if len(hints) == maxAddressHints-1 {
+				break
+			}
+		}
+	}
+
+	// Loopback last, for pairing two folders on the same machine
+	return append(hints, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+}
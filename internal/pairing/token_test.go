@@ -0,0 +1,42 @@
+package pairing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPairTokenURLRoundTrip(t *testing.T) {
+	token := &PairToken{
+		DeviceID:  "device",
+		Secret:    "c2VjcmV0",
+		Addresses: []string{"192.168.1.2:4000", "[fd00::1]:4000"},
+		ExpiresAt: time.Now().Add(time.Minute).Truncate(time.Second),
+	}
+
+	parsed, err := ParsePairURL(token.URL())
+	require.NoError(t, err)
+	assert.Equal(t, token.DeviceID, parsed.DeviceID)
+	assert.Equal(t, token.Secret, parsed.Secret)
+	assert.Equal(t, token.Addresses, parsed.Addresses)
+	assert.True(t, parsed.ExpiresAt.Equal(token.ExpiresAt))
+}
+
+func TestParsePairURLRejects(t *testing.T) {
+	expired := &PairToken{
+		DeviceID:  "device",
+		Secret:    "c2VjcmV0",
+		Addresses: []string{"127.0.0.1:4000"},
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}
+	_, err := ParsePairURL(expired.URL())
+	assert.ErrorIs(t, err, ErrPairTokenExpired)
+
+	_, err = ParsePairURL("fybrk://pair?key=abc123&path=/remote&expires=123456")
+	assert.ErrorIs(t, err, ErrLegacyPairURL)
+
+	_, err = ParsePairURL("fybrk://pair?v=2&id=device&expires=9999999999")
+	assert.Error(t, err, "URL without secret")
+}
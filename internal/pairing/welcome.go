@@ -0,0 +1,46 @@
+package pairing
+
+import (
+	"errors"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+)
+
+var ErrInvalidWelcome = errors.New("received an invalid folder key")
+
+// Welcome is what the inviting device sends over the pairing channel once
+// the joining device has been confirmed: the master keys of every epoch, so
+// it can read what was written before it joined, the devices revoked from
+// the folder, and where the inviting device syncs
+type Welcome struct {
+	Keys           map[uint32][]byte `json:"keys"`
+	RevokedDevices []string          `json:"revoked_devices,omitempty"`
+	SyncAddresses  []string          `json:"sync_addresses,omitempty"`
+}
+
+// NewWelcome hands over the folder keyRing belongs to
+func NewWelcome(keyRing *storage.KeyRing, syncAddresses []string) *Welcome {
+	return &Welcome{
+		Keys:           keyRing.EpochKeys(),
+		RevokedDevices: keyRing.RevokedDevices(),
+		SyncAddresses:  syncAddresses,
+	}
+}
+
+// KeyRing rebuilds the inviting device's key ring. Devices are only
+// revoked by rotations, so the revocations go with the later epochs.
+func (w *Welcome) KeyRing() (*storage.KeyRing, error) {
+	keyRing, err := storage.NewKeyRing(w.Keys[0])
+	if err != nil {
+		return nil, ErrInvalidWelcome
+	}
+	for epoch, key := range w.Keys {
+		if epoch == 0 {
+			continue
+		}
+		if _, err := keyRing.AddEpoch(epoch, key, w.RevokedDevices); err != nil {
+			return nil, ErrInvalidWelcome
+		}
+	}
+	return keyRing, nil
+}
@@ -0,0 +1,37 @@
+package pairing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWelcomeKeyRing(t *testing.T) {
+	keyRing, err := storage.NewKeyRing([]byte("12345678901234567890123456789012"))
+	require.NoError(t, err)
+	_, err = keyRing.Rotate("tablet")
+	require.NoError(t, err)
+	epoch, err := keyRing.Rotate()
+	require.NoError(t, err)
+
+	// As sent over the pairing channel
+	data, err := json.Marshal(NewWelcome(keyRing, []string{"192.168.1.2:4000"}))
+	require.NoError(t, err)
+	var welcome Welcome
+	require.NoError(t, json.Unmarshal(data, &welcome))
+	assert.Equal(t, []string{"192.168.1.2:4000"}, welcome.SyncAddresses)
+
+	rebuilt, err := welcome.KeyRing()
+	require.NoError(t, err)
+	assert.Equal(t, epoch, rebuilt.CurrentEpoch())
+	assert.Equal(t, keyRing.EpochKeys(), rebuilt.EpochKeys())
+	assert.True(t, rebuilt.IsRevoked("tablet"))
+
+	_, err = (&Welcome{Keys: map[uint32][]byte{0: []byte("short")}}).KeyRing()
+	assert.ErrorIs(t, err, ErrInvalidWelcome)
+	_, err = (&Welcome{}).KeyRing()
+	assert.ErrorIs(t, err, ErrInvalidWelcome)
+}
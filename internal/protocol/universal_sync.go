@@ -1,9 +1,12 @@
 package protocol
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
 	"github.com/Fybrk/fybrk/pkg/types"
 )
 
@@ -51,7 +54,8 @@ const (
 	MsgSearchResult = "search.result"
 )
 
-// DeviceAnnouncement for device discovery
+// DeviceAnnouncement for device discovery. It is signed with the device's
+// identity key, whose public half is included and must match DeviceID.
 type DeviceAnnouncement struct {
 	DeviceID     string            `json:"device_id"`
 	DeviceName   string            `json:"device_name"`
@@ -59,6 +63,54 @@ type DeviceAnnouncement struct {
 	Capabilities []string          `json:"capabilities"`
 	NetworkInfo  map[string]string `json:"network_info"`
 	PublicKey    string            `json:"public_key"`
+	SignedAt     time.Time         `json:"signed_at"`
+	Signature    string            `json:"signature,omitempty"`
+}
+
+// signedBytes returns what the signature covers: the announcement without
+// its signature, followed by the channel binding
+func (a *DeviceAnnouncement) signedBytes(binding []byte) ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = ""
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, binding...), nil
+}
+
+// Sign signs the announcement with id. binding ties the signature to one
+// connection (see transport.ChannelBinding) so it cannot be replayed on
+// another; it may be nil for announcements that are not sent over one.
+func (a *DeviceAnnouncement) Sign(id *identity.Identity, binding []byte) error {
+	a.DeviceID = id.DeviceID()
+	a.PublicKey = id.PublicKeyString()
+	a.SignedAt = time.Now().UTC().Truncate(time.Second)
+
+	data, err := a.signedBytes(binding)
+	if err != nil {
+		return err
+	}
+	a.Signature = base64.RawURLEncoding.EncodeToString(id.Sign(data))
+	return nil
+}
+
+// Verify checks that the announcement was signed by the device it names
+// over the same binding
+func (a *DeviceAnnouncement) Verify(binding []byte) error {
+	if err := identity.VerifyDeviceID(a.DeviceID, a.PublicKey); err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(a.Signature)
+	if err != nil {
+		return identity.ErrInvalidSignature
+	}
+	data, err := a.signedBytes(binding)
+	if err != nil {
+		return err
+	}
+	return identity.Verify(a.PublicKey, data, signature)
 }
 
 // FileOperation represents file sync operations
@@ -76,6 +128,38 @@ type ConflictInfo struct {
 	LocalFile    *types.FileMetadata `json:"local_file"`
 	RemoteFile   *types.FileMetadata `json:"remote_file"`
 	Resolution   string              `json:"resolution"` // local_wins, remote_wins, merge, manual
+
+	// Set for conflicts recorded in a folder's database
+	ID       int64  `json:"id,omitempty"`
+	Path     string `json:"path,omitempty"`
+	CopyPath string `json:"copy_path,omitempty"`
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+// Conflict types and resolutions
+const (
+	ConflictTimestamp = "timestamp"
+	ConflictContent   = "content"
+	ConflictDelete    = "delete"
+
+	ResolutionLocalWins  = "local_wins"
+	ResolutionRemoteWins = "remote_wins"
+	ResolutionMerge      = "merge"
+	ResolutionManual     = "manual"
+)
+
+// NewConflictInfo describes a recorded content conflict
+func NewConflictInfo(conflict *types.Conflict) *ConflictInfo {
+	return &ConflictInfo{
+		ConflictType: ConflictContent,
+		LocalFile:    conflict.LocalFile,
+		RemoteFile:   conflict.RemoteFile,
+		Resolution:   conflict.Resolution,
+		ID:           conflict.ID,
+		Path:         conflict.Path,
+		CopyPath:     conflict.CopyPath,
+		DeviceID:     conflict.DeviceID,
+	}
 }
 
 // SyncStatus represents sync state
@@ -132,10 +216,14 @@ func (usp *UniversalSyncProtocol) ParseMessage(msg *SyncMessage, target interfac
 	return json.Unmarshal(payloadBytes, target)
 }
 
-// CreateDeviceAnnouncement creates a device announcement message
-func (usp *UniversalSyncProtocol) CreateDeviceAnnouncement(name string, capabilities []string, publicKey string) (*SyncMessage, error) {
+// CreateDeviceAnnouncement creates a device announcement message signed with
+// the device identity
+func (usp *UniversalSyncProtocol) CreateDeviceAnnouncement(name string, capabilities []string, id *identity.Identity) (*SyncMessage, error) {
+	if id.DeviceID() != usp.deviceID {
+		return nil, fmt.Errorf("identity belongs to device %s, not %s", id.DeviceID(), usp.deviceID)
+	}
+
 	announcement := DeviceAnnouncement{
-		DeviceID:     usp.deviceID,
 		DeviceName:   name,
 		DeviceType:   usp.deviceType,
 		Capabilities: capabilities,
@@ -143,7 +231,9 @@ func (usp *UniversalSyncProtocol) CreateDeviceAnnouncement(name string, capabili
 			"protocol": "fybrk-v1",
 			"platform": usp.deviceType,
 		},
-		PublicKey: publicKey,
+	}
+	if err := announcement.Sign(id, nil); err != nil {
+		return nil, err
 	}
 
 	return usp.CreateMessage(MsgDeviceAnnounce, announcement)
@@ -166,6 +256,11 @@ func (usp *UniversalSyncProtocol) CreateSyncStatus(status SyncStatus) (*SyncMess
 	return usp.CreateMessage(MsgSyncStatus, status)
 }
 
+// CreateConflict creates a sync conflict message
+func (usp *UniversalSyncProtocol) CreateConflict(conflict *ConflictInfo) (*SyncMessage, error) {
+	return usp.CreateMessage(MsgSyncConflict, conflict)
+}
+
 // IsCompatible checks if a message is compatible with this protocol version
 func (usp *UniversalSyncProtocol) IsCompatible(msg *SyncMessage) bool {
 	return msg.Version <= usp.version
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
 	"github.com/Fybrk/fybrk/pkg/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -78,28 +79,67 @@ func TestParseMessage(t *testing.T) {
 }
 
 func TestCreateDeviceAnnouncement(t *testing.T) {
-	usp := NewUniversalSyncProtocol("test-device", "desktop")
+	id, err := identity.Generate()
+	require.NoError(t, err)
+	usp := NewUniversalSyncProtocol(id.DeviceID(), "desktop")
 
 	capabilities := []string{"sync", "pair", "store"}
-	publicKey := "test-public-key"
 
-	msg, err := usp.CreateDeviceAnnouncement("Test Device", capabilities, publicKey)
+	msg, err := usp.CreateDeviceAnnouncement("Test Device", capabilities, id)
 	require.NoError(t, err)
 
 	assert.Equal(t, MsgDeviceAnnounce, msg.Type)
-	assert.Equal(t, "test-device", msg.DeviceID)
+	assert.Equal(t, id.DeviceID(), msg.DeviceID)
 
 	var announcement DeviceAnnouncement
 	err = usp.ParseMessage(msg, &announcement)
 	require.NoError(t, err)
 
-	assert.Equal(t, "test-device", announcement.DeviceID)
+	assert.Equal(t, id.DeviceID(), announcement.DeviceID)
 	assert.Equal(t, "Test Device", announcement.DeviceName)
 	assert.Equal(t, "desktop", announcement.DeviceType)
 	assert.Equal(t, capabilities, announcement.Capabilities)
 	assert.Equal(t, "fybrk-v1", announcement.NetworkInfo["protocol"])
 	assert.Equal(t, "desktop", announcement.NetworkInfo["platform"])
-	assert.Equal(t, publicKey, announcement.PublicKey)
+	assert.Equal(t, id.PublicKeyString(), announcement.PublicKey)
+
+	// The signature survives the trip through the message payload
+	assert.NoError(t, announcement.Verify(nil))
+
+	// An identity for another device is refused
+	other, err := identity.Generate()
+	require.NoError(t, err)
+	_, err = usp.CreateDeviceAnnouncement("Test Device", capabilities, other)
+	assert.Error(t, err)
+}
+
+func TestDeviceAnnouncementVerify(t *testing.T) {
+	id, err := identity.Generate()
+	require.NoError(t, err)
+	binding := []byte("connection binding")
+
+	sign := func() *DeviceAnnouncement {
+		announcement := &DeviceAnnouncement{DeviceName: "Laptop", DeviceType: "desktop"}
+		require.NoError(t, announcement.Sign(id, binding))
+		return announcement
+	}
+
+	assert.NoError(t, sign().Verify(binding))
+
+	// Replayed on another connection
+	assert.Equal(t, identity.ErrInvalidSignature, sign().Verify([]byte("other connection")))
+
+	// Tampered field
+	announcement := sign()
+	announcement.DeviceName = "Impostor"
+	assert.Equal(t, identity.ErrInvalidSignature, announcement.Verify(binding))
+
+	// Claiming another device's ID with our key
+	other, err := identity.Generate()
+	require.NoError(t, err)
+	announcement = sign()
+	announcement.DeviceID = other.DeviceID()
+	assert.Equal(t, identity.ErrDeviceIDMismatch, announcement.Verify(binding))
 }
 
 func TestCreateFileOperation(t *testing.T) {
@@ -180,6 +220,33 @@ func TestCreateSyncStatus(t *testing.T) {
 	assert.Equal(t, []string{"error1", "error2"}, parsed.Errors)
 }
 
+func TestCreateConflict(t *testing.T) {
+	usp := NewUniversalSyncProtocol("test-device", "desktop")
+
+	conflict := &types.Conflict{
+		ID:         7,
+		Path:       "notes.txt",
+		CopyPath:   "notes.sync-conflict-20260101-120000-testdevi.txt",
+		DeviceID:   "laptop",
+		Resolution: ResolutionRemoteWins,
+		LocalFile:  &types.FileMetadata{Path: "notes.txt", VersionVector: types.VersionVector{"test-device": 2}},
+		RemoteFile: &types.FileMetadata{Path: "notes.txt", VersionVector: types.VersionVector{"laptop": 1}},
+	}
+
+	msg, err := usp.CreateConflict(NewConflictInfo(conflict))
+	require.NoError(t, err)
+	assert.Equal(t, MsgSyncConflict, msg.Type)
+
+	var parsed ConflictInfo
+	require.NoError(t, usp.ParseMessage(msg, &parsed))
+	assert.Equal(t, ConflictContent, parsed.ConflictType)
+	assert.Equal(t, ResolutionRemoteWins, parsed.Resolution)
+	assert.Equal(t, int64(7), parsed.ID)
+	assert.Equal(t, conflict.CopyPath, parsed.CopyPath)
+	assert.Equal(t, "laptop", parsed.DeviceID)
+	assert.Equal(t, conflict.LocalFile.VersionVector, parsed.LocalFile.VersionVector)
+}
+
 func TestIsCompatible(t *testing.T) {
 	usp := NewUniversalSyncProtocol("test-device", "desktop")
 
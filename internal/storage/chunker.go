@@ -2,8 +2,12 @@ package storage
 
 import (
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/Fybrk/fybrk/pkg/types"
@@ -11,15 +15,76 @@ import (
 
 const DefaultChunkSize = 1024 * 1024 // 1MB chunks
 
+// Default bounds for content-defined chunking
+const (
+	DefaultMinChunkSize = 256 * 1024      // 256KB
+	DefaultAvgChunkSize = 1024 * 1024     // 1MB
+	DefaultMaxChunkSize = 4 * 1024 * 1024 // 4MB
+)
+
+// ChunkingMode selects how a Chunker picks chunk boundaries
+type ChunkingMode int
+
+const (
+	FixedChunking          ChunkingMode = iota // Cut every chunkSize bytes
+	ContentDefinedChunking                     // Cut where a rolling hash matches (FastCDC)
+)
+
 type Chunker struct {
 	chunkSize int
+	mode      ChunkingMode
+	minSize   int
+	avgSize   int
+	maxSize   int
+	maskS     uint64 // Stricter mask used before avgSize
+	maskL     uint64 // Looser mask used after avgSize
+}
+
+// ChunkerOption configures optional Chunker behaviour
+type ChunkerOption func(*Chunker)
+
+// WithContentDefinedChunking switches the chunker to FastCDC-style
+// content-defined chunking. Boundaries depend on the data rather than on
+// offsets, so a small insert only changes the chunks around it. Sizes that
+// are zero or inconsistent fall back to the defaults.
+func WithContentDefinedChunking(minSize, avgSize, maxSize int) ChunkerOption {
+	return func(c *Chunker) {
+		if minSize <= 0 || avgSize <= minSize || maxSize <= avgSize {
+			minSize, avgSize, maxSize = DefaultMinChunkSize, DefaultAvgChunkSize, DefaultMaxChunkSize
+		}
+		c.mode = ContentDefinedChunking
+		c.minSize = minSize
+		c.avgSize = avgSize
+		c.maxSize = maxSize
+	}
 }
 
-func NewChunker(chunkSize int) *Chunker {
+func NewChunker(chunkSize int, opts ...ChunkerOption) *Chunker {
 	if chunkSize <= 0 {
 		chunkSize = DefaultChunkSize
 	}
-	return &Chunker{chunkSize: chunkSize}
+	c := &Chunker{chunkSize: chunkSize}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.mode == ContentDefinedChunking {
+		// Normalized chunking: one extra bit before the average size and one
+		// fewer after it keeps chunk sizes clustered around avgSize.
+		bits := 0
+		for (1 << (bits + 1)) <= c.avgSize {
+			bits++
+		}
+		c.maskS = gearMask(bits + 1)
+		c.maskL = gearMask(bits - 1)
+	}
+
+	return c
+}
+
+// Mode returns the chunking mode in use
+func (c *Chunker) Mode() ChunkingMode {
+	return c.mode
 }
 
 // ChunkFile splits a file into encrypted chunks
@@ -31,35 +96,158 @@ func (c *Chunker) ChunkFile(filePath string) ([]types.Chunk, error) {
 	defer file.Close()
 
 	var chunks []types.Chunk
-	buffer := make([]byte, c.chunkSize)
-
+	stream := c.NewChunkStream(file)
 	for {
-		n, err := file.Read(buffer)
+		chunk, err := stream.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
+		chunks = append(chunks, *chunk)
+	}
+
+	return chunks, nil
+}
+
+// ChunkStream yields the chunks of a reader one at a time, so only a single
+// chunk is held in memory. The hash of everything read is computed in the
+// same pass and is available from Sum once Next has returned io.EOF.
+type ChunkStream struct {
+	chunker *Chunker
+	reader  io.Reader
+	hash    hash.Hash
+	buffer  []byte
+	filled  int
+	size    int64
+	eof     bool
+}
+
+// NewChunkStream creates a stream that chunks r
+func (c *Chunker) NewChunkStream(r io.Reader) *ChunkStream {
+	bufSize := c.chunkSize
+	if c.mode == ContentDefinedChunking {
+		bufSize = c.maxSize
+	}
 
-		chunkData := make([]byte, n)
-		copy(chunkData, buffer[:n])
-		hash := sha256.Sum256(chunkData)
+	h := sha256.New()
+	return &ChunkStream{
+		chunker: c,
+		reader:  io.TeeReader(r, h),
+		hash:    h,
+		buffer:  make([]byte, bufSize),
+	}
+}
 
-		chunk := types.Chunk{
-			Hash:      hash,
-			Data:      chunkData,
-			Size:      int64(n),
-			Encrypted: false,
-			CreatedAt: time.Now(),
+// Next returns the next chunk, or io.EOF when the reader is exhausted
+func (s *ChunkStream) Next() (*types.Chunk, error) {
+	if !s.eof && s.filled < len(s.buffer) {
+		n, err := io.ReadFull(s.reader, s.buffer[s.filled:])
+		s.filled += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.eof = true
+		} else if err != nil {
+			return nil, err
 		}
+	}
 
-		chunks = append(chunks, chunk)
+	if s.filled == 0 {
+		return nil, io.EOF
 	}
 
-	return chunks, nil
+	cut := s.filled
+	if s.chunker.mode == ContentDefinedChunking {
+		cut = s.chunker.cutPoint(s.buffer[:s.filled])
+	}
+
+	chunkData := make([]byte, cut)
+	copy(chunkData, s.buffer[:cut])
+	s.filled = copy(s.buffer, s.buffer[cut:s.filled])
+	s.size += int64(cut)
+
+	return &types.Chunk{
+		Hash:      sha256.Sum256(chunkData),
+		Data:      chunkData,
+		Size:      int64(cut),
+		Encrypted: false,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// Sum returns the SHA-256 of all data read so far
+func (s *ChunkStream) Sum() [32]byte {
+	var sum [32]byte
+	copy(sum[:], s.hash.Sum(nil))
+	return sum
+}
+
+// Size returns the number of bytes chunked so far
+func (s *ChunkStream) Size() int64 {
+	return s.size
+}
+
+// cutPoint returns the length of the next content-defined chunk in data
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+
+	barrier := c.avgSize
+	if barrier > n {
+		barrier = n
+	}
+
+	var hash uint64
+	i := c.minSize
+	for ; i < barrier; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// gearMask returns a mask selecting the top bits of the gear hash, which
+// depend on the widest window of recent bytes.
+func gearMask(bits int) uint64 {
+	if bits <= 0 {
+		return 0
+	}
+	if bits >= 64 {
+		return ^uint64(0)
+	}
+	return ((uint64(1) << bits) - 1) << (64 - bits)
 }
 
+// gearTable maps each byte to a pseudo-random value for the rolling hash.
+// It is generated from a fixed seed so every device cuts at the same places.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x46796272_6b434443) // "FybrkCDC"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
 // ReassembleChunks combines chunks back into file data
 func (c *Chunker) ReassembleChunks(chunks []types.Chunk) ([]byte, error) {
 	var result []byte
@@ -68,3 +256,108 @@ func (c *Chunker) ReassembleChunks(chunks []types.Chunk) ([]byte, error) {
 	}
 	return result, nil
 }
+
+var ErrChunkHashMismatch = errors.New("chunk data does not match its hash")
+
+// Reassembler writes chunks straight to a temporary file next to the
+// destination and renames it into place on Commit, so received files never
+// need to fit in memory and are never seen half-written.
+type Reassembler struct {
+	destPath string
+	file     *os.File
+	mode     os.FileMode
+	hash     hash.Hash
+	size     int64
+}
+
+// DefaultFileMode is the mode of files reassembled where none existed
+const DefaultFileMode os.FileMode = 0644
+
+// NewReassembler starts reassembling a file that will end up at destPath.
+// It keeps the mode of the file it replaces, or DefaultFileMode.
+func NewReassembler(destPath string) (*Reassembler, error) {
+	dir := filepath.Dir(destPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(dir, ".fybrk-"+filepath.Base(destPath)+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	mode := DefaultFileMode
+	if info, err := os.Stat(destPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	return &Reassembler{
+		destPath: destPath,
+		file:     file,
+		mode:     mode,
+		hash:     sha256.New(),
+	}, nil
+}
+
+// SetMode sets the permissions the file is committed with
+func (r *Reassembler) SetMode(mode os.FileMode) {
+	r.mode = mode.Perm()
+}
+
+// WriteChunk appends a decrypted chunk after checking it against its hash
+func (r *Reassembler) WriteChunk(chunk *types.Chunk) error {
+	if chunk.Encrypted {
+		return fmt.Errorf("cannot reassemble encrypted chunk")
+	}
+	if sha256.Sum256(chunk.Data) != chunk.Hash {
+		return ErrChunkHashMismatch
+	}
+
+	if _, err := r.file.Write(chunk.Data); err != nil {
+		return err
+	}
+	r.hash.Write(chunk.Data)
+	r.size += int64(len(chunk.Data))
+
+	return nil
+}
+
+// Sum returns the SHA-256 of all data written so far
+func (r *Reassembler) Sum() [32]byte {
+	var sum [32]byte
+	copy(sum[:], r.hash.Sum(nil))
+	return sum
+}
+
+// Size returns the number of bytes written so far
+func (r *Reassembler) Size() int64 {
+	return r.size
+}
+
+// Commit flushes the temporary file and moves it to the destination
+func (r *Reassembler) Commit() error {
+	// Temporary files are created private
+	if err := r.file.Chmod(r.mode); err != nil {
+		r.Abort()
+		return err
+	}
+	if err := r.file.Sync(); err != nil {
+		r.Abort()
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		os.Remove(r.file.Name())
+		return err
+	}
+	if err := os.Rename(r.file.Name(), r.destPath); err != nil {
+		os.Remove(r.file.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort discards the temporary file
+func (r *Reassembler) Abort() error {
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
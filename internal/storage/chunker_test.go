@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
@@ -126,3 +129,183 @@ func TestChunkIntegrity(t *testing.T) {
 		offset += int(chunk.Size)
 	}
 }
+
+func TestContentDefinedChunking(t *testing.T) {
+	// Pseudo-random data so the rolling hash finds boundaries
+	testData := make([]byte, 256*1024)
+	_, err := rand.New(rand.NewSource(42)).Read(testData)
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(tmpDir, name)
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		return path
+	}
+
+	chunker := NewChunker(0, WithContentDefinedChunking(2048, 8192, 32768))
+	assert.Equal(t, ContentDefinedChunking, chunker.Mode())
+
+	t.Run("chunk sizes respect bounds", func(t *testing.T) {
+		chunks, err := chunker.ChunkFile(writeFile("bounds.bin", testData))
+		require.NoError(t, err)
+		assert.Greater(t, len(chunks), 1)
+
+		for i, chunk := range chunks {
+			assert.LessOrEqual(t, chunk.Size, int64(32768))
+			if i < len(chunks)-1 {
+				assert.GreaterOrEqual(t, chunk.Size, int64(2048))
+			}
+		}
+
+		reassembled, err := chunker.ReassembleChunks(chunks)
+		require.NoError(t, err)
+		assert.Equal(t, testData, reassembled)
+	})
+
+	t.Run("insert keeps most chunks stable", func(t *testing.T) {
+		original, err := chunker.ChunkFile(writeFile("original.bin", testData))
+		require.NoError(t, err)
+
+		edited := append([]byte{0xFF}, testData...)
+		modified, err := chunker.ChunkFile(writeFile("edited.bin", edited))
+		require.NoError(t, err)
+
+		known := make(map[[32]byte]bool)
+		for _, chunk := range original {
+			known[chunk.Hash] = true
+		}
+
+		changed := 0
+		for _, chunk := range modified {
+			if !known[chunk.Hash] {
+				changed++
+			}
+		}
+
+		// Only the chunk containing the inserted byte should differ
+		assert.Equal(t, 1, changed)
+	})
+
+	t.Run("fixed chunking shifts every chunk", func(t *testing.T) {
+		fixed := NewChunker(8192)
+		original, err := fixed.ChunkFile(writeFile("fixed.bin", testData))
+		require.NoError(t, err)
+
+		modified, err := fixed.ChunkFile(writeFile("fixed_edited.bin", append([]byte{0xFF}, testData...)))
+		require.NoError(t, err)
+
+		assert.NotEqual(t, original[len(original)-1].Hash, modified[len(modified)-1].Hash)
+	})
+
+	t.Run("invalid sizes use defaults", func(t *testing.T) {
+		c := NewChunker(0, WithContentDefinedChunking(10, 5, 1))
+		assert.Equal(t, DefaultMinChunkSize, c.minSize)
+		assert.Equal(t, DefaultAvgChunkSize, c.avgSize)
+		assert.Equal(t, DefaultMaxChunkSize, c.maxSize)
+	})
+}
+
+func TestChunkStream(t *testing.T) {
+	testData := make([]byte, 100*1024)
+	_, err := rand.New(rand.NewSource(7)).Read(testData)
+	require.NoError(t, err)
+
+	for name, chunker := range map[string]*Chunker{
+		"fixed":           NewChunker(4096),
+		"content defined": NewChunker(0, WithContentDefinedChunking(1024, 4096, 16384)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			stream := chunker.NewChunkStream(bytes.NewReader(testData))
+
+			var reassembled []byte
+			for {
+				chunk, err := stream.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				assert.Equal(t, sha256.Sum256(chunk.Data), chunk.Hash)
+				reassembled = append(reassembled, chunk.Data...)
+			}
+
+			assert.Equal(t, testData, reassembled)
+			assert.Equal(t, sha256.Sum256(testData), stream.Sum())
+			assert.Equal(t, int64(len(testData)), stream.Size())
+		})
+	}
+
+	t.Run("empty reader", func(t *testing.T) {
+		stream := NewChunker(1024).NewChunkStream(bytes.NewReader(nil))
+		_, err := stream.Next()
+		assert.Equal(t, io.EOF, err)
+		assert.Equal(t, sha256.Sum256(nil), stream.Sum())
+	})
+}
+
+func TestReassembler(t *testing.T) {
+	testData := []byte("Streaming reassembly writes chunks straight to disk")
+	tmpDir := t.TempDir()
+
+	srcFile := filepath.Join(tmpDir, "src.txt")
+	require.NoError(t, os.WriteFile(srcFile, testData, 0644))
+
+	chunks, err := NewChunker(8).ChunkFile(srcFile)
+	require.NoError(t, err)
+
+	t.Run("commit writes file", func(t *testing.T) {
+		destFile := filepath.Join(tmpDir, "nested", "dest.txt")
+		reassembler, err := NewReassembler(destFile)
+		require.NoError(t, err)
+
+		for i := range chunks {
+			require.NoError(t, reassembler.WriteChunk(&chunks[i]))
+		}
+
+		// Nothing is visible at the destination until commit
+		_, err = os.Stat(destFile)
+		assert.True(t, os.IsNotExist(err))
+
+		require.NoError(t, reassembler.Commit())
+
+		data, err := os.ReadFile(destFile)
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+		assert.Equal(t, sha256.Sum256(testData), reassembler.Sum())
+		assert.Equal(t, int64(len(testData)), reassembler.Size())
+
+		info, err := os.Stat(destFile)
+		require.NoError(t, err)
+		assert.Equal(t, DefaultFileMode, info.Mode().Perm())
+	})
+
+	t.Run("commit keeps the replaced file's mode", func(t *testing.T) {
+		destFile := filepath.Join(tmpDir, "script.sh")
+		require.NoError(t, os.WriteFile(destFile, []byte("old"), 0755))
+		require.NoError(t, os.Chmod(destFile, 0755))
+
+		reassembler, err := NewReassembler(destFile)
+		require.NoError(t, err)
+		require.NoError(t, reassembler.WriteChunk(&chunks[0]))
+		require.NoError(t, reassembler.Commit())
+
+		info, err := os.Stat(destFile)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	})
+
+	t.Run("corrupt chunk is rejected", func(t *testing.T) {
+		destFile := filepath.Join(tmpDir, "corrupt.txt")
+		reassembler, err := NewReassembler(destFile)
+		require.NoError(t, err)
+
+		bad := chunks[0]
+		bad.Data = []byte("tampered")
+		assert.Equal(t, ErrChunkHashMismatch, reassembler.WriteChunk(&bad))
+
+		require.NoError(t, reassembler.Abort())
+		entries, err := filepath.Glob(filepath.Join(tmpDir, ".fybrk-*"))
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+var ErrChunkNotFound = errors.New("chunk not found")
+
+// ChunkStore keeps chunks on disk addressed by their plaintext hash, so a
+// chunk shared by several files is stored once. Reference counts live in
+// the MetadataStore and follow the file rows that list each chunk.
+type ChunkStore struct {
+	dir           string
+	metadataStore *MetadataStore
+
+	// Chunks of files being written or received, which no file row
+	// references yet, with how many such files list them
+	mu     sync.Mutex
+	pinned map[[32]byte]int
+}
+
+func NewChunkStore(dir string, metadataStore *MetadataStore) (*ChunkStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &ChunkStore{dir: dir, metadataStore: metadataStore, pinned: make(map[[32]byte]int)}, nil
+}
+
+// Pin keeps chunks from being garbage collected until they are unpinned.
+// Pin the chunks of a file before storing them and unpin them once its
+// metadata references them, or the file is given up on.
+func (cs *ChunkStore) Pin(hashes [][32]byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, hash := range hashes {
+		cs.pinned[hash]++
+	}
+}
+
+// Unpin releases chunks pinned by Pin
+func (cs *ChunkStore) Unpin(hashes [][32]byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, hash := range hashes {
+		if cs.pinned[hash]--; cs.pinned[hash] <= 0 {
+			delete(cs.pinned, hash)
+		}
+	}
+}
+
+// chunkPath shards chunks into subdirectories by the first hash byte
+func (cs *ChunkStore) chunkPath(hash [32]byte) string {
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(cs.dir, name[:2], name)
+}
+
+// Has reports whether a chunk is present in the store
+func (cs *ChunkStore) Has(hash [32]byte) bool {
+	_, err := os.Stat(cs.chunkPath(hash))
+	return err == nil
+}
+
+// Put stores a chunk's data as-is. Storing a chunk that is already present
+// is a no-op, which is what deduplicates identical chunks across files.
+func (cs *ChunkStore) Put(chunk *types.Chunk) error {
+	if cs.Has(chunk.Hash) {
+		return nil
+	}
+
+	return cs.write(chunk)
+}
+
+// Replace overwrites a stored chunk, e.g. after re-encrypting it under a
+// newer key epoch
+func (cs *ChunkStore) Replace(chunk *types.Chunk) error {
+	return cs.write(chunk)
+}
+
+func (cs *ChunkStore) write(chunk *types.Chunk) error {
+	path := cs.chunkPath(chunk.Hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a crash never leaves a truncated chunk
+	if err := writeFileAtomic(path, chunk.Data); err != nil {
+		return err
+	}
+
+	var format byte
+	epoch, ok := ChunkKeyEpoch(chunk)
+	if ok {
+		format = ChunkFormat
+	}
+	return cs.metadataStore.StoreChunkInfo(chunk.Hash, chunk.Size, chunk.Encrypted, epoch, format)
+}
+
+// Get loads a chunk by hash
+func (cs *ChunkStore) Get(hash [32]byte) (*types.Chunk, error) {
+	data, err := os.ReadFile(cs.chunkPath(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrChunkNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size, encrypted, _, err := cs.metadataStore.GetChunkInfo(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Chunk{
+		Hash:      hash,
+		Data:      data,
+		Size:      size,
+		Encrypted: encrypted,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// GarbageCollect deletes every chunk that no file references any more and
+// returns how many were removed
+func (cs *ChunkStore) GarbageCollect() (int, error) {
+	hashes, err := cs.metadataStore.ListUnreferencedChunks()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, hash := range hashes {
+		deleted, err := cs.collect(hash)
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// collect deletes an unreferenced chunk unless it is pinned. Pinning waits
+// for a deletion in progress, so a chunk pinned and then found present is
+// not deleted under its pinner.
+func (cs *ChunkStore) collect(hash [32]byte) (bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.pinned[hash] > 0 {
+		return false, nil
+	}
+
+	deleted, err := cs.metadataStore.DeleteChunkInfo(hash)
+	if err != nil || !deleted {
+		return false, err // Referenced again since we listed it
+	}
+	if err := os.Remove(cs.chunkPath(hash)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
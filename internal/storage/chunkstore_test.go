@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestChunkStore(t *testing.T) (*ChunkStore, *MetadataStore) {
+	tmpDir := t.TempDir()
+
+	metadataStore, err := NewMetadataStore(filepath.Join(tmpDir, "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { metadataStore.Close() })
+
+	chunkStore, err := NewChunkStore(filepath.Join(tmpDir, "chunks"), metadataStore)
+	require.NoError(t, err)
+
+	return chunkStore, metadataStore
+}
+
+func testChunk(data string) *types.Chunk {
+	return &types.Chunk{
+		Hash:      sha256.Sum256([]byte(data)),
+		Data:      []byte(data),
+		Size:      int64(len(data)),
+		CreatedAt: time.Now(),
+	}
+}
+
+func TestChunkStorePutGet(t *testing.T) {
+	chunkStore, _ := newTestChunkStore(t)
+	chunk := testChunk("chunk data")
+
+	assert.False(t, chunkStore.Has(chunk.Hash))
+	require.NoError(t, chunkStore.Put(chunk))
+	assert.True(t, chunkStore.Has(chunk.Hash))
+
+	// Storing again is a no-op
+	require.NoError(t, chunkStore.Put(chunk))
+
+	retrieved, err := chunkStore.Get(chunk.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, chunk.Data, retrieved.Data)
+	assert.Equal(t, chunk.Size, retrieved.Size)
+	assert.False(t, retrieved.Encrypted)
+
+	_, err = chunkStore.Get(sha256.Sum256([]byte("missing")))
+	assert.Equal(t, ErrChunkNotFound, err)
+}
+
+func TestChunkStoreRefCounts(t *testing.T) {
+	chunkStore, metadataStore := newTestChunkStore(t)
+	metadataStore.SetVersionRetention(VersionRetention{}) // No history holding chunks
+
+	shared := testChunk("shared")
+	onlyA := testChunk("only in a")
+	for _, chunk := range []*types.Chunk{shared, onlyA} {
+		require.NoError(t, chunkStore.Put(chunk))
+	}
+
+	storeFile := func(path string, chunks ...*types.Chunk) {
+		hashes := make([][32]byte, len(chunks))
+		for i, chunk := range chunks {
+			hashes[i] = chunk.Hash
+		}
+		require.NoError(t, metadataStore.StoreFileMetadata(&types.FileMetadata{
+			Path:    path,
+			ModTime: time.Now().UTC().Truncate(time.Second),
+			Chunks:  hashes,
+			Version: 1,
+		}))
+	}
+
+	storeFile("a.txt", shared, onlyA)
+	storeFile("b.txt", shared)
+
+	_, _, refs, err := metadataStore.GetChunkInfo(shared.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, 2, refs)
+
+	// Nothing is garbage while both files exist
+	removed, err := chunkStore.GarbageCollect()
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// Rewriting a.txt drops its reference to onlyA
+	storeFile("a.txt", shared)
+	removed, err = chunkStore.GarbageCollect()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.False(t, chunkStore.Has(onlyA.Hash))
+	assert.True(t, chunkStore.Has(shared.Hash))
+
+	// Shared chunk survives until the last file is gone
+	require.NoError(t, metadataStore.DeleteFileMetadata("a.txt"))
+	removed, err = chunkStore.GarbageCollect()
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	require.NoError(t, metadataStore.DeleteFileMetadata("b.txt"))
+	removed, err = chunkStore.GarbageCollect()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.False(t, chunkStore.Has(shared.Hash))
+}
+
+func TestChunkStorePin(t *testing.T) {
+	chunkStore, _ := newTestChunkStore(t)
+	chunk := testChunk("being received")
+
+	// A chunk stored for a file whose metadata is not recorded yet
+	chunkStore.Pin([][32]byte{chunk.Hash})
+	require.NoError(t, chunkStore.Put(chunk))
+
+	removed, err := chunkStore.GarbageCollect()
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+	assert.True(t, chunkStore.Has(chunk.Hash))
+
+	// Once the file is given up on it goes with the garbage
+	chunkStore.Unpin([][32]byte{chunk.Hash})
+	removed, err = chunkStore.GarbageCollect()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.False(t, chunkStore.Has(chunk.Hash))
+}
@@ -1,88 +1,347 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"io"
 
 	"github.com/Fybrk/fybrk/pkg/types"
 )
 
+// ChunkFormat is the leading byte of encrypted chunks, naming their layout
+const ChunkFormat byte = 2
+
+const (
+	formatSize      = 1
+	epochSize       = 4
+	gcmNonceSize    = 12 // Standard AES-GCM nonce size
+	bindingTagSize  = 16
+	chunkHeaderSize = formatSize + epochSize + gcmNonceSize + bindingTagSize
+
+	// Chunks written before the format byte: key epoch | nonce | binding
+	// tag | ciphertext, and before that nonce | ciphertext
+	boundHeaderSize = epochSize + gcmNonceSize + bindingTagSize
+)
+
 var (
-	ErrInvalidKeySize = errors.New("invalid key size")
-	ErrDecryption     = errors.New("decryption failed")
+	ErrInvalidKeySize       = errors.New("invalid key size")
+	ErrDecryption           = errors.New("decryption failed")
+	ErrChunkBindingMismatch = errors.New("chunk is bound to a different file")
+)
+
+// EncryptionMode is the threat-model switch for chunk encryption.
+//
+// RandomNonceEncryption (the default) uses the folder key with a fresh random
+// nonce for every call, so ciphertexts reveal nothing about their contents,
+// not even whether two chunks are equal.
+//
+// ConvergentEncryption derives the key and nonce from the data key and the
+// chunk's plaintext hash, so identical chunks encrypt to identical bytes on
+// every device and can be deduplicated while still encrypted. The trade-off
+// is that anyone who sees ciphertexts learns which chunks are equal, and
+// anyone holding the folder key can confirm whether a folder contains a
+// chunk they can guess. Use it only where that is acceptable.
+type EncryptionMode int
+
+const (
+	RandomNonceEncryption EncryptionMode = iota
+	ConvergentEncryption
 )
 
 type Encryptor struct {
-	key []byte
+	key     []byte
+	keyRing *KeyRing
+	mode    EncryptionMode
 }
 
-func NewEncryptor(key []byte) (*Encryptor, error) {
+// EncryptorOption configures optional Encryptor behaviour
+type EncryptorOption func(*Encryptor)
+
+// WithEncryptionMode selects the encryption mode, see EncryptionMode
+func WithEncryptionMode(mode EncryptionMode) EncryptorOption {
+	return func(e *Encryptor) {
+		e.mode = mode
+	}
+}
+
+func NewEncryptor(key []byte, opts ...EncryptorOption) (*Encryptor, error) {
 	if len(key) != 32 { // AES-256 requires 32-byte key
 		return nil, ErrInvalidKeySize
 	}
-	return &Encryptor{key: key}, nil
+	keyRing, err := NewKeyRing(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptorWithKeyRing(keyRing, opts...), nil
 }
 
-// EncryptChunk encrypts a chunk's data using AES-GCM
+// NewEncryptorWithKeyRing creates an encryptor that encrypts under the key
+// ring's current epoch and can decrypt any epoch the ring holds
+func NewEncryptorWithKeyRing(keyRing *KeyRing, opts ...EncryptorOption) *Encryptor {
+	e := &Encryptor{key: keyRing.MasterKey(), keyRing: keyRing}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// KeyRing returns the key hierarchy backing this encryptor
+func (e *Encryptor) KeyRing() *KeyRing {
+	return e.keyRing
+}
+
+// Mode returns the encryption mode in use
+func (e *Encryptor) Mode() EncryptionMode {
+	return e.mode
+}
+
+// ChunkContext says where in which file a chunk is sent for: its path, the
+// version of the file by its content hash, and the chunk's index in that
+// version. When given, it is authenticated along with the chunk hash so a
+// chunk cannot be replayed into another file, another version of it or
+// another place in it.
+type ChunkContext struct {
+	Path    string
+	Version [32]byte
+	Index   uint32
+}
+
+// associatedData encodes the chunk identity authenticated by AES-GCM
+func associatedData(epoch uint32, chunkHash [32]byte, ctx *ChunkContext) []byte {
+	ad := make([]byte, 0, 64)
+	ad = append(ad, "fybrk-chunk-v2"...)
+	ad = binary.BigEndian.AppendUint32(ad, epoch)
+	ad = append(ad, chunkHash[:]...)
+	if ctx == nil {
+		return append(ad, 0)
+	}
+
+	ad = append(ad, 1)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(ctx.Path)))
+	ad = append(ad, ctx.Path...)
+	ad = append(ad, ctx.Version[:]...)
+	return binary.BigEndian.AppendUint32(ad, ctx.Index)
+}
+
+// v1AssociatedData is the associated data of chunks written before the
+// format byte, which are bound to their hash and key epoch but never to a
+// file
+func v1AssociatedData(epoch uint32, chunkHash [32]byte) []byte {
+	ad := make([]byte, 0, 64)
+	ad = append(ad, "fybrk-chunk-v1"...)
+	ad = binary.BigEndian.AppendUint32(ad, epoch)
+	ad = append(ad, chunkHash[:]...)
+	return append(ad, 0)
+}
+
+// bindingTag is a short digest of the associated data stored in clear
+// ahead of the ciphertext. It lets DecryptChunk tell a chunk presented under
+// the wrong identity apart from a wrong key or corrupted data. It reveals
+// nothing beyond the hashes, path and index, which file lists carry anyway.
+func bindingTag(ad []byte) []byte {
+	sum := sha256.Sum256(ad)
+	return sum[:bindingTagSize]
+}
+
+// convergentKey derives the per-chunk key and nonce used in convergent mode
+func convergentKey(dataKey []byte, chunkHash [32]byte, ad []byte, nonceSize int) (key, nonce []byte, err error) {
+	material, err := hkdf.Key(sha256.New, dataKey, chunkHash[:], "fybrk convergent chunk"+string(ad), 32+nonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return material[:32], material[32:], nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptChunk encrypts a chunk's data using AES-GCM, authenticating the
+// chunk hash as associated data
 func (e *Encryptor) EncryptChunk(chunk *types.Chunk) error {
+	return e.EncryptChunkWithContext(chunk, nil)
+}
+
+// EncryptChunkWithContext encrypts a chunk's data using AES-GCM and binds
+// it to its hash and, if ctx is not nil, to its file
+func (e *Encryptor) EncryptChunkWithContext(chunk *types.Chunk, ctx *ChunkContext) error {
 	if chunk.Encrypted {
 		return nil // Already encrypted
 	}
 
-	block, err := aes.NewCipher(e.key)
+	epoch := e.keyRing.CurrentEpoch()
+	dataKey, err := e.keyRing.DataKey(epoch)
 	if err != nil {
 		return err
 	}
+	ad := associatedData(epoch, chunk.Hash, ctx)
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return err
+	key := dataKey
+	var nonce []byte
+	if e.mode == ConvergentEncryption {
+		key, nonce, err = convergentKey(dataKey, chunk.Hash, ad, gcmNonceSize)
+		if err != nil {
+			return err
+		}
+	} else {
+		nonce = make([]byte, gcmNonceSize)
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	gcm, err := newGCM(key)
+	if err != nil {
 		return err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, chunk.Data, nil)
-	chunk.Data = ciphertext
+	// Layout: format | key epoch | nonce | binding tag | ciphertext
+	header := append(make([]byte, 0, chunkHeaderSize), ChunkFormat)
+	header = binary.BigEndian.AppendUint32(header, epoch)
+	header = append(header, nonce...)
+	header = append(header, bindingTag(ad)...)
+	chunk.Data = gcm.Seal(header, nonce, chunk.Data, ad)
 	chunk.Encrypted = true
 
 	return nil
 }
 
-// DecryptChunk decrypts a chunk's data using AES-GCM
+// DecryptChunk decrypts a chunk's data using AES-GCM. Chunks written in
+// the other mode are still accepted, so a folder can switch modes without
+// re-encrypting what it already stores.
 func (e *Encryptor) DecryptChunk(chunk *types.Chunk) error {
+	return e.DecryptChunkWithContext(chunk, nil)
+}
+
+// DecryptChunkWithContext decrypts a chunk that was encrypted with the same
+// context. A chunk bound to a different hash or file is rejected with
+// ErrChunkBindingMismatch. Chunks stored in an earlier format are still
+// read; they are never bound to a file, as bound chunks only travel
+// between devices.
+func (e *Encryptor) DecryptChunkWithContext(chunk *types.Chunk, ctx *ChunkContext) error {
 	if !chunk.Encrypted {
 		return nil // Not encrypted
 	}
 
-	block, err := aes.NewCipher(e.key)
-	if err != nil {
+	err := e.decryptCurrent(chunk, ctx)
+	if err == nil {
+		return nil
+	}
+	if ctx != nil {
+		if len(chunk.Data) == 0 || chunk.Data[0] != ChunkFormat {
+			return ErrChunkBindingMismatch // Sent by a device too old to bind it
+		}
 		return err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	// The leading byte of an older chunk may match the format by chance,
+	// so whatever the current format made of it, try the older ones
+	if e.decryptLegacy(chunk) == nil {
+		return nil
+	}
+	return err
+}
+
+// decryptCurrent decrypts a chunk in the current format
+func (e *Encryptor) decryptCurrent(chunk *types.Chunk, ctx *ChunkContext) error {
+	if len(chunk.Data) < chunkHeaderSize || chunk.Data[0] != ChunkFormat {
+		return ErrDecryption
+	}
+
+	epoch := binary.BigEndian.Uint32(chunk.Data[formatSize:])
+	dataKey, err := e.keyRing.DataKey(epoch)
 	if err != nil {
 		return err
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(chunk.Data) < nonceSize {
-		return ErrDecryption
+	ad := associatedData(epoch, chunk.Hash, ctx)
+	nonce := chunk.Data[formatSize+epochSize : formatSize+epochSize+gcmNonceSize]
+	tag := chunk.Data[formatSize+epochSize+gcmNonceSize : chunkHeaderSize]
+	if !bytes.Equal(tag, bindingTag(ad)) {
+		return ErrChunkBindingMismatch
 	}
 
-	nonce, ciphertext := chunk.Data[:nonceSize], chunk.Data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	chunkKey, _, err := convergentKey(dataKey, chunk.Hash, ad, gcmNonceSize)
 	if err != nil {
+		return err
+	}
+	return e.open(chunk, [][]byte{dataKey, chunkKey}, nonce, chunk.Data[chunkHeaderSize:], ad)
+}
+
+// decryptLegacy decrypts an unbound chunk written before the format byte:
+// first as bound to its hash under a key epoch, then as written before
+// epochs, under the folder's first master key
+func (e *Encryptor) decryptLegacy(chunk *types.Chunk) error {
+	if len(chunk.Data) >= boundHeaderSize {
+		epoch := binary.BigEndian.Uint32(chunk.Data)
+		if dataKey, err := e.keyRing.DataKey(epoch); err == nil {
+			ad := v1AssociatedData(epoch, chunk.Hash)
+			nonce := chunk.Data[epochSize : epochSize+gcmNonceSize]
+			tag := chunk.Data[epochSize+gcmNonceSize : boundHeaderSize]
+			if bytes.Equal(tag, bindingTag(ad)) {
+				chunkKey, _, err := convergentKey(dataKey, chunk.Hash, ad, gcmNonceSize)
+				if err != nil {
+					return err
+				}
+				if e.open(chunk, [][]byte{dataKey, chunkKey}, nonce, chunk.Data[boundHeaderSize:], ad) == nil {
+					return nil
+				}
+			}
+		}
+	}
+
+	masterKey, err := e.keyRing.epochMasterKey(0)
+	if err != nil || len(chunk.Data) < gcmNonceSize {
 		return ErrDecryption
 	}
+	material, err := hkdf.Key(sha256.New, masterKey, chunk.Hash[:], "fybrk convergent chunk", 32+gcmNonceSize)
+	if err != nil {
+		return err
+	}
+	return e.open(chunk, [][]byte{masterKey, material[:32]}, chunk.Data[:gcmNonceSize], chunk.Data[gcmNonceSize:], nil)
+}
+
+// open tries the keys a chunk may be sealed under, the one of this
+// encryptor's mode first, and replaces its data with the plaintext
+func (e *Encryptor) open(chunk *types.Chunk, keys [][]byte, nonce, ciphertext, ad []byte) error {
+	if e.mode == ConvergentEncryption {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
 
-	chunk.Data = plaintext
-	chunk.Encrypted = false
+	for _, key := range keys {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		plaintext, err := gcm.Open(nil, nonce, ciphertext, ad)
+		if err != nil {
+			continue
+		}
+
+		chunk.Data = plaintext
+		chunk.Encrypted = false
+		return nil
+	}
+
+	return ErrDecryption
+}
+
+// ChunkKeyEpoch returns the key epoch a chunk in the current format was
+// sealed under. It reports false for chunks in an earlier format.
+func ChunkKeyEpoch(chunk *types.Chunk) (uint32, bool) {
+	if !chunk.Encrypted || len(chunk.Data) < chunkHeaderSize || chunk.Data[0] != ChunkFormat {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(chunk.Data[formatSize:]), true
 }
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"testing"
 	"time"
@@ -213,3 +215,202 @@ func TestEncryptDecryptRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestConvergentEncryption(t *testing.T) {
+	key := generateTestKey()
+	newChunk := func(data string) *types.Chunk {
+		return &types.Chunk{
+			Hash: sha256.Sum256([]byte(data)),
+			Data: []byte(data),
+			Size: int64(len(data)),
+		}
+	}
+
+	convergent, err := NewEncryptor(key, WithEncryptionMode(ConvergentEncryption))
+	require.NoError(t, err)
+	assert.Equal(t, ConvergentEncryption, convergent.Mode())
+
+	t.Run("identical chunks encrypt identically", func(t *testing.T) {
+		// A second encryptor stands in for another device with the same key
+		otherDevice, err := NewEncryptor(key, WithEncryptionMode(ConvergentEncryption))
+		require.NoError(t, err)
+
+		a, b := newChunk("same plaintext"), newChunk("same plaintext")
+		require.NoError(t, convergent.EncryptChunk(a))
+		require.NoError(t, otherDevice.EncryptChunk(b))
+		assert.Equal(t, a.Data, b.Data)
+
+		c := newChunk("different plaintext")
+		require.NoError(t, convergent.EncryptChunk(c))
+		assert.NotEqual(t, a.Data, c.Data)
+
+		require.NoError(t, otherDevice.DecryptChunk(a))
+		assert.Equal(t, []byte("same plaintext"), a.Data)
+	})
+
+	t.Run("random mode never repeats ciphertext", func(t *testing.T) {
+		random, err := NewEncryptor(key)
+		require.NoError(t, err)
+		assert.Equal(t, RandomNonceEncryption, random.Mode())
+
+		a, b := newChunk("same plaintext"), newChunk("same plaintext")
+		require.NoError(t, random.EncryptChunk(a))
+		require.NoError(t, random.EncryptChunk(b))
+		assert.NotEqual(t, a.Data, b.Data)
+	})
+
+	t.Run("modes can read each other's chunks", func(t *testing.T) {
+		random, err := NewEncryptor(key)
+		require.NoError(t, err)
+
+		a := newChunk("written before switching modes")
+		require.NoError(t, random.EncryptChunk(a))
+		require.NoError(t, convergent.DecryptChunk(a))
+		assert.Equal(t, []byte("written before switching modes"), a.Data)
+
+		b := newChunk("written after switching modes")
+		require.NoError(t, convergent.EncryptChunk(b))
+		require.NoError(t, random.DecryptChunk(b))
+		assert.Equal(t, []byte("written after switching modes"), b.Data)
+	})
+
+	t.Run("wrong key still fails", func(t *testing.T) {
+		other, err := NewEncryptor(generateTestKey(), WithEncryptionMode(ConvergentEncryption))
+		require.NoError(t, err)
+
+		a := newChunk("secret")
+		require.NoError(t, convergent.EncryptChunk(a))
+		assert.Equal(t, ErrDecryption, other.DecryptChunk(a))
+	})
+}
+
+func TestChunkContextBinding(t *testing.T) {
+	encryptor, err := NewEncryptor(generateTestKey())
+	require.NoError(t, err)
+
+	data := []byte("page 7 of the contract")
+	version := sha256.Sum256([]byte("the contract"))
+	ctx := &ChunkContext{Path: "docs/contract.pdf", Version: version, Index: 7}
+
+	seal := func() *types.Chunk {
+		chunk := &types.Chunk{Hash: sha256.Sum256(data), Data: append([]byte(nil), data...)}
+		require.NoError(t, encryptor.EncryptChunkWithContext(chunk, ctx))
+		return chunk
+	}
+
+	t.Run("matching context decrypts", func(t *testing.T) {
+		chunk := seal()
+		require.NoError(t, encryptor.DecryptChunkWithContext(chunk, ctx))
+		assert.Equal(t, data, chunk.Data)
+	})
+
+	mismatches := map[string]*ChunkContext{
+		"other file":    {Path: "docs/other.pdf", Version: version, Index: 7},
+		"other version": {Path: "docs/contract.pdf", Version: sha256.Sum256([]byte("an earlier draft")), Index: 7},
+		"other index":   {Path: "docs/contract.pdf", Version: version, Index: 8},
+		"no context":    nil,
+	}
+	for name, other := range mismatches {
+		t.Run(name, func(t *testing.T) {
+			chunk := seal()
+			assert.Equal(t, ErrChunkBindingMismatch, encryptor.DecryptChunkWithContext(chunk, other))
+			assert.True(t, chunk.Encrypted)
+		})
+	}
+
+	t.Run("swapped hash", func(t *testing.T) {
+		chunk := seal()
+		chunk.Hash = sha256.Sum256([]byte("another chunk"))
+		assert.Equal(t, ErrChunkBindingMismatch, encryptor.DecryptChunkWithContext(chunk, ctx))
+	})
+
+	t.Run("forged binding tag", func(t *testing.T) {
+		chunk := seal()
+		other := &ChunkContext{Path: "docs/other.pdf"}
+		copy(chunk.Data[formatSize+epochSize+gcmNonceSize:], bindingTag(associatedData(0, chunk.Hash, other)))
+
+		// Rewriting the clear tag does not get past authentication
+		assert.Equal(t, ErrDecryption, encryptor.DecryptChunkWithContext(chunk, other))
+	})
+}
+
+func TestLegacyChunkFormats(t *testing.T) {
+	key := generateTestKey()
+	data := []byte("written by an earlier release")
+	hash := sha256.Sum256(data)
+
+	seal := func(key, nonce, ad []byte) []byte {
+		gcm, err := newGCM(key)
+		require.NoError(t, err)
+		return gcm.Seal(nil, nonce, data, ad)
+	}
+	randomNonce := func() []byte {
+		nonce := make([]byte, gcmNonceSize)
+		_, err := rand.Read(nonce)
+		require.NoError(t, err)
+		return nonce
+	}
+
+	// Chunks bound to their hash and key epoch, before the format byte
+	bound := func(mode EncryptionMode) []byte {
+		keyRing, err := NewKeyRing(key)
+		require.NoError(t, err)
+		dataKey, err := keyRing.DataKey(0)
+		require.NoError(t, err)
+
+		ad := v1AssociatedData(0, hash)
+		chunkKey, nonce, err := convergentKey(dataKey, hash, ad, gcmNonceSize)
+		require.NoError(t, err)
+		if mode == RandomNonceEncryption {
+			chunkKey, nonce = dataKey, randomNonce()
+		}
+
+		sealed := binary.BigEndian.AppendUint32(nil, 0)
+		sealed = append(sealed, nonce...)
+		sealed = append(sealed, bindingTag(ad)...)
+		return append(sealed, seal(chunkKey, nonce, ad)...)
+	}
+
+	// Chunks sealed under the master key, before key epochs
+	unbound := func(mode EncryptionMode) []byte {
+		chunkKey, nonce := key, randomNonce()
+		if mode == ConvergentEncryption {
+			material, err := hkdf.Key(sha256.New, key, hash[:], "fybrk convergent chunk", 32+gcmNonceSize)
+			require.NoError(t, err)
+			chunkKey, nonce = material[:32], material[32:]
+		}
+		return append(append([]byte(nil), nonce...), seal(chunkKey, nonce, nil)...)
+	}
+
+	for _, mode := range []EncryptionMode{RandomNonceEncryption, ConvergentEncryption} {
+		for name, sealed := range map[string][]byte{"bound": bound(mode), "unbound": unbound(mode)} {
+			t.Run(fmt.Sprintf("%s mode %d", name, mode), func(t *testing.T) {
+				encryptor, err := NewEncryptor(key, WithEncryptionMode(mode))
+				require.NoError(t, err)
+
+				chunk := &types.Chunk{Hash: hash, Data: append([]byte(nil), sealed...), Encrypted: true}
+				_, ok := ChunkKeyEpoch(chunk)
+				assert.False(t, ok, "legacy chunks are not in the current format")
+
+				require.NoError(t, encryptor.DecryptChunk(chunk))
+				assert.Equal(t, data, chunk.Data)
+
+				// A peer cannot pass one off as bound to a file
+				chunk = &types.Chunk{Hash: hash, Data: append([]byte(nil), sealed...), Encrypted: true}
+				assert.Equal(t, ErrChunkBindingMismatch, encryptor.DecryptChunkWithContext(chunk, &ChunkContext{Path: "a.txt"}))
+			})
+		}
+	}
+
+	t.Run("current format", func(t *testing.T) {
+		encryptor, err := NewEncryptor(key)
+		require.NoError(t, err)
+
+		chunk := &types.Chunk{Hash: hash, Data: append([]byte(nil), data...)}
+		require.NoError(t, encryptor.EncryptChunk(chunk))
+		assert.Equal(t, ChunkFormat, chunk.Data[0])
+		epoch, ok := ChunkKeyEpoch(chunk)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(0), epoch)
+	})
+}
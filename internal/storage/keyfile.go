@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+const (
+	// PassphraseEnv names the environment variable consulted before
+	// prompting for the passphrase that unlocks a sealed key file
+	PassphraseEnv = "FYBRK_PASSPHRASE"
+
+	// NewPassphraseEnv names the environment variable consulted before
+	// prompting for a new passphrase, when it differs from the one in
+	// PassphraseEnv that unlocks the key file now
+	NewPassphraseEnv = "FYBRK_NEW_PASSPHRASE"
+)
+
+var (
+	ErrPassphraseRequired = errors.New("key file is passphrase protected")
+	ErrWrongPassphrase    = errors.New("wrong passphrase")
+	ErrPassphraseMismatch = errors.New("passphrases do not match")
+)
+
+// PassphraseFunc supplies the passphrase for a sealed key file. It is only
+// called when the key file on disk is actually sealed.
+type PassphraseFunc func() (string, error)
+
+// Argon2id parameters for new sealed key files. They are stored alongside
+// the sealed key so they can be raised later without breaking old files.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// sealedKeyFile is the on-disk form of a passphrase protected key. A raw
+// key file is exactly 32 bytes, so the two are easy to tell apart.
+type sealedKeyFile struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Sealed  []byte `json:"sealed"` // nonce | AES-GCM ciphertext under the KEK
+}
+
+// ReadKeyFile loads a key written by WriteKeyFile, asking passphrase for
+// the passphrase if the file is sealed. It also returns the passphrase that
+// unlocked it ("" for a plain key file) so the key can be re-sealed later.
+func ReadKeyFile(path string, passphrase PassphraseFunc) ([]byte, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !isSealedKey(data) {
+		if len(data) != 32 {
+			return nil, "", ErrInvalidKeySize
+		}
+		return data, "", nil
+	}
+
+	if passphrase == nil {
+		return nil, "", ErrPassphraseRequired
+	}
+	pass, err := passphrase()
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, err := openSealedKey(data, pass)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, pass, nil
+}
+
+// WriteKeyFile writes key to path, sealed under passphrase unless it is
+// empty, in which case the raw key is written
+func WriteKeyFile(path string, key []byte, passphrase string) error {
+	if passphrase == "" {
+		return writeFileAtomic(path, key)
+	}
+
+	data, err := sealKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// IsKeyFileSealed reports whether the key file at path is passphrase protected
+func IsKeyFileSealed(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return isSealedKey(data), nil
+}
+
+func isSealedKey(data []byte) bool {
+	return len(data) != 32 && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func sealKey(key []byte, passphrase string) ([]byte, error) {
+	file := sealedKeyFile{
+		KDF:     "argon2id",
+		Salt:    make([]byte, 16),
+		Time:    argon2Time,
+		Memory:  argon2Memory,
+		Threads: argon2Threads,
+	}
+	if _, err := io.ReadFull(rand.Reader, file.Salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(file.kek(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	file.Sealed = gcm.Seal(nonce, nonce, key, []byte("fybrk-key-file"))
+
+	return json.MarshalIndent(file, "", "  ")
+}
+
+func openSealedKey(data []byte, passphrase string) ([]byte, error) {
+	var file sealedKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid key file: %v", err)
+	}
+	if file.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported key derivation %q", file.KDF)
+	}
+
+	gcm, err := newGCM(file.kek(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid key file: sealed key too short")
+	}
+
+	nonce, ciphertext := file.Sealed[:gcm.NonceSize()], file.Sealed[gcm.NonceSize():]
+	key, err := gcm.Open(nil, nonce, ciphertext, []byte("fybrk-key-file"))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// kek derives the key-encryption key from a passphrase
+func (f *sealedKeyFile) kek(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), f.Salt, f.Time, f.Memory, f.Threads, 32)
+}
+
+// PassphraseFromEnvOrTerminal returns a PassphraseFunc that reads
+// FYBRK_PASSPHRASE, falling back to prompting on the terminal without echo
+func PassphraseFromEnvOrTerminal(prompt string) PassphraseFunc {
+	return func() (string, error) {
+		if pass, ok := os.LookupEnv(PassphraseEnv); ok {
+			return pass, nil
+		}
+		return ReadPassphrase(prompt)
+	}
+}
+
+// ReadNewPassphrase returns the passphrase to seal a key file with. It reads
+// FYBRK_NEW_PASSPHRASE or else FYBRK_PASSPHRASE, so the key file goes on to
+// open with what is set, and only prompts twice on the terminal if neither
+// is set.
+func ReadNewPassphrase() (string, error) {
+	for _, env := range []string{NewPassphraseEnv, PassphraseEnv} {
+		if pass, ok := os.LookupEnv(env); ok {
+			return pass, nil
+		}
+	}
+
+	passphrase, err := ReadPassphrase("New passphrase (empty to remove): ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := ReadPassphrase("Repeat new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirm {
+		return "", ErrPassphraseMismatch
+	}
+	return passphrase, nil
+}
+
+// ReadPassphrase prompts for a passphrase on the terminal without echo
+func ReadPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("%w: set %s or run from a terminal", ErrPassphraseRequired, PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealedKeyFile(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key")
+	key := []byte("12345678901234567890123456789012")
+	passphrase := func(pass string) PassphraseFunc {
+		return func() (string, error) { return pass, nil }
+	}
+
+	require.NoError(t, WriteKeyFile(keyPath, key, "correct horse"))
+
+	sealed, err := IsKeyFileSealed(keyPath)
+	require.NoError(t, err)
+	assert.True(t, sealed)
+
+	// The raw key never reaches the disk
+	data, err := os.ReadFile(keyPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), string(key))
+
+	_, _, err = ReadKeyFile(keyPath, nil)
+	assert.Equal(t, ErrPassphraseRequired, err)
+
+	_, _, err = ReadKeyFile(keyPath, passphrase("battery staple"))
+	assert.Equal(t, ErrWrongPassphrase, err)
+
+	loaded, pass, err := ReadKeyFile(keyPath, passphrase("correct horse"))
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+	assert.Equal(t, "correct horse", pass)
+
+	// An empty passphrase writes the plain key again
+	require.NoError(t, WriteKeyFile(keyPath, key, ""))
+	loaded, pass, err = ReadKeyFile(keyPath, nil)
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+	assert.Empty(t, pass)
+}
+
+func TestKeyRingKeepsPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := func() (string, error) { return "hunter2", nil }
+
+	keyRing, err := LoadOrCreateKeyRing(dir, nil)
+	require.NoError(t, err)
+	assert.False(t, keyRing.Protected())
+
+	keyRing.SetPassphrase("hunter2")
+	require.NoError(t, keyRing.Save(dir))
+
+	_, err = LoadKeyRing(dir, nil)
+	assert.Equal(t, ErrPassphraseRequired, err)
+
+	// Rotating a protected ring keeps the key file sealed
+	loaded, err := LoadKeyRing(dir, passphrase)
+	require.NoError(t, err)
+	assert.True(t, loaded.Protected())
+	_, err = loaded.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, loaded.Save(dir))
+
+	sealed, err := IsKeyFileSealed(filepath.Join(dir, keyFileName))
+	require.NoError(t, err)
+	assert.True(t, sealed)
+
+	reloaded, err := LoadKeyRing(dir, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), reloaded.CurrentEpoch())
+	assert.Equal(t, loaded.MasterKey(), reloaded.MasterKey())
+}
+
+func TestReadNewPassphrase(t *testing.T) {
+	// Without a terminal, the environment decides
+	t.Setenv(PassphraseEnv, "from env")
+	passphrase, err := ReadNewPassphrase()
+	require.NoError(t, err)
+	assert.Equal(t, "from env", passphrase)
+
+	t.Setenv(NewPassphraseEnv, "")
+	passphrase, err = ReadNewPassphrase()
+	require.NoError(t, err)
+	assert.Empty(t, passphrase, "an empty new passphrase removes the protection")
+}
@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKeyEpoch = errors.New("no key for this key epoch")
+
+const (
+	keyFileName         = "key"
+	keyRingFileName     = "keyring.json"
+	nextKeyRingFileName = "keyring.json.next"
+)
+
+// KeyRing is the key hierarchy of a sync folder. Each rotation starts a new
+// epoch with a fresh folder master key; chunk data keys are derived from an
+// epoch's master key with HKDF and never stored. Master keys of earlier
+// epochs are kept wrapped under the current one, so a device holding the
+// current key can still read older data while a device removed before the
+// rotation cannot read anything written afterwards.
+type KeyRing struct {
+	current    uint32
+	keys       map[uint32][]byte
+	revoked    []string
+	passphrase string // Seals the key file on Save when not empty
+	mu         sync.RWMutex
+}
+
+// keyRingFile is the on-disk form of the older epochs, stored next to the
+// raw current key in .fybrk. KeyID names the master key the older epochs
+// are wrapped under, so a key ring that does not go with the key file is
+// never used.
+type keyRingFile struct {
+	CurrentEpoch   uint32       `json:"current_epoch"`
+	KeyID          string       `json:"key_id,omitempty"`
+	Wrapped        []wrappedKey `json:"wrapped"`
+	RevokedDevices []string     `json:"revoked_devices,omitempty"`
+	RotatedAt      time.Time    `json:"rotated_at,omitempty"`
+}
+
+type wrappedKey struct {
+	Epoch uint32 `json:"epoch"`
+	Key   []byte `json:"key"` // nonce | AES-GCM ciphertext under the current master key
+}
+
+// NewKeyRing creates a key ring whose only epoch (0) uses masterKey
+func NewKeyRing(masterKey []byte) (*KeyRing, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrInvalidKeySize
+	}
+	return &KeyRing{
+		keys: map[uint32][]byte{0: masterKey},
+	}, nil
+}
+
+// LoadOrCreateKeyRing loads the key ring kept in dir, generating a new
+// master key on first use. passphrase is only asked for if the key file is
+// sealed and may be nil.
+func LoadOrCreateKeyRing(dir string, passphrase PassphraseFunc) (*KeyRing, error) {
+	keyPath := filepath.Join(dir, keyFileName)
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		masterKey := make([]byte, 32)
+		if _, err := rand.Read(masterKey); err != nil {
+			return nil, err
+		}
+		kr, err := NewKeyRing(masterKey)
+		if err != nil {
+			return nil, err
+		}
+		return kr, kr.Save(dir)
+	}
+	return LoadKeyRing(dir, passphrase)
+}
+
+// LoadKeyRing loads the current master key and unwraps earlier epochs
+func LoadKeyRing(dir string, passphrase PassphraseFunc) (*KeyRing, error) {
+	masterKey, pass, err := ReadKeyFile(filepath.Join(dir, keyFileName), passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	kr, err := NewKeyRing(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	kr.passphrase = pass
+
+	file, err := readKeyRingFile(dir, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return kr, nil // Never rotated
+	}
+
+	kr.current = file.CurrentEpoch
+	kr.keys = map[uint32][]byte{file.CurrentEpoch: masterKey}
+	kr.revoked = file.RevokedDevices
+
+	for _, wrapped := range file.Wrapped {
+		key, err := unwrapKey(masterKey, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap key for epoch %d: %v", wrapped.Epoch, err)
+		}
+		kr.keys[wrapped.Epoch] = key
+	}
+
+	return kr, nil
+}
+
+// readKeyRingFile reads the key ring that goes with masterKey. Save writes
+// the next key ring before the key file and moves it into place after, so
+// the key file decides which of the two is current if Save was cut short.
+func readKeyRingFile(dir string, masterKey []byte) (*keyRingFile, error) {
+	read := func(name string) (*keyRingFile, error) {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var file keyRingFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("invalid key ring: %v", err)
+		}
+		return &file, nil
+	}
+
+	id := keyID(masterKey)
+	next, err := read(nextKeyRingFileName)
+	if err != nil {
+		return nil, err
+	}
+	if next != nil {
+		if next.KeyID == id {
+			// The key file was replaced, but not the key ring
+			if err := os.Rename(filepath.Join(dir, nextKeyRingFileName), filepath.Join(dir, keyRingFileName)); err != nil {
+				return nil, err
+			}
+			return next, nil
+		}
+		// The key file was never replaced
+		if err := os.Remove(filepath.Join(dir, nextKeyRingFileName)); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := read(keyRingFileName)
+	if err != nil || file == nil {
+		return nil, err
+	}
+	// Key rings written before key IDs were recorded have none
+	if file.KeyID != "" && file.KeyID != id {
+		return nil, fmt.Errorf("key ring does not belong to the key file")
+	}
+	return file, nil
+}
+
+// keyID names a master key without revealing it
+func keyID(masterKey []byte) string {
+	id, err := hkdf.Key(sha256.New, masterKey, nil, "fybrk key id", 8)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", id)
+}
+
+// Save writes the current master key and the wrapped earlier epochs to dir.
+// The key ring is written to the side first and moved into place once the
+// key file holds the key it is wrapped under, so a crash at any point
+// leaves a key file and key ring that belong together.
+func (kr *KeyRing) Save(dir string) error {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	masterKey := kr.keys[kr.current]
+
+	if kr.current > 0 {
+		file := keyRingFile{
+			CurrentEpoch:   kr.current,
+			KeyID:          keyID(masterKey),
+			RevokedDevices: kr.revoked,
+			RotatedAt:      time.Now(),
+		}
+		for epoch, key := range kr.keys {
+			if epoch == kr.current {
+				continue
+			}
+			wrapped, err := wrapKey(masterKey, epoch, key)
+			if err != nil {
+				return err
+			}
+			file.Wrapped = append(file.Wrapped, wrapped)
+		}
+
+		data, err := json.MarshalIndent(file, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, nextKeyRingFileName), data); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteKeyFile(filepath.Join(dir, keyFileName), masterKey, kr.passphrase); err != nil {
+		return err
+	}
+	if kr.current == 0 {
+		return nil
+	}
+	return os.Rename(filepath.Join(dir, nextKeyRingFileName), filepath.Join(dir, keyRingFileName))
+}
+
+// SetPassphrase changes the passphrase the key file is sealed with on the
+// next Save. An empty passphrase stores the key unprotected.
+func (kr *KeyRing) SetPassphrase(passphrase string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.passphrase = passphrase
+}
+
+// Protected reports whether the key file is sealed with a passphrase
+func (kr *KeyRing) Protected() bool {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.passphrase != ""
+}
+
+// Rotate starts a new epoch with a fresh master key. Earlier master keys are
+// re-wrapped under it on Save. revokedDevices are recorded so the new key
+// is never handed to them.
+func (kr *KeyRing) Rotate(revokedDevices ...string) (uint32, error) {
+	masterKey := make([]byte, 32)
+	if _, err := rand.Read(masterKey); err != nil {
+		return 0, err
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	kr.current++
+	kr.keys[kr.current] = masterKey
+	kr.revoked = append(kr.revoked, revokedDevices...)
+
+	return kr.current, nil
+}
+
+// AddEpoch adds the master key of an epoch handed over by another device,
+// along with the devices it was revoked from. A later epoch than the
+// current one becomes current. It reports whether the key was new.
+func (kr *KeyRing) AddEpoch(epoch uint32, masterKey []byte, revokedDevices []string) (bool, error) {
+	if len(masterKey) != 32 {
+		return false, ErrInvalidKeySize
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for _, device := range revokedDevices {
+		if !slices.Contains(kr.revoked, device) {
+			kr.revoked = append(kr.revoked, device)
+		}
+	}
+	if _, ok := kr.keys[epoch]; ok {
+		return false, nil
+	}
+
+	kr.keys[epoch] = append([]byte(nil), masterKey...)
+	if epoch > kr.current {
+		kr.current = epoch
+	}
+	return true, nil
+}
+
+// CurrentEpoch returns the epoch new data is encrypted under
+func (kr *KeyRing) CurrentEpoch() uint32 {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current
+}
+
+// MasterKey returns the folder master key of the current epoch
+func (kr *KeyRing) MasterKey() []byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[kr.current]
+}
+
+// EpochKeys returns the master keys of every epoch, for handing the whole
+// folder to a newly paired device
+func (kr *KeyRing) EpochKeys() map[uint32][]byte {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	keys := make(map[uint32][]byte, len(kr.keys))
+	for epoch, key := range kr.keys {
+		keys[epoch] = append([]byte(nil), key...)
+	}
+	return keys
+}
+
+// RevokedDevices returns the devices excluded from key rotations
+func (kr *KeyRing) RevokedDevices() []string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return append([]string(nil), kr.revoked...)
+}
+
+// IsRevoked reports whether a device was excluded from a key rotation
+func (kr *KeyRing) IsRevoked(deviceID string) bool {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return slices.Contains(kr.revoked, deviceID)
+}
+
+// DataKey derives the chunk data key for an epoch
+func (kr *KeyRing) DataKey(epoch uint32) ([]byte, error) {
+	masterKey, err := kr.epochMasterKey(epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	info := binary.BigEndian.AppendUint32([]byte("fybrk data key"), epoch)
+	return hkdf.Key(sha256.New, masterKey, nil, string(info), 32)
+}
+
+// epochMasterKey returns the master key of an epoch
+func (kr *KeyRing) epochMasterKey(epoch uint32) ([]byte, error) {
+	kr.mu.RLock()
+	masterKey, ok := kr.keys[epoch]
+	kr.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKeyEpoch
+	}
+	return masterKey, nil
+}
+
+// TransportSecret derives the secret peers prove they hold when connecting.
+// It follows the current epoch, so a rotation also locks out revoked
+// devices at the network level.
+func (kr *KeyRing) TransportSecret() ([]byte, error) {
+	return transportSecret(kr.MasterKey())
+}
+
+// EarlierTransportSecrets returns the transport secrets of the epochs
+// before the current one, newest first. Devices that missed a rotation
+// still prove one of them and can be handed the current key.
+func (kr *KeyRing) EarlierTransportSecrets() ([][]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	var secrets [][]byte
+	for epoch := kr.current; epoch > 0; epoch-- {
+		masterKey, ok := kr.keys[epoch-1]
+		if !ok {
+			continue
+		}
+		secret, err := transportSecret(masterKey)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+func transportSecret(masterKey []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, masterKey, nil, "fybrk transport secret", 32)
+}
+
+func wrapKey(wrappingKey []byte, epoch uint32, key []byte) (wrappedKey, error) {
+	gcm, err := newGCM(wrappingKey)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return wrappedKey{}, err
+	}
+
+	ad := binary.BigEndian.AppendUint32([]byte("fybrk-keyring"), epoch)
+	return wrappedKey{
+		Epoch: epoch,
+		Key:   gcm.Seal(nonce, nonce, key, ad),
+	}, nil
+}
+
+func unwrapKey(wrappingKey []byte, wrapped wrappedKey) ([]byte, error) {
+	gcm, err := newGCM(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped.Key) < gcm.NonceSize() {
+		return nil, ErrDecryption
+	}
+
+	ad := binary.BigEndian.AppendUint32([]byte("fybrk-keyring"), wrapped.Epoch)
+	nonce, ciphertext := wrapped.Key[:gcm.NonceSize()], wrapped.Key[gcm.NonceSize():]
+	key, err := gcm.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return key, nil
+}
+
+// writeFileAtomic replaces path with data, readable by the owner only
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
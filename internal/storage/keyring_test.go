@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	keyRing, err := LoadOrCreateKeyRing(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), keyRing.CurrentEpoch())
+
+	encryptor := NewEncryptorWithKeyRing(keyRing)
+	data := []byte("written before the rotation")
+	oldChunk := &types.Chunk{Hash: sha256.Sum256(data), Data: append([]byte(nil), data...), CreatedAt: time.Now()}
+	require.NoError(t, encryptor.EncryptChunk(oldChunk))
+
+	// A device holding only the epoch 0 key
+	revokedRing, err := NewKeyRing(keyRing.MasterKey())
+	require.NoError(t, err)
+	revoked := NewEncryptorWithKeyRing(revokedRing)
+
+	epoch, err := keyRing.Rotate("old-laptop")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), epoch)
+	require.NoError(t, keyRing.Save(dir))
+
+	data = []byte("written after the rotation")
+	newChunk := &types.Chunk{Hash: sha256.Sum256(data), Data: append([]byte(nil), data...), CreatedAt: time.Now()}
+	require.NoError(t, encryptor.EncryptChunk(newChunk))
+
+	chunkEpoch, ok := ChunkKeyEpoch(newChunk)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), chunkEpoch)
+
+	// The revoked device cannot read anything written under the new key
+	assert.Equal(t, ErrUnknownKeyEpoch, revoked.DecryptChunk(cloneChunk(newChunk)))
+	require.NoError(t, revoked.DecryptChunk(cloneChunk(oldChunk)))
+
+	// Reloading from disk keeps every epoch readable
+	loaded, err := LoadKeyRing(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), loaded.CurrentEpoch())
+	assert.Equal(t, []string{"old-laptop"}, loaded.RevokedDevices())
+
+	reloaded := NewEncryptorWithKeyRing(loaded)
+	for _, chunk := range []*types.Chunk{oldChunk, newChunk} {
+		plain := cloneChunk(chunk)
+		require.NoError(t, reloaded.DecryptChunk(plain))
+		assert.Equal(t, chunk.Hash, sha256.Sum256(plain.Data))
+	}
+}
+
+func TestKeyRingTamperedFile(t *testing.T) {
+	dir := t.TempDir()
+
+	keyRing, err := LoadOrCreateKeyRing(dir, nil)
+	require.NoError(t, err)
+	_, err = keyRing.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, keyRing.Save(dir))
+
+	// Replacing the current key makes the wrapped epochs unreadable
+	otherKey := make([]byte, 32)
+	_, err = rand.Read(otherKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, keyFileName), otherKey, 0600))
+
+	_, err = LoadKeyRing(dir, nil)
+	assert.Error(t, err)
+}
+
+func TestKeyRingInterruptedSave(t *testing.T) {
+	dir := t.TempDir()
+
+	keyRing, err := LoadOrCreateKeyRing(dir, nil)
+	require.NoError(t, err)
+	_, err = keyRing.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, keyRing.Save(dir))
+
+	read := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		return data
+	}
+	oldKey, oldRing := read(keyFileName), read(keyRingFileName)
+
+	_, err = keyRing.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, keyRing.Save(dir))
+	newKey, newRing := read(keyFileName), read(keyRingFileName)
+	assert.NoFileExists(t, filepath.Join(dir, nextKeyRingFileName))
+
+	// A save is cut short after the next key ring or the key file is
+	// written; either way the key file decides which epoch is current
+	for _, tc := range []struct {
+		name  string
+		key   []byte
+		epoch uint32
+	}{
+		{"before the key file", oldKey, 1},
+		{"after the key file", newKey, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, keyFileName), tc.key, 0600))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, keyRingFileName), oldRing, 0600))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, nextKeyRingFileName), newRing, 0600))
+
+			loaded, err := LoadKeyRing(dir, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tc.epoch, loaded.CurrentEpoch())
+			assert.NoFileExists(t, filepath.Join(dir, nextKeyRingFileName))
+
+			// And the result loads again
+			loaded, err = LoadKeyRing(dir, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tc.epoch, loaded.CurrentEpoch())
+		})
+	}
+}
+
+func TestKeyRingAddEpoch(t *testing.T) {
+	keyRing, err := LoadOrCreateKeyRing(t.TempDir(), nil)
+	require.NoError(t, err)
+	initial, err := keyRing.TransportSecret()
+	require.NoError(t, err)
+
+	// Another device rotated and hands over its key
+	rotated, err := NewKeyRing(keyRing.MasterKey())
+	require.NoError(t, err)
+	epoch, err := rotated.Rotate("old-laptop")
+	require.NoError(t, err)
+
+	added, err := keyRing.AddEpoch(epoch, rotated.MasterKey(), rotated.RevokedDevices())
+	require.NoError(t, err)
+	assert.True(t, added)
+	assert.Equal(t, epoch, keyRing.CurrentEpoch())
+	assert.Equal(t, rotated.MasterKey(), keyRing.MasterKey())
+	assert.True(t, keyRing.IsRevoked("old-laptop"))
+	assert.False(t, keyRing.IsRevoked("phone"))
+
+	// Devices that missed the rotation still prove the earlier secret
+	earlier, err := keyRing.EarlierTransportSecrets()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{initial}, earlier)
+
+	// Handing it over again changes nothing
+	added, err = keyRing.AddEpoch(epoch, rotated.MasterKey(), nil)
+	require.NoError(t, err)
+	assert.False(t, added)
+}
+
+func cloneChunk(chunk *types.Chunk) *types.Chunk {
+	clone := *chunk
+	clone.Data = append([]byte(nil), chunk.Data...)
+	return &clone
+}
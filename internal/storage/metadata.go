@@ -3,22 +3,53 @@ package storage
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/Fybrk/fybrk/pkg/types"
 	_ "modernc.org/sqlite"
 )
 
+var (
+	ErrDeviceNotFound   = errors.New("device not found")
+	ErrConflictNotFound = errors.New("conflict not found")
+	ErrNoMergeBase      = errors.New("no merge base recorded")
+	ErrVersionNotFound  = errors.New("file version not found")
+	ErrNoTombstone      = errors.New("no tombstone recorded")
+)
+
+// VersionRetention decides which past versions of each file are kept: the
+// KeepLast most recent ones, and the newest one of each day for KeepDaily
+// days. Versions of deleted files are only kept by day.
+type VersionRetention struct {
+	KeepLast  int `json:"keep_last"`
+	KeepDaily int `json:"keep_daily"`
+}
+
+// DefaultVersionRetention keeps the last 10 versions of a file and one a
+// day for 30 days
+var DefaultVersionRetention = VersionRetention{KeepLast: 10, KeepDaily: 30}
+
 type MetadataStore struct {
 	db *sql.DB
+
+	mu        sync.Mutex
+	retention VersionRetention
 }
 
 func NewMetadataStore(dbPath string) (*MetadataStore, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// Wait for concurrent writers instead of failing with SQLITE_BUSY.
+	// Transactions take the write lock up front, as two that both read
+	// before writing would otherwise fail at once rather than wait.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
 
-	store := &MetadataStore{db: db}
+	store := &MetadataStore{db: db, retention: DefaultVersionRetention}
 	if err := store.initTables(); err != nil {
 		return nil, err
 	}
@@ -35,66 +66,260 @@ func (m *MetadataStore) initTables() error {
 		mod_time DATETIME NOT NULL,
 		chunks TEXT NOT NULL,
 		version INTEGER NOT NULL,
+		version_vector TEXT NOT NULL DEFAULT '{}',
+		modified_by TEXT NOT NULL DEFAULT '',
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL,
+		hash BLOB NOT NULL,
+		size INTEGER NOT NULL,
+		mod_time DATETIME NOT NULL,
+		chunks TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		version_vector TEXT NOT NULL DEFAULT '{}',
+		modified_by TEXT NOT NULL DEFAULT '',
+		replaced_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS merge_bases (
+		path TEXT PRIMARY KEY,
+		hash BLOB NOT NULL,
+		size INTEGER NOT NULL,
+		chunks TEXT NOT NULL,
+		version_vector TEXT NOT NULL DEFAULT '{}'
+	);
+
+	CREATE TABLE IF NOT EXISTS tombstones (
+		path TEXT PRIMARY KEY,
+		version_vector TEXT NOT NULL DEFAULT '{}',
+		deleted_by TEXT NOT NULL,
+		deleted_at DATETIME NOT NULL,
+		moved_to TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS tombstone_acks (
+		path TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		PRIMARY KEY (path, device_id)
+	);
+
 	CREATE TABLE IF NOT EXISTS devices (
 		id TEXT PRIMARY KEY,
 		name TEXT NOT NULL,
 		profile INTEGER NOT NULL,
-		last_seen DATETIME NOT NULL
+		last_seen DATETIME NOT NULL,
+		public_key TEXT NOT NULL DEFAULT '',
+		trust_level INTEGER NOT NULL DEFAULT 0,
+		device_type TEXT NOT NULL DEFAULT '',
+		capabilities TEXT NOT NULL DEFAULT '[]',
+		revoked INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS chunks (
+		hash BLOB PRIMARY KEY,
+		size INTEGER NOT NULL DEFAULT 0,
+		encrypted INTEGER NOT NULL DEFAULT 0,
+		key_epoch INTEGER NOT NULL DEFAULT 0,
+		chunk_format INTEGER NOT NULL DEFAULT 0,
+		ref_count INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS conflicts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL,
+		copy_path TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		resolution TEXT NOT NULL,
+		local_file TEXT NOT NULL,
+		remote_file TEXT NOT NULL,
+		detected_at DATETIME NOT NULL,
+		resolved_at DATETIME
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_files_hash ON files(hash);
+	CREATE INDEX IF NOT EXISTS idx_file_versions_path ON file_versions(path);
+	CREATE INDEX IF NOT EXISTS idx_chunks_ref_count ON chunks(ref_count);
 	CREATE INDEX IF NOT EXISTS idx_devices_last_seen ON devices(last_seen);
 	`
 
-	_, err := m.db.Exec(schema)
+	if _, err := m.db.Exec(schema); err != nil {
+		return err
+	}
+
+	// Columns added after the table was first released
+	columns := []struct{ table, column, definition string }{
+		{"files", "version_vector", "TEXT NOT NULL DEFAULT '{}'"},
+		{"files", "modified_by", "TEXT NOT NULL DEFAULT ''"},
+		{"tombstones", "moved_to", "TEXT NOT NULL DEFAULT ''"},
+		{"chunks", "key_epoch", "INTEGER NOT NULL DEFAULT 0"},
+		{"chunks", "chunk_format", "INTEGER NOT NULL DEFAULT 0"},
+		{"devices", "public_key", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "trust_level", "INTEGER NOT NULL DEFAULT 0"},
+		{"devices", "device_type", "TEXT NOT NULL DEFAULT ''"},
+		{"devices", "capabilities", "TEXT NOT NULL DEFAULT '[]'"},
+		{"devices", "revoked", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := m.addColumnIfMissing(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing upgrades databases created before a column existed
+func (m *MetadataStore) addColumnIfMissing(table, column, definition string) error {
+	rows, err := m.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = m.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
 func (m *MetadataStore) StoreFileMetadata(metadata *types.FileMetadata) error {
-	chunksJSON, err := json.Marshal(metadata.Chunks)
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Keep the version being replaced in the file's history, or release
+	// its chunks if only its metadata changed
+	now := time.Now()
+	old, err := fileRow(tx, metadata.Path)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.Hash != metadata.Hash {
+		if err := archiveVersion(tx, old, now); err != nil {
+			return err
+		}
+	} else if old != nil {
+		if err := adjustChunkRefs(tx, old.Chunks, -1); err != nil {
+			return err
+		}
+	}
+
+	if err := insertFile(tx, metadata); err != nil {
+		return err
+	}
+	if old != nil && old.Hash != metadata.Hash {
+		if err := m.pruneVersions(tx, metadata.Path, now); err != nil {
+			return err
+		}
+	}
+
+	// The file exists again
+	if err := deleteTombstone(tx, metadata.Path); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertFile writes the row of a file, taking a reference to its chunks
+func insertFile(tx *sql.Tx, metadata *types.FileMetadata) error {
+	chunksJSON, vectorJSON, err := encodeFile(metadata)
 	if err != nil {
 		return err
 	}
 
 	query := `
-	INSERT OR REPLACE INTO files (path, hash, size, mod_time, chunks, version)
-	VALUES (?, ?, ?, ?, ?, ?)
+	INSERT OR REPLACE INTO files (path, hash, size, mod_time, chunks, version, version_vector, modified_by)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err = m.db.Exec(query,
+	_, err = tx.Exec(query,
 		metadata.Path,
 		metadata.Hash[:],
 		metadata.Size,
 		metadata.ModTime,
-		string(chunksJSON),
+		chunksJSON,
 		metadata.Version,
+		vectorJSON,
+		metadata.ModifiedBy,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return adjustChunkRefs(tx, metadata.Chunks, 1)
 }
 
-func (m *MetadataStore) GetFileMetadata(path string) (*types.FileMetadata, error) {
-	query := `SELECT path, hash, size, mod_time, chunks, version FROM files WHERE path = ?`
+// encodeFile encodes the chunk list and version vector of a file for storage
+func encodeFile(metadata *types.FileMetadata) (chunksJSON, vectorJSON string, err error) {
+	chunks, err := json.Marshal(metadata.Chunks)
+	if err != nil {
+		return "", "", err
+	}
+	vector := []byte("{}")
+	if metadata.VersionVector != nil {
+		if vector, err = json.Marshal(metadata.VersionVector); err != nil {
+			return "", "", err
+		}
+	}
+	return string(chunks), string(vector), nil
+}
+
+// decodeVersionVector reads a stored version vector. Rows written before
+// vectors existed hold an empty one, which is returned as nil.
+func decodeVersionVector(data string) (types.VersionVector, error) {
+	var vector types.VersionVector
+	if err := json.Unmarshal([]byte(data), &vector); err != nil {
+		return nil, err
+	}
+	if len(vector) == 0 {
+		return nil, nil
+	}
+	return vector, nil
+}
 
-	row := m.db.QueryRow(query, path)
+const fileColumns = `path, hash, size, mod_time, chunks, version, version_vector, modified_by`
 
+// scanFile reads a row selected with fileColumns, after any columns given
+// in extra
+func scanFile(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*types.FileMetadata, error) {
 	var metadata types.FileMetadata
 	var hashBytes []byte
-	var chunksJSON string
+	var chunksJSON, vectorJSON string
 
-	err := row.Scan(
+	dest := append(extra,
 		&metadata.Path,
 		&hashBytes,
 		&metadata.Size,
 		&metadata.ModTime,
 		&chunksJSON,
 		&metadata.Version,
+		&vectorJSON,
+		&metadata.ModifiedBy,
 	)
-
-	if err != nil {
+	if err := row.Scan(dest...); err != nil {
 		return nil, err
 	}
 
@@ -103,12 +328,21 @@ func (m *MetadataStore) GetFileMetadata(path string) (*types.FileMetadata, error
 	if err := json.Unmarshal([]byte(chunksJSON), &metadata.Chunks); err != nil {
 		return nil, err
 	}
+	var err error
+	if metadata.VersionVector, err = decodeVersionVector(vectorJSON); err != nil {
+		return nil, err
+	}
 
 	return &metadata, nil
 }
 
+func (m *MetadataStore) GetFileMetadata(path string) (*types.FileMetadata, error) {
+	query := `SELECT ` + fileColumns + ` FROM files WHERE path = ?`
+	return scanFile(m.db.QueryRow(query, path))
+}
+
 func (m *MetadataStore) ListFiles() ([]*types.FileMetadata, error) {
-	query := `SELECT path, hash, size, mod_time, chunks, version FROM files ORDER BY path`
+	query := `SELECT ` + fileColumns + ` FROM files ORDER BY path`
 
 	rows, err := m.db.Query(query)
 	if err != nil {
@@ -117,74 +351,936 @@ func (m *MetadataStore) ListFiles() ([]*types.FileMetadata, error) {
 	defer rows.Close()
 
 	var files []*types.FileMetadata
-
 	for rows.Next() {
-		var metadata types.FileMetadata
-		var hashBytes []byte
-		var chunksJSON string
-
-		err := rows.Scan(
-			&metadata.Path,
-			&hashBytes,
-			&metadata.Size,
-			&metadata.ModTime,
-			&chunksJSON,
-			&metadata.Version,
-		)
-
+		metadata, err := scanFile(rows)
 		if err != nil {
 			return nil, err
 		}
+		files = append(files, metadata)
+	}
+
+	return files, rows.Err()
+}
 
-		copy(metadata.Hash[:], hashBytes)
+// ListFilesUnder returns the files inside directory dir, at any depth
+func (m *MetadataStore) ListFilesUnder(dir string) ([]*types.FileMetadata, error) {
+	// Paths under dir sort between its prefix and the prefix with the
+	// separator's successor, so the primary key index serves the range
+	prefix := dir + string(filepath.Separator)
+	end := dir + string(filepath.Separator+1)
+	query := `SELECT ` + fileColumns + ` FROM files WHERE path >= ? AND path < ? ORDER BY path`
+
+	rows, err := m.db.Query(query, prefix, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		if err := json.Unmarshal([]byte(chunksJSON), &metadata.Chunks); err != nil {
+	var files []*types.FileMetadata
+	for rows.Next() {
+		metadata, err := scanFile(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		files = append(files, &metadata)
+		files = append(files, metadata)
 	}
 
 	return files, rows.Err()
 }
 
+// DeleteFileMetadata forgets a deleted file. Its last version is kept in
+// its history.
 func (m *MetadataStore) DeleteFileMetadata(path string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.deleteFile(tx, path); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteFile drops the file at path, keeping its last version in its
+// history
+func (m *MetadataStore) deleteFile(tx *sql.Tx, path string) error {
+	now := time.Now()
+	old, err := fileRow(tx, path)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if err := archiveVersion(tx, old, now); err != nil {
+			return err
+		}
+	}
+
 	query := `DELETE FROM files WHERE path = ?`
-	_, err := m.db.Exec(query, path)
+	if _, err := tx.Exec(query, path); err != nil {
+		return err
+	}
+	if err := deleteMergeBase(tx, path); err != nil {
+		return err
+	}
+	return m.pruneVersions(tx, path, now)
+}
+
+// StoreTombstone records the deletion of a file, forgetting the file as
+// DeleteFileMetadata does. A tombstone replacing an earlier one for the
+// same path has to be acknowledged again.
+func (m *MetadataStore) StoreTombstone(tombstone *types.Tombstone) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.deleteFile(tx, tombstone.Path); err != nil {
+		return err
+	}
+	if err := insertTombstone(tx, tombstone); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MoveFile records that the file at tombstone.Path was moved to to.Path,
+// leaving the tombstone in its place. Its history and merge base move with
+// it; a file it replaced at the new path is kept in the history.
+func (m *MetadataStore) MoveFile(tombstone *types.Tombstone, to *types.FileMetadata) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	from, err := fileRow(tx, tombstone.Path)
+	if err != nil {
+		return err
+	}
+	if from == nil {
+		return fmt.Errorf("%s is not synced", tombstone.Path)
+	}
+	if err := m.deleteFile(tx, to.Path); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM files WHERE path = ?`, from.Path); err != nil {
+		return err
+	}
+	if err := adjustChunkRefs(tx, from.Chunks, -1); err != nil {
+		return err
+	}
+	if err := insertFile(tx, to); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE file_versions SET path = ? WHERE path = ?`, to.Path, from.Path); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE merge_bases SET path = ? WHERE path = ?`, to.Path, from.Path); err != nil {
+		return err
+	}
+	if err := deleteTombstone(tx, to.Path); err != nil {
+		return err
+	}
+	if err := insertTombstone(tx, tombstone); err != nil {
+		return err
+	}
+	if err := m.pruneVersions(tx, to.Path, time.Now()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertTombstone writes a tombstone, replacing any earlier one for the
+// same path along with its acknowledgements
+func insertTombstone(tx *sql.Tx, tombstone *types.Tombstone) error {
+	vector := []byte("{}")
+	if tombstone.VersionVector != nil {
+		var err error
+		if vector, err = json.Marshal(tombstone.VersionVector); err != nil {
+			return err
+		}
+	}
+
+	if err := deleteTombstone(tx, tombstone.Path); err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO tombstones (path, version_vector, deleted_by, deleted_at, moved_to)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := tx.Exec(query, tombstone.Path, string(vector), tombstone.DeletedBy, tombstone.DeletedAt, tombstone.MovedTo)
 	return err
 }
 
-func (m *MetadataStore) StoreDevice(device *types.Device) error {
+// GetTombstone returns the tombstone of a deleted file, or ErrNoTombstone
+func (m *MetadataStore) GetTombstone(path string) (*types.Tombstone, error) {
+	query := `SELECT path, version_vector, deleted_by, deleted_at, moved_to FROM tombstones WHERE path = ?`
+	tombstone, err := scanTombstone(m.db.QueryRow(query, path))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoTombstone
+	}
+	return tombstone, err
+}
+
+// ListTombstones returns the tombstones of all deleted files still kept
+func (m *MetadataStore) ListTombstones() ([]*types.Tombstone, error) {
+	query := `SELECT path, version_vector, deleted_by, deleted_at, moved_to FROM tombstones ORDER BY path`
+
+	rows, err := m.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tombstones []*types.Tombstone
+	for rows.Next() {
+		tombstone, err := scanTombstone(rows)
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+
+	return tombstones, rows.Err()
+}
+
+func scanTombstone(row interface{ Scan(...interface{}) error }) (*types.Tombstone, error) {
+	var tombstone types.Tombstone
+	var vectorJSON string
+	if err := row.Scan(&tombstone.Path, &vectorJSON, &tombstone.DeletedBy, &tombstone.DeletedAt, &tombstone.MovedTo); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if tombstone.VersionVector, err = decodeVersionVector(vectorJSON); err != nil {
+		return nil, err
+	}
+	return &tombstone, nil
+}
+
+// AcknowledgeTombstone records that a device no longer has the deleted file
+// at path
+func (m *MetadataStore) AcknowledgeTombstone(path, deviceID string) error {
 	query := `
-	INSERT OR REPLACE INTO devices (id, name, profile, last_seen)
-	VALUES (?, ?, ?, ?)
+	INSERT OR IGNORE INTO tombstone_acks (path, device_id)
+	SELECT path, ? FROM tombstones WHERE path = ?
 	`
+	_, err := m.db.Exec(query, deviceID, path)
+	return err
+}
 
-	_, err := m.db.Exec(query,
-		device.ID,
-		device.Name,
-		int(device.Profile),
-		device.LastSeen,
-	)
+// CollectTombstones drops the tombstones every one of deviceIDs has
+// acknowledged, as no device is left that could bring the file back. With
+// no devices given nothing is dropped. It returns how many were dropped.
+func (m *MetadataStore) CollectTombstones(deviceIDs []string) (int, error) {
+	if len(deviceIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT path FROM tombstones`)
+	if err != nil {
+		return 0, err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	collected := 0
+	for _, path := range paths {
+		acked := true
+		for _, deviceID := range deviceIDs {
+			var exists int
+			err := tx.QueryRow(`SELECT 1 FROM tombstone_acks WHERE path = ? AND device_id = ?`, path, deviceID).Scan(&exists)
+			if err == sql.ErrNoRows {
+				acked = false
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		if !acked {
+			continue
+		}
+		if err := deleteTombstone(tx, path); err != nil {
+			return 0, err
+		}
+		collected++
+	}
+
+	return collected, tx.Commit()
+}
 
+// deleteTombstone drops the tombstone of path and its acknowledgements
+func deleteTombstone(tx *sql.Tx, path string) error {
+	if _, err := tx.Exec(`DELETE FROM tombstone_acks WHERE path = ?`, path); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM tombstones WHERE path = ?`, path)
 	return err
 }
 
-func (m *MetadataStore) GetDevice(id string) (*types.Device, error) {
-	query := `SELECT id, name, profile, last_seen FROM devices WHERE id = ?`
+// StoreMergeBase records a version of a file known to be held by other
+// devices too, as the common ancestor to merge later concurrent edits
+// against. Its chunks are kept for as long as it is the merge base.
+func (m *MetadataStore) StoreMergeBase(metadata *types.FileMetadata) error {
+	chunksJSON, vectorJSON, err := encodeFile(metadata)
+	if err != nil {
+		return err
+	}
 
-	row := m.db.QueryRow(query, id)
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	var device types.Device
-	var profile int
+	if err := deleteMergeBase(tx, metadata.Path); err != nil {
+		return err
+	}
 
-	err := row.Scan(&device.ID, &device.Name, &profile, &device.LastSeen)
+	query := `
+	INSERT INTO merge_bases (path, hash, size, chunks, version_vector)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	_, err = tx.Exec(query, metadata.Path, metadata.Hash[:], metadata.Size, chunksJSON, vectorJSON)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	device.Profile = types.DeviceProfile(profile)
-	return &device, nil
+	if err := adjustChunkRefs(tx, metadata.Chunks, 1); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetMergeBase returns the merge base recorded for a file, or ErrNoMergeBase
+func (m *MetadataStore) GetMergeBase(path string) (*types.FileMetadata, error) {
+	query := `SELECT path, hash, size, chunks, version_vector FROM merge_bases WHERE path = ?`
+
+	var metadata types.FileMetadata
+	var hashBytes []byte
+	var chunksJSON, vectorJSON string
+	err := m.db.QueryRow(query, path).Scan(&metadata.Path, &hashBytes, &metadata.Size, &chunksJSON, &vectorJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoMergeBase
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	copy(metadata.Hash[:], hashBytes)
+	if err := json.Unmarshal([]byte(chunksJSON), &metadata.Chunks); err != nil {
+		return nil, err
+	}
+	if metadata.VersionVector, err = decodeVersionVector(vectorJSON); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// DeleteMergeBase drops the merge base recorded for a file, if any
+func (m *MetadataStore) DeleteMergeBase(path string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteMergeBase(tx, path); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteMergeBase drops the merge base of the file at path, releasing its
+// chunks
+func deleteMergeBase(tx *sql.Tx, path string) error {
+	var chunksJSON string
+	err := tx.QueryRow(`SELECT chunks FROM merge_bases WHERE path = ?`, path).Scan(&chunksJSON)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var chunks [][32]byte
+	if err := json.Unmarshal([]byte(chunksJSON), &chunks); err != nil {
+		return err
+	}
+	if err := adjustChunkRefs(tx, chunks, -1); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM merge_bases WHERE path = ?`, path)
+	return err
+}
+
+// SetVersionRetention sets which past versions of files are kept. It
+// applies to each file the next time it changes, or to all of them on
+// PruneVersions.
+func (m *MetadataStore) SetVersionRetention(retention VersionRetention) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retention = retention
+}
+
+func (m *MetadataStore) versionRetention() VersionRetention {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.retention
+}
+
+// ListFileVersions returns the past versions kept of the file at path,
+// newest first
+func (m *MetadataStore) ListFileVersions(path string) ([]*types.FileVersion, error) {
+	query := `SELECT id, replaced_at, ` + fileColumns + ` FROM file_versions WHERE path = ? ORDER BY replaced_at DESC, id DESC`
+
+	rows, err := m.db.Query(query, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []*types.FileVersion
+	for rows.Next() {
+		version, err := scanFileVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// GetFileVersion returns a past version of a file by ID
+func (m *MetadataStore) GetFileVersion(id int64) (*types.FileVersion, error) {
+	query := `SELECT id, replaced_at, ` + fileColumns + ` FROM file_versions WHERE id = ?`
+
+	version, err := scanFileVersion(m.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrVersionNotFound
+	}
+	return version, err
+}
+
+// PruneVersions drops the past versions of every file that the retention
+// policy no longer keeps and returns how many were dropped. Their chunks
+// are collected with the chunk store's garbage.
+func (m *MetadataStore) PruneVersions() (int, error) {
+	rows, err := m.db.Query(`SELECT DISTINCT path FROM file_versions`)
+	if err != nil {
+		return 0, err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	now := time.Now()
+	for _, path := range paths {
+		tx, err := m.db.Begin()
+		if err != nil {
+			return pruned, err
+		}
+		n, err := m.pruneFileVersions(tx, path, now)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return pruned, err
+		}
+		pruned += n
+	}
+	return pruned, nil
+}
+
+// archiveVersion keeps a replaced or deleted version of a file in its
+// history. The version keeps holding its chunks.
+func archiveVersion(tx *sql.Tx, metadata *types.FileMetadata, replacedAt time.Time) error {
+	chunksJSON, vectorJSON, err := encodeFile(metadata)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO file_versions (path, hash, size, mod_time, chunks, version, version_vector, modified_by, replaced_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = tx.Exec(query,
+		metadata.Path,
+		metadata.Hash[:],
+		metadata.Size,
+		metadata.ModTime,
+		chunksJSON,
+		metadata.Version,
+		vectorJSON,
+		metadata.ModifiedBy,
+		replacedAt,
+	)
+	return err
+}
+
+// pruneVersions applies the retention policy to the history of the file
+// at path
+func (m *MetadataStore) pruneVersions(tx *sql.Tx, path string, now time.Time) error {
+	_, err := m.pruneFileVersions(tx, path, now)
+	return err
+}
+
+func (m *MetadataStore) pruneFileVersions(tx *sql.Tx, path string, now time.Time) (int, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM files WHERE path = ?)`, path).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `SELECT id, replaced_at, ` + fileColumns + ` FROM file_versions WHERE path = ? ORDER BY replaced_at DESC, id DESC`
+	rows, err := tx.Query(query, path)
+	if err != nil {
+		return 0, err
+	}
+	var versions []*types.FileVersion
+	for rows.Next() {
+		version, err := scanFileVersion(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		versions = append(versions, version)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	retention := m.versionRetention()
+	cutoff := now.AddDate(0, 0, -retention.KeepDaily)
+	days := make(map[string]bool)
+	pruned := 0
+	for i, version := range versions {
+		keep := exists && i < retention.KeepLast
+
+		// Versions are newest first, so the first one seen each day is
+		// the last one replaced that day
+		day := version.ReplacedAt.Local().Format("2006-01-02")
+		if !days[day] {
+			days[day] = true
+			keep = keep || version.ReplacedAt.After(cutoff)
+		}
+		if keep {
+			continue
+		}
+
+		if _, err := tx.Exec(`DELETE FROM file_versions WHERE id = ?`, version.ID); err != nil {
+			return pruned, err
+		}
+		if err := adjustChunkRefs(tx, version.Chunks, -1); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// scanFileVersion reads a row selected with id, replaced_at and fileColumns
+func scanFileVersion(row interface{ Scan(...interface{}) error }) (*types.FileVersion, error) {
+	var version types.FileVersion
+	metadata, err := scanFile(row, &version.ID, &version.ReplacedAt)
+	if err != nil {
+		return nil, err
+	}
+	version.FileMetadata = *metadata
+	return &version, nil
+}
+
+// fileRow returns the file row at path, or nil
+func fileRow(tx *sql.Tx, path string) (*types.FileMetadata, error) {
+	metadata, err := scanFile(tx.QueryRow(`SELECT `+fileColumns+` FROM files WHERE path = ?`, path))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return metadata, err
+}
+
+// adjustChunkRefs adds delta to the reference count of each distinct chunk
+func adjustChunkRefs(tx *sql.Tx, chunks [][32]byte, delta int) error {
+	seen := make(map[[32]byte]bool, len(chunks))
+	for _, hash := range chunks {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		query := `
+		INSERT INTO chunks (hash, ref_count) VALUES (?, ?)
+		ON CONFLICT(hash) DO UPDATE SET ref_count = MAX(ref_count + excluded.ref_count, 0)
+		`
+		if _, err := tx.Exec(query, hash[:], delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StoreChunkInfo records the size, encryption state, key epoch and format
+// of a stored chunk without touching its reference count
+func (m *MetadataStore) StoreChunkInfo(hash [32]byte, size int64, encrypted bool, keyEpoch uint32, format byte) error {
+	query := `
+	INSERT INTO chunks (hash, size, encrypted, key_epoch, chunk_format) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(hash) DO UPDATE SET size = excluded.size, encrypted = excluded.encrypted,
+		key_epoch = excluded.key_epoch, chunk_format = excluded.chunk_format
+	`
+	_, err := m.db.Exec(query, hash[:], size, encrypted, keyEpoch, format)
+	return err
+}
+
+// GetChunkInfo returns the recorded size, encryption state and reference
+// count of a chunk
+func (m *MetadataStore) GetChunkInfo(hash [32]byte) (size int64, encrypted bool, refCount int, err error) {
+	query := `SELECT size, encrypted, ref_count FROM chunks WHERE hash = ?`
+	err = m.db.QueryRow(query, hash[:]).Scan(&size, &encrypted, &refCount)
+	return size, encrypted, refCount, err
+}
+
+// ListUnreferencedChunks returns chunks no file row refers to any more
+func (m *MetadataStore) ListUnreferencedChunks() ([][32]byte, error) {
+	rows, err := m.db.Query(`SELECT hash FROM chunks WHERE ref_count <= 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes [][32]byte
+	for rows.Next() {
+		var hashBytes []byte
+		if err := rows.Scan(&hashBytes); err != nil {
+			return nil, err
+		}
+
+		var hash [32]byte
+		copy(hash[:], hashBytes)
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// ListStaleChunks returns encrypted chunks sealed under a key epoch older
+// than epoch, or stored in a format older than format. Chunks stored before
+// formats were recorded count as the oldest.
+func (m *MetadataStore) ListStaleChunks(epoch uint32, format byte) ([][32]byte, error) {
+	query := `SELECT hash FROM chunks WHERE encrypted = 1 AND (key_epoch < ? OR chunk_format < ?)`
+	rows, err := m.db.Query(query, epoch, format)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes [][32]byte
+	for rows.Next() {
+		var hashBytes []byte
+		if err := rows.Scan(&hashBytes); err != nil {
+			return nil, err
+		}
+
+		var hash [32]byte
+		copy(hash[:], hashBytes)
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// DeleteChunkInfo removes a chunk row if it is still unreferenced
+func (m *MetadataStore) DeleteChunkInfo(hash [32]byte) (bool, error) {
+	result, err := m.db.Exec(`DELETE FROM chunks WHERE hash = ? AND ref_count <= 0`, hash[:])
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (m *MetadataStore) StoreDevice(device *types.Device) error {
+	// Storing a device again, e.g. when it pairs again, updates what it
+	// told us about itself but keeps the trust it was given here
+	query := `
+	INSERT INTO devices (id, name, profile, last_seen, public_key, trust_level, device_type, capabilities, revoked)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		name = excluded.name,
+		profile = excluded.profile,
+		last_seen = excluded.last_seen,
+		public_key = excluded.public_key,
+		device_type = excluded.device_type,
+		capabilities = excluded.capabilities
+	`
+
+	capabilities, err := json.Marshal(device.Capabilities)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db.Exec(query,
+		device.ID,
+		device.Name,
+		int(device.Profile),
+		device.LastSeen,
+		device.PublicKey,
+		device.TrustLevel,
+		device.DeviceType,
+		string(capabilities),
+		device.Revoked,
+	)
+
+	return err
+}
+
+const deviceColumns = `id, name, profile, last_seen, public_key, trust_level, device_type, capabilities, revoked`
+
+func (m *MetadataStore) GetDevice(id string) (*types.Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE id = ?`
+
+	device, err := scanDevice(m.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceNotFound
+	}
+	return device, err
+}
+
+// ListDevices returns every device in the registry, ordered by name
+func (m *MetadataStore) ListDevices() ([]*types.Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices ORDER BY name, id`
+
+	rows, err := m.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*types.Device
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// HasDevices reports whether any device, revoked or not, is in the registry
+func (m *MetadataStore) HasDevices() (bool, error) {
+	var exists bool
+	err := m.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM devices)`).Scan(&exists)
+	return exists, err
+}
+
+// RenameDevice changes the name a device is shown under
+func (m *MetadataStore) RenameDevice(id, name string) error {
+	return m.updateDevice(`UPDATE devices SET name = ? WHERE id = ?`, name, id)
+}
+
+// RevokeDevice marks a device as revoked so its connections are refused.
+// The record is kept so the device stays known as revoked.
+func (m *MetadataStore) RevokeDevice(id string) error {
+	return m.updateDevice(`UPDATE devices SET revoked = 1 WHERE id = ?`, id)
+}
+
+// SetDeviceTrust sets a device's trust level and lifts any revocation
+func (m *MetadataStore) SetDeviceTrust(id string, trustLevel int) error {
+	return m.updateDevice(`UPDATE devices SET trust_level = ?, revoked = 0 WHERE id = ?`, trustLevel, id)
+}
+
+// updateDevice runs an update on a single device, failing if it is unknown
+func (m *MetadataStore) updateDevice(query string, args ...interface{}) error {
+	result, err := m.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// scanDevice reads a row selected with deviceColumns
+func scanDevice(row interface{ Scan(...interface{}) error }) (*types.Device, error) {
+	var device types.Device
+	var profile int
+	var capabilities string
+
+	err := row.Scan(&device.ID, &device.Name, &profile, &device.LastSeen,
+		&device.PublicKey, &device.TrustLevel, &device.DeviceType, &capabilities, &device.Revoked)
+	if err != nil {
+		return nil, err
+	}
+
+	device.Profile = types.DeviceProfile(profile)
+	if err := json.Unmarshal([]byte(capabilities), &device.Capabilities); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// AddConflict records a conflict, resolved or not, and sets its ID
+func (m *MetadataStore) AddConflict(conflict *types.Conflict) error {
+	localFile, err := json.Marshal(conflict.LocalFile)
+	if err != nil {
+		return err
+	}
+	remoteFile, err := json.Marshal(conflict.RemoteFile)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO conflicts (path, copy_path, device_id, resolution, local_file, remote_file, detected_at, resolved_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	var resolvedAt sql.NullTime
+	if conflict.Resolved() {
+		resolvedAt = sql.NullTime{Time: conflict.ResolvedAt, Valid: true}
+	}
+	result, err := m.db.Exec(query,
+		conflict.Path,
+		conflict.CopyPath,
+		conflict.DeviceID,
+		conflict.Resolution,
+		string(localFile),
+		string(remoteFile),
+		conflict.DetectedAt,
+		resolvedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	conflict.ID, err = result.LastInsertId()
+	return err
+}
+
+const conflictColumns = `id, path, copy_path, device_id, resolution, local_file, remote_file, detected_at, resolved_at`
+
+// GetConflict returns the conflict with the given ID
+func (m *MetadataStore) GetConflict(id int64) (*types.Conflict, error) {
+	query := `SELECT ` + conflictColumns + ` FROM conflicts WHERE id = ?`
+
+	conflict, err := scanConflict(m.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrConflictNotFound
+	}
+	return conflict, err
+}
+
+// ListConflicts returns conflicts in the order they were detected, leaving
+// out resolved ones unless includeResolved is set
+func (m *MetadataStore) ListConflicts(includeResolved bool) ([]*types.Conflict, error) {
+	query := `SELECT ` + conflictColumns + ` FROM conflicts`
+	if !includeResolved {
+		query += ` WHERE resolved_at IS NULL`
+	}
+	query += ` ORDER BY id`
+
+	rows, err := m.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []*types.Conflict
+	for rows.Next() {
+		conflict, err := scanConflict(rows)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+
+	return conflicts, rows.Err()
+}
+
+// ResolveConflict marks a conflict resolved with the given resolution
+func (m *MetadataStore) ResolveConflict(id int64, resolution string, resolvedAt time.Time) error {
+	result, err := m.db.Exec(`UPDATE conflicts SET resolution = ?, resolved_at = ? WHERE id = ?`, resolution, resolvedAt, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrConflictNotFound
+	}
+	return nil
+}
+
+// scanConflict reads a row selected with conflictColumns
+func scanConflict(row interface{ Scan(...interface{}) error }) (*types.Conflict, error) {
+	var conflict types.Conflict
+	var localFile, remoteFile string
+	var resolvedAt sql.NullTime
+
+	err := row.Scan(&conflict.ID, &conflict.Path, &conflict.CopyPath, &conflict.DeviceID, &conflict.Resolution,
+		&localFile, &remoteFile, &conflict.DetectedAt, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(localFile), &conflict.LocalFile); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(remoteFile), &conflict.RemoteFile); err != nil {
+		return nil, err
+	}
+	if resolvedAt.Valid {
+		conflict.ResolvedAt = resolvedAt.Time
+	}
+	return &conflict, nil
 }
 
 func (m *MetadataStore) Close() error {
@@ -184,6 +184,82 @@ func TestStoreAndGetDevice(t *testing.T) {
 	assert.Equal(t, device.LastSeen, retrieved.LastSeen)
 }
 
+func TestStorePairedDevice(t *testing.T) {
+	store, err := NewMetadataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	device := &types.Device{
+		ID:           "device-123",
+		Name:         "Laptop",
+		LastSeen:     time.Now().UTC().Truncate(time.Second),
+		PublicKey:    "public-key",
+		TrustLevel:   2,
+		DeviceType:   "desktop",
+		Capabilities: []string{"sync", "storage"},
+	}
+	require.NoError(t, store.StoreDevice(device))
+
+	retrieved, err := store.GetDevice("device-123")
+	require.NoError(t, err)
+	assert.Equal(t, device, retrieved)
+}
+
+func TestDeviceRegistry(t *testing.T) {
+	store, err := NewMetadataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	for _, device := range []*types.Device{
+		{ID: "b", Name: "Phone", TrustLevel: 2, LastSeen: time.Now()},
+		{ID: "a", Name: "Laptop", TrustLevel: 2, LastSeen: time.Now()},
+	} {
+		require.NoError(t, store.StoreDevice(device))
+	}
+
+	paired, err := store.HasDevices()
+	require.NoError(t, err)
+	assert.True(t, paired)
+
+	devices, err := store.ListDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "Laptop", devices[0].Name)
+	assert.True(t, devices[0].Trusted())
+
+	require.NoError(t, store.RenameDevice("a", "Work laptop"))
+	require.NoError(t, store.RevokeDevice("b"))
+
+	renamed, err := store.GetDevice("a")
+	require.NoError(t, err)
+	assert.Equal(t, "Work laptop", renamed.Name)
+
+	revoked, err := store.GetDevice("b")
+	require.NoError(t, err)
+	assert.True(t, revoked.Revoked)
+	assert.False(t, revoked.Trusted())
+
+	// Pairing again updates the device but keeps the revocation
+	require.NoError(t, store.StoreDevice(&types.Device{ID: "b", Name: "New phone", PublicKey: "new-key", TrustLevel: 3, LastSeen: time.Now()}))
+	repaired, err := store.GetDevice("b")
+	require.NoError(t, err)
+	assert.Equal(t, "New phone", repaired.Name)
+	assert.Equal(t, "new-key", repaired.PublicKey)
+	assert.Equal(t, 2, repaired.TrustLevel)
+	assert.True(t, repaired.Revoked)
+
+	// Trusting a revoked device again lifts the revocation
+	require.NoError(t, store.SetDeviceTrust("b", 3))
+	restored, err := store.GetDevice("b")
+	require.NoError(t, err)
+	assert.Equal(t, 3, restored.TrustLevel)
+	assert.True(t, restored.Trusted())
+
+	assert.ErrorIs(t, store.RenameDevice("missing", "x"), ErrDeviceNotFound)
+	assert.ErrorIs(t, store.RevokeDevice("missing"), ErrDeviceNotFound)
+	assert.ErrorIs(t, store.SetDeviceTrust("missing", 1), ErrDeviceNotFound)
+}
+
 func TestGetNonexistentDevice(t *testing.T) {
 	tmpDir := t.TempDir()
 	dbPath := filepath.Join(tmpDir, "test.db")
@@ -194,6 +270,10 @@ func TestGetNonexistentDevice(t *testing.T) {
 
 	_, err = store.GetDevice("nonexistent-device")
 	assert.Error(t, err)
+
+	paired, err := store.HasDevices()
+	require.NoError(t, err)
+	assert.False(t, paired)
 }
 
 func TestUpdateFileMetadata(t *testing.T) {
@@ -235,3 +315,397 @@ func TestUpdateFileMetadata(t *testing.T) {
 	assert.Equal(t, int64(20), retrieved.Size)
 	assert.Equal(t, int64(2), retrieved.Version)
 }
+
+func TestFileVersionVector(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	store, err := NewMetadataStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	hash := sha256.Sum256([]byte("content"))
+	vector := types.VersionVector{"laptop": 2, "phone": 1}
+	require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{
+		Path:          "notes.txt",
+		Hash:          hash,
+		ModTime:       time.Now(),
+		Chunks:        [][32]byte{hash},
+		Version:       3,
+		VersionVector: vector,
+	}))
+	require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{
+		Path:    "legacy.txt",
+		Hash:    hash,
+		ModTime: time.Now(),
+		Chunks:  [][32]byte{hash},
+		Version: 1,
+	}))
+
+	retrieved, err := store.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, vector, retrieved.VersionVector)
+
+	files, err := store.ListFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Nil(t, files[0].VersionVector)
+	assert.Equal(t, vector, files[1].VersionVector)
+}
+
+func TestMergeBase(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	store, err := NewMetadataStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	store.SetVersionRetention(VersionRetention{}) // No history holding chunks
+
+	_, err = store.GetMergeBase("notes.txt")
+	assert.ErrorIs(t, err, ErrNoMergeBase)
+
+	oldChunk := sha256.Sum256([]byte("old"))
+	newChunk := sha256.Sum256([]byte("new"))
+	base := &types.FileMetadata{
+		Path:          "notes.txt",
+		Hash:          oldChunk,
+		Size:          3,
+		Chunks:        [][32]byte{oldChunk},
+		VersionVector: types.VersionVector{"laptop": 1},
+	}
+	require.NoError(t, store.StoreMergeBase(base))
+	require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{
+		Path:    "notes.txt",
+		Hash:    newChunk,
+		ModTime: time.Now(),
+		Chunks:  [][32]byte{newChunk},
+		Version: 2,
+	}))
+
+	retrieved, err := store.GetMergeBase("notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, base, retrieved)
+
+	// The base keeps its chunks referenced after the file moved on
+	_, _, refCount, err := store.GetChunkInfo(oldChunk)
+	require.NoError(t, err)
+	assert.Equal(t, 1, refCount)
+
+	// Replacing the base releases the old one's chunks
+	base.Hash, base.Chunks = newChunk, [][32]byte{newChunk}
+	require.NoError(t, store.StoreMergeBase(base))
+	_, _, refCount, err = store.GetChunkInfo(oldChunk)
+	require.NoError(t, err)
+	assert.Equal(t, 0, refCount)
+	_, _, refCount, err = store.GetChunkInfo(newChunk)
+	require.NoError(t, err)
+	assert.Equal(t, 2, refCount)
+
+	// Deleting the file drops its base too
+	require.NoError(t, store.DeleteFileMetadata("notes.txt"))
+	_, err = store.GetMergeBase("notes.txt")
+	assert.ErrorIs(t, err, ErrNoMergeBase)
+	_, _, refCount, err = store.GetChunkInfo(newChunk)
+	require.NoError(t, err)
+	assert.Equal(t, 0, refCount)
+}
+
+func TestFileVersions(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	store, err := NewMetadataStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+	store.SetVersionRetention(VersionRetention{KeepLast: 2})
+
+	storeVersion := func(content string, version int64, device string) [32]byte {
+		hash := sha256.Sum256([]byte(content))
+		require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{
+			Path:       "notes.txt",
+			Hash:       hash,
+			Size:       int64(len(content)),
+			ModTime:    time.Now(),
+			Chunks:     [][32]byte{hash},
+			Version:    version,
+			ModifiedBy: device,
+		}))
+		return hash
+	}
+	refCount := func(hash [32]byte) int {
+		_, _, refCount, err := store.GetChunkInfo(hash)
+		require.NoError(t, err)
+		return refCount
+	}
+
+	first := storeVersion("one", 1, "laptop")
+	second := storeVersion("two", 2, "phone")
+	current := storeVersion("three", 3, "laptop")
+
+	versions, err := store.ListFileVersions("notes.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, second, versions[0].Hash)
+	assert.Equal(t, "phone", versions[0].ModifiedBy)
+	assert.Equal(t, int64(2), versions[0].Version)
+	assert.Equal(t, first, versions[1].Hash)
+	assert.Equal(t, 1, refCount(first))
+
+	version, err := store.GetFileVersion(versions[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, versions[1], version)
+	_, err = store.GetFileVersion(999)
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+
+	retrieved, err := store.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, current, retrieved.Hash)
+	assert.Equal(t, "laptop", retrieved.ModifiedBy)
+
+	// Only the last two are kept
+	storeVersion("four", 4, "laptop")
+	versions, err = store.ListFileVersions("notes.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, current, versions[0].Hash)
+	assert.Equal(t, 0, refCount(first))
+
+	// A deleted file's history is only kept by day
+	require.NoError(t, store.DeleteFileMetadata("notes.txt"))
+	versions, err = store.ListFileVersions("notes.txt")
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+	assert.Equal(t, 0, refCount(current))
+
+	// One version a day is kept for KeepDaily days
+	store.SetVersionRetention(DefaultVersionRetention)
+	for i, content := range []string{"a", "b", "c", "d", "e"} {
+		storeVersion(content, int64(i+1), "laptop")
+	}
+	versions, err = store.ListFileVersions("notes.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 4)
+
+	now := time.Now()
+	noon := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, time.Local)
+	replaced := []time.Time{noon, noon.Add(-time.Minute), noon.AddDate(0, 0, -1), noon.AddDate(0, 0, -40)}
+	for i, version := range versions {
+		_, err := store.db.Exec(`UPDATE file_versions SET replaced_at = ? WHERE id = ?`, replaced[i], version.ID)
+		require.NoError(t, err)
+	}
+
+	store.SetVersionRetention(VersionRetention{KeepDaily: 30})
+	pruned, err := store.PruneVersions()
+	require.NoError(t, err)
+	assert.Equal(t, 2, pruned)
+	versions, err = store.ListFileVersions("notes.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, sha256.Sum256([]byte("d")), versions[0].Hash)
+	assert.Equal(t, sha256.Sum256([]byte("b")), versions[1].Hash)
+}
+
+func TestTombstones(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	store, err := NewMetadataStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	chunk := sha256.Sum256([]byte("report"))
+	require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{
+		Path:          "report.txt",
+		Hash:          chunk,
+		Size:          6,
+		Chunks:        [][32]byte{chunk},
+		VersionVector: types.VersionVector{"laptop": 1},
+	}))
+
+	_, err = store.GetTombstone("report.txt")
+	assert.ErrorIs(t, err, ErrNoTombstone)
+
+	deletedAt := time.Now().Truncate(time.Second)
+	require.NoError(t, store.StoreTombstone(&types.Tombstone{
+		Path:          "report.txt",
+		VersionVector: types.VersionVector{"laptop": 1, "phone": 1},
+		DeletedBy:     "phone",
+		DeletedAt:     deletedAt,
+	}))
+
+	// The file is gone, its last version kept in the history
+	_, err = store.GetFileMetadata("report.txt")
+	assert.Error(t, err)
+	versions, err := store.ListFileVersions("report.txt")
+	require.NoError(t, err)
+	assert.Len(t, versions, 1)
+
+	tombstone, err := store.GetTombstone("report.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.VersionVector{"laptop": 1, "phone": 1}, tombstone.VersionVector)
+	assert.Equal(t, "phone", tombstone.DeletedBy)
+	assert.True(t, deletedAt.Equal(tombstone.DeletedAt))
+
+	tombstones, err := store.ListTombstones()
+	require.NoError(t, err)
+	assert.Len(t, tombstones, 1)
+
+	// Dropped only once every device has acknowledged it
+	require.NoError(t, store.AcknowledgeTombstone("report.txt", "laptop"))
+	require.NoError(t, store.AcknowledgeTombstone("other.txt", "laptop"))
+	collected, err := store.CollectTombstones([]string{"laptop", "tablet"})
+	require.NoError(t, err)
+	assert.Zero(t, collected)
+	collected, err = store.CollectTombstones(nil)
+	require.NoError(t, err)
+	assert.Zero(t, collected)
+
+	require.NoError(t, store.AcknowledgeTombstone("report.txt", "tablet"))
+	collected, err = store.CollectTombstones([]string{"laptop", "tablet"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, collected)
+	_, err = store.GetTombstone("report.txt")
+	assert.ErrorIs(t, err, ErrNoTombstone)
+
+	// A file created again replaces its tombstone
+	require.NoError(t, store.StoreTombstone(&types.Tombstone{Path: "draft.txt", DeletedBy: "laptop", DeletedAt: deletedAt}))
+	require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{Path: "draft.txt", Hash: chunk, Chunks: [][32]byte{chunk}}))
+	_, err = store.GetTombstone("draft.txt")
+	assert.ErrorIs(t, err, ErrNoTombstone)
+}
+
+func TestMoveFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	store, err := NewMetadataStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	first := sha256.Sum256([]byte("first"))
+	second := sha256.Sum256([]byte("second"))
+	for _, chunk := range [][32]byte{first, second} {
+		require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{
+			Path:          "draft.txt",
+			Hash:          chunk,
+			Chunks:        [][32]byte{chunk},
+			VersionVector: types.VersionVector{"laptop": 1},
+		}))
+	}
+	require.NoError(t, store.StoreMergeBase(&types.FileMetadata{Path: "draft.txt", Hash: first, Chunks: [][32]byte{first}}))
+	require.NoError(t, store.StoreTombstone(&types.Tombstone{Path: "final.txt", DeletedBy: "phone", DeletedAt: time.Now()}))
+
+	vector := types.VersionVector{"laptop": 2}
+	require.NoError(t, store.MoveFile(
+		&types.Tombstone{Path: "draft.txt", VersionVector: vector, DeletedBy: "laptop", DeletedAt: time.Now(), MovedTo: "final.txt"},
+		&types.FileMetadata{Path: "final.txt", Hash: second, Chunks: [][32]byte{second}, VersionVector: vector},
+	))
+
+	_, err = store.GetFileMetadata("draft.txt")
+	assert.Error(t, err)
+	moved, err := store.GetFileMetadata("final.txt")
+	require.NoError(t, err)
+	assert.Equal(t, second, moved.Hash)
+	assert.Equal(t, vector, moved.VersionVector)
+
+	tombstone, err := store.GetTombstone("draft.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "final.txt", tombstone.MovedTo)
+	_, err = store.GetTombstone("final.txt")
+	assert.ErrorIs(t, err, ErrNoTombstone)
+
+	// The history and merge base follow the file, and chunks stay
+	// referenced once
+	versions, err := store.ListFileVersions("final.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, first, versions[0].Hash)
+	base, err := store.GetMergeBase("final.txt")
+	require.NoError(t, err)
+	assert.Equal(t, first, base.Hash)
+	_, _, refs, err := store.GetChunkInfo(second)
+	require.NoError(t, err)
+	assert.Equal(t, 1, refs)
+
+	assert.Error(t, store.MoveFile(&types.Tombstone{Path: "missing.txt", MovedTo: "elsewhere.txt"}, &types.FileMetadata{Path: "elsewhere.txt"}))
+}
+
+func TestListFilesUnder(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	store, err := NewMetadataStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	paths := []string{
+		"docs",
+		filepath.Join("docs", "plan.txt"),
+		filepath.Join("docs", "old", "notes.txt"),
+		"docs.txt",
+		"docsets",
+	}
+	for _, path := range paths {
+		require.NoError(t, store.StoreFileMetadata(&types.FileMetadata{Path: path}))
+	}
+
+	files, err := store.ListFilesUnder("docs")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, filepath.Join("docs", "old", "notes.txt"), files[0].Path)
+	assert.Equal(t, filepath.Join("docs", "plan.txt"), files[1].Path)
+
+	files, err = store.ListFilesUnder("missing")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestConflicts(t *testing.T) {
+	tmpDir := t.TempDir()
+	dbPath := filepath.Join(tmpDir, "test.db")
+
+	store, err := NewMetadataStore(dbPath)
+	require.NoError(t, err)
+	defer store.Close()
+
+	conflict := &types.Conflict{
+		Path:       "notes.txt",
+		CopyPath:   "notes.sync-conflict-20260101-120000-3f2a9c1b.txt",
+		DeviceID:   "laptop",
+		Resolution: "remote_wins",
+		LocalFile:  &types.FileMetadata{Path: "notes.txt", Version: 2, VersionVector: types.VersionVector{"phone": 2}},
+		RemoteFile: &types.FileMetadata{Path: "notes.txt", Version: 2, VersionVector: types.VersionVector{"laptop": 2}},
+		DetectedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	require.NoError(t, store.AddConflict(conflict))
+	assert.NotZero(t, conflict.ID)
+
+	retrieved, err := store.GetConflict(conflict.ID)
+	require.NoError(t, err)
+	assert.Equal(t, conflict.CopyPath, retrieved.CopyPath)
+	assert.Equal(t, conflict.RemoteFile.VersionVector, retrieved.RemoteFile.VersionVector)
+	assert.False(t, retrieved.Resolved())
+
+	open, err := store.ListConflicts(false)
+	require.NoError(t, err)
+	assert.Len(t, open, 1)
+
+	require.NoError(t, store.ResolveConflict(conflict.ID, "local_wins", time.Now()))
+	retrieved, err = store.GetConflict(conflict.ID)
+	require.NoError(t, err)
+	assert.True(t, retrieved.Resolved())
+	assert.Equal(t, "local_wins", retrieved.Resolution)
+
+	open, err = store.ListConflicts(false)
+	require.NoError(t, err)
+	assert.Empty(t, open)
+	all, err := store.ListConflicts(true)
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+
+	_, err = store.GetConflict(999)
+	assert.ErrorIs(t, err, ErrConflictNotFound)
+	assert.ErrorIs(t, store.ResolveConflict(999, "manual", time.Now()), ErrConflictNotFound)
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTrashRetention is how long files deleted by peers stay in the
+// trash before they are removed for good
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// trashInfoFile holds an entry's details next to the trashed file
+const trashInfoFile = "info.json"
+
+var ErrTrashEntryNotFound = errors.New("no such entry in the trash")
+
+// TrashEntry is a file that was moved to the trash instead of deleted
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"` // Where it was in the sync folder
+	Size      int64     `json:"size"`
+	IsDir     bool      `json:"is_dir,omitempty"`
+	DeletedBy string    `json:"deleted_by"` // The device whose deletion it was
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Trash keeps files deleted by other devices in .fybrk/trash for a while,
+// so a deletion made by mistake on one device can be undone on the others.
+// Each entry is a directory named by its ID, holding the file under its
+// original name and the entry's details in info.json.
+type Trash struct {
+	dir string
+
+	mu        sync.Mutex
+	retention time.Duration
+}
+
+// NewTrash opens the trash in dir. Entries older than retention are
+// removed by Expire; a retention of zero keeps them until emptied.
+func NewTrash(dir string, retention time.Duration) (*Trash, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create trash: %v", err)
+	}
+	return &Trash{dir: dir, retention: retention}, nil
+}
+
+// SetRetention changes how long entries are kept
+func (t *Trash) SetRetention(retention time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retention = retention
+}
+
+// Move moves the file or directory at relPath inside root to the trash
+func (t *Trash) Move(root, relPath, deletedBy string) (*TrashEntry, error) {
+	if !filepath.IsLocal(relPath) {
+		return nil, fmt.Errorf("invalid path: %s", relPath)
+	}
+	src := filepath.Join(root, relPath)
+	info, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	entry := &TrashEntry{
+		ID:        hex.EncodeToString(id),
+		Path:      relPath,
+		IsDir:     info.IsDir(),
+		DeletedBy: deletedBy,
+		DeletedAt: time.Now(),
+	}
+	if !info.IsDir() {
+		entry.Size = info.Size()
+	}
+
+	entryDir := filepath.Join(t.dir, entry.ID)
+	if err := os.Mkdir(entryDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create trash entry: %v", err)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		os.RemoveAll(entryDir)
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(entryDir, trashInfoFile), data, 0644); err != nil {
+		os.RemoveAll(entryDir)
+		return nil, fmt.Errorf("failed to create trash entry: %v", err)
+	}
+	if err := os.Rename(src, filepath.Join(entryDir, filepath.Base(relPath))); err != nil {
+		os.RemoveAll(entryDir)
+		return nil, fmt.Errorf("failed to move %s to the trash: %v", relPath, err)
+	}
+	return entry, nil
+}
+
+// List returns the entries in the trash, most recently deleted first
+func (t *Trash) List() ([]*TrashEntry, error) {
+	dirs, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*TrashEntry
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entry, err := t.Get(dir.Name())
+		if err != nil {
+			continue // Not an entry, or a half-written one
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+// Get returns the entry with the given ID
+func (t *Trash) Get(id string) (*TrashEntry, error) {
+	if !filepath.IsLocal(id) || filepath.Base(id) != id {
+		return nil, ErrTrashEntryNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(t.dir, id, trashInfoFile))
+	if os.IsNotExist(err) {
+		return nil, ErrTrashEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid trash entry %s: %v", id, err)
+	}
+	if entry.ID != id || !filepath.IsLocal(entry.Path) {
+		return nil, fmt.Errorf("invalid trash entry %s", id)
+	}
+	return &entry, nil
+}
+
+// Restore moves an entry back to where it was inside root. It refuses to
+// replace a file that has since been created in its place.
+func (t *Trash) Restore(root, id string) (*TrashEntry, error) {
+	entry, err := t.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := filepath.Join(root, entry.Path)
+	if _, err := os.Lstat(dst); err == nil {
+		return nil, fmt.Errorf("%s already exists", entry.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+
+	entryDir := filepath.Join(t.dir, id)
+	if err := os.Rename(filepath.Join(entryDir, filepath.Base(entry.Path)), dst); err != nil {
+		return nil, fmt.Errorf("failed to restore %s: %v", entry.Path, err)
+	}
+	if err := os.RemoveAll(entryDir); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Remove deletes an entry for good
+func (t *Trash) Remove(id string) error {
+	if _, err := t.Get(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(t.dir, id))
+}
+
+// Empty deletes every entry in the trash and returns how many there were
+func (t *Trash) Empty() (int, error) {
+	entries, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(t.dir, entry.ID)); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Expire deletes the entries kept longer than the retention period and
+// returns how many it removed
+func (t *Trash) Expire() (int, error) {
+	t.mu.Lock()
+	retention := t.retention
+	t.mu.Unlock()
+	if retention <= 0 {
+		return 0, nil
+	}
+	entries, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	removed := 0
+	for _, entry := range entries {
+		if entry.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(t.dir, entry.ID)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "docs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "plan.txt"), []byte("the plan"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "notes.txt"), []byte("notes"), 0644))
+
+	trash, err := NewTrash(filepath.Join(root, ".fybrk", "trash"), time.Hour)
+	require.NoError(t, err)
+
+	plan, err := trash.Move(root, filepath.Join("docs", "plan.txt"), "laptop")
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), plan.Size)
+	assert.Equal(t, "laptop", plan.DeletedBy)
+	assert.NoFileExists(t, filepath.Join(root, "docs", "plan.txt"))
+
+	notes, err := trash.Move(root, "notes.txt", "phone")
+	require.NoError(t, err)
+
+	_, err = trash.Move(root, "missing.txt", "phone")
+	assert.True(t, os.IsNotExist(err))
+	_, err = trash.Move(root, "../outside.txt", "phone")
+	assert.Error(t, err)
+
+	entries, err := trash.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, notes.ID, entries[0].ID)
+	assert.Equal(t, plan.ID, entries[1].ID)
+
+	// Restoring puts the file back where it was, unless something took
+	// its place
+	require.NoError(t, os.WriteFile(filepath.Join(root, "notes.txt"), []byte("new notes"), 0644))
+	_, err = trash.Restore(root, notes.ID)
+	assert.Error(t, err)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "docs")))
+	restored, err := trash.Restore(root, plan.ID)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("docs", "plan.txt"), restored.Path)
+	data, err := os.ReadFile(filepath.Join(root, "docs", "plan.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "the plan", string(data))
+
+	_, err = trash.Restore(root, plan.ID)
+	assert.ErrorIs(t, err, ErrTrashEntryNotFound)
+	_, err = trash.Get("../" + notes.ID)
+	assert.ErrorIs(t, err, ErrTrashEntryNotFound)
+
+	count, err := trash.Empty()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	entries, err = trash.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestTrashExpire(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"old.txt", "new.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(name), 0644))
+	}
+
+	trash, err := NewTrash(filepath.Join(root, ".fybrk", "trash"), 24*time.Hour)
+	require.NoError(t, err)
+
+	old, err := trash.Move(root, "old.txt", "laptop")
+	require.NoError(t, err)
+	_, err = trash.Move(root, "new.txt", "laptop")
+	require.NoError(t, err)
+
+	// Backdate the first deletion past the retention period
+	old.DeletedAt = time.Now().Add(-48 * time.Hour)
+	data, err := json.Marshal(old)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(trash.dir, old.ID, trashInfoFile), data, 0644))
+
+	removed, err := trash.Expire()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	entries, err := trash.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "new.txt", entries[0].Path)
+	assert.NoDirExists(t, filepath.Join(trash.dir, old.ID))
+
+	// Without a retention period nothing expires
+	forever, err := NewTrash(trash.dir, 0)
+	require.NoError(t, err)
+	removed, err = forever.Expire()
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+}
@@ -0,0 +1,286 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/protocol"
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+// What to keep when resolving a conflict
+const (
+	KeepCurrent = "current" // The version that won; the conflict copy is deleted
+	KeepCopy    = "copy"    // The conflict copy, which replaces the file
+	KeepBoth    = "both"    // Both files, as they are
+)
+
+// ConflictHandler is told about each conflict once it has been recorded
+type ConflictHandler func(conflict *types.Conflict)
+
+// SetConflictResolver sets how conflicts in this folder are settled. The
+// default merges text files and keeps both versions of anything else
+// (DefaultConflictPolicy).
+func (e *Engine) SetConflictResolver(resolver ConflictResolver) {
+	e.handlersMu.Lock()
+	defer e.handlersMu.Unlock()
+	e.resolver = resolver
+}
+
+func (e *Engine) conflictResolver() ConflictResolver {
+	e.handlersMu.Lock()
+	defer e.handlersMu.Unlock()
+	if e.resolver == nil {
+		return ResolveMerge
+	}
+	return e.resolver
+}
+
+// OnConflict registers a handler called for every conflict detected
+func (e *Engine) OnConflict(handler ConflictHandler) {
+	e.handlersMu.Lock()
+	defer e.handlersMu.Unlock()
+	e.conflictHandlers = append(e.conflictHandlers, handler)
+}
+
+// ListConflicts returns conflicts not resolved yet, or all of them
+func (e *Engine) ListConflicts(includeResolved bool) ([]*types.Conflict, error) {
+	return e.metadataStore.ListConflicts(includeResolved)
+}
+
+// ResolveConflict settles a conflict by keeping the current version, the
+// conflict copy, or both files
+func (e *Engine) ResolveConflict(id int64, keep string) error {
+	conflict, err := e.metadataStore.GetConflict(id)
+	if err != nil {
+		return err
+	}
+	if conflict.Resolved() {
+		return fmt.Errorf("conflict %d is already resolved", id)
+	}
+
+	fullPath := filepath.Join(e.syncPath, conflict.Path)
+	copyPath := filepath.Join(e.syncPath, conflict.CopyPath)
+
+	var resolution string
+	switch keep {
+	case KeepCurrent:
+		if err := os.Remove(copyPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		resolution = protocol.ResolutionRemoteWins
+	case KeepCopy:
+		if err := os.Rename(copyPath, fullPath); err != nil {
+			return err
+		}
+		// Record the change now rather than waiting for the watcher
+		if err := e.processFile(fullPath, conflict.Path); err != nil {
+			return err
+		}
+		resolution = protocol.ResolutionLocalWins
+	case KeepBoth:
+		resolution = protocol.ResolutionManual
+	default:
+		return fmt.Errorf("unknown conflict resolution '%s'", keep)
+	}
+
+	if keep != KeepBoth {
+		if err := e.recordDeletion(conflict.CopyPath); err != nil {
+			return err
+		}
+		e.collectGarbage()
+	}
+	return e.metadataStore.ResolveConflict(id, resolution, time.Now())
+}
+
+// recordConflict records that our version of a file lost to a concurrent
+// edit on deviceID and reports it. Unless the resolution drops our version,
+// it is kept next to the file as a conflict copy, which is synced to other
+// devices like any new file, and the conflict stays open for the user.
+func (e *Engine) recordConflict(localFile, remoteFile *types.FileMetadata, deviceID, resolution string) error {
+	now := time.Now()
+	conflict := &types.Conflict{
+		Path:       localFile.Path,
+		DeviceID:   deviceID,
+		Resolution: resolution,
+		LocalFile:  localFile,
+		RemoteFile: remoteFile,
+		DetectedAt: now,
+	}
+
+	if resolution == protocol.ResolutionManual {
+		conflict.CopyPath = conflictCopyOf(localFile, e.deviceID)
+		err := copyFile(filepath.Join(e.syncPath, localFile.Path), filepath.Join(e.syncPath, conflict.CopyPath))
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	} else {
+		conflict.ResolvedAt = now // Settled by policy
+	}
+
+	return e.reportConflict(conflict)
+}
+
+// keepRemoteCopy records that a peer's version of a file lost to ours
+// while both are kept. It is rebuilt from the chunk store as the conflict
+// copy the peer keeps too, so its edit survives even if the peer takes our
+// version before it sees the conflict itself.
+func (e *Engine) keepRemoteCopy(localFile, remoteFile *types.FileMetadata, deviceID string) error {
+	conflict := &types.Conflict{
+		Path:       localFile.Path,
+		CopyPath:   conflictCopyOf(remoteFile, deviceID),
+		DeviceID:   deviceID,
+		Resolution: protocol.ResolutionManual,
+		LocalFile:  localFile,
+		RemoteFile: remoteFile,
+		DetectedAt: time.Now(),
+	}
+
+	copyPath := filepath.Join(e.syncPath, conflict.CopyPath)
+	if _, err := os.Lstat(copyPath); os.IsNotExist(err) {
+		if _, err := e.rebuildFile(remoteFile, copyPath); err != nil {
+			return err
+		}
+		// The watcher leaves the rebuilt copy alone; it is a new file here
+		if err := e.indexFile(copyPath, conflict.CopyPath, nil); err != nil {
+			return err
+		}
+	}
+	return e.reportConflict(conflict)
+}
+
+// recordMergeConflict records that lines changed in a file conflicted with
+// a concurrent edit on deviceID when merging the two. The side whose lines
+// lost, the version lost edited on lostBy, is kept in a conflict copy
+// holding data, the merge taking its lines, and the conflict stays open
+// for the user. Both devices keep the copy under the same name.
+func (e *Engine) recordMergeConflict(localFile, remoteFile *types.FileMetadata, deviceID string, lost *types.FileMetadata, lostBy string, data []byte) error {
+	now := time.Now()
+	conflict := &types.Conflict{
+		Path:       localFile.Path,
+		CopyPath:   conflictCopyOf(lost, lostBy),
+		DeviceID:   deviceID,
+		Resolution: protocol.ResolutionMerge,
+		LocalFile:  localFile,
+		RemoteFile: remoteFile,
+		DetectedAt: now,
+	}
+
+	info, err := os.Stat(filepath.Join(e.syncPath, localFile.Path))
+	if err != nil {
+		return err
+	}
+	copyPath := filepath.Join(e.syncPath, conflict.CopyPath)
+	out, err := os.OpenFile(copyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if os.IsExist(err) {
+		return e.reportConflict(conflict) // Kept already, e.g. synced from the peer
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		os.Remove(copyPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(copyPath)
+		return err
+	}
+
+	return e.reportConflict(conflict)
+}
+
+// reportConflict stores a conflict and tells the handlers about it
+func (e *Engine) reportConflict(conflict *types.Conflict) error {
+	if err := e.metadataStore.AddConflict(conflict); err != nil {
+		return err
+	}
+
+	e.handlersMu.Lock()
+	handlers := append([]ConflictHandler(nil), e.conflictHandlers...)
+	e.handlersMu.Unlock()
+	for _, handler := range handlers {
+		handler(conflict)
+	}
+	return nil
+}
+
+// writeMerged replaces a file with the result of merging it with another
+// device's version, recorded as a local edit descending from both
+func (e *Engine) writeMerged(relPath string, data []byte, merged types.VersionVector) error {
+	fullPath := filepath.Join(e.syncPath, relPath)
+
+	reassembler, err := storage.NewReassembler(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	if err := reassembler.WriteChunk(&types.Chunk{Hash: sha256.Sum256(data), Data: data}); err != nil {
+		reassembler.Abort()
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+
+	// The watcher leaves the write alone; it is indexed below
+	e.setReceiving(relPath, reassembler.Sum())
+	if err := reassembler.Commit(); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+
+	return e.indexFile(fullPath, relPath, merged)
+}
+
+// conflictCopyName names the copy of relPath as edited on deviceID, e.g.
+// notes.sync-conflict-20260102-150405-3f2a9c1b.txt
+func conflictCopyName(relPath, deviceID string, t time.Time) string {
+	ext := filepath.Ext(relPath)
+	if ext == filepath.Base(relPath) {
+		ext = "" // A dotfile such as .bashrc has no extension
+	}
+	if len(deviceID) > 8 {
+		deviceID = deviceID[:8]
+	}
+	stem := strings.TrimSuffix(relPath, ext)
+	return fmt.Sprintf("%s.sync-conflict-%s-%s%s", stem, t.Format("20060102-150405"), deviceID, ext)
+}
+
+// conflictCopyOf names the conflict copy of a version of a file edited on
+// deviceID. It is named after the version rather than when the conflict was
+// found, so both devices keep the losing side under the same name.
+func conflictCopyOf(file *types.FileMetadata, deviceID string) string {
+	return conflictCopyName(file.Path, deviceID, file.ModTime.UTC())
+}
+
+// copyFile copies src to a new file dst, keeping its modification time
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,216 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/protocol"
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictCopyName(t *testing.T) {
+	at := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	assert.Equal(t, "notes.sync-conflict-20260102-150405-3f2a9c1b.txt",
+		conflictCopyName("notes.txt", "3f2a9c1b8d7e6f5a", at))
+	assert.Equal(t, "docs/report.v2.sync-conflict-20260102-150405-laptop.pdf",
+		conflictCopyName("docs/report.v2.pdf", "laptop", at))
+	assert.Equal(t, ".bashrc.sync-conflict-20260102-150405-laptop",
+		conflictCopyName(".bashrc", "laptop", at))
+}
+
+// concurrentEdit sets up an engine whose a.txt loses to a concurrent edit
+// on "phone". The winning content is already stored locally as b.txt, so
+// no network is needed to fetch it.
+func concurrentEdit(t *testing.T, onConflict ConflictHandler) *Engine {
+	return concurrentEditWith(t, nil, onConflict)
+}
+
+// concurrentEditWith is concurrentEdit with the given conflict resolver
+func concurrentEditWith(t *testing.T, resolver ConflictResolver, onConflict ConflictHandler) *Engine {
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "a.txt"), []byte("ours"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "b.txt"), []byte("theirs"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	require.NoError(t, engine.ScanDirectory())
+	if resolver != nil {
+		engine.SetConflictResolver(resolver)
+	}
+	if onConflict != nil {
+		engine.OnConflict(onConflict)
+	}
+
+	local, err := engine.metadataStore.GetFileMetadata("a.txt")
+	require.NoError(t, err)
+	theirs, err := engine.metadataStore.GetFileMetadata("b.txt")
+	require.NoError(t, err)
+
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	mds.handleFileList("phone", []*types.FileMetadata{{
+		Path:          "a.txt",
+		Hash:          theirs.Hash,
+		Size:          theirs.Size,
+		ModTime:       local.ModTime.Add(time.Hour),
+		Chunks:        theirs.Chunks,
+		Version:       1,
+		VersionVector: types.VersionVector{"phone": 1},
+	}}, nil)
+	return engine
+}
+
+func TestConflictKeepsLosingVersion(t *testing.T) {
+	reported := make(chan *types.Conflict, 1)
+	engine := concurrentEdit(t, func(conflict *types.Conflict) { reported <- conflict })
+
+	var conflict *types.Conflict
+	select {
+	case conflict = <-reported:
+	default:
+		t.Fatal("conflict was not reported")
+	}
+	assert.Equal(t, "a.txt", conflict.Path)
+	assert.Equal(t, "phone", conflict.DeviceID)
+	assert.Equal(t, protocol.ResolutionManual, conflict.Resolution)
+	assert.False(t, conflict.Resolved())
+	assert.Regexp(t, `^a\.sync-conflict-\d{8}-\d{6}-test-dev\.txt$`, conflict.CopyPath)
+
+	data, err := os.ReadFile(filepath.Join(engine.syncPath, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "theirs", string(data))
+	data, err = os.ReadFile(filepath.Join(engine.syncPath, conflict.CopyPath))
+	require.NoError(t, err)
+	assert.Equal(t, "ours", string(data))
+
+	conflicts, err := engine.ListConflicts(false)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, conflict.ID, conflicts[0].ID)
+}
+
+func TestResolveConflict(t *testing.T) {
+	tests := []struct {
+		keep       string
+		content    string
+		copyKept   bool
+		resolution string
+	}{
+		{KeepCurrent, "theirs", false, protocol.ResolutionRemoteWins},
+		{KeepCopy, "ours", false, protocol.ResolutionLocalWins},
+		{KeepBoth, "theirs", true, protocol.ResolutionManual},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keep, func(t *testing.T) {
+			engine := concurrentEdit(t, nil)
+
+			conflicts, err := engine.ListConflicts(false)
+			require.NoError(t, err)
+			require.Len(t, conflicts, 1)
+			conflict := conflicts[0]
+
+			require.NoError(t, engine.ResolveConflict(conflict.ID, tt.keep))
+
+			data, err := os.ReadFile(filepath.Join(engine.syncPath, "a.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.content, string(data))
+			_, err = os.Stat(filepath.Join(engine.syncPath, conflict.CopyPath))
+			assert.Equal(t, tt.copyKept, err == nil)
+
+			resolved, err := engine.metadataStore.GetConflict(conflict.ID)
+			require.NoError(t, err)
+			assert.True(t, resolved.Resolved())
+			assert.Equal(t, tt.resolution, resolved.Resolution)
+
+			open, err := engine.ListConflicts(false)
+			require.NoError(t, err)
+			assert.Empty(t, open)
+			assert.Error(t, engine.ResolveConflict(conflict.ID, tt.keep))
+		})
+	}
+
+	engine := concurrentEdit(t, nil)
+	conflicts, err := engine.ListConflicts(false)
+	require.NoError(t, err)
+	assert.Error(t, engine.ResolveConflict(conflicts[0].ID, "neither"))
+}
+
+// editedOnTwoDevices sets up "laptop" and "phone", connected directly,
+// which both changed path from a version they share. The laptop's edit is
+// the newer one.
+func editedOnTwoDevices(t *testing.T, resolver ConflictResolver, path, shared, laptopEdit, phoneEdit string) (laptop, phone *MultiDeviceSync) {
+	key := []byte("12345678901234567890123456789012")
+	device := func(deviceID string) *MultiDeviceSync {
+		engine := newTestDevice(t, t.TempDir(), key, deviceID)
+		engine.SetConflictResolver(resolver)
+		return &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, deviceID: deviceID, pending: make(map[string]*pendingFile)}
+	}
+	laptop, phone = device("laptop"), device("phone")
+	connectTestPeers(t, laptop, "laptop", phone, "phone")
+
+	require.NoError(t, os.WriteFile(filepath.Join(laptop.engine.syncPath, path), []byte(shared), 0644))
+	require.NoError(t, laptop.engine.ScanDirectory())
+	sendFileList(t, laptop, phone)
+	require.FileExists(t, filepath.Join(phone.engine.syncPath, path))
+	// Each learns the other holds it, the version to merge edits against
+	sendFileList(t, phone, laptop)
+	sendFileList(t, laptop, phone)
+
+	modTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	edit := func(mds *MultiDeviceSync, content string, modTime time.Time) {
+		fullPath := filepath.Join(mds.engine.syncPath, path)
+		require.NoError(t, os.WriteFile(fullPath, []byte(content), 0644))
+		require.NoError(t, os.Chtimes(fullPath, modTime, modTime))
+		require.NoError(t, mds.engine.ScanDirectory())
+	}
+	edit(laptop, laptopEdit, modTime.Add(time.Hour))
+	edit(phone, phoneEdit, modTime)
+	return laptop, phone
+}
+
+// sendFileList hands the file list of one device to another, after a scan
+// so it holds conflict copies the watcher may not have indexed yet
+func sendFileList(t *testing.T, from, to *MultiDeviceSync) {
+	require.NoError(t, from.engine.ScanDirectory())
+	files, err := from.engine.GetSyncedFiles()
+	require.NoError(t, err)
+	to.handleFileList(from.deviceID, files, nil)
+}
+
+func TestConflictKeepsLosingVersionOnBothDevices(t *testing.T) {
+	laptop, phone := editedOnTwoDevices(t, ResolveKeepBoth, "a.txt", "shared", "laptop", "phone")
+
+	// The winner sees the conflict first, and the loser then fast-forwards
+	// to it without ever seeing the conflict itself
+	sendFileList(t, phone, laptop)
+	sendFileList(t, laptop, phone)
+
+	for _, mds := range []*MultiDeviceSync{laptop, phone} {
+		data, err := os.ReadFile(filepath.Join(mds.engine.syncPath, "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "laptop", string(data), mds.deviceID)
+
+		copies, err := filepath.Glob(filepath.Join(mds.engine.syncPath, "a.sync-conflict-*-phone.txt"))
+		require.NoError(t, err)
+		require.Len(t, copies, 1, mds.deviceID)
+		data, err = os.ReadFile(copies[0])
+		require.NoError(t, err)
+		assert.Equal(t, "phone", string(data), mds.deviceID)
+	}
+
+	conflicts, err := laptop.engine.ListConflicts(false)
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, "phone", conflicts[0].DeviceID)
+	assert.Equal(t, "a.txt", conflicts[0].Path)
+
+	// Both copies are the same file, so the devices agree from here
+	sendFileList(t, phone, laptop)
+	sendFileList(t, laptop, phone)
+	copies, err := filepath.Glob(filepath.Join(laptop.engine.syncPath, "a.sync-conflict-*"))
+	require.NoError(t, err)
+	assert.Len(t, copies, 1)
+}
@@ -1,24 +1,55 @@
 package sync
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	gosync "sync"
+	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/network"
 	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/internal/transport"
 	"github.com/Fybrk/fybrk/internal/watcher"
 	"github.com/Fybrk/fybrk/pkg/types"
 )
 
 type Engine struct {
 	metadataStore *storage.MetadataStore
+	chunkStore    *storage.ChunkStore
+	trash         *storage.Trash
 	chunker       *storage.Chunker
 	encryptor     *storage.Encryptor
 	watcher       *watcher.FileWatcher
 	syncPath      string
 	deviceID      string
+	identity      *identity.Identity
+	keyDir        string // Where the key ring is saved, if anywhere
 	multiDevice   *MultiDeviceSync
+
+	// Paths written with content from a peer, by the hash written; a zero
+	// hash marks a path the peer removed. Watcher events arrive after the
+	// write, so they are matched against what the file holds rather than
+	// against when they come: while the file is as written they are
+	// dropped, and the first event that finds it changed is a local edit.
+	receiving   map[string]receivedWrite
+	receivingMu gosync.Mutex
+
+	// Paths removed locally that may turn out to have been moved, by when
+	// they were removed. Only touched by the file event goroutine.
+	removed map[string]time.Time
+
+	resolver         ConflictResolver
+	conflictHandlers []ConflictHandler
+	handlersMu       gosync.Mutex
+
+	stop    chan struct{}
+	stopped chan struct{} // Closed once no file event is being handled
 }
 
 func NewEngine(metadataStore *storage.MetadataStore, chunker *storage.Chunker, encryptor *storage.Encryptor, syncPath, deviceID string) (*Engine, error) {
@@ -27,13 +58,31 @@ func NewEngine(metadataStore *storage.MetadataStore, chunker *storage.Chunker, e
 		return nil, err
 	}
 
+	// Chunks live in a content-addressed store next to the database
+	chunkStore, err := storage.NewChunkStore(filepath.Join(syncPath, ".fybrk", "chunks"), metadataStore)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files deleted by peers are moved aside rather than removed
+	trash, err := storage.NewTrash(filepath.Join(syncPath, ".fybrk", "trash"), storage.DefaultTrashRetention)
+	if err != nil {
+		return nil, err
+	}
+
 	engine := &Engine{
 		metadataStore: metadataStore,
+		chunkStore:    chunkStore,
+		trash:         trash,
 		chunker:       chunker,
 		encryptor:     encryptor,
 		watcher:       fileWatcher,
 		syncPath:      syncPath,
 		deviceID:      deviceID,
+		receiving:     make(map[string]receivedWrite),
+		removed:       make(map[string]time.Time),
+		stop:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
 
 	// Start watching the sync path
@@ -42,9 +91,44 @@ func NewEngine(metadataStore *storage.MetadataStore, chunker *storage.Chunker, e
 	}
 
 	go engine.handleFileEvents()
+
+	// Chunks sealed under a rotated-out key or in an older format are
+	// upgraded in the background. Each one is recorded as it is rewritten,
+	// so an interrupted run picks up where it stopped.
+	if stale, err := metadataStore.ListStaleChunks(encryptor.KeyRing().CurrentEpoch(), storage.ChunkFormat); err == nil && len(stale) > 0 {
+		go func() {
+			if _, err := engine.ReencryptStaleChunks(); err != nil {
+				fmt.Printf("Error re-encrypting chunks: %v\n", err)
+			}
+		}()
+	}
+
 	return engine, nil
 }
 
+// SetIdentity sets the device identity peers are shown. The engine's device
+// ID becomes the one derived from it. Call before EnableMultiDeviceSync.
+func (e *Engine) SetIdentity(id *identity.Identity) {
+	e.identity = id
+	e.deviceID = id.DeviceID()
+}
+
+// SetKeyDir sets the directory the key ring is saved to when a peer hands
+// over the key of a new epoch. Without one such keys are refused.
+func (e *Engine) SetKeyDir(dir string) {
+	e.keyDir = dir
+}
+
+// MetadataStore returns the store holding this folder's metadata
+func (e *Engine) MetadataStore() *storage.MetadataStore {
+	return e.metadataStore
+}
+
+// DeviceID returns the ID this engine records changes under
+func (e *Engine) DeviceID() string {
+	return e.deviceID
+}
+
 func (e *Engine) EnableMultiDeviceSync(port int) error {
 	mds, err := NewMultiDeviceSync(e, e.encryptor, e.deviceID, port)
 	if err != nil {
@@ -55,6 +139,19 @@ func (e *Engine) EnableMultiDeviceSync(port int) error {
 	return mds.Start()
 }
 
+// EnableSharedMultiDeviceSync enables peer-to-peer synchronization through
+// a listener shared with other folders. Peers reach this folder by proving
+// they hold its key; folderID names it on mux.
+func (e *Engine) EnableSharedMultiDeviceSync(mux *transport.Mux, folderID string) error {
+	mds, err := NewMultiDeviceSync(e, e.encryptor, e.deviceID, mux.Port(), network.WithMux(mux, folderID))
+	if err != nil {
+		return err
+	}
+
+	e.multiDevice = mds
+	return mds.Start()
+}
+
 func (e *Engine) GetConnectedDevices() []string {
 	if e.multiDevice == nil {
 		return []string{}
@@ -62,36 +159,66 @@ func (e *Engine) GetConnectedDevices() []string {
 	return e.multiDevice.GetConnectedDevices()
 }
 
+// DistributeKey hands the key of the current epoch to every connected
+// device that has not been revoked, and drops those that have. Call it after
+// rotating the key.
+func (e *Engine) DistributeKey() error {
+	if e.multiDevice == nil {
+		return nil
+	}
+	return e.multiDevice.distributeKey()
+}
+
+// RevokeDevice marks a device as revoked in the registry and drops any
+// connection to it
+func (e *Engine) RevokeDevice(deviceID string) error {
+	if err := e.metadataStore.RevokeDevice(deviceID); err != nil {
+		return err
+	}
+	if e.multiDevice != nil {
+		e.multiDevice.DisconnectDevice(deviceID)
+	}
+	return nil
+}
+
 func (e *Engine) handleFileEvents() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(moveWindow / 2)
+	defer ticker.Stop()
 	for {
 		select {
 		case event := <-e.watcher.Events():
 			e.processFileEvent(event)
 		case err := <-e.watcher.Errors():
 			fmt.Printf("File watcher error: %v\n", err)
+		case <-ticker.C:
+			e.expireRemovals(false)
+			e.expireReceiving()
+		case <-e.stop:
+			return
 		}
 	}
 }
 
 func (e *Engine) processFileEvent(event watcher.FileEvent) {
-	// Skip if file is outside sync path
+	// Skip if file is outside sync path or internal to fybrk
 	relPath, err := filepath.Rel(e.syncPath, event.Path)
-	if err != nil || filepath.IsAbs(relPath) {
+	if err != nil || filepath.IsAbs(relPath) || isInternalPath(relPath) {
 		return
 	}
 
 	switch event.Operation {
 	case "create", "write":
 		e.handleFileChange(event.Path)
-	case "remove":
+	case "remove", "rename":
+		// A rename reports the old path; the new one is created
 		e.handleFileRemoval(event.Path)
 	}
 }
 
 func (e *Engine) handleFileChange(filePath string) {
-	// Skip directories
 	info, err := os.Stat(filePath)
-	if err != nil || info.IsDir() {
+	if err != nil {
 		return
 	}
 
@@ -101,6 +228,14 @@ func (e *Engine) handleFileChange(filePath string) {
 		return
 	}
 
+	if info.IsDir() {
+		e.handleDirectory(filePath, relPath)
+		return
+	}
+	if e.isReceived(relPath, filePath) {
+		return
+	}
+
 	// Check if file has changed
 	existingMetadata, err := e.metadataStore.GetFileMetadata(relPath)
 	if err == nil {
@@ -108,6 +243,8 @@ func (e *Engine) handleFileChange(filePath string) {
 		if info.ModTime().Equal(existingMetadata.ModTime) && info.Size() == existingMetadata.Size {
 			return // No change
 		}
+	} else if e.detectMove(filePath, relPath, info) {
+		return
 	}
 
 	// Process the file
@@ -116,70 +253,218 @@ func (e *Engine) handleFileChange(filePath string) {
 	}
 }
 
+// receivingTimeout is how long a write from a peer is remembered for the
+// watcher events it causes
+const receivingTimeout = time.Minute
+
+// receivedWrite is content a peer wrote to a path
+type receivedWrite struct {
+	hash [32]byte
+	at   time.Time
+}
+
+// setReceiving marks relPath as about to hold content from a peer with the
+// given hash, or to be removed if the hash is zero
+func (e *Engine) setReceiving(relPath string, hash [32]byte) {
+	e.receivingMu.Lock()
+	defer e.receivingMu.Unlock()
+	e.receiving[relPath] = receivedWrite{hash: hash, at: time.Now()}
+}
+
+// isReceived reports whether the file at filePath still holds what a peer
+// wrote there, so a watcher event for it is not a local change. Once the
+// file holds anything else the mark is dropped; a missing file keeps it, as
+// the event may be one from before the write finished.
+func (e *Engine) isReceived(relPath, filePath string) bool {
+	e.receivingMu.Lock()
+	write, ok := e.receiving[relPath]
+	e.receivingMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	var hash [32]byte
+	file, err := os.Open(filePath)
+	if err == nil {
+		h := sha256.New()
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return false
+		}
+		copy(hash[:], h.Sum(nil))
+	}
+	if hash == write.hash {
+		return true
+	}
+	if file == nil {
+		return false
+	}
+
+	e.receivingMu.Lock()
+	if e.receiving[relPath] == write {
+		delete(e.receiving, relPath)
+	}
+	e.receivingMu.Unlock()
+	return false
+}
+
+// expireReceiving forgets writes from peers whose events have long been
+// handled
+func (e *Engine) expireReceiving() {
+	e.receivingMu.Lock()
+	defer e.receivingMu.Unlock()
+	for relPath, write := range e.receiving {
+		if time.Since(write.at) > receivingTimeout {
+			delete(e.receiving, relPath)
+		}
+	}
+}
+
 func (e *Engine) handleFileRemoval(filePath string) {
 	relPath, err := filepath.Rel(e.syncPath, filePath)
+	if err != nil || e.isReceived(relPath, filePath) {
+		return
+	}
+
+	// The watcher reports a directory it follows being moved under its
+	// new path too
+	if _, err := os.Lstat(filePath); err == nil {
+		return
+	}
+
+	// Recorded once it is clear the file was not moved
+	e.holdRemoval(relPath)
+}
+
+// recordDeletion records that a synced file was deleted on this device.
+// The tombstone left in its place carries the deletion to other devices,
+// including ones that are offline now.
+func (e *Engine) recordDeletion(relPath string) error {
+	existing, err := e.metadataStore.GetFileMetadata(relPath)
+	if err != nil {
+		return nil // Not synced, or already deleted
+	}
+
+	return e.metadataStore.StoreTombstone(&types.Tombstone{
+		Path:          relPath,
+		VersionVector: existing.VersionVector.Increment(e.deviceID),
+		DeletedBy:     e.deviceID,
+		DeletedAt:     time.Now(),
+	})
+}
+
+// collectTombstones drops the tombstones every trusted device has
+// acknowledged. Until devices are paired, tombstones are kept.
+func (e *Engine) collectTombstones() {
+	devices, err := e.metadataStore.ListDevices()
 	if err != nil {
+		fmt.Printf("Error listing devices: %v\n", err)
 		return
 	}
 
-	// Remove from metadata store
-	if err := e.metadataStore.DeleteFileMetadata(relPath); err != nil {
-		fmt.Printf("Error removing file metadata %s: %v\n", relPath, err)
+	var known []string
+	for _, device := range devices {
+		if device.Trusted() && device.ID != e.deviceID {
+			known = append(known, device.ID)
+		}
+	}
+	if _, err := e.metadataStore.CollectTombstones(known); err != nil {
+		fmt.Printf("Error collecting tombstones: %v\n", err)
 	}
 }
 
 func (e *Engine) processFile(filePath, relPath string) error {
+	return e.indexFile(filePath, relPath, nil)
+}
+
+// indexFile chunks the file at filePath and records its metadata. If its
+// content changed, the new version descends from the previous one and from
+// merged, the version of another device it was merged with, if any.
+func (e *Engine) indexFile(filePath, relPath string, merged types.VersionVector) error {
 	// Get file info
 	info, err := os.Stat(filePath)
 	if err != nil {
 		return err
 	}
 
-	// Chunk the file
-	chunks, err := e.chunker.ChunkFile(filePath)
+	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	// Chunk and hash the file in a single streaming pass
+	stream := e.chunker.NewChunkStream(file)
+	var chunkHashes [][32]byte
 
-	// Encrypt chunks
-	for i := range chunks {
-		if err := e.encryptor.EncryptChunk(&chunks[i]); err != nil {
+	// Until the metadata below references them, the chunks are only
+	// kept by their pins
+	defer func() { e.chunkStore.Unpin(chunkHashes) }()
+	for {
+		chunk, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			return err
 		}
-	}
 
-	// Calculate file hash
-	fileData, err := os.ReadFile(filePath)
-	if err != nil {
-		return err
-	}
-	fileHash := sha256.Sum256(fileData)
+		e.chunkStore.Pin([][32]byte{chunk.Hash})
+		chunkHashes = append(chunkHashes, chunk.Hash)
+		if e.chunkStore.Has(chunk.Hash) {
+			continue // Already stored for this or another file
+		}
 
-	// Create chunk hashes
-	chunkHashes := make([][32]byte, len(chunks))
-	for i, chunk := range chunks {
-		chunkHashes[i] = chunk.Hash
+		// Encrypt chunk and keep it in the chunk store
+		if err := e.encryptor.EncryptChunk(chunk); err != nil {
+			return err
+		}
+		if err := e.chunkStore.Put(chunk); err != nil {
+			return err
+		}
 	}
+	fileHash := stream.Sum()
 
-	// Get version number - only increment if content actually changed
+	// Get version number - only increment if content actually changed. The
+	// version vector records that this device made the change.
 	version := int64(1)
-	if existingMetadata, err := e.metadataStore.GetFileMetadata(relPath); err == nil {
+	vector := types.VersionVector{}.Increment(e.deviceID)
+	modifiedBy := e.deviceID
+	existingMetadata, err := e.metadataStore.GetFileMetadata(relPath)
+	if err == nil {
 		// Only increment version if hash changed (content changed)
 		if existingMetadata.Hash != fileHash {
 			version = existingMetadata.Version + 1
+			vector = existingMetadata.VersionVector.Merge(merged).Increment(e.deviceID)
+
+			// Until a version shared with a peer is known, merge against
+			// the one this edit started from
+			if _, err := e.metadataStore.GetMergeBase(relPath); err == storage.ErrNoMergeBase {
+				if err := e.recordMergeBase(existingMetadata); err != nil {
+					return err
+				}
+			}
 		} else {
 			version = existingMetadata.Version // Keep same version if no content change
+			vector = existingMetadata.VersionVector.Merge(merged)
+			modifiedBy = existingMetadata.ModifiedBy
 		}
+	} else if tombstone, err := e.metadataStore.GetTombstone(relPath); err == nil {
+		// Created again after it was deleted, so it wins over the deletion
+		vector = tombstone.VersionVector.Merge(merged).Increment(e.deviceID)
 	}
 
 	// Create metadata
 	metadata := &types.FileMetadata{
-		Path:    relPath,
-		Hash:    fileHash,
-		Size:    info.Size(),
-		ModTime: info.ModTime(),
-		Chunks:  chunkHashes,
-		Version: version,
+		Path:          relPath,
+		Hash:          fileHash,
+		Size:          info.Size(),
+		ModTime:       info.ModTime(),
+		Chunks:        chunkHashes,
+		Version:       version,
+		VersionVector: vector,
+		ModifiedBy:    modifiedBy,
 	}
 
 	// Store metadata
@@ -187,31 +472,222 @@ func (e *Engine) processFile(filePath, relPath string) error {
 }
 
 func (e *Engine) ScanDirectory() error {
-	return filepath.Walk(e.syncPath, func(path string, info os.FileInfo, err error) error {
+	seen := make(map[string]bool)
+	err := filepath.Walk(e.syncPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if info.IsDir() {
-			return nil
-		}
-
 		relPath, err := filepath.Rel(e.syncPath, path)
 		if err != nil {
 			return err
 		}
 
+		if info.IsDir() {
+			if isInternalPath(relPath) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		seen[relPath] = true
 		return e.processFile(path, relPath)
 	})
+	if err != nil {
+		return err
+	}
+
+	// Files deleted while we were not watching
+	files, err := e.metadataStore.ListFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !seen[file.Path] {
+			if err := e.recordDeletion(file.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Versions the retention policy no longer keeps, e.g. of files
+	// deleted long ago, go with the garbage
+	if _, err := e.metadataStore.PruneVersions(); err != nil {
+		return err
+	}
+	e.collectGarbage()
+
+	_, err = e.trash.Expire()
+	return err
+}
+
+// GetChunk returns a stored (encrypted) chunk by hash
+func (e *Engine) GetChunk(hash [32]byte) (*types.Chunk, error) {
+	return e.chunkStore.Get(hash)
+}
+
+// rebuildFile writes a file version from the chunk store to fullPath,
+// replacing the file there once it is complete, and returns its hash
+func (e *Engine) rebuildFile(metadata *types.FileMetadata, fullPath string) ([32]byte, error) {
+	// Stream decrypted chunks into a temp file next to the destination
+	reassembler, err := storage.NewReassembler(fullPath)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("failed to create file: %v", err)
+	}
+
+	for _, hash := range metadata.Chunks {
+		chunk, err := e.GetChunk(hash)
+		if err != nil {
+			reassembler.Abort()
+			return [32]byte{}, fmt.Errorf("failed to load chunk: %v", err)
+		}
+		if err := e.encryptor.DecryptChunk(chunk); err != nil {
+			reassembler.Abort()
+			return [32]byte{}, fmt.Errorf("failed to decrypt chunk: %v", err)
+		}
+		if err := reassembler.WriteChunk(chunk); err != nil {
+			reassembler.Abort()
+			return [32]byte{}, fmt.Errorf("failed to write chunk: %v", err)
+		}
+	}
+
+	if metadata.Hash != ([32]byte{}) && reassembler.Sum() != metadata.Hash {
+		reassembler.Abort()
+		return [32]byte{}, fmt.Errorf("file hash mismatch for %s", metadata.Path)
+	}
+
+	// Keep the watcher from recording the write as a local edit
+	if relPath, err := filepath.Rel(e.syncPath, fullPath); err == nil {
+		e.setReceiving(relPath, reassembler.Sum())
+	}
+	if err := reassembler.Commit(); err != nil {
+		return [32]byte{}, fmt.Errorf("failed to write file: %v", err)
+	}
+	return reassembler.Sum(), nil
+}
+
+// readFile returns the content of a file version from the chunk store
+func (e *Engine) readFile(metadata *types.FileMetadata) ([]byte, error) {
+	var data bytes.Buffer
+	for _, hash := range metadata.Chunks {
+		chunk, err := e.GetChunk(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load chunk: %v", err)
+		}
+		if err := e.encryptor.DecryptChunk(chunk); err != nil {
+			return nil, fmt.Errorf("failed to decrypt chunk: %v", err)
+		}
+		data.Write(chunk.Data)
+	}
+
+	if sha256.Sum256(data.Bytes()) != metadata.Hash {
+		return nil, fmt.Errorf("file hash mismatch for %s", metadata.Path)
+	}
+	return data.Bytes(), nil
+}
+
+// ReencryptStaleChunks re-encrypts stored chunks sealed under an older key
+// epoch, or in an older format, with the current ones and returns how many
+// were rewritten. Old epochs and formats stay readable, so this only needs
+// to happen eventually.
+func (e *Engine) ReencryptStaleChunks() (int, error) {
+	epoch := e.encryptor.KeyRing().CurrentEpoch()
+	hashes, err := e.metadataStore.ListStaleChunks(epoch, storage.ChunkFormat)
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, hash := range hashes {
+		chunk, err := e.chunkStore.Get(hash)
+		if err == storage.ErrChunkNotFound {
+			continue // Collected since we listed it
+		}
+		if err != nil {
+			return rewritten, err
+		}
+
+		if err := e.encryptor.DecryptChunk(chunk); err != nil {
+			return rewritten, fmt.Errorf("failed to decrypt chunk %x: %v", hash[:8], err)
+		}
+		if err := e.encryptor.EncryptChunk(chunk); err != nil {
+			return rewritten, err
+		}
+		if err := e.chunkStore.Replace(chunk); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+
+	return rewritten, nil
+}
+
+// recordMergeBase records a version of a file that other devices hold too,
+// to merge concurrent edits of it against. Files too large to merge keep
+// none.
+func (e *Engine) recordMergeBase(metadata *types.FileMetadata) error {
+	if metadata.Size > maxMergeSize {
+		return e.metadataStore.DeleteMergeBase(metadata.Path)
+	}
+	if base, err := e.metadataStore.GetMergeBase(metadata.Path); err == nil && base.Hash == metadata.Hash {
+		return nil
+	}
+	return e.metadataStore.StoreMergeBase(metadata)
+}
+
+// collectGarbage drops chunks that no file references any more
+func (e *Engine) collectGarbage() {
+	if _, err := e.chunkStore.GarbageCollect(); err != nil {
+		fmt.Printf("Error collecting unused chunks: %v\n", err)
+	}
+}
+
+// isInternalPath reports whether relPath is inside the .fybrk directory or
+// is a temporary file written while reassembling a received file
+func isInternalPath(relPath string) bool {
+	first := strings.SplitN(filepath.ToSlash(relPath), "/", 2)[0]
+	if first == ".fybrk" {
+		return true
+	}
+	base := filepath.Base(relPath)
+	return strings.HasPrefix(base, ".fybrk-") && strings.HasSuffix(base, ".tmp")
 }
 
 func (e *Engine) GetSyncedFiles() ([]*types.FileMetadata, error) {
 	return e.metadataStore.ListFiles()
 }
 
+// ShutdownSummary describes what happened during a sync session
+type ShutdownSummary struct {
+	Peers         int   `json:"peers"`          // Peers connected when shutdown began
+	FilesSent     int64 `json:"files_sent"`     // Files sent to peers
+	FilesReceived int64 `json:"files_received"` // Files received from peers
+	Interrupted   int   `json:"interrupted"`    // Fetches still waiting when the drain timed out
+}
+
+// Shutdown stops syncing cleanly. It stops accepting peers, waits up to
+// timeout for transfers in progress to finish, then disconnects from peers
+// and stops watching for changes.
+func (e *Engine) Shutdown(timeout time.Duration) (*ShutdownSummary, error) {
+	summary := &ShutdownSummary{}
+	if e.multiDevice != nil {
+		summary.Peers = len(e.multiDevice.GetConnectedDevices())
+		e.multiDevice.network.StopAccepting()
+		summary.Interrupted = e.multiDevice.Drain(timeout)
+		summary.FilesSent = e.multiDevice.filesSent.Load()
+		summary.FilesReceived = e.multiDevice.filesReceived.Load()
+	}
+	return summary, e.Close()
+}
+
 func (e *Engine) Close() error {
 	if e.multiDevice != nil {
 		e.multiDevice.Stop()
 	}
+
+	// Let a change being recorded finish before the store is closed
+	close(e.stop)
+	<-e.stopped
+	e.expireRemovals(true)
 	return e.watcher.Close()
 }
@@ -0,0 +1,50 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReencryptStaleChunks(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "notes.txt"), []byte("rotate me"), 0644))
+
+	engine := newTestEngine(t, syncPath, key)
+	require.NoError(t, engine.ScanDirectory())
+
+	metadata, err := engine.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	require.Len(t, metadata.Chunks, 1)
+
+	epoch, err := engine.encryptor.KeyRing().Rotate()
+	require.NoError(t, err)
+
+	rewritten, err := engine.ReencryptStaleChunks()
+	require.NoError(t, err)
+	assert.Equal(t, 1, rewritten)
+
+	chunk, err := engine.GetChunk(metadata.Chunks[0])
+	require.NoError(t, err)
+	chunkEpoch, _ := storage.ChunkKeyEpoch(chunk)
+	assert.Equal(t, epoch, chunkEpoch)
+
+	require.NoError(t, engine.encryptor.DecryptChunk(chunk))
+	assert.Equal(t, []byte("rotate me"), chunk.Data)
+
+	// Nothing left to do once every chunk is on the current epoch
+	rewritten, err = engine.ReencryptStaleChunks()
+	require.NoError(t, err)
+	assert.Equal(t, 0, rewritten)
+
+	// Chunks stored before their format was recorded are rewritten too
+	require.NoError(t, engine.metadataStore.StoreChunkInfo(chunk.Hash, chunk.Size, true, epoch, 0))
+	rewritten, err = engine.ReencryptStaleChunks()
+	require.NoError(t, err)
+	assert.Equal(t, 1, rewritten)
+}
@@ -0,0 +1,34 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+// FileHistory returns the past versions kept of a file, newest first. The
+// history of a deleted file is kept for a while too.
+func (e *Engine) FileHistory(relPath string) ([]*types.FileVersion, error) {
+	return e.metadataStore.ListFileVersions(relPath)
+}
+
+// RestoreVersion brings back a past version of a file from the chunk
+// store. It becomes the current version, synced to other devices like any
+// local edit, and the version it replaces is kept in the history.
+func (e *Engine) RestoreVersion(relPath string, id int64) error {
+	version, err := e.metadataStore.GetFileVersion(id)
+	if err != nil {
+		return err
+	}
+	if version.Path != relPath {
+		return fmt.Errorf("version %d is not a version of %s", id, relPath)
+	}
+
+	// rebuildFile keeps the watcher off the write; it is indexed below
+	fullPath := filepath.Join(e.syncPath, relPath)
+	if _, err := e.rebuildFile(&version.FileMetadata, fullPath); err != nil {
+		return err
+	}
+	return e.processFile(fullPath, relPath)
+}
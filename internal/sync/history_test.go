@@ -0,0 +1,60 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreVersion(t *testing.T) {
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "a.txt"), []byte("first draft"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "b.txt"), []byte("second draft"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	require.NoError(t, engine.ScanDirectory())
+
+	// a.txt moves on to b.txt's content, as if received from a peer
+	original, err := engine.metadataStore.GetFileMetadata("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "test-device", original.ModifiedBy)
+	edited, err := engine.metadataStore.GetFileMetadata("b.txt")
+	require.NoError(t, err)
+	edited.Path = "a.txt"
+	edited.ModifiedBy = "phone"
+	edited.VersionVector = original.VersionVector.Increment("phone")
+	require.NoError(t, engine.metadataStore.StoreFileMetadata(edited))
+
+	history, err := engine.FileHistory("a.txt")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, original.Hash, history[0].Hash)
+
+	require.NoError(t, engine.RestoreVersion("a.txt", history[0].ID))
+
+	data, err := os.ReadFile(filepath.Join(syncPath, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "first draft", string(data))
+
+	// The restore is a local edit, and what it replaced is kept
+	restored, err := engine.metadataStore.GetFileMetadata("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, original.Hash, restored.Hash)
+	assert.Equal(t, "test-device", restored.ModifiedBy)
+	assert.Equal(t, uint64(2), restored.VersionVector["test-device"])
+	assert.Equal(t, uint64(1), restored.VersionVector["phone"])
+
+	history, err = engine.FileHistory("a.txt")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, edited.Hash, history[0].Hash)
+	assert.Equal(t, "phone", history[0].ModifiedBy)
+
+	// Versions belong to one file
+	assert.Error(t, engine.RestoreVersion("b.txt", history[0].ID))
+	assert.ErrorIs(t, engine.RestoreVersion("a.txt", 999), storage.ErrVersionNotFound)
+}
@@ -0,0 +1,149 @@
+package sync
+
+import (
+	"log"
+	"maps"
+	"slices"
+
+	"github.com/Fybrk/fybrk/internal/network"
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+// keyRingRegistry is the device registry as the network sees it: devices
+// excluded from a key rotation count as revoked, even if the registry never
+// heard of the revocation. A folder nobody has paired with yet, such as one
+// shared by copying its key, lets in any device holding the current folder
+// secret; the network refuses earlier secrets from devices it does not know.
+type keyRingRegistry struct {
+	store   *storage.MetadataStore
+	keyRing *storage.KeyRing
+}
+
+func (r *keyRingRegistry) GetDevice(id string) (*types.Device, error) {
+	device, err := r.store.GetDevice(id)
+	if err == storage.ErrDeviceNotFound && !r.keyRing.IsRevoked(id) {
+		if paired, err := r.store.HasDevices(); err == nil && !paired {
+			return nil, network.ErrNoDevicesPaired
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.keyRing.IsRevoked(id) {
+		device.Revoked = true
+	}
+	return device, nil
+}
+
+// distributeKey switches the network to the current key epoch and hands its
+// key to the connected devices that were not revoked
+func (mds *MultiDeviceSync) distributeKey() error {
+	if err := mds.applyKeyRing(); err != nil {
+		return err
+	}
+
+	for _, deviceID := range mds.GetConnectedDevices() {
+		mds.sendKeyUpdate(deviceID)
+	}
+	return nil
+}
+
+// applyKeyRing makes the network follow the key ring: it accepts the
+// current epoch's secret, and earlier ones from devices that missed the
+// rotation, and drops connections made before a device was revoked
+func (mds *MultiDeviceSync) applyKeyRing() error {
+	if mds.network == nil {
+		return nil // Messages are not going over a network
+	}
+
+	keyRing := mds.encryptor.KeyRing()
+	secret, err := keyRing.TransportSecret()
+	if err != nil {
+		return err
+	}
+	earlier, err := keyRing.EarlierTransportSecrets()
+	if err != nil {
+		return err
+	}
+	if err := mds.network.SetSecrets(secret, earlier); err != nil {
+		return err
+	}
+
+	for _, deviceID := range mds.GetConnectedDevices() {
+		if keyRing.IsRevoked(deviceID) {
+			mds.DisconnectDevice(deviceID)
+		}
+	}
+	return nil
+}
+
+// sendKeyUpdate hands the folder keys to a device, one epoch at a time in
+// order, so a device that missed several rotations catches up. Keys only
+// go to devices that proved who they are to a registry and were not
+// revoked.
+func (mds *MultiDeviceSync) sendKeyUpdate(deviceID string) {
+	keyRing := mds.encryptor.KeyRing()
+	if mds.engine.identity == nil || keyRing.IsRevoked(deviceID) {
+		return
+	}
+
+	keys := keyRing.EpochKeys()
+	revoked := keyRing.RevokedDevices()
+	for _, epoch := range slices.Sorted(maps.Keys(keys)) {
+		update := &KeyUpdate{
+			Epoch:          epoch,
+			Key:            keys[epoch],
+			RevokedDevices: revoked,
+		}
+		if err := mds.sendSyncMessage(deviceID, SyncMessage{Type: "key_update", Key: update}); err != nil {
+			log.Printf("Error sending key to %s: %v", deviceID, err)
+			return
+		}
+	}
+}
+
+// handleKeyUpdate adopts the folder key of the epoch after ours, which a
+// paired device rotated to, and adds the devices it revoked to the ones
+// revoked already. Like sendKeyUpdate, it needs the sender to have proven
+// who it is.
+func (mds *MultiDeviceSync) handleKeyUpdate(deviceID string, update *KeyUpdate) {
+	if update == nil {
+		return
+	}
+
+	keyRing := mds.encryptor.KeyRing()
+	if mds.engine.identity == nil || mds.engine.keyDir == "" || !mds.trustedDevice(deviceID) {
+		log.Printf("Ignoring key update from %s", deviceID)
+		return
+	}
+	if update.Epoch != keyRing.CurrentEpoch()+1 {
+		return // Known already, or the epochs before it come first
+	}
+
+	added, err := keyRing.AddEpoch(update.Epoch, update.Key, update.RevokedDevices)
+	if err != nil {
+		log.Printf("Error adopting key from %s: %v", deviceID, err)
+		return
+	}
+	if !added {
+		return
+	}
+
+	if err := keyRing.Save(mds.engine.keyDir); err != nil {
+		log.Printf("Error saving key ring: %v", err)
+		return
+	}
+	if err := mds.applyKeyRing(); err != nil {
+		log.Printf("Error updating folder secret: %v", err)
+		return
+	}
+	log.Printf("Received folder key for epoch %d from %s", update.Epoch, deviceID)
+}
+
+// trustedDevice reports whether a device is paired, trusted and not revoked
+func (mds *MultiDeviceSync) trustedDevice(deviceID string) bool {
+	registry := &keyRingRegistry{store: mds.engine.metadataStore, keyRing: mds.encryptor.KeyRing()}
+	device, err := registry.GetDevice(deviceID)
+	return err == nil && !device.Revoked && device.Trusted()
+}
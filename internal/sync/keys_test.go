@@ -0,0 +1,129 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/network"
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyUpdate(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+
+	newDevice := func() *MultiDeviceSync {
+		engine := newTestEngine(t, t.TempDir(), key)
+		id, err := identity.Generate()
+		require.NoError(t, err)
+		engine.SetIdentity(id)
+		engine.SetKeyDir(t.TempDir())
+		return &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	}
+	pair := func(mds *MultiDeviceSync, deviceIDs ...string) {
+		for _, deviceID := range deviceIDs {
+			require.NoError(t, mds.engine.metadataStore.StoreDevice(&types.Device{ID: deviceID, TrustLevel: 2, LastSeen: time.Now()}))
+		}
+	}
+	laptop, phone, tablet := newDevice(), newDevice(), newDevice()
+	pair(phone, "laptop", "tablet")
+	connectTestPeers(t, laptop, "laptop", phone, "phone")
+
+	// The phone already knows of a revoked device the laptop does not
+	phoneKeys := phone.encryptor.KeyRing()
+	_, err := phoneKeys.AddEpoch(0, key, []string{"watch"})
+	require.NoError(t, err)
+
+	// The laptop rotates the key twice, revoking the tablet, and the phone
+	// is handed both new epochs in order
+	_, err = laptop.encryptor.KeyRing().Rotate()
+	require.NoError(t, err)
+	epoch, err := laptop.encryptor.KeyRing().Rotate("tablet")
+	require.NoError(t, err)
+	laptop.sendKeyUpdate("phone")
+
+	assert.Equal(t, epoch, phoneKeys.CurrentEpoch())
+	assert.Equal(t, laptop.encryptor.KeyRing().MasterKey(), phoneKeys.MasterKey())
+	assert.True(t, phoneKeys.IsRevoked("tablet"))
+	assert.True(t, phoneKeys.IsRevoked("watch"))
+
+	// The phone keeps it, and reads what the laptop writes under it
+	saved, err := storage.LoadKeyRing(phone.engine.keyDir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, epoch, saved.CurrentEpoch())
+
+	data := []byte("after the rotation")
+	chunk := &types.Chunk{Hash: sha256.Sum256(data), Data: append([]byte(nil), data...)}
+	require.NoError(t, laptop.encryptor.EncryptChunk(chunk))
+	require.NoError(t, phone.encryptor.DecryptChunk(chunk))
+	assert.Equal(t, data, chunk.Data)
+
+	// The revoked tablet is never handed the key, nor can it hand out one
+	connectTestPeers(t, laptop, "laptop", tablet, "tablet")
+	laptop.sendKeyUpdate("tablet")
+	assert.Equal(t, uint32(0), tablet.encryptor.KeyRing().CurrentEpoch())
+
+	connectTestPeers(t, phone, "phone", tablet, "tablet")
+	for range 3 {
+		_, err = tablet.encryptor.KeyRing().Rotate()
+		require.NoError(t, err)
+	}
+	tablet.sendKeyUpdate("phone")
+	assert.Equal(t, epoch, phoneKeys.CurrentEpoch())
+	assert.Equal(t, laptop.encryptor.KeyRing().MasterKey(), phoneKeys.MasterKey())
+
+	// Nor are keys taken from a device that was never paired
+	stranger := newDevice()
+	connectTestPeers(t, phone, "phone", stranger, "stranger")
+	for range 3 {
+		_, err = stranger.encryptor.KeyRing().Rotate()
+		require.NoError(t, err)
+	}
+	stranger.sendKeyUpdate("phone")
+	assert.Equal(t, epoch, phoneKeys.CurrentEpoch())
+
+	// Or that skip an epoch
+	connectTestPeers(t, laptop, "laptop", phone, "phone")
+	laptopKeys := laptop.encryptor.KeyRing()
+	_, err = laptopKeys.Rotate()
+	require.NoError(t, err)
+	skipped, err := laptopKeys.Rotate()
+	require.NoError(t, err)
+	phone.handleKeyUpdate("laptop", &KeyUpdate{Epoch: skipped, Key: laptopKeys.MasterKey()})
+	assert.Equal(t, epoch, phoneKeys.CurrentEpoch())
+
+	// Without proven identities no keys change hands
+	open := &MultiDeviceSync{engine: newTestEngine(t, t.TempDir(), key), pending: make(map[string]*pendingFile)}
+	open.encryptor = open.engine.encryptor
+	connectTestPeers(t, laptop, "laptop", open, "open")
+	laptop.sendKeyUpdate("open")
+	assert.Equal(t, uint32(0), open.encryptor.KeyRing().CurrentEpoch())
+}
+
+func TestKeyRingRegistry(t *testing.T) {
+	engine := newTestEngine(t, t.TempDir(), []byte("12345678901234567890123456789012"))
+	keyRing := engine.encryptor.KeyRing()
+	registry := &keyRingRegistry{store: engine.metadataStore, keyRing: keyRing}
+
+	// Until a device is paired, any device holding the folder secret is let in
+	_, err := registry.GetDevice("laptop")
+	assert.ErrorIs(t, err, network.ErrNoDevicesPaired)
+
+	// Except one excluded from a key rotation
+	_, err = keyRing.Rotate("tablet")
+	require.NoError(t, err)
+	_, err = registry.GetDevice("tablet")
+	assert.ErrorIs(t, err, storage.ErrDeviceNotFound)
+
+	// Once one is, unknown devices are refused
+	require.NoError(t, engine.metadataStore.StoreDevice(&types.Device{ID: "phone", Name: "Phone", TrustLevel: 2, LastSeen: time.Now()}))
+	_, err = registry.GetDevice("laptop")
+	assert.ErrorIs(t, err, storage.ErrDeviceNotFound)
+	phone, err := registry.GetDevice("phone")
+	require.NoError(t, err)
+	assert.True(t, phone.Trusted())
+}
@@ -0,0 +1,213 @@
+package sync
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on what is merged line by line rather than kept as a conflict copy
+const (
+	maxMergeSize  = 4 << 20 // Bytes in any of the three versions
+	maxMergeEdits = 2000    // Lines changed between the base and either side
+)
+
+// textMerge is a three-way merge of two versions of a text file edited
+// independently from a common ancestor, the base
+type textMerge struct {
+	hunks []mergeHunk
+}
+
+// mergeHunk is a run of merged lines. Lines only one side changed, or both
+// changed the same way, are in both ours and theirs; a conflicting hunk
+// holds each side's lines.
+type mergeHunk struct {
+	ours     []string
+	theirs   []string
+	conflict bool
+}
+
+// isText reports whether data looks like plain text that can be merged
+func isText(data []byte) bool {
+	return bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
+
+// diff3 merges ours and theirs line by line against base. It returns false
+// if either side differs from the base in too many lines to merge.
+func diff3(base, ours, theirs []byte) (*textMerge, bool) {
+	baseLines, ourLines, theirLines := splitLines(base), splitLines(ours), splitLines(theirs)
+
+	ourMatch, ok := matchLines(baseLines, ourLines)
+	if !ok {
+		return nil, false
+	}
+	theirMatch, ok := matchLines(baseLines, theirLines)
+	if !ok {
+		return nil, false
+	}
+
+	merge := &textMerge{}
+	b, o, t := 0, 0, 0
+	for b < len(baseLines) || o < len(ourLines) || t < len(theirLines) {
+		// Find the next base line both sides kept
+		next := b
+		for next < len(baseLines) && (ourMatch[next] < 0 || theirMatch[next] < 0) {
+			next++
+		}
+		ourEnd, theirEnd := len(ourLines), len(theirLines)
+		if next < len(baseLines) {
+			ourEnd, theirEnd = ourMatch[next], theirMatch[next]
+		}
+
+		if next == b && ourEnd == o && theirEnd == t {
+			// Unchanged on both sides
+			merge.add(baseLines[b:b+1], baseLines[b:b+1], false)
+			b, o, t = b+1, o+1, t+1
+			continue
+		}
+
+		baseHunk, ourHunk, theirHunk := baseLines[b:next], ourLines[o:ourEnd], theirLines[t:theirEnd]
+		switch {
+		case equalLines(ourHunk, baseHunk):
+			merge.add(theirHunk, theirHunk, false)
+		case equalLines(theirHunk, baseHunk), equalLines(ourHunk, theirHunk):
+			merge.add(ourHunk, ourHunk, false)
+		default:
+			merge.add(ourHunk, theirHunk, true)
+		}
+		b, o, t = next, ourEnd, theirEnd
+	}
+
+	return merge, true
+}
+
+func (m *textMerge) add(ours, theirs []string, conflict bool) {
+	if !conflict && len(m.hunks) > 0 && !m.hunks[len(m.hunks)-1].conflict {
+		last := &m.hunks[len(m.hunks)-1]
+		last.ours = append(last.ours, ours...)
+		last.theirs = append(last.theirs, theirs...)
+		return
+	}
+	m.hunks = append(m.hunks, mergeHunk{ours: ours, theirs: theirs, conflict: conflict})
+}
+
+// Clean reports whether the merge has no conflicting hunks
+func (m *textMerge) Clean() bool {
+	for _, hunk := range m.hunks {
+		if hunk.conflict {
+			return false
+		}
+	}
+	return true
+}
+
+// Result returns the merged text, taking conflicting hunks from theirs or
+// from ours
+func (m *textMerge) Result(preferTheirs bool) []byte {
+	var out strings.Builder
+	for _, hunk := range m.hunks {
+		lines := hunk.ours
+		if preferTheirs {
+			lines = hunk.theirs
+		}
+		for _, line := range lines {
+			out.WriteString(line)
+		}
+	}
+	return []byte(out.String())
+}
+
+// splitLines splits text into lines, each keeping its line ending
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchLines finds a shortest edit script from a to b (Myers' algorithm)
+// and returns, for each line of a, the index of the line of b it is kept
+// as, or -1 if it was removed. It returns false if more than maxMergeEdits
+// lines were added or removed.
+func matchLines(a, b []string) ([]int, bool) {
+	n, m := len(a), len(b)
+	match := make([]int, n)
+	for i := range match {
+		match[i] = -1
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k = x - y. trace
+	// keeps v for diagonals -d..d as it was before each step d.
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		if d > maxMergeEdits {
+			return nil, false
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1] // Insertion in b
+			} else {
+				x = v[offset+k-1] + 1 // Removal from a
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				backtrack(trace, d, n, m, match)
+				return match, true
+			}
+		}
+	}
+	return match, true
+}
+
+// backtrack walks the edit script found after d steps back from (n, m),
+// recording the lines kept
+func backtrack(trace [][]int, d, x, y int, match []int) {
+	for ; d > 0; d-- {
+		prev := trace[d] // Diagonals -d..d before step d
+		k := x - y
+		var prevK int
+		if k == -d || k != d && prev[d+k-1] < prev[d+k+1] {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[d+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			match[x] = y
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		match[x] = y
+	}
+}
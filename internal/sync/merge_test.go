@@ -0,0 +1,262 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/protocol"
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lines(s ...string) []byte {
+	return []byte(strings.Join(s, "\n") + "\n")
+}
+
+func TestDiff3(t *testing.T) {
+	base := lines("one", "two", "three", "four", "five")
+
+	tests := []struct {
+		name         string
+		ours, theirs []byte
+		clean        bool
+		preferOurs   []byte
+		preferTheirs []byte
+	}{
+		{
+			name:       "separate edits",
+			ours:       lines("one", "TWO", "three", "four", "five"),
+			theirs:     lines("one", "two", "three", "four", "FIVE", "six"),
+			clean:      true,
+			preferOurs: lines("one", "TWO", "three", "four", "FIVE", "six"),
+		},
+		{
+			name:       "one side only",
+			ours:       base,
+			theirs:     lines("zero", "one", "three", "four", "five"),
+			clean:      true,
+			preferOurs: lines("zero", "one", "three", "four", "five"),
+		},
+		{
+			name:       "same edit on both sides",
+			ours:       lines("one", "2", "three", "four", "five"),
+			theirs:     lines("one", "2", "three", "four", "five", "six"),
+			clean:      true,
+			preferOurs: lines("one", "2", "three", "four", "five", "six"),
+		},
+		{
+			name:         "same line changed",
+			ours:         lines("one", "two", "THREE", "four", "five"),
+			theirs:       lines("one", "two", "3", "four", "FIVE"),
+			clean:        false,
+			preferOurs:   lines("one", "two", "THREE", "four", "FIVE"),
+			preferTheirs: lines("one", "two", "3", "four", "FIVE"),
+		},
+		{
+			name:       "missing final newline",
+			ours:       []byte("one\ntwo\nthree\nfour\nfive"),
+			theirs:     lines("ONE", "two", "three", "four", "five"),
+			clean:      true,
+			preferOurs: []byte("ONE\ntwo\nthree\nfour\nfive"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merge, ok := diff3(base, tt.ours, tt.theirs)
+			require.True(t, ok)
+			assert.Equal(t, tt.clean, merge.Clean())
+			assert.Equal(t, string(tt.preferOurs), string(merge.Result(false)))
+			if tt.clean {
+				assert.Equal(t, string(tt.preferOurs), string(merge.Result(true)))
+			} else {
+				assert.Equal(t, string(tt.preferTheirs), string(merge.Result(true)))
+			}
+
+			// Merging the other way round gives the same result
+			mirrored, ok := diff3(base, tt.theirs, tt.ours)
+			require.True(t, ok)
+			assert.Equal(t, string(merge.Result(true)), string(mirrored.Result(false)))
+		})
+	}
+
+	// Too many changes to merge
+	var rewritten []string
+	for i := 0; i <= maxMergeEdits; i++ {
+		rewritten = append(rewritten, "line")
+	}
+	_, ok := diff3(base, lines(rewritten...), base)
+	assert.False(t, ok)
+
+	assert.True(t, isText(base))
+	assert.False(t, isText([]byte{0x89, 'P', 'N', 'G', 0}))
+	assert.False(t, isText([]byte{0xff, 0xfe}))
+}
+
+// concurrentTextEdit sets up an engine whose notes.txt was edited from base
+// to ours while "phone" edited it to theirs, and hands it phone's file
+// list. Both base and theirs are stored locally under other names, so no
+// network is needed.
+func concurrentTextEdit(t *testing.T, base, ours, theirs []byte, remoteModTime time.Duration, onConflict ConflictHandler) *Engine {
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "notes.txt"), ours, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "base.txt"), base, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "theirs.txt"), theirs, 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	require.NoError(t, engine.ScanDirectory())
+	if onConflict != nil {
+		engine.OnConflict(onConflict)
+	}
+
+	ancestor, err := engine.metadataStore.GetFileMetadata("base.txt")
+	require.NoError(t, err)
+	ancestor.Path = "notes.txt"
+	require.NoError(t, engine.metadataStore.StoreMergeBase(ancestor))
+
+	local, err := engine.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	remote, err := engine.metadataStore.GetFileMetadata("theirs.txt")
+	require.NoError(t, err)
+	remote.Path = "notes.txt"
+	remote.ModTime = local.ModTime.Add(remoteModTime)
+	remote.VersionVector = types.VersionVector{"phone": 1}
+
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	mds.handleFileList("phone", []*types.FileMetadata{remote}, nil)
+	return engine
+}
+
+func TestMergeConcurrentEdit(t *testing.T) {
+	base := lines("# Notes", "", "milk", "eggs")
+	ours := lines("# Notes", "", "oat milk", "eggs")
+	theirs := lines("# Notes", "", "milk", "eggs", "bread")
+	engine := concurrentTextEdit(t, base, ours, theirs, time.Hour, func(conflict *types.Conflict) {
+		t.Errorf("unexpected conflict on %s", conflict.Path)
+	})
+
+	data, err := os.ReadFile(filepath.Join(engine.syncPath, "notes.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, string(lines("# Notes", "", "oat milk", "eggs", "bread")), string(data))
+
+	// The merge descends from both versions and is what we merge against
+	// next, with the peer's version as the common ancestor
+	merged, err := engine.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.VersionVector{"test-device": 2, "phone": 1}, merged.VersionVector)
+	ancestor, err := engine.metadataStore.GetMergeBase("notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.VersionVector{"phone": 1}, ancestor.VersionVector)
+
+	conflicts, err := engine.ListConflicts(true)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+}
+
+func TestMergeConflictingLines(t *testing.T) {
+	base := lines("title: draft", "body", "tags: []")
+	ours := lines("title: final", "body", "tags: []")
+	theirs := lines("title: published", "body", "tags: [go]")
+
+	t.Run("peer wins the lines", func(t *testing.T) {
+		reported := make(chan *types.Conflict, 1)
+		engine := concurrentTextEdit(t, base, ours, theirs, time.Hour, func(conflict *types.Conflict) { reported <- conflict })
+
+		var conflict *types.Conflict
+		select {
+		case conflict = <-reported:
+		default:
+			t.Fatal("conflict was not reported")
+		}
+		assert.Equal(t, protocol.ResolutionMerge, conflict.Resolution)
+		assert.False(t, conflict.Resolved())
+
+		data, err := os.ReadFile(filepath.Join(engine.syncPath, "notes.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, string(theirs), string(data))
+
+		// The copy holds the merge with our side of the conflicting lines
+		data, err = os.ReadFile(filepath.Join(engine.syncPath, conflict.CopyPath))
+		require.NoError(t, err)
+		assert.Equal(t, string(lines("title: final", "body", "tags: [go]")), string(data))
+	})
+
+	t.Run("we win the lines", func(t *testing.T) {
+		reported := make(chan *types.Conflict, 1)
+		engine := concurrentTextEdit(t, base, ours, theirs, -time.Hour, func(conflict *types.Conflict) { reported <- conflict })
+
+		var conflict *types.Conflict
+		select {
+		case conflict = <-reported:
+		default:
+			t.Fatal("conflict was not reported")
+		}
+		assert.Equal(t, "phone", conflict.DeviceID)
+		assert.Regexp(t, `^notes\.sync-conflict-\d{8}-\d{6}-phone\.txt$`, conflict.CopyPath)
+
+		data, err := os.ReadFile(filepath.Join(engine.syncPath, "notes.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, string(lines("title: final", "body", "tags: [go]")), string(data))
+
+		// The copy holds the merge with the peer's side of the lines
+		data, err = os.ReadFile(filepath.Join(engine.syncPath, conflict.CopyPath))
+		require.NoError(t, err)
+		assert.Equal(t, string(theirs), string(data))
+	})
+}
+
+func TestMergeConflictingLinesOnBothDevices(t *testing.T) {
+	base := lines("title: draft", "body", "tags: []")
+	laptopEdit := lines("title: final", "body", "tags: []")
+	phoneEdit := lines("title: published", "body", "tags: [go]")
+
+	tests := []struct {
+		name  string
+		first func(laptop, phone *MultiDeviceSync)
+	}{
+		// The loser takes the winner's merge without merging itself
+		{"winner merges first", func(laptop, phone *MultiDeviceSync) {
+			sendFileList(t, phone, laptop)
+			sendFileList(t, laptop, phone)
+		}},
+		{"loser merges first", func(laptop, phone *MultiDeviceSync) {
+			sendFileList(t, laptop, phone)
+			sendFileList(t, phone, laptop)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			laptop, phone := editedOnTwoDevices(t, ResolveMerge, "notes.txt", string(base), string(laptopEdit), string(phoneEdit))
+			tt.first(laptop, phone)
+
+			for _, mds := range []*MultiDeviceSync{laptop, phone} {
+				data, err := os.ReadFile(filepath.Join(mds.engine.syncPath, "notes.txt"))
+				require.NoError(t, err)
+				assert.Equal(t, string(lines("title: final", "body", "tags: [go]")), string(data), mds.deviceID)
+
+				copies, err := filepath.Glob(filepath.Join(mds.engine.syncPath, "notes.sync-conflict-*"))
+				require.NoError(t, err)
+				require.Len(t, copies, 1, mds.deviceID)
+				assert.Regexp(t, `-phone\.txt$`, copies[0])
+				data, err = os.ReadFile(copies[0])
+				require.NoError(t, err)
+				assert.Equal(t, string(phoneEdit), string(data), mds.deviceID)
+			}
+		})
+	}
+}
+
+func TestMergeFallsBackToKeepBoth(t *testing.T) {
+	binary := []byte{0x89, 'P', 'N', 'G', 0, 1, 2}
+	reported := make(chan *types.Conflict, 1)
+	engine := concurrentTextEdit(t, binary, append(binary, 3), append(binary, 4), time.Hour, func(conflict *types.Conflict) { reported <- conflict })
+
+	conflict := <-reported
+	assert.Equal(t, protocol.ResolutionManual, conflict.Resolution)
+	data, err := os.ReadFile(filepath.Join(engine.syncPath, conflict.CopyPath))
+	require.NoError(t, err)
+	assert.Equal(t, append(binary, 3), data)
+}
@@ -0,0 +1,273 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+// moveWindow is how long a removed file waits to be paired with a file that
+// appears elsewhere with the same content. The pair is recorded as a move,
+// which peers apply by renaming their copy; unpaired removals are recorded
+// as deletions.
+const moveWindow = 2 * time.Second
+
+// FileMove is a file moved on a device: the tombstone left at its old path,
+// naming the new one, and the file at its new path
+type FileMove struct {
+	Tombstone *types.Tombstone    `json:"tombstone"`
+	File      *types.FileMetadata `json:"file"`
+}
+
+// move is a path pair detected by the watcher
+type move struct {
+	from, to string
+}
+
+// holdRemoval sets a removed file, or a removed directory of synced files,
+// aside for the move window
+func (e *Engine) holdRemoval(relPath string) {
+	if _, err := e.metadataStore.GetFileMetadata(relPath); err != nil {
+		files, err := e.metadataStore.ListFilesUnder(relPath)
+		if err != nil || len(files) == 0 {
+			return // Nothing synced there
+		}
+	}
+	e.removed[relPath] = time.Now()
+}
+
+// expireRemovals records the removals held longer than the move window, or
+// all of them, as deletions
+func (e *Engine) expireRemovals(all bool) {
+	expired := false
+	for relPath, removedAt := range e.removed {
+		if !all && time.Since(removedAt) < moveWindow {
+			continue
+		}
+		delete(e.removed, relPath)
+		expired = true
+
+		paths := []string{relPath}
+		if files, err := e.metadataStore.ListFilesUnder(relPath); err == nil {
+			for _, file := range files {
+				paths = append(paths, file.Path)
+			}
+		}
+		for _, path := range paths {
+			// Back since, e.g. written by a peer
+			if _, err := os.Lstat(filepath.Join(e.syncPath, path)); err == nil {
+				continue
+			}
+			if err := e.recordDeletion(path); err != nil {
+				fmt.Printf("Error removing file metadata %s: %v\n", path, err)
+			}
+		}
+	}
+
+	if expired {
+		e.collectGarbage()
+	}
+}
+
+// detectMove pairs a new file with a removed one of the same size,
+// modification time and content
+func (e *Engine) detectMove(filePath, relPath string, info os.FileInfo) bool {
+	var hash *[32]byte
+	for from := range e.removed {
+		old, err := e.metadataStore.GetFileMetadata(from)
+		if err != nil || old.Size != info.Size() || !old.ModTime.Equal(info.ModTime()) {
+			continue
+		}
+		if hash == nil {
+			sum, err := hashFile(filePath)
+			if err != nil {
+				return false
+			}
+			hash = &sum
+		}
+		if *hash != old.Hash {
+			continue
+		}
+
+		delete(e.removed, from)
+		e.recordMoves([]move{{from: from, to: relPath}})
+		return true
+	}
+	return false
+}
+
+// handleDirectory indexes a directory that appeared in the sync folder
+func (e *Engine) handleDirectory(dirPath, relPath string) {
+	present := make(map[string]os.FileInfo)
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			present[strings.TrimPrefix(path, dirPath)] = info
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error scanning directory %s: %v\n", dirPath, err)
+		return
+	}
+	if e.detectDirectoryMove(relPath, present) {
+		return
+	}
+
+	// Files created with the directory, or moved in from outside the
+	// folder, come without events of their own
+	for suffix := range present {
+		e.handleFileChange(dirPath + suffix)
+	}
+}
+
+// detectDirectoryMove pairs a new directory with a removed one holding the
+// same files, matched by size and modification time. A renamed directory
+// keeps its files untouched, so their content is not read again.
+func (e *Engine) detectDirectoryMove(relPath string, present map[string]os.FileInfo) bool {
+	for from := range e.removed {
+		files, err := e.metadataStore.ListFilesUnder(from)
+		if err != nil || len(files) == 0 || len(files) != len(present) {
+			continue
+		}
+
+		moves := make([]move, 0, len(files))
+		for _, file := range files {
+			suffix := strings.TrimPrefix(file.Path, from)
+			info, ok := present[suffix]
+			if !ok || info.Size() != file.Size || !info.ModTime().Equal(file.ModTime) {
+				break
+			}
+			moves = append(moves, move{from: file.Path, to: relPath + suffix})
+		}
+		if len(moves) != len(files) {
+			continue
+		}
+
+		delete(e.removed, from)
+		e.recordMoves(moves)
+		return true
+	}
+	return false
+}
+
+// recordMoves records files moved on this device and tells connected peers,
+// so they rename their copies instead of fetching them again
+func (e *Engine) recordMoves(moves []move) {
+	var recorded []*FileMove
+	for _, m := range moves {
+		fileMove, err := e.recordMove(m.from, m.to)
+		if err != nil {
+			fmt.Printf("Error recording move of %s: %v\n", m.from, err)
+			continue
+		}
+		recorded = append(recorded, fileMove)
+	}
+
+	if len(recorded) > 0 && e.multiDevice != nil {
+		e.multiDevice.broadcastMoves(recorded)
+	}
+}
+
+// recordMove records that a synced file was moved on this device. The move
+// is a new version of the file, which descends from a deletion at its new
+// path if there was one, and the tombstone at its old path names where it
+// went.
+func (e *Engine) recordMove(from, to string) (*FileMove, error) {
+	old, err := e.metadataStore.GetFileMetadata(from)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filepath.Join(e.syncPath, to))
+	if err != nil {
+		return nil, err
+	}
+
+	vector := old.VersionVector
+	if tombstone, err := e.metadataStore.GetTombstone(to); err == nil {
+		vector = vector.Merge(tombstone.VersionVector)
+	}
+	vector = vector.Increment(e.deviceID)
+
+	moved := *old
+	moved.Path = to
+	moved.ModTime = info.ModTime()
+	moved.VersionVector = vector
+	moved.ModifiedBy = e.deviceID
+	tombstone := &types.Tombstone{
+		Path:          from,
+		VersionVector: vector,
+		DeletedBy:     e.deviceID,
+		DeletedAt:     time.Now(),
+		MovedTo:       to,
+	}
+
+	if err := e.metadataStore.MoveFile(tombstone, &moved); err != nil {
+		return nil, err
+	}
+	return &FileMove{Tombstone: tombstone, File: &moved}, nil
+}
+
+// applyMove renames a file as a peer did. The caller has checked that our
+// copy is the version that was moved and that nothing is in its way.
+func (e *Engine) applyMove(fileMove *FileMove) error {
+	from, to := fileMove.Tombstone.Path, fileMove.File.Path
+	fromPath := filepath.Join(e.syncPath, from)
+	toPath := filepath.Join(e.syncPath, to)
+
+	// The watcher leaves the rename alone; it is recorded below
+	e.setReceiving(from, [32]byte{})
+	e.setReceiving(to, fileMove.File.Hash)
+
+	if err := os.MkdirAll(filepath.Dir(toPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return err
+	}
+	info, err := os.Stat(toPath)
+	if err != nil {
+		return err
+	}
+
+	moved := *fileMove.File
+	moved.ModTime = info.ModTime()
+	if err := e.metadataStore.MoveFile(fileMove.Tombstone, &moved); err != nil {
+		return err
+	}
+
+	// Directories the peer moved away leave nothing behind here either
+	for dir := filepath.Dir(fromPath); dir != e.syncPath && strings.HasPrefix(dir, e.syncPath); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // Not empty
+		}
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 of a file's content, as recorded in its
+// metadata
+func hashFile(filePath string) ([32]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return [32]byte{}, err
+	}
+
+	var sum [32]byte
+	copy(sum[:], hasher.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,160 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectMoves(t *testing.T) {
+	syncPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(syncPath, "docs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "docs", "plan.txt"), []byte("the plan"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "docs", "notes.txt"), []byte("notes"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "draft.txt"), []byte("draft"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	require.NoError(t, engine.ScanDirectory())
+
+	movedTo := func(from string) string {
+		tombstone, err := engine.metadataStore.GetTombstone(from)
+		if err != nil {
+			return ""
+		}
+		return tombstone.MovedTo
+	}
+
+	// A renamed file is recorded as moved, as a new version of the file
+	require.NoError(t, os.Rename(filepath.Join(syncPath, "draft.txt"), filepath.Join(syncPath, "final.txt")))
+	require.Eventually(t, func() bool { return movedTo("draft.txt") == "final.txt" }, 5*time.Second, 10*time.Millisecond)
+	moved, err := engine.metadataStore.GetFileMetadata("final.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.VersionVector{"test-device": 2}, moved.VersionVector)
+
+	// So is every file in a renamed directory
+	require.NoError(t, os.Rename(filepath.Join(syncPath, "docs"), filepath.Join(syncPath, "archive")))
+	require.Eventually(t, func() bool {
+		return movedTo(filepath.Join("docs", "plan.txt")) == filepath.Join("archive", "plan.txt") &&
+			movedTo(filepath.Join("docs", "notes.txt")) == filepath.Join("archive", "notes.txt")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A file that does not turn up elsewhere was deleted
+	require.NoError(t, os.Remove(filepath.Join(syncPath, "final.txt")))
+	require.Eventually(t, func() bool {
+		tombstone, err := engine.metadataStore.GetTombstone("final.txt")
+		return err == nil && tombstone.MovedTo == ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	files, err := engine.GetSyncedFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, filepath.Join("archive", "notes.txt"), files[0].Path)
+	assert.Equal(t, filepath.Join("archive", "plan.txt"), files[1].Path)
+}
+
+func TestHandleFileMoves(t *testing.T) {
+	syncPath := t.TempDir()
+	for _, name := range []string{"draft.txt", "edited.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(syncPath, name), []byte(name), 0644))
+	}
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	require.NoError(t, engine.ScanDirectory())
+
+	movedOnPhone := func(from, to string) *FileMove {
+		file, err := engine.metadataStore.GetFileMetadata(from)
+		require.NoError(t, err)
+		vector := file.VersionVector.Increment("phone")
+		moved := *file
+		moved.Path = to
+		moved.VersionVector = vector
+		moved.ModifiedBy = "phone"
+		return &FileMove{
+			Tombstone: &types.Tombstone{Path: from, VersionVector: vector, DeletedBy: "phone", DeletedAt: time.Now(), MovedTo: to},
+			File:      &moved,
+		}
+	}
+
+	// The phone moved both files, but edited.txt was changed here since
+	draft := movedOnPhone("draft.txt", filepath.Join("final", "draft.txt"))
+	edited := movedOnPhone("edited.txt", "renamed.txt")
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "edited.txt"), []byte("changed here"), 0644))
+	require.NoError(t, engine.processFile(filepath.Join(syncPath, "edited.txt"), "edited.txt"))
+
+	mds.handleFileMoves("phone", []*FileMove{draft, edited})
+
+	// Our copy of the moved version is renamed
+	assert.NoFileExists(t, filepath.Join(syncPath, "draft.txt"))
+	data, err := os.ReadFile(filepath.Join(syncPath, "final", "draft.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "draft.txt", string(data))
+	moved, err := engine.metadataStore.GetFileMetadata(filepath.Join("final", "draft.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, draft.File.VersionVector, moved.VersionVector)
+	tombstone, err := engine.metadataStore.GetTombstone("draft.txt")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("final", "draft.txt"), tombstone.MovedTo)
+
+	// The change here is kept, and the moved version is rebuilt from the
+	// chunks we hold rather than fetched
+	data, err = os.ReadFile(filepath.Join(syncPath, "edited.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed here", string(data))
+	data, err = os.ReadFile(filepath.Join(syncPath, "renamed.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "edited.txt", string(data))
+
+	// Applying a move again changes nothing
+	mds.handleFileMoves("phone", []*FileMove{draft})
+	assert.FileExists(t, filepath.Join(syncPath, "final", "draft.txt"))
+}
+
+func TestHandleFileMovesNestedFallback(t *testing.T) {
+	syncPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(syncPath, "docs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "docs", "notes.txt"), []byte("notes"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	require.NoError(t, engine.ScanDirectory())
+
+	from := filepath.Join("docs", "notes.txt")
+	to := filepath.Join("archive", "2024", "notes.txt")
+	file, err := engine.metadataStore.GetFileMetadata(from)
+	require.NoError(t, err)
+	vector := file.VersionVector.Increment("phone")
+	moved := *file
+	moved.Path = to
+	moved.VersionVector = vector
+	moved.ModifiedBy = "phone"
+	move := &FileMove{
+		Tombstone: &types.Tombstone{Path: from, VersionVector: vector, DeletedBy: "phone", DeletedAt: time.Now(), MovedTo: to},
+		File:      &moved,
+	}
+
+	// Changed here since, so the move cannot be applied as a rename
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, from), []byte("changed here"), 0644))
+	require.NoError(t, engine.processFile(filepath.Join(syncPath, from), from))
+
+	mds.handleFileMoves("phone", []*FileMove{move})
+
+	// The change here is kept, and the moved version is rebuilt in
+	// directories that did not exist yet
+	data, err := os.ReadFile(filepath.Join(syncPath, from))
+	require.NoError(t, err)
+	assert.Equal(t, "changed here", string(data))
+	data, err = os.ReadFile(filepath.Join(syncPath, to))
+	require.NoError(t, err)
+	assert.Equal(t, "notes", string(data))
+	rebuilt, err := engine.metadataStore.GetFileMetadata(to)
+	require.NoError(t, err)
+	assert.Equal(t, vector, rebuilt.VersionVector)
+	_, err = engine.metadataStore.GetTombstone(from)
+	assert.Error(t, err, "the change here is not deleted")
+}
@@ -1,14 +1,19 @@
 package sync
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	gosync "sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Fybrk/fybrk/internal/network"
+	"github.com/Fybrk/fybrk/internal/protocol"
 	"github.com/Fybrk/fybrk/internal/storage"
 	"github.com/Fybrk/fybrk/pkg/types"
 )
@@ -18,36 +23,100 @@ type MultiDeviceSync struct {
 	network   *network.PeerNetwork
 	encryptor *storage.Encryptor
 	deviceID  string
+	pending   map[string]*pendingFile // Incoming files waiting on chunks, by path
+	mu        gosync.Mutex
+
+	// send delivers a sync message to one peer, over the peer network
+	send func(deviceID string, syncMsg SyncMessage) error
+
+	stop     chan struct{}
+	stopOnce gosync.Once
+
+	// Peer messages being handled, and totals for the shutdown summary
+	inFlight      atomic.Int64
+	filesSent     atomic.Int64
+	filesReceived atomic.Int64
+}
+
+// pendingFile tracks a file whose missing chunks have been requested.
+// A file fetched to merge with ours also carries our version and the
+// version to merge against.
+type pendingFile struct {
+	metadata *types.FileMetadata
+	missing  map[[32]byte]bool
+	local    *types.FileMetadata
+	base     *types.FileMetadata
+	keepCopy bool      // Fetched to keep as a conflict copy of ours
+	updated  time.Time // When it was requested or last received a chunk
 }
 
+// pendingTimeout is how long a requested file may go without receiving a
+// chunk before it is given up on. It is requested again from the next file
+// list that has it.
+const pendingTimeout = 2 * time.Minute
+
 type SyncMessage struct {
-	Type     string                `json:"type"`
-	Files    []*types.FileMetadata `json:"files,omitempty"`
-	Request  *FileRequest          `json:"request,omitempty"`
-	Response *FileResponse         `json:"response,omitempty"`
+	Type       string                `json:"type"`
+	Files      []*types.FileMetadata `json:"files,omitempty"`
+	Tombstones []*types.Tombstone    `json:"tombstones,omitempty"`
+	Moves      []*FileMove           `json:"moves,omitempty"`
+	Request    *FileRequest          `json:"request,omitempty"`
+	Chunk      *ChunkResponse        `json:"chunk,omitempty"`
+	Key        *KeyUpdate            `json:"key,omitempty"`
+}
+
+// KeyUpdate hands the folder key of a new epoch to a device that missed
+// the rotation, along with the devices the rotation revoked
+type KeyUpdate struct {
+	Epoch          uint32   `json:"epoch"`
+	Key            []byte   `json:"key"`
+	RevokedDevices []string `json:"revoked_devices,omitempty"`
 }
 
 type FileRequest struct {
 	Path   string     `json:"path"`
+	Hash   [32]byte   `json:"hash"` // The version requested
 	Chunks [][32]byte `json:"chunks"`
 }
 
-type FileResponse struct {
-	Path   string        `json:"path"`
-	Chunks []types.Chunk `json:"chunks"`
+// ChunkResponse carries a single requested chunk
+type ChunkResponse struct {
+	Path  string      `json:"path"`
+	Chunk types.Chunk `json:"chunk"`
 }
 
-func NewMultiDeviceSync(engine *Engine, encryptor *storage.Encryptor, deviceID string, port int) (*MultiDeviceSync, error) {
-	peerNetwork := network.NewPeerNetwork(deviceID, port)
+func NewMultiDeviceSync(engine *Engine, encryptor *storage.Encryptor, deviceID string, port int, extraOpts ...network.PeerNetworkOption) (*MultiDeviceSync, error) {
+	// Peers authenticate with a secret derived from the folder key
+	secret, err := encryptor.KeyRing().TransportSecret()
+	if err != nil {
+		return nil, err
+	}
+	opts := []network.PeerNetworkOption{network.WithFolderSecret(secret)}
+	if engine.identity != nil {
+		// Once a device has been paired, only trusted devices from the
+		// registry may connect. Those that missed a key rotation still
+		// can, to be handed the new key.
+		earlier, err := encryptor.KeyRing().EarlierTransportSecrets()
+		if err != nil {
+			return nil, err
+		}
+		registry := &keyRingRegistry{store: engine.metadataStore, keyRing: encryptor.KeyRing()}
+		opts = append(opts, network.WithIdentity(engine.identity), network.WithDeviceRegistry(registry), network.WithEarlierSecrets(earlier))
+	}
+	peerNetwork := network.NewPeerNetwork(deviceID, port, append(opts, extraOpts...)...)
 
 	mds := &MultiDeviceSync{
 		engine:    engine,
 		network:   peerNetwork,
 		encryptor: encryptor,
 		deviceID:  deviceID,
+		pending:   make(map[string]*pendingFile),
+		stop:      make(chan struct{}),
 	}
+	mds.send = mds.sendOverNetwork
 
 	peerNetwork.SetMessageHandler(mds.handleMessage)
+	peerNetwork.SetStalePeerHandler(mds.sendKeyUpdate)
 
 	return mds, nil
 }
@@ -63,16 +132,47 @@ func (mds *MultiDeviceSync) Start() error {
 	return nil
 }
 
+// Stop disconnects from peers, removes any UPnP port mapping and withdraws
+// rendezvous points registered for pairing
 func (mds *MultiDeviceSync) Stop() error {
-	return mds.network.Stop()
+	mds.stopOnce.Do(func() { close(mds.stop) })
+
+	err := mds.network.Stop()
+	if closeErr := mds.network.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Drain waits up to timeout for the messages being handled and the files
+// being fetched to finish. It returns how many fetches were still waiting
+// on chunks; they are requested again from the next file list that has
+// them.
+func (mds *MultiDeviceSync) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		mds.mu.Lock()
+		fetching := len(mds.pending)
+		mds.mu.Unlock()
+		if (fetching == 0 && mds.inFlight.Load() == 0) || !time.Now().Before(deadline) {
+			return fetching
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
 func (mds *MultiDeviceSync) periodicSync() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		mds.broadcastFileList()
+	for {
+		select {
+		case <-ticker.C:
+			mds.expirePending()
+			mds.broadcastFileList()
+		case <-mds.stop:
+			return
+		}
 	}
 }
 
@@ -82,10 +182,16 @@ func (mds *MultiDeviceSync) broadcastFileList() {
 		log.Printf("Error getting synced files: %v", err)
 		return
 	}
+	tombstones, err := mds.engine.metadataStore.ListTombstones()
+	if err != nil {
+		log.Printf("Error getting tombstones: %v", err)
+		return
+	}
 
 	syncMsg := SyncMessage{
-		Type:  "file_list",
-		Files: files,
+		Type:       "file_list",
+		Files:      files,
+		Tombstones: tombstones,
 	}
 
 	msg := &network.Message{
@@ -98,10 +204,28 @@ func (mds *MultiDeviceSync) broadcastFileList() {
 	mds.network.BroadcastMessage(msg)
 }
 
+// broadcastMoves tells connected peers about files moved here. Peers that
+// miss it learn of the moves from the tombstones in our file list.
+func (mds *MultiDeviceSync) broadcastMoves(moves []*FileMove) {
+	msg := &network.Message{
+		Type:      "sync",
+		DeviceID:  mds.deviceID,
+		Timestamp: time.Now(),
+		Data: SyncMessage{
+			Type:  "file_move",
+			Moves: moves,
+		},
+	}
+
+	mds.network.BroadcastMessage(msg)
+}
+
 func (mds *MultiDeviceSync) handleMessage(deviceID string, msg *network.Message) {
 	if msg.Type != "sync" {
 		return
 	}
+	mds.inFlight.Add(1)
+	defer mds.inFlight.Add(-1)
 
 	// Parse sync message
 	dataBytes, err := json.Marshal(msg.Data)
@@ -116,17 +240,42 @@ func (mds *MultiDeviceSync) handleMessage(deviceID string, msg *network.Message)
 		return
 	}
 
+	mds.handleSyncMessage(deviceID, &syncMsg)
+}
+
+// handleSyncMessage dispatches a sync message from a peer
+func (mds *MultiDeviceSync) handleSyncMessage(deviceID string, syncMsg *SyncMessage) {
 	switch syncMsg.Type {
 	case "file_list":
-		mds.handleFileList(deviceID, syncMsg.Files)
+		mds.handleFileList(deviceID, syncMsg.Files, syncMsg.Tombstones)
+	case "file_move":
+		mds.handleFileMoves(deviceID, syncMsg.Moves)
 	case "file_request":
 		mds.handleFileRequest(deviceID, syncMsg.Request)
-	case "file_response":
-		mds.handleFileResponse(deviceID, syncMsg.Response)
+	case "chunk_response":
+		mds.handleChunkResponse(deviceID, syncMsg.Chunk)
+	case "key_update":
+		mds.handleKeyUpdate(deviceID, syncMsg.Key)
 	}
 }
 
-func (mds *MultiDeviceSync) handleFileList(deviceID string, remoteFiles []*types.FileMetadata) {
+func (mds *MultiDeviceSync) handleFileList(deviceID string, remoteFiles []*types.FileMetadata, remoteTombstones []*types.Tombstone) {
+	remoteFileMap := make(map[string]*types.FileMetadata)
+	for _, remoteFile := range remoteFiles {
+		remoteFileMap[remoteFile.Path] = remoteFile
+	}
+
+	// Deletions first, so files deleted there are not fetched back below.
+	// Files moved there are renamed here, if we hold what was moved.
+	for _, tombstone := range remoteTombstones {
+		if moved := remoteFileMap[tombstone.MovedTo]; tombstone.MovedTo != "" && moved != nil {
+			if mds.applyMove(deviceID, &FileMove{Tombstone: tombstone, File: moved}) {
+				continue
+			}
+		}
+		mds.applyTombstone(deviceID, tombstone)
+	}
+
 	localFiles, err := mds.engine.GetSyncedFiles()
 	if err != nil {
 		log.Printf("Error getting local files: %v", err)
@@ -141,19 +290,437 @@ func (mds *MultiDeviceSync) handleFileList(deviceID string, remoteFiles []*types
 
 	// Check for files we need
 	for _, remoteFile := range remoteFiles {
+		if remoteFile.ModifiedBy == "" {
+			remoteFile.ModifiedBy = deviceID // Peers from before it was recorded
+		}
+
 		localFile, exists := localFileMap[remoteFile.Path]
+		if !exists {
+			mds.requestMissingFile(deviceID, remoteFile)
+			continue
+		}
 
-		if !exists || localFile.Version < remoteFile.Version {
-			// Request this file
+		switch remoteFile.CompareVersion(localFile) {
+		case types.Newer:
+			// The peer's version descends from ours: fast-forward
 			mds.requestFile(deviceID, remoteFile)
+		case types.Equal:
+			// The peer holds our version, so it is the one to merge
+			// later edits against
+			if remoteFile.Hash == localFile.Hash {
+				if err := mds.engine.recordMergeBase(localFile); err != nil {
+					log.Printf("Error recording merge base of %s: %v", localFile.Path, err)
+				}
+			}
+		case types.Concurrent:
+			mds.resolveConcurrent(deviceID, localFile, remoteFile)
+		}
+		// Older: the peer fetches ours from our file list
+	}
+
+	// A peer without a file we deleted has seen the deletion, or never
+	// had the file; either way it will not bring it back
+	tombstones, err := mds.engine.metadataStore.ListTombstones()
+	if err != nil {
+		log.Printf("Error getting tombstones: %v", err)
+		return
+	}
+	for _, tombstone := range tombstones {
+		if remoteFileMap[tombstone.Path] != nil {
+			continue
+		}
+		if err := mds.engine.metadataStore.AcknowledgeTombstone(tombstone.Path, deviceID); err != nil {
+			log.Printf("Error acknowledging deletion of %s: %v", tombstone.Path, err)
+		}
+	}
+	mds.engine.collectTombstones()
+}
+
+// requestMissingFile fetches a file the peer has and we don't, unless we
+// deleted it since the peer's version
+func (mds *MultiDeviceSync) requestMissingFile(deviceID string, remoteFile *types.FileMetadata) {
+	tombstone, err := mds.engine.metadataStore.GetTombstone(remoteFile.Path)
+	if err != nil {
+		if err != storage.ErrNoTombstone {
+			log.Printf("Error getting tombstone of %s: %v", remoteFile.Path, err)
+			return
+		}
+		mds.requestFile(deviceID, remoteFile)
+		return
+	}
+
+	switch remoteFile.VersionVector.Compare(tombstone.VersionVector) {
+	case types.Newer:
+		// Created again or restored after the deletion
+		mds.requestFile(deviceID, remoteFile)
+	case types.Concurrent:
+		// Edited there after we deleted it: the edit wins, descending
+		// from the deletion so it is not deleted again
+		log.Printf("Conflict on %s: deleted here and changed on %s, keeping the change", remoteFile.Path, deviceID)
+		resolved := *remoteFile
+		resolved.VersionVector = remoteFile.VersionVector.Merge(tombstone.VersionVector)
+		mds.requestFile(deviceID, &resolved)
+	}
+	// Older or equal: the peer deletes it once it sees our tombstone
+}
+
+// handleFileMoves applies files a peer moved. Moves that cannot be applied
+// as a rename, e.g. because our copy differs, are settled as a deletion of
+// the old path and a new file at the new one.
+func (mds *MultiDeviceSync) handleFileMoves(deviceID string, moves []*FileMove) {
+	for _, fileMove := range moves {
+		if fileMove == nil || fileMove.Tombstone == nil || fileMove.File == nil {
+			continue
+		}
+		if mds.applyMove(deviceID, fileMove) {
+			continue
+		}
+
+		mds.applyTombstone(deviceID, fileMove.Tombstone)
+		if !filepath.IsLocal(fileMove.File.Path) || mds.isPending(fileMove.File.Path) {
+			continue
+		}
+		if fileMove.File.ModifiedBy == "" {
+			fileMove.File.ModifiedBy = deviceID
+		}
+		if _, err := mds.engine.metadataStore.GetFileMetadata(fileMove.File.Path); err != nil {
+			mds.requestMissingFile(deviceID, fileMove.File)
+		}
+		// Otherwise settled on the peer's next file list
+	}
+}
+
+// applyMove renames a file a peer moved, when our copy is the version that
+// was moved and nothing is at the new path. It reports whether it did.
+func (mds *MultiDeviceSync) applyMove(deviceID string, fileMove *FileMove) bool {
+	tombstone, moved := fileMove.Tombstone, fileMove.File
+	if tombstone.MovedTo != moved.Path || !filepath.IsLocal(tombstone.Path) || !filepath.IsLocal(moved.Path) {
+		log.Printf("Ignoring invalid move of %s from %s", tombstone.Path, deviceID)
+		return false
+	}
+	if mds.isPending(tombstone.Path) || mds.isPending(moved.Path) {
+		return false
+	}
+
+	localFile, err := mds.engine.metadataStore.GetFileMetadata(tombstone.Path)
+	if err != nil || localFile.Hash != moved.Hash {
+		return false
+	}
+	if order := tombstone.VersionVector.Compare(localFile.VersionVector); order != types.Newer && order != types.Equal {
+		return false // Changed here since
+	}
+	if _, err := mds.engine.metadataStore.GetFileMetadata(moved.Path); err == nil {
+		return false
+	}
+	if _, err := os.Lstat(filepath.Join(mds.engine.syncPath, moved.Path)); err == nil {
+		return false
+	}
+
+	if moved.ModifiedBy == "" {
+		moved.ModifiedBy = deviceID
+	}
+	if err := mds.engine.applyMove(fileMove); err != nil {
+		log.Printf("Error moving %s to %s: %v", tombstone.Path, moved.Path, err)
+		return false
+	}
+	log.Printf("Moved %s to %s, as on %s", tombstone.Path, moved.Path, deviceID)
+	return true
+}
+
+// applyTombstone settles a file a peer deleted. Unless it was changed here
+// since, it goes to the trash; the tombstone is kept either way to pass
+// the deletion on to other devices.
+func (mds *MultiDeviceSync) applyTombstone(deviceID string, tombstone *types.Tombstone) {
+	if !filepath.IsLocal(tombstone.Path) {
+		log.Printf("Ignoring deletion of invalid path %s from %s", tombstone.Path, deviceID)
+		return
+	}
+	if mds.isPending(tombstone.Path) {
+		return // Settled on a later file list
+	}
+
+	localFile, err := mds.engine.metadataStore.GetFileMetadata(tombstone.Path)
+	if err != nil {
+		// Already gone here: keep the newest deletion
+		existing, err := mds.engine.metadataStore.GetTombstone(tombstone.Path)
+		if err == nil {
+			if order := existing.VersionVector.Compare(tombstone.VersionVector); order == types.Newer || order == types.Equal {
+				return
+			}
+			merged := *tombstone
+			merged.VersionVector = existing.VersionVector.Merge(tombstone.VersionVector)
+			tombstone = &merged
+		}
+		if err := mds.engine.metadataStore.StoreTombstone(tombstone); err != nil {
+			log.Printf("Error recording deletion of %s: %v", tombstone.Path, err)
+		}
+		return
+	}
+
+	switch tombstone.VersionVector.Compare(localFile.VersionVector) {
+	case types.Newer, types.Equal:
+		if err := mds.engine.trashFile(tombstone); err != nil {
+			log.Printf("Error deleting %s: %v", tombstone.Path, err)
+			return
+		}
+		log.Printf("Moved %s to the trash, deleted on %s", tombstone.Path, tombstone.DeletedBy)
+	case types.Concurrent:
+		// Changed here after the peer deleted it: keep the change, now
+		// descending from the deletion so the peer fetches it back
+		log.Printf("Conflict on %s: deleted on %s and changed here, keeping the change", tombstone.Path, deviceID)
+		resolved := *localFile
+		resolved.VersionVector = localFile.VersionVector.Merge(tombstone.VersionVector)
+		if err := mds.engine.metadataStore.StoreFileMetadata(&resolved); err != nil {
+			log.Printf("Error recording merged version of %s: %v", tombstone.Path, err)
+		}
+	}
+	// Older: created again here since; the peer fetches it from our list
+}
+
+// resolveConcurrent settles a file changed both here and on a peer since
+// they last synced, using the engine's conflict resolver. Text files it
+// merges are fetched and merged line by line against the last version both
+// devices held; otherwise one version is kept, or both when the resolver
+// leaves it to the user.
+func (mds *MultiDeviceSync) resolveConcurrent(deviceID string, localFile, remoteFile *types.FileMetadata) {
+	if localFile.Hash == remoteFile.Hash {
+		// Both devices made the same change
+		mds.settle(deviceID, localFile, remoteFile, protocol.ResolutionLocalWins)
+		if err := mds.engine.recordMergeBase(localFile); err != nil {
+			log.Printf("Error recording merge base of %s: %v", localFile.Path, err)
+		}
+		return
+	}
+
+	resolution := mds.engine.conflictResolver().Resolve(
+		&ConflictVersion{DeviceID: mds.deviceID, File: localFile},
+		&ConflictVersion{DeviceID: deviceID, File: remoteFile},
+	)
+	log.Printf("Conflict on %s: changed here and on %s (%s)", localFile.Path, deviceID, resolution)
+
+	if resolution == protocol.ResolutionMerge {
+		if base := mds.mergeBase(localFile, remoteFile); base != nil {
+			if !mds.isPending(localFile.Path) {
+				mds.fetch(deviceID, &pendingFile{metadata: remoteFile, local: localFile, base: base})
+			}
+			return
+		}
+		resolution = protocol.ResolutionManual // Nothing to merge against
+	}
+	mds.settle(deviceID, localFile, remoteFile, resolution)
+}
+
+// settle keeps one version of a file changed concurrently here and on a
+// peer. The winner is recorded under the merged vector so it descends from
+// both histories and the loser fast-forwards to it. When both versions are
+// kept, the one ResolveNewestMTime picks stays in place and both devices
+// keep the loser as a conflict copy of the same name. The winner fetches
+// the losing version for it before taking the merged vector, since the
+// loser may fast-forward to the winner before seeing the conflict itself.
+func (mds *MultiDeviceSync) settle(deviceID string, localFile, remoteFile *types.FileMetadata, resolution string) {
+	merged := localFile.VersionVector.Merge(remoteFile.VersionVector)
+
+	if resolution == protocol.ResolutionRemoteWins ||
+		resolution == protocol.ResolutionManual && newerRemote(localFile, remoteFile) {
+		if mds.isPending(localFile.Path) {
+			return // Already fetching the winner
+		}
+		// Record the conflict before our version is replaced
+		if err := mds.engine.recordConflict(localFile, remoteFile, deviceID, resolution); err != nil {
+			log.Printf("Error recording conflict on %s: %v", localFile.Path, err)
+			return
+		}
+
+		resolved := *remoteFile
+		resolved.VersionVector = merged
+		mds.requestFile(deviceID, &resolved)
+		return
+	}
+
+	if resolution == protocol.ResolutionManual {
+		if !mds.isPending(localFile.Path) {
+			mds.fetch(deviceID, &pendingFile{metadata: remoteFile, local: localFile, keepCopy: true})
+		}
+		return
+	}
+
+	// Keep our content, now descending from the peer's version too
+	mds.keepLocal(localFile, merged)
+}
+
+// keepLocal records our version of a file under the vector merged with a
+// peer's concurrent version, so it descends from both
+func (mds *MultiDeviceSync) keepLocal(localFile *types.FileMetadata, merged types.VersionVector) {
+	resolved := *localFile
+	resolved.VersionVector = merged
+	if err := mds.engine.metadataStore.StoreFileMetadata(&resolved); err != nil {
+		log.Printf("Error recording merged version of %s: %v", localFile.Path, err)
+	}
+}
+
+// keepBoth keeps a peer's version of a file that lost to ours as a conflict
+// copy, then records ours under the merged vector
+func (mds *MultiDeviceSync) keepBoth(deviceID string, pending *pendingFile) error {
+	localFile, remoteFile := pending.local, pending.metadata
+
+	current, err := mds.engine.metadataStore.GetFileMetadata(localFile.Path)
+	if err != nil {
+		return err
+	}
+	if current.Hash != localFile.Hash {
+		// Settled on the next file list, against the new edit
+		return fmt.Errorf("%s changed while keeping both versions", localFile.Path)
+	}
+
+	if err := mds.engine.keepRemoteCopy(localFile, remoteFile, deviceID); err != nil {
+		return fmt.Errorf("failed to record conflict: %v", err)
+	}
+	mds.keepLocal(localFile, localFile.VersionVector.Merge(remoteFile.VersionVector))
+	return nil
+}
+
+// mergeBase returns the version to merge concurrent edits of a file
+// against, or nil if they cannot be merged
+func (mds *MultiDeviceSync) mergeBase(localFile, remoteFile *types.FileMetadata) *types.FileMetadata {
+	if localFile.Size > maxMergeSize || remoteFile.Size > maxMergeSize {
+		return nil
+	}
+	base, err := mds.engine.metadataStore.GetMergeBase(localFile.Path)
+	if err != nil {
+		if err != storage.ErrNoMergeBase {
+			log.Printf("Error getting merge base of %s: %v", localFile.Path, err)
+		}
+		return nil
+	}
+	return base
+}
+
+// mergeFile merges a peer's version of a file, edited concurrently with
+// ours, line by line against their common ancestor. Where both devices
+// changed the same lines, the version ResolveNewestMTime picks wins those
+// lines on both devices, and both keep the losing side in a conflict copy
+// of the same name, as the loser may take the winner's merge before merging
+// itself. Files that turn out not to be text are kept both.
+func (mds *MultiDeviceSync) mergeFile(deviceID string, pending *pendingFile) error {
+	localFile, remoteFile := pending.local, pending.metadata
+
+	ours, err := os.ReadFile(filepath.Join(mds.engine.syncPath, localFile.Path))
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	if sha256.Sum256(ours) != localFile.Hash {
+		// Merged on the next file list, against the new edit
+		return fmt.Errorf("%s changed while merging", localFile.Path)
+	}
+	base, err := mds.engine.readFile(pending.base)
+	if err != nil {
+		return err
+	}
+	theirs, err := mds.engine.readFile(remoteFile)
+	if err != nil {
+		return err
+	}
+
+	var merge *textMerge
+	mergeable := isText(base) && isText(ours) && isText(theirs)
+	if mergeable {
+		merge, mergeable = diff3(base, ours, theirs)
+	}
+	if !mergeable {
+		mds.settle(deviceID, localFile, remoteFile, protocol.ResolutionManual)
+		return nil
+	}
+
+	remoteWins := newerRemote(localFile, remoteFile)
+	if !merge.Clean() {
+		lost, lostBy := remoteFile, deviceID
+		if remoteWins {
+			lost, lostBy = localFile, mds.engine.deviceID
+		}
+		if err := mds.engine.recordMergeConflict(localFile, remoteFile, deviceID, lost, lostBy, merge.Result(!remoteWins)); err != nil {
+			return fmt.Errorf("failed to record conflict: %v", err)
+		}
+	}
+
+	if err := mds.engine.writeMerged(localFile.Path, merge.Result(remoteWins), remoteFile.VersionVector); err != nil {
+		return err
+	}
+	log.Printf("Merged %s with the version on %s", localFile.Path, deviceID)
+
+	// Both devices hold the peer's version now
+	return mds.engine.recordMergeBase(remoteFile)
+}
+
+// isPending reports whether a file is waiting on chunks from a peer
+func (mds *MultiDeviceSync) isPending(path string) bool {
+	mds.mu.Lock()
+	defer mds.mu.Unlock()
+	_, pending := mds.pending[path]
+	return pending
+}
+
+// expirePending gives up on requested files that stopped receiving chunks,
+// e.g. because a response was lost or the peer went away
+func (mds *MultiDeviceSync) expirePending() {
+	cutoff := time.Now().Add(-pendingTimeout)
+
+	var expired []*pendingFile
+	mds.mu.Lock()
+	for path, pending := range mds.pending {
+		if pending.updated.Before(cutoff) {
+			delete(mds.pending, path)
+			expired = append(expired, pending)
 		}
 	}
+	mds.mu.Unlock()
+
+	for _, pending := range expired {
+		log.Printf("Gave up waiting for %s, %d chunks missing", pending.metadata.Path, len(pending.missing))
+		mds.engine.chunkStore.Unpin(pending.metadata.Chunks)
+	}
 }
 
+// requestFile fetches a file from a peer and writes it in place
 func (mds *MultiDeviceSync) requestFile(deviceID string, fileMetadata *types.FileMetadata) {
+	mds.fetch(deviceID, &pendingFile{metadata: fileMetadata})
+}
+
+// fetch asks a peer for only the chunks of a file we don't already hold
+// locally, under any path, and completes the file once all are stored
+func (mds *MultiDeviceSync) fetch(deviceID string, pending *pendingFile) {
+	fileMetadata := pending.metadata
+
+	// Chunks stored for the file are unreferenced until it completes
+	mds.engine.chunkStore.Pin(fileMetadata.Chunks)
+	missing := make(map[[32]byte]bool)
+	var missingList [][32]byte
+	for _, hash := range fileMetadata.Chunks {
+		if !missing[hash] && !mds.engine.chunkStore.Has(hash) {
+			missing[hash] = true
+			missingList = append(missingList, hash)
+		}
+	}
+
+	if len(missingList) == 0 {
+		// Everything is local already, e.g. a copy or rename on the peer
+		mds.complete(deviceID, pending)
+		return
+	}
+
+	pending.missing = missing
+	pending.updated = time.Now()
+	mds.mu.Lock()
+	replaced := mds.pending[fileMetadata.Path]
+	mds.pending[fileMetadata.Path] = pending
+	mds.mu.Unlock()
+	if replaced != nil {
+		mds.engine.chunkStore.Unpin(replaced.metadata.Chunks)
+	}
+
 	request := &FileRequest{
 		Path:   fileMetadata.Path,
-		Chunks: fileMetadata.Chunks,
+		Hash:   fileMetadata.Hash,
+		Chunks: missingList,
 	}
 
 	syncMsg := SyncMessage{
@@ -161,19 +728,45 @@ func (mds *MultiDeviceSync) requestFile(deviceID string, fileMetadata *types.Fil
 		Request: request,
 	}
 
-	msg := &network.Message{
-		Type:      "sync",
-		DeviceID:  mds.deviceID,
-		Timestamp: time.Now(),
-		Data:      syncMsg,
+	if err := mds.sendSyncMessage(deviceID, syncMsg); err != nil {
+		log.Printf("Error sending file request: %v", err)
 	}
+}
 
-	if err := mds.network.SendMessage(deviceID, msg); err != nil {
-		log.Printf("Error sending file request: %v", err)
+// complete writes a fetched file once all its chunks are stored, merging it
+// with ours or keeping it next to ours if it was fetched for a conflict
+func (mds *MultiDeviceSync) complete(deviceID string, pending *pendingFile) {
+	defer mds.engine.chunkStore.Unpin(pending.metadata.Chunks)
+
+	var err error
+	switch {
+	case pending.base != nil:
+		err = mds.mergeFile(deviceID, pending)
+	case pending.keepCopy:
+		err = mds.keepBoth(deviceID, pending)
+	default:
+		err = mds.assembleFile(pending.metadata)
+	}
+	if err != nil {
+		log.Printf("Error writing received file %s: %v", pending.metadata.Path, err)
+		return
 	}
+
+	mds.filesReceived.Add(1)
+	log.Printf("Successfully synced file: %s", pending.metadata.Path)
 }
 
+// handleFileRequest answers a request with one message per chunk. Each
+// chunk is re-sealed for the wire bound to its place in the requested
+// version of the file, so a relay or peer cannot splice chunks between
+// files, versions or places in a file.
 func (mds *MultiDeviceSync) handleFileRequest(deviceID string, request *FileRequest) {
+	version, err := mds.requestedVersion(request)
+	if err != nil {
+		log.Printf("Error getting file metadata: %v", err)
+		return
+	}
+
 	// Get chunks for requested file
 	chunks, err := mds.getFileChunks(request.Path, request.Chunks)
 	if err != nil {
@@ -181,52 +774,122 @@ func (mds *MultiDeviceSync) handleFileRequest(deviceID string, request *FileRequ
 		return
 	}
 
-	response := &FileResponse{
-		Path:   request.Path,
-		Chunks: chunks,
+	for i := range chunks {
+		index := slices.Index(version.Chunks, chunks[i].Hash)
+		if index < 0 {
+			log.Printf("Chunk %x is not part of the requested version of %s", chunks[i].Hash[:8], request.Path)
+			return
+		}
+		ctx := chunkContext(version, index)
+		if err := mds.sealForTransport(&chunks[i], ctx); err != nil {
+			log.Printf("Error sealing chunk: %v", err)
+			return
+		}
+
+		syncMsg := SyncMessage{
+			Type: "chunk_response",
+			Chunk: &ChunkResponse{
+				Path:  request.Path,
+				Chunk: chunks[i],
+			},
+		}
+
+		if err := mds.sendSyncMessage(deviceID, syncMsg); err != nil {
+			log.Printf("Error sending chunk response: %v", err)
+			return
+		}
 	}
+	mds.filesSent.Add(1)
+}
 
-	syncMsg := SyncMessage{
-		Type:     "file_response",
-		Response: response,
+// handleChunkResponse stores a received chunk and assembles its file once
+// no chunks are missing any more
+func (mds *MultiDeviceSync) handleChunkResponse(deviceID string, response *ChunkResponse) {
+	if response == nil {
+		return
 	}
 
-	msg := &network.Message{
-		Type:      "sync",
-		DeviceID:  mds.deviceID,
-		Timestamp: time.Now(),
-		Data:      syncMsg,
+	mds.mu.Lock()
+	pending, exists := mds.pending[response.Path]
+	requested := exists && pending.missing[response.Chunk.Hash]
+	mds.mu.Unlock()
+	if !requested {
+		return // Not something we asked for
 	}
 
-	if err := mds.network.SendMessage(deviceID, msg); err != nil {
-		log.Printf("Error sending file response: %v", err)
+	// The chunk must be bound to its place in the version we requested
+	ctx := chunkContext(pending.metadata, slices.Index(pending.metadata.Chunks, response.Chunk.Hash))
+	if err := mds.storeReceivedChunk(&response.Chunk, ctx); err != nil {
+		log.Printf("Error storing chunk for %s: %v", response.Path, err)
+		return
+	}
+
+	mds.mu.Lock()
+	delete(pending.missing, response.Chunk.Hash)
+	pending.updated = time.Now()
+	complete := len(pending.missing) == 0 && mds.pending[response.Path] == pending
+	if complete {
+		delete(mds.pending, response.Path)
+	}
+	mds.mu.Unlock()
+
+	if complete {
+		mds.complete(deviceID, pending)
 	}
 }
 
-func (mds *MultiDeviceSync) handleFileResponse(deviceID string, response *FileResponse) {
-	// Decrypt chunks
-	for i := range response.Chunks {
-		if err := mds.encryptor.DecryptChunk(&response.Chunks[i]); err != nil {
-			log.Printf("Error decrypting chunk: %v", err)
-			return
+// chunkContext binds a chunk to its index in the version of a file it is
+// sent for. A chunk repeated within the file is sent once, bound to the
+// first index it appears at.
+func chunkContext(metadata *types.FileMetadata, index int) *storage.ChunkContext {
+	return &storage.ChunkContext{Path: metadata.Path, Version: metadata.Hash, Index: uint32(index)}
+}
+
+// requestedVersion returns the version of a file a peer requested. A file
+// edited since it was listed still completes from its kept versions.
+func (mds *MultiDeviceSync) requestedVersion(request *FileRequest) (*types.FileMetadata, error) {
+	current, err := mds.engine.metadataStore.GetFileMetadata(request.Path)
+	if err != nil {
+		return nil, err
+	}
+	if current.Hash == request.Hash {
+		return current, nil
+	}
+	versions, err := mds.engine.metadataStore.ListFileVersions(request.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.Hash == request.Hash {
+			return &version.FileMetadata, nil
 		}
 	}
+	return nil, fmt.Errorf("version %x of %s is no longer kept", request.Hash[:8], request.Path)
+}
 
-	// Reassemble file
-	chunker := storage.NewChunker(storage.DefaultChunkSize)
-	fileData, err := chunker.ReassembleChunks(response.Chunks)
-	if err != nil {
-		log.Printf("Error reassembling file: %v", err)
-		return
+// sealForTransport re-encrypts a stored chunk bound to ctx
+func (mds *MultiDeviceSync) sealForTransport(chunk *types.Chunk, ctx *storage.ChunkContext) error {
+	if err := mds.encryptor.DecryptChunk(chunk); err != nil {
+		return err
 	}
+	return mds.encryptor.EncryptChunkWithContext(chunk, ctx)
+}
 
-	// Write file to sync directory
-	if err := mds.writeReceivedFile(response.Path, fileData); err != nil {
-		log.Printf("Error writing received file: %v", err)
-		return
+// storeReceivedChunk checks a chunk received under ctx against its hash and
+// keeps it in the chunk store, re-encrypted for storage at rest
+func (mds *MultiDeviceSync) storeReceivedChunk(chunk *types.Chunk, ctx *storage.ChunkContext) error {
+	plain := *chunk
+	if err := mds.encryptor.DecryptChunkWithContext(&plain, ctx); err != nil {
+		return fmt.Errorf("failed to decrypt chunk: %w", err)
+	}
+	if sha256.Sum256(plain.Data) != chunk.Hash {
+		return storage.ErrChunkHashMismatch
 	}
 
-	log.Printf("Successfully synced file: %s", response.Path)
+	if err := mds.encryptor.EncryptChunk(&plain); err != nil {
+		return err
+	}
+	return mds.engine.chunkStore.Put(&plain)
 }
 
 func (mds *MultiDeviceSync) getFileChunks(path string, chunkHashes [][32]byte) ([]types.Chunk, error) {
@@ -236,40 +899,62 @@ func (mds *MultiDeviceSync) getFileChunks(path string, chunkHashes [][32]byte) (
 		return nil, fmt.Errorf("file not found: %v", err)
 	}
 
-	// Create chunker to read chunks
-	chunker := storage.NewChunker(storage.DefaultChunkSize)
+	if len(chunkHashes) == 0 {
+		chunkHashes = fileMetadata.Chunks
+	}
 
-	// Read and chunk the file
-	chunks, err := chunker.ChunkFile(fileMetadata.Path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to chunk file: %v", err)
+	// Only chunks of the file itself are served, not whatever else the
+	// store holds. Those of its kept versions count, so a request for a
+	// version edited since it was listed still completes.
+	listed := make(map[[32]byte]bool, len(fileMetadata.Chunks))
+	for _, hash := range fileMetadata.Chunks {
+		listed[hash] = true
+	}
+	if versions, err := mds.engine.metadataStore.ListFileVersions(path); err == nil {
+		for _, version := range versions {
+			for _, hash := range version.Chunks {
+				listed[hash] = true
+			}
+		}
 	}
 
-	// Encrypt chunks
-	for i := range chunks {
-		if err := mds.encryptor.EncryptChunk(&chunks[i]); err != nil {
-			return nil, fmt.Errorf("failed to encrypt chunk: %v", err)
+	// Serve chunks straight from the chunk store by hash
+	chunks := make([]types.Chunk, 0, len(chunkHashes))
+	for _, hash := range chunkHashes {
+		if !listed[hash] {
+			return nil, fmt.Errorf("chunk %x is not part of %s", hash[:8], path)
+		}
+
+		chunk, err := mds.engine.GetChunk(hash)
+		if err == storage.ErrChunkNotFound {
+			// Store is missing data for this file; re-index it from disk once
+			if err := mds.engine.processFile(filepath.Join(mds.engine.syncPath, fileMetadata.Path), fileMetadata.Path); err != nil {
+				return nil, fmt.Errorf("failed to chunk file: %v", err)
+			}
+			chunk, err = mds.engine.GetChunk(hash)
 		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load chunk %x: %v", hash[:8], err)
+		}
+		chunks = append(chunks, *chunk)
 	}
 
 	return chunks, nil
 }
 
-func (mds *MultiDeviceSync) writeReceivedFile(path string, data []byte) error {
-	// Get the sync directory from the engine
-	syncDir := mds.engine.syncPath
-
-	// Create full path within sync directory
-	fullPath := filepath.Join(syncDir, filepath.Base(path))
-
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
+// assembleFile rebuilds a file from the chunk store and records its metadata
+func (mds *MultiDeviceSync) assembleFile(metadata *types.FileMetadata) error {
+	// Peers name files relative to the sync directory, and may not
+	// reach outside it
+	relPath := filepath.Clean(metadata.Path)
+	if !filepath.IsLocal(relPath) || isInternalPath(relPath) {
+		return fmt.Errorf("invalid path: %s", metadata.Path)
 	}
+	fullPath := filepath.Join(mds.engine.syncPath, relPath)
 
-	// Write file
-	if err := os.WriteFile(fullPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write file: %v", err)
+	hash, err := mds.engine.rebuildFile(metadata, fullPath)
+	if err != nil {
+		return err
 	}
 
 	// Update metadata store
@@ -278,31 +963,52 @@ func (mds *MultiDeviceSync) writeReceivedFile(path string, data []byte) error {
 		return fmt.Errorf("failed to stat file: %v", err)
 	}
 
-	// Create chunker to get chunk hashes
-	chunker := storage.NewChunker(storage.DefaultChunkSize)
-	chunks, err := chunker.ChunkFile(fullPath)
-	if err != nil {
-		return fmt.Errorf("failed to chunk file: %v", err)
+	version := metadata.Version
+	if version == 0 {
+		version = 1
 	}
 
-	// Create chunk hashes
-	chunkHashes := make([][32]byte, len(chunks))
-	for i, chunk := range chunks {
-		chunkHashes[i] = chunk.Hash
+	// Store metadata
+	stored := &types.FileMetadata{
+		Path:          relPath,
+		Hash:          hash,
+		Size:          fileInfo.Size(),
+		ModTime:       fileInfo.ModTime(),
+		Chunks:        metadata.Chunks,
+		Version:       version,
+		VersionVector: metadata.VersionVector,
+		ModifiedBy:    metadata.ModifiedBy,
+	}
+	if err := mds.engine.metadataStore.StoreFileMetadata(stored); err != nil {
+		return err
 	}
 
-	// Store metadata
-	metadata := &types.FileMetadata{
-		Path:    fullPath,
-		Size:    fileInfo.Size(),
-		ModTime: fileInfo.ModTime(),
-		Chunks:  chunkHashes,
-		Version: 1,
+	// The peer holds this version too
+	return mds.engine.recordMergeBase(stored)
+}
+
+// sendSyncMessage sends a sync message to a peer
+func (mds *MultiDeviceSync) sendSyncMessage(deviceID string, syncMsg SyncMessage) error {
+	return mds.send(deviceID, syncMsg)
+}
+
+// sendOverNetwork wraps a sync message for the peer network and sends it
+func (mds *MultiDeviceSync) sendOverNetwork(deviceID string, syncMsg SyncMessage) error {
+	msg := &network.Message{
+		Type:      "sync",
+		DeviceID:  mds.deviceID,
+		Timestamp: time.Now(),
+		Data:      syncMsg,
 	}
 
-	return mds.engine.metadataStore.StoreFileMetadata(metadata)
+	return mds.network.SendMessage(deviceID, msg)
 }
 
 func (mds *MultiDeviceSync) GetConnectedDevices() []string {
 	return mds.network.GetPeers()
 }
+
+// DisconnectDevice drops the connection to a device
+func (mds *MultiDeviceSync) DisconnectDevice(deviceID string) {
+	mds.network.DisconnectPeer(deviceID)
+}
@@ -0,0 +1,464 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLink records the sync messages one test device sent the other
+type testLink struct {
+	requests       []*FileRequest
+	beforeDelivery func(syncMsg *SyncMessage)
+}
+
+// connectTestPeers delivers the sync messages of two devices to each other
+// directly, encoded as on the wire
+func connectTestPeers(t *testing.T, a *MultiDeviceSync, aID string, b *MultiDeviceSync, bID string) *testLink {
+	link := &testLink{}
+	deliver := func(to *MultiDeviceSync, from string) func(string, SyncMessage) error {
+		return func(_ string, syncMsg SyncMessage) error {
+			data, err := json.Marshal(syncMsg)
+			require.NoError(t, err)
+			var received SyncMessage
+			require.NoError(t, json.Unmarshal(data, &received))
+
+			if received.Request != nil {
+				link.requests = append(link.requests, received.Request)
+			}
+			if link.beforeDelivery != nil {
+				link.beforeDelivery(&received)
+			}
+			to.handleSyncMessage(from, &received)
+			return nil
+		}
+	}
+	a.send = deliver(b, aID)
+	b.send = deliver(a, bID)
+	return link
+}
+
+func newTestEngine(t *testing.T, syncPath string, key []byte) *Engine {
+	return newTestDevice(t, syncPath, key, "test-device")
+}
+
+// newTestDevice is newTestEngine for the given device
+func newTestDevice(t *testing.T, syncPath string, key []byte, deviceID string) *Engine {
+	metadataStore, err := storage.NewMetadataStore(filepath.Join(t.TempDir(), "metadata.db"))
+	require.NoError(t, err)
+
+	chunker := storage.NewChunker(0, storage.WithContentDefinedChunking(1024, 4096, 16384))
+	encryptor, err := storage.NewEncryptor(key)
+	require.NoError(t, err)
+
+	engine, err := NewEngine(metadataStore, chunker, encryptor, syncPath, deviceID)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		engine.Close()
+		metadataStore.Close()
+	})
+
+	return engine
+}
+
+func TestDeltaTransfer(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+
+	original := make([]byte, 128*1024)
+	_, err := rand.New(rand.NewSource(1)).Read(original)
+	require.NoError(t, err)
+
+	// Both devices start with the same file
+	var engines []*Engine
+	for i := 0; i < 2; i++ {
+		syncPath := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(syncPath, "data.bin"), original, 0644))
+
+		engine := newTestEngine(t, syncPath, key)
+		require.NoError(t, engine.ScanDirectory())
+		engines = append(engines, engine)
+	}
+	sender, receiver := engines[0], engines[1]
+
+	// The sender edits a byte in two places
+	edited := append([]byte(nil), original...)
+	edited[len(edited)/4] ^= 0xFF
+	edited[len(edited)*3/4] ^= 0xFF
+	require.NoError(t, os.WriteFile(filepath.Join(sender.syncPath, "data.bin"), edited, 0644))
+	require.NoError(t, sender.ScanDirectory())
+
+	remote, err := sender.metadataStore.GetFileMetadata("data.bin")
+	require.NoError(t, err)
+
+	mds := &MultiDeviceSync{engine: receiver, encryptor: receiver.encryptor, pending: make(map[string]*pendingFile)}
+	senderMDS := &MultiDeviceSync{engine: sender, encryptor: sender.encryptor, pending: make(map[string]*pendingFile)}
+	sent := connectTestPeers(t, mds, "receiver", senderMDS, "sender")
+
+	// Chunks received so far are not referenced by any file yet; they must
+	// survive garbage collection until the file is complete
+	received := 0
+	sent.beforeDelivery = func(syncMsg *SyncMessage) {
+		if syncMsg.Type == "chunk_response" {
+			received++
+			receiver.collectGarbage()
+		}
+	}
+
+	mds.requestFile("sender", remote)
+
+	// Only the missing chunks were asked for, and answered one per message
+	require.Len(t, sent.requests, 1)
+	missing := sent.requests[0].Chunks
+	assert.GreaterOrEqual(t, len(missing), 2)
+	assert.Less(t, len(missing), len(remote.Chunks))
+	assert.Equal(t, len(missing), received)
+
+	data, err := os.ReadFile(filepath.Join(receiver.syncPath, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, edited, data)
+
+	stored, err := receiver.metadataStore.GetFileMetadata("data.bin")
+	require.NoError(t, err)
+	assert.Equal(t, remote.Hash, stored.Hash)
+	assert.Equal(t, remote.Chunks, stored.Chunks)
+	assert.Empty(t, mds.pending)
+	assert.Equal(t, int64(1), mds.filesReceived.Load())
+	assert.Equal(t, int64(1), senderMDS.filesSent.Load())
+	assert.Zero(t, mds.Drain(time.Second))
+
+	// Chunks that are not part of the requested file are not served
+	unrelated := sha256.Sum256([]byte("not in data.bin"))
+	_, err = senderMDS.getFileChunks("data.bin", [][32]byte{unrelated})
+	assert.Error(t, err)
+}
+
+func TestRequestEditedSinceListed(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+	sender := newTestEngine(t, t.TempDir(), key)
+	receiver := newTestEngine(t, t.TempDir(), key)
+
+	require.NoError(t, os.WriteFile(filepath.Join(sender.syncPath, "notes.txt"), []byte("as listed"), 0644))
+	require.NoError(t, sender.ScanDirectory())
+	listed, err := sender.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+
+	// The sender changes the file before the request reaches it
+	require.NoError(t, os.WriteFile(filepath.Join(sender.syncPath, "notes.txt"), []byte("changed since"), 0644))
+	require.NoError(t, sender.ScanDirectory())
+
+	mds := &MultiDeviceSync{engine: receiver, encryptor: receiver.encryptor, pending: make(map[string]*pendingFile)}
+	senderMDS := &MultiDeviceSync{engine: sender, encryptor: sender.encryptor, pending: make(map[string]*pendingFile)}
+	connectTestPeers(t, mds, "receiver", senderMDS, "sender")
+
+	// The listed version is still served, and the next file list brings
+	// the change
+	mds.requestFile("sender", listed)
+	data, err := os.ReadFile(filepath.Join(receiver.syncPath, "notes.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "as listed", string(data))
+	assert.Empty(t, mds.pending)
+}
+
+func TestExpirePending(t *testing.T) {
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "a.txt"), []byte("hello"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+
+	// A peer that never answers
+	mds.send = func(string, SyncMessage) error { return nil }
+	stalled := &types.FileMetadata{Path: "b.txt", Chunks: [][32]byte{sha256.Sum256([]byte("lost"))}}
+	mds.requestFile("peer", stalled)
+	require.True(t, mds.isPending("b.txt"))
+
+	mds.expirePending()
+	assert.True(t, mds.isPending("b.txt"), "kept while within the timeout")
+
+	mds.pending["b.txt"].updated = time.Now().Add(-pendingTimeout - time.Second)
+	mds.expirePending()
+	assert.False(t, mds.isPending("b.txt"))
+}
+
+func TestHandleChunkResponseTakesRequestedChunks(t *testing.T) {
+	engine := newTestEngine(t, t.TempDir(), []byte("12345678901234567890123456789012"))
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	mds.send = func(string, SyncMessage) error { return nil }
+
+	sealed := func(metadata *types.FileMetadata, data string) *types.Chunk {
+		chunk := &types.Chunk{Hash: sha256.Sum256([]byte(data)), Data: []byte(data)}
+		require.NoError(t, engine.encryptor.EncryptChunk(chunk))
+		require.NoError(t, mds.sealForTransport(chunk, chunkContext(metadata, 0)))
+		return chunk
+	}
+	requested := &types.FileMetadata{Path: "a.txt", Chunks: [][32]byte{sha256.Sum256([]byte("requested"))}}
+	mds.requestFile("peer", requested)
+
+	// A chunk sealed for the file, but not one of its chunks
+	unrequested := sealed(requested, "unrequested")
+	mds.handleChunkResponse("peer", &ChunkResponse{Path: "a.txt", Chunk: *unrequested})
+	assert.False(t, engine.chunkStore.Has(unrequested.Hash))
+	assert.True(t, mds.isPending("a.txt"))
+
+	mds.handleChunkResponse("peer", &ChunkResponse{Path: "a.txt", Chunk: *sealed(requested, "requested")})
+	assert.False(t, mds.isPending("a.txt"))
+	data, err := os.ReadFile(filepath.Join(engine.syncPath, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "requested", string(data))
+}
+
+func TestStoreReceivedChunkRejectsTampering(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "a.txt"), []byte("hello"), 0644))
+
+	engine := newTestEngine(t, syncPath, key)
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor}
+	require.NoError(t, engine.ScanDirectory())
+
+	metadata, err := engine.metadataStore.GetFileMetadata("a.txt")
+	require.NoError(t, err)
+	chunk, err := engine.GetChunk(metadata.Chunks[0])
+	require.NoError(t, err)
+
+	spliced := map[string]*storage.ChunkContext{
+		"another file":    {Path: "other.txt", Version: metadata.Hash},
+		"another version": {Path: metadata.Path, Version: sha256.Sum256([]byte("an earlier hello"))},
+		"another index":   chunkContext(metadata, 1),
+	}
+	for name, from := range spliced {
+		t.Run("spliced from "+name, func(t *testing.T) {
+			spliced := *chunk
+			require.NoError(t, mds.sealForTransport(&spliced, from))
+
+			err := mds.storeReceivedChunk(&spliced, chunkContext(metadata, 0))
+			assert.ErrorIs(t, err, storage.ErrChunkBindingMismatch)
+		})
+	}
+
+	t.Run("wrong hash", func(t *testing.T) {
+		sealed := *chunk
+		require.NoError(t, mds.sealForTransport(&sealed, chunkContext(metadata, 0)))
+		sealed.Hash[0] ^= 0xFF
+		err := mds.storeReceivedChunk(&sealed, chunkContext(metadata, 0))
+		assert.ErrorIs(t, err, storage.ErrChunkBindingMismatch)
+	})
+}
+
+func TestHandleFileListVersionVectors(t *testing.T) {
+	key := []byte("12345678901234567890123456789012")
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "a.txt"), []byte("ours"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "b.txt"), []byte("theirs"), 0644))
+
+	engine := newTestEngine(t, syncPath, key)
+	engine.SetConflictResolver(ResolveKeepBoth) // Merging is tested on its own
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	require.NoError(t, engine.ScanDirectory())
+
+	local, err := engine.metadataStore.GetFileMetadata("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.VersionVector{"test-device": 1}, local.VersionVector)
+
+	// The peer's a.txt holds b.txt's content, so no chunks need fetching
+	theirs, err := engine.metadataStore.GetFileMetadata("b.txt")
+	require.NoError(t, err)
+	remote := func(vector types.VersionVector, modTime time.Time) *types.FileMetadata {
+		return &types.FileMetadata{
+			Path:          "a.txt",
+			Hash:          theirs.Hash,
+			Size:          theirs.Size,
+			ModTime:       modTime,
+			Chunks:        theirs.Chunks,
+			Version:       2,
+			VersionVector: vector,
+		}
+	}
+	current := func() *types.FileMetadata {
+		metadata, err := engine.metadataStore.GetFileMetadata("a.txt")
+		require.NoError(t, err)
+		return metadata
+	}
+
+	t.Run("concurrent edit keeps the newer local version", func(t *testing.T) {
+		vector := types.VersionVector{"phone": 1}
+		mds.handleFileList("phone", []*types.FileMetadata{remote(vector, local.ModTime.Add(-time.Hour))}, nil)
+
+		resolved := current()
+		assert.Equal(t, local.Hash, resolved.Hash)
+		assert.Equal(t, types.VersionVector{"test-device": 1, "phone": 1}, resolved.VersionVector)
+	})
+
+	t.Run("stale peer is ignored", func(t *testing.T) {
+		mds.handleFileList("phone", []*types.FileMetadata{remote(types.VersionVector{"test-device": 1}, time.Now())}, nil)
+
+		resolved := current()
+		assert.Equal(t, local.Hash, resolved.Hash)
+		assert.Equal(t, types.VersionVector{"test-device": 1, "phone": 1}, resolved.VersionVector)
+	})
+
+	t.Run("fast-forward to a descendant", func(t *testing.T) {
+		vector := types.VersionVector{"test-device": 1, "phone": 2}
+		mds.handleFileList("phone", []*types.FileMetadata{remote(vector, time.Now())}, nil)
+
+		resolved := current()
+		assert.Equal(t, theirs.Hash, resolved.Hash)
+		assert.Equal(t, vector, resolved.VersionVector)
+
+		data, err := os.ReadFile(filepath.Join(syncPath, "a.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "theirs", string(data))
+	})
+
+	t.Run("concurrent edit takes the newer remote version", func(t *testing.T) {
+		// A local edit, picked up by the watcher
+		require.NoError(t, os.WriteFile(filepath.Join(syncPath, "a.txt"), []byte("ours again"), 0644))
+		require.Eventually(t, func() bool {
+			return current().Hash == sha256.Sum256([]byte("ours again"))
+		}, 5*time.Second, 10*time.Millisecond)
+		edited := current()
+		assert.Equal(t, uint64(2), edited.VersionVector["phone"])
+		assert.Greater(t, edited.VersionVector["test-device"], uint64(1))
+
+		vector := types.VersionVector{"test-device": 1, "phone": 3}
+		mds.handleFileList("phone", []*types.FileMetadata{remote(vector, edited.ModTime.Add(time.Hour))}, nil)
+
+		resolved := current()
+		assert.Equal(t, theirs.Hash, resolved.Hash)
+		assert.Equal(t, edited.VersionVector.Merge(vector), resolved.VersionVector)
+	})
+}
+
+func TestHandleFileListTombstones(t *testing.T) {
+	syncPath := t.TempDir()
+	for _, name := range []string{"deleted-there.txt", "deleted-here.txt", "edited-here.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(syncPath, name), []byte(name), 0644))
+	}
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	require.NoError(t, engine.ScanDirectory())
+
+	// Deleted here while the phone was offline
+	deletedHere, err := engine.metadataStore.GetFileMetadata("deleted-here.txt")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(syncPath, "deleted-here.txt")))
+	require.NoError(t, engine.ScanDirectory())
+	tombstone, err := engine.metadataStore.GetTombstone("deleted-here.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.VersionVector{"test-device": 2}, tombstone.VersionVector)
+	assert.Equal(t, "test-device", tombstone.DeletedBy)
+
+	// The phone still has it, and deleted two files we have
+	mds.handleFileList("phone", []*types.FileMetadata{deletedHere}, []*types.Tombstone{
+		{Path: "deleted-there.txt", VersionVector: types.VersionVector{"test-device": 1, "phone": 1}, DeletedBy: "phone"},
+		{Path: "edited-here.txt", VersionVector: types.VersionVector{"phone": 1}, DeletedBy: "phone"},
+	})
+
+	// Our deletion is not undone by the phone's stale copy
+	assert.NoFileExists(t, filepath.Join(syncPath, "deleted-here.txt"))
+	_, err = engine.metadataStore.GetFileMetadata("deleted-here.txt")
+	assert.Error(t, err)
+
+	// The phone's deletion moves our copy to the trash
+	assert.NoFileExists(t, filepath.Join(syncPath, "deleted-there.txt"))
+	entries, err := engine.ListTrash()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "deleted-there.txt", entries[0].Path)
+	_, err = engine.metadataStore.GetTombstone("deleted-there.txt")
+	assert.NoError(t, err)
+
+	// A file changed here since it was deleted there is kept, and now
+	// wins over the deletion
+	edited, err := engine.metadataStore.GetFileMetadata("edited-here.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.VersionVector{"test-device": 1, "phone": 1}, edited.VersionVector)
+	assert.FileExists(t, filepath.Join(syncPath, "edited-here.txt"))
+
+	// Tombstones are dropped once every paired device has seen them
+	require.NoError(t, engine.metadataStore.StoreDevice(&types.Device{ID: "phone", Name: "Phone", TrustLevel: 2, LastSeen: time.Now()}))
+	mds.handleFileList("phone", []*types.FileMetadata{deletedHere}, nil)
+	_, err = engine.metadataStore.GetTombstone("deleted-there.txt")
+	assert.ErrorIs(t, err, storage.ErrNoTombstone)
+	_, err = engine.metadataStore.GetTombstone("deleted-here.txt")
+	assert.NoError(t, err, "kept while the phone still has the file")
+
+	mds.handleFileList("phone", nil, []*types.Tombstone{tombstone})
+	_, err = engine.metadataStore.GetTombstone("deleted-here.txt")
+	assert.ErrorIs(t, err, storage.ErrNoTombstone)
+}
+
+func TestAssembleFileKeepsDirectories(t *testing.T) {
+	syncPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(syncPath, "docs", "2026"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "docs", "2026", "plan.txt"), []byte("the plan"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	require.NoError(t, engine.ScanDirectory())
+
+	relPath := filepath.Join("docs", "2026", "plan.txt")
+	metadata, err := engine.metadataStore.GetFileMetadata(relPath)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(syncPath, "docs")))
+
+	// The file is written where the peer has it, with the default mode
+	require.NoError(t, mds.assembleFile(metadata))
+	data, err := os.ReadFile(filepath.Join(syncPath, relPath))
+	require.NoError(t, err)
+	assert.Equal(t, "the plan", string(data))
+	assert.NoFileExists(t, filepath.Join(syncPath, "plan.txt"))
+	info, err := os.Stat(filepath.Join(syncPath, relPath))
+	require.NoError(t, err)
+	assert.Equal(t, storage.DefaultFileMode, info.Mode().Perm())
+
+	outside := *metadata
+	outside.Path = filepath.Join("..", "plan.txt")
+	assert.Error(t, mds.assembleFile(&outside))
+}
+
+func TestLateWatcherEventsForReceivedFiles(t *testing.T) {
+	syncPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "notes.txt"), []byte("from the phone"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	mds := &MultiDeviceSync{engine: engine, encryptor: engine.encryptor, pending: make(map[string]*pendingFile)}
+	require.NoError(t, engine.ScanDirectory())
+	remote, err := engine.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	remote.VersionVector = types.VersionVector{"phone": 1}
+	remote.ModifiedBy = "phone"
+	require.NoError(t, os.Remove(filepath.Join(syncPath, "notes.txt")))
+	require.NoError(t, mds.assembleFile(remote))
+	received, err := engine.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+
+	// An event arriving after the write finished, even with another
+	// modification time, is not a local edit
+	fullPath := filepath.Join(syncPath, "notes.txt")
+	later := received.ModTime.Add(time.Hour)
+	require.NoError(t, os.Chtimes(fullPath, later, later))
+	engine.handleFileChange(fullPath)
+	stored, err := engine.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	assert.True(t, received.ModTime.Equal(stored.ModTime))
+	assert.Equal(t, types.VersionVector{"phone": 1}, stored.VersionVector)
+
+	// Once the content changes it is
+	require.NoError(t, os.WriteFile(fullPath, []byte("edited here"), 0644))
+	engine.handleFileChange(fullPath)
+	stored, err = engine.metadataStore.GetFileMetadata("notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, types.Newer, stored.VersionVector.Compare(types.VersionVector{"phone": 1}))
+	assert.NotZero(t, stored.VersionVector["test-device"])
+}
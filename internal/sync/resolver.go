@@ -0,0 +1,191 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/protocol"
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+// Built-in conflict policies. PolicyPreferDevice is written with the device
+// ID it prefers, as "prefer-device:<device-id>".
+const (
+	PolicyMerge        = "merge"
+	PolicyNewestMTime  = "newest-mtime"
+	PolicyLargest      = "largest"
+	PolicyKeepBoth     = "keep-both"
+	PolicyPreferDevice = "prefer-device"
+)
+
+// DefaultConflictPolicy merges text files and keeps both versions of
+// anything else, so nothing is lost unless a folder opts into discarding
+// the loser
+const DefaultConflictPolicy = PolicyMerge
+
+// ConflictVersion is one side of a conflict: a version of the file and the
+// device offering it
+type ConflictVersion struct {
+	DeviceID string
+	File     *types.FileMetadata
+}
+
+// ConflictResolver decides how a file changed concurrently here and on a
+// peer is settled. Resolve returns protocol.ResolutionLocalWins or
+// ResolutionRemoteWins to keep one version and drop the other,
+// ResolutionMerge to merge text files line by line, or ResolutionManual to
+// keep both until the user resolves the conflict. Files that cannot be
+// merged are kept both.
+//
+// Both devices resolve the conflict independently, each seeing itself as
+// local, so a resolver must pick the same version whichever side it runs
+// on. Devices sharing a folder should use the same policies.
+type ConflictResolver interface {
+	Resolve(local, remote *ConflictVersion) string
+}
+
+// ConflictResolverFunc adapts a function to a ConflictResolver
+type ConflictResolverFunc func(local, remote *ConflictVersion) string
+
+func (f ConflictResolverFunc) Resolve(local, remote *ConflictVersion) string {
+	return f(local, remote)
+}
+
+// ResolveNewestMTime keeps the most recently modified version, or the one
+// with the higher hash if both were modified at the same time
+var ResolveNewestMTime = ConflictResolverFunc(func(local, remote *ConflictVersion) string {
+	return winner(newerRemote(local.File, remote.File))
+})
+
+// ResolveLargest keeps the larger version, falling back to
+// ResolveNewestMTime on a tie
+var ResolveLargest = ConflictResolverFunc(func(local, remote *ConflictVersion) string {
+	if local.File.Size != remote.File.Size {
+		return winner(remote.File.Size > local.File.Size)
+	}
+	return ResolveNewestMTime.Resolve(local, remote)
+})
+
+// ResolveMerge merges both versions of a text file against their common
+// ancestor. Lines both devices changed are taken from the version
+// ResolveNewestMTime picks, and the other side of them is kept as a
+// conflict copy.
+var ResolveMerge = ConflictResolverFunc(func(local, remote *ConflictVersion) string {
+	return protocol.ResolutionMerge
+})
+
+// ResolveKeepBoth keeps both versions. The one ResolveNewestMTime picks
+// stays in place; the other is kept as a conflict copy.
+var ResolveKeepBoth = ConflictResolverFunc(func(local, remote *ConflictVersion) string {
+	return protocol.ResolutionManual
+})
+
+// ResolvePreferDevice keeps the version offered by deviceID, falling back to
+// ResolveNewestMTime when neither side is that device
+func ResolvePreferDevice(deviceID string) ConflictResolver {
+	return ConflictResolverFunc(func(local, remote *ConflictVersion) string {
+		switch deviceID {
+		case local.DeviceID:
+			return protocol.ResolutionLocalWins
+		case remote.DeviceID:
+			return protocol.ResolutionRemoteWins
+		}
+		return ResolveNewestMTime.Resolve(local, remote)
+	})
+}
+
+// NewConflictResolver returns the resolver for a built-in policy name
+func NewConflictResolver(policy string) (ConflictResolver, error) {
+	switch policy {
+	case PolicyMerge:
+		return ResolveMerge, nil
+	case PolicyNewestMTime:
+		return ResolveNewestMTime, nil
+	case PolicyLargest:
+		return ResolveLargest, nil
+	case PolicyKeepBoth:
+		return ResolveKeepBoth, nil
+	}
+
+	if deviceID, ok := strings.CutPrefix(policy, PolicyPreferDevice+":"); ok && deviceID != "" {
+		return ResolvePreferDevice(deviceID), nil
+	}
+	return nil, fmt.Errorf("unknown conflict policy '%s'", policy)
+}
+
+type patternResolver struct {
+	pattern  string
+	resolver ConflictResolver
+}
+
+// ConflictPolicies picks a resolver by file path: the first rule whose
+// pattern matches, or the folder's default
+type ConflictPolicies struct {
+	rules    []patternResolver
+	fallback ConflictResolver
+}
+
+// NewConflictPolicies builds the resolver for a folder from its default
+// policy and rules. An empty default means DefaultConflictPolicy.
+func NewConflictPolicies(defaultPolicy string, rules []config.ConflictRule) (*ConflictPolicies, error) {
+	if defaultPolicy == "" {
+		defaultPolicy = DefaultConflictPolicy
+	}
+	fallback, err := NewConflictResolver(defaultPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := &ConflictPolicies{fallback: fallback}
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", rule.Pattern, err)
+		}
+		resolver, err := NewConflictResolver(rule.Policy)
+		if err != nil {
+			return nil, err
+		}
+		policies.rules = append(policies.rules, patternResolver{rule.Pattern, resolver})
+	}
+	return policies, nil
+}
+
+// ResolverFor returns the resolver for the file at relPath
+func (p *ConflictPolicies) ResolverFor(relPath string) ConflictResolver {
+	relPath = filepath.ToSlash(relPath)
+	for _, rule := range p.rules {
+		name := relPath
+		if !strings.Contains(rule.pattern, "/") {
+			name = path.Base(relPath)
+		}
+		if matched, _ := path.Match(rule.pattern, name); matched {
+			return rule.resolver
+		}
+	}
+	return p.fallback
+}
+
+// Resolve settles a conflict with the resolver for the file's path
+func (p *ConflictPolicies) Resolve(local, remote *ConflictVersion) string {
+	return p.ResolverFor(local.File.Path).Resolve(local, remote)
+}
+
+// newerRemote reports whether the remote version was modified more
+// recently, breaking ties by hash so both devices agree
+func newerRemote(localFile, remoteFile *types.FileMetadata) bool {
+	if !remoteFile.ModTime.Equal(localFile.ModTime) {
+		return remoteFile.ModTime.After(localFile.ModTime)
+	}
+	return bytes.Compare(remoteFile.Hash[:], localFile.Hash[:]) > 0
+}
+
+func winner(remoteWins bool) string {
+	if remoteWins {
+		return protocol.ResolutionRemoteWins
+	}
+	return protocol.ResolutionLocalWins
+}
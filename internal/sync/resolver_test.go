@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/protocol"
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflictResolvers(t *testing.T) {
+	now := time.Now()
+	laptop := &ConflictVersion{DeviceID: "laptop", File: &types.FileMetadata{Path: "a.txt", Size: 10, ModTime: now}}
+	phone := &ConflictVersion{DeviceID: "phone", File: &types.FileMetadata{Path: "a.txt", Size: 20, ModTime: now.Add(-time.Hour)}}
+
+	tests := []struct {
+		policy string
+		want   string // Resolution with laptop local
+	}{
+		{PolicyMerge, protocol.ResolutionMerge},
+		{PolicyNewestMTime, protocol.ResolutionLocalWins},
+		{PolicyLargest, protocol.ResolutionRemoteWins},
+		{PolicyKeepBoth, protocol.ResolutionManual},
+		{"prefer-device:phone", protocol.ResolutionRemoteWins},
+		{"prefer-device:tablet", protocol.ResolutionLocalWins},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			resolver, err := NewConflictResolver(tt.policy)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, resolver.Resolve(laptop, phone))
+
+			// The other device must come to the same decision
+			mirrored := map[string]string{
+				protocol.ResolutionLocalWins:  protocol.ResolutionRemoteWins,
+				protocol.ResolutionRemoteWins: protocol.ResolutionLocalWins,
+				protocol.ResolutionMerge:      protocol.ResolutionMerge,
+				protocol.ResolutionManual:     protocol.ResolutionManual,
+			}
+			assert.Equal(t, mirrored[tt.want], resolver.Resolve(phone, laptop))
+		})
+	}
+
+	for _, policy := range []string{"", "oldest", "prefer-device", "prefer-device:"} {
+		_, err := NewConflictResolver(policy)
+		assert.Error(t, err, policy)
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	policies, err := NewConflictPolicies("", []config.ConflictRule{
+		{Pattern: "*.psd", Policy: PolicyKeepBoth},
+		{Pattern: "logs/*", Policy: PolicyLargest},
+		{Pattern: "*.log", Policy: PolicyNewestMTime},
+	})
+	require.NoError(t, err)
+
+	resolution := func(path string) string {
+		local := &ConflictVersion{DeviceID: "laptop", File: &types.FileMetadata{Path: path, Size: 1, ModTime: time.Now()}}
+		remote := &ConflictVersion{DeviceID: "phone", File: &types.FileMetadata{Path: path, Size: 2}}
+		return policies.Resolve(local, remote)
+	}
+	assert.Equal(t, protocol.ResolutionManual, resolution("art/cover.psd"))
+	assert.Equal(t, protocol.ResolutionRemoteWins, resolution("logs/app.log"))
+	assert.Equal(t, protocol.ResolutionLocalWins, resolution("old/app.log"))
+	assert.Equal(t, protocol.ResolutionMerge, resolution("notes.txt")) // Default
+
+	_, err = NewConflictPolicies("loudest", nil)
+	assert.Error(t, err)
+	_, err = NewConflictPolicies(PolicyLargest, []config.ConflictRule{{Pattern: "[", Policy: PolicyLargest}})
+	assert.Error(t, err)
+	_, err = NewConflictPolicies(PolicyLargest, []config.ConflictRule{{Pattern: "*.md", Policy: "merge-ish"}})
+	assert.Error(t, err)
+}
+
+func TestConflictPolicyDropsLoser(t *testing.T) {
+	reported := make(chan *types.Conflict, 1)
+	engine := concurrentEditWith(t, ResolveNewestMTime, func(conflict *types.Conflict) { reported <- conflict })
+
+	conflict := <-reported
+	assert.Equal(t, protocol.ResolutionRemoteWins, conflict.Resolution)
+	assert.True(t, conflict.Resolved())
+	assert.Empty(t, conflict.CopyPath)
+
+	open, err := engine.ListConflicts(false)
+	require.NoError(t, err)
+	assert.Empty(t, open)
+	all, err := engine.ListConflicts(true)
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+
+	files, err := engine.GetSyncedFiles()
+	require.NoError(t, err)
+	assert.Len(t, files, 2) // a.txt and b.txt, no conflict copy
+}
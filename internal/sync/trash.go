@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+// SetTrashRetention sets how long files deleted by peers stay in the trash
+func (e *Engine) SetTrashRetention(retention time.Duration) {
+	e.trash.SetRetention(retention)
+}
+
+// ListTrash returns the files deleted by peers that are kept in the trash,
+// most recently deleted first
+func (e *Engine) ListTrash() ([]*storage.TrashEntry, error) {
+	return e.trash.List()
+}
+
+// RestoreFromTrash moves a trashed file back to where it was. It is indexed
+// as a local change, so the devices that deleted it get it back too.
+func (e *Engine) RestoreFromTrash(id string) (*storage.TrashEntry, error) {
+	entry, err := e.trash.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The restored files are indexed below; the watcher finds them
+	// unchanged when their events arrive
+	if _, err := e.trash.Restore(e.syncPath, id); err != nil {
+		return nil, err
+	}
+
+	fullPath := filepath.Join(e.syncPath, entry.Path)
+	if !entry.IsDir {
+		return entry, e.processFile(fullPath, entry.Path)
+	}
+	err = filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel(e.syncPath, path)
+		if err != nil {
+			return err
+		}
+		return e.processFile(path, relPath)
+	})
+	return entry, err
+}
+
+// EmptyTrash deletes every file in the trash for good and returns how many
+// there were
+func (e *Engine) EmptyTrash() (int, error) {
+	return e.trash.Empty()
+}
+
+// trashFile applies a peer's deletion of a file: the file is moved to the
+// trash and its tombstone recorded, to be passed on to other devices. Its
+// past versions stay in the history.
+func (e *Engine) trashFile(tombstone *types.Tombstone) error {
+	e.setReceiving(tombstone.Path, [32]byte{})
+
+	if _, err := e.trash.Move(e.syncPath, tombstone.Path, tombstone.DeletedBy); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := e.metadataStore.StoreTombstone(tombstone); err != nil {
+		return err
+	}
+	e.collectGarbage()
+	return nil
+}
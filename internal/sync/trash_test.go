@@ -0,0 +1,60 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	syncPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(syncPath, "docs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "docs", "plan.txt"), []byte("the plan"), 0644))
+
+	engine := newTestEngine(t, syncPath, []byte("12345678901234567890123456789012"))
+	require.NoError(t, engine.ScanDirectory())
+
+	relPath := filepath.Join("docs", "plan.txt")
+	tombstone := &types.Tombstone{Path: relPath, VersionVector: types.VersionVector{"test-device": 1, "phone": 1}, DeletedBy: "phone"}
+	require.NoError(t, engine.trashFile(tombstone))
+	assert.NoFileExists(t, filepath.Join(syncPath, relPath))
+	_, err := engine.metadataStore.GetFileMetadata(relPath)
+	assert.Error(t, err)
+
+	// A deletion of a file that is already gone is fine
+	require.NoError(t, engine.trashFile(tombstone))
+
+	entries, err := engine.ListTrash()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, relPath, entries[0].Path)
+	assert.Equal(t, "phone", entries[0].DeletedBy)
+
+	restored, err := engine.RestoreFromTrash(entries[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, relPath, restored.Path)
+
+	data, err := os.ReadFile(filepath.Join(syncPath, relPath))
+	require.NoError(t, err)
+	assert.Equal(t, "the plan", string(data))
+
+	// The restored file is synced again as a change of this device, one
+	// that wins over the deletion
+	metadata, err := engine.metadataStore.GetFileMetadata(relPath)
+	require.NoError(t, err)
+	assert.Equal(t, "test-device", metadata.ModifiedBy)
+	assert.Equal(t, types.VersionVector{"test-device": 2, "phone": 1}, metadata.VersionVector)
+	_, err = engine.metadataStore.GetTombstone(relPath)
+	assert.ErrorIs(t, err, storage.ErrNoTombstone)
+
+	_, err = engine.RestoreFromTrash(entries[0].ID)
+	assert.ErrorIs(t, err, storage.ErrTrashEntryNotFound)
+	entries, err = engine.ListTrash()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,453 @@
+// Package transport wraps peer connections in an authenticated, encrypted
+// channel.
+//
+// Every connection is TLS 1.3. Certificates are not used to authenticate
+// peers; instead, once the TLS handshake is done, both sides prove they hold
+// the folder secret by sending an HMAC over a keying-material export of the
+// TLS session. The export is unique to the session, so a proof cannot be
+// replayed on another connection, and a man in the middle who does not hold
+// the secret cannot complete the exchange on either side. Peers that fail to
+// prove possession of the secret are disconnected before any sync traffic.
+package transport
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandshakeTimeout bounds how long a peer may take to authenticate
+const HandshakeTimeout = 10 * time.Second
+
+var (
+	ErrNoFolderSecret    = errors.New("no folder secret configured")
+	ErrPeerNotAuthorized = errors.New("peer could not prove possession of the folder secret")
+)
+
+const (
+	exporterLabel        = "EXPORTER-fybrk-peer-auth"
+	bindingExporterLabel = "EXPORTER-fybrk-channel-binding"
+	proofSize            = sha256.Size
+)
+
+// Client runs the client side of the handshake over conn and returns the
+// encrypted connection. conn is closed if the handshake fails.
+func Client(conn net.Conn, secret []byte) (net.Conn, error) {
+	if len(secret) == 0 {
+		conn.Close()
+		return nil, ErrNoFolderSecret
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		// The server certificate is ephemeral; the peer is authenticated by
+		// the folder secret proof below instead
+		InsecureSkipVerify: true,
+	})
+	secureConn, _, err := handshake(tlsConn, map[string][]byte{"": secret}, "client")
+	return secureConn, err
+}
+
+// Server runs the server side of the handshake over conn and returns the
+// encrypted connection. conn is closed if the handshake fails.
+func Server(conn net.Conn, secret []byte) (net.Conn, error) {
+	if len(secret) == 0 {
+		conn.Close()
+		return nil, ErrNoFolderSecret
+	}
+
+	secureConn, _, err := serverAny(conn, map[string][]byte{"": secret})
+	return secureConn, err
+}
+
+// ServerEpochs runs the server side of the handshake for a folder whose
+// secret changed with key rotations. It accepts a client holding any one
+// of secrets, the current one first, and returns the index of the one the
+// client proved.
+func ServerEpochs(conn net.Conn, secrets [][]byte) (net.Conn, int, error) {
+	if len(secrets) == 0 || len(secrets[0]) == 0 {
+		conn.Close()
+		return nil, 0, ErrNoFolderSecret
+	}
+
+	named := make(map[string][]byte, len(secrets))
+	for i, secret := range secrets {
+		named[strconv.Itoa(i)] = secret
+	}
+	secureConn, name, err := serverAny(conn, named)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.Atoi(name)
+	return secureConn, index, nil
+}
+
+// serverAny runs the server side of the handshake, accepting a client that
+// holds any one of secrets. It returns the name of the secret the client
+// proved.
+func serverAny(conn net.Conn, secrets map[string][]byte) (net.Conn, string, error) {
+	cert, err := serverCertificate()
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+	})
+	return handshake(tlsConn, secrets, "server")
+}
+
+// handshake completes TLS and exchanges folder secret proofs. The client
+// proves itself first so an unauthenticated client learns nothing from the
+// server. A server may hold several secrets; the client's proof selects the
+// one both sides continue with, and its name is returned.
+func handshake(conn *tls.Conn, secrets map[string][]byte, role string) (net.Conn, string, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("tls handshake failed: %w", err)
+	}
+
+	state := conn.ConnectionState()
+	binding, err := state.ExportKeyingMaterial(exporterLabel, nil, 32)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	authKeys := make(map[string][]byte, len(secrets))
+	for name, secret := range secrets {
+		authKey, err := hkdf.Key(sha256.New, secret, nil, "fybrk transport auth", 32)
+		if err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		authKeys[name] = authKey
+	}
+
+	peerRole := "server"
+	if role == "server" {
+		peerRole = "client"
+	}
+
+	// A client holds a single secret, named ""
+	matched := ""
+	send := func() error {
+		_, err := conn.Write(proof(authKeys[matched], binding, role))
+		return err
+	}
+	verify := func() error {
+		received := make([]byte, proofSize)
+		if _, err := io.ReadFull(conn, received); err != nil {
+			return ErrPeerNotAuthorized
+		}
+		found := false
+		for name, authKey := range authKeys {
+			if hmac.Equal(received, proof(authKey, binding, peerRole)) {
+				matched, found = name, true
+			}
+		}
+		if !found {
+			return ErrPeerNotAuthorized
+		}
+		return nil
+	}
+
+	steps := []func() error{send, verify}
+	if role == "server" {
+		steps = []func() error{verify, send}
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, matched, nil
+}
+
+// proof is the HMAC a peer sends to show it holds the folder secret
+func proof(authKey, binding []byte, role string) []byte {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write(binding)
+	mac.Write([]byte(role))
+	return mac.Sum(nil)
+}
+
+// ChannelBinding returns a value unique to the encrypted session on conn.
+// Signing it ties a statement, such as a device announcement, to this one
+// connection so it cannot be replayed on another.
+func ChannelBinding(conn net.Conn) ([]byte, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("connection is not encrypted")
+	}
+	state := tlsConn.ConnectionState()
+	return state.ExportKeyingMaterial(bindingExporterLabel, nil, 32)
+}
+
+var (
+	certOnce sync.Once
+	cert     tls.Certificate
+	certErr  error
+)
+
+// serverCertificate returns a self-signed certificate generated once per
+// process. It only serves to run TLS; it carries no identity.
+func serverCertificate() (tls.Certificate, error) {
+	certOnce.Do(func() {
+		var priv ed25519.PrivateKey
+		_, priv, certErr = ed25519.GenerateKey(rand.Reader)
+		if certErr != nil {
+			return
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "fybrk"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		}
+
+		var der []byte
+		der, certErr = x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+		if certErr != nil {
+			return
+		}
+		cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+	})
+	return cert, certErr
+}
+
+// Listener authenticates every accepted connection before handing it out,
+// so callers such as http.Server only ever see encrypted, authorized peers
+type Listener struct {
+	net.Listener
+	secret []byte
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewListener wraps inner so that Accept returns only connections that
+// completed the handshake
+func NewListener(inner net.Listener, secret []byte) *Listener {
+	l := &Listener{
+		Listener: inner,
+		secret:   secret,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+
+		// Handshake off the accept loop so a slow peer cannot stall others
+		go func() {
+			secureConn, err := Server(conn, l.secret)
+			if err != nil {
+				return
+			}
+			select {
+			case l.conns <- secureConn:
+			case <-l.done:
+				secureConn.Close()
+			}
+		}()
+	}
+}
+
+// Accept waits for the next authenticated connection
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// Mux accepts peer connections for many folders on one listener. A peer
+// proves it holds one folder's secret and is handed to that folder, so the
+// folder is never named on the wire and a peer of one folder cannot reach
+// another.
+type Mux struct {
+	inner   net.Listener
+	mu      sync.RWMutex
+	folders map[string]*muxFolder
+	done    chan struct{}
+	once    sync.Once
+}
+
+type muxFolder struct {
+	secrets [][]byte
+	handler func(conn net.Conn, secret int)
+}
+
+// NewMux starts accepting connections on inner for the folders registered
+// with it
+func NewMux(inner net.Listener) *Mux {
+	m := &Mux{
+		inner:   inner,
+		folders: make(map[string]*muxFolder),
+		done:    make(chan struct{}),
+	}
+	go m.acceptLoop()
+	return m
+}
+
+// Register routes peers holding secret to handler, which owns the
+// authenticated connection. Registering a folder ID again replaces it.
+func (m *Mux) Register(folderID string, secret []byte, handler func(net.Conn)) error {
+	return m.RegisterEpochs(folderID, [][]byte{secret}, func(conn net.Conn, _ int) {
+		handler(conn)
+	})
+}
+
+// RegisterEpochs routes peers holding any one of secrets, the current one
+// first, to handler along with the index of the secret they proved
+func (m *Mux) RegisterEpochs(folderID string, secrets [][]byte, handler func(conn net.Conn, secret int)) error {
+	if len(secrets) == 0 || len(secrets[0]) == 0 {
+		return ErrNoFolderSecret
+	}
+
+	m.mu.Lock()
+	m.folders[folderID] = &muxFolder{secrets: secrets, handler: handler}
+	m.mu.Unlock()
+	return nil
+}
+
+// Unregister stops accepting peers for a folder
+func (m *Mux) Unregister(folderID string) {
+	m.mu.Lock()
+	delete(m.folders, folderID)
+	m.mu.Unlock()
+}
+
+// Port returns the TCP port the mux listens on
+func (m *Mux) Port() int {
+	if addr, ok := m.inner.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// acceptLoop accepts connections until the mux is closed. Temporary errors,
+// such as running out of file descriptors, are retried with a growing delay
+// as net/http does, so a burst of connections does not stop the daemon
+// taking peers.
+func (m *Mux) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := m.inner.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				delay = max(2*delay, 5*time.Millisecond)
+				delay = min(delay, time.Second)
+				select {
+				case <-time.After(delay):
+					continue
+				case <-m.done:
+					return
+				}
+			}
+			m.Close()
+			return
+		}
+		delay = 0
+
+		// Handshake off the accept loop so a slow peer cannot stall others
+		go m.route(conn)
+	}
+}
+
+// route authenticates conn against every registered folder and hands it
+// to the one whose secret the peer proved
+func (m *Mux) route(conn net.Conn) {
+	// Secrets are named index/folder ID
+	m.mu.RLock()
+	secrets := make(map[string][]byte, len(m.folders))
+	for folderID, folder := range m.folders {
+		for i, secret := range folder.secrets {
+			secrets[strconv.Itoa(i)+"/"+folderID] = secret
+		}
+	}
+	m.mu.RUnlock()
+
+	if len(secrets) == 0 {
+		conn.Close()
+		return
+	}
+
+	secureConn, name, err := serverAny(conn, secrets)
+	if err != nil {
+		return
+	}
+	index, folderID, _ := strings.Cut(name, "/")
+	secret, _ := strconv.Atoi(index)
+
+	m.mu.RLock()
+	folder, exists := m.folders[folderID]
+	m.mu.RUnlock()
+
+	select {
+	case <-m.done:
+		secureConn.Close()
+		return
+	default:
+	}
+	if !exists {
+		secureConn.Close() // Removed while the peer was authenticating
+		return
+	}
+
+	folder.handler(secureConn, secret)
+}
+
+// Close stops accepting connections
+func (m *Mux) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.done)
+		err = m.inner.Close()
+	})
+	return err
+}
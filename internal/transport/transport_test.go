@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectPair runs both handshake sides over a loopback connection
+func connectPair(t *testing.T, clientSecret, serverSecret []byte) (client, server net.Conn, clientErr, serverErr error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	clientRaw, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverRaw, err := listener.Accept()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		server, serverErr = Server(serverRaw, serverSecret)
+		close(done)
+	}()
+	client, clientErr = Client(clientRaw, clientSecret)
+	<-done
+
+	return client, server, clientErr, serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	secret := []byte("folder secret")
+
+	client, server, clientErr, serverErr := connectPair(t, secret, secret)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(server, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestHandshakeRejectsWrongSecret(t *testing.T) {
+	_, _, clientErr, serverErr := connectPair(t, []byte("guess"), []byte("folder secret"))
+	assert.ErrorIs(t, clientErr, ErrPeerNotAuthorized)
+	assert.ErrorIs(t, serverErr, ErrPeerNotAuthorized)
+}
+
+func TestHandshakeRequiresSecret(t *testing.T) {
+	_, _, clientErr, _ := connectPair(t, nil, []byte("folder secret"))
+	assert.ErrorIs(t, clientErr, ErrNoFolderSecret)
+}
+
+func TestListenerOnlyYieldsAuthorizedPeers(t *testing.T) {
+	secret := []byte("folder secret")
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := NewListener(inner, secret)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func(secret []byte) error {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		secureConn, err := Client(conn, secret)
+		if err == nil {
+			secureConn.Close()
+		}
+		return err
+	}
+
+	assert.ErrorIs(t, dial([]byte("guess")), ErrPeerNotAuthorized)
+	require.NoError(t, dial(secret))
+
+	conn := <-accepted
+	conn.Close()
+	assert.Empty(t, accepted)
+}
+
+func TestChannelBinding(t *testing.T) {
+	secret := []byte("folder secret")
+
+	client, server, clientErr, serverErr := connectPair(t, secret, secret)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+	defer client.Close()
+	defer server.Close()
+
+	clientBinding, err := ChannelBinding(client)
+	require.NoError(t, err)
+	serverBinding, err := ChannelBinding(server)
+	require.NoError(t, err)
+	assert.Equal(t, clientBinding, serverBinding)
+
+	// Another session gets a different binding
+	other, otherServer, _, _ := connectPair(t, secret, secret)
+	defer other.Close()
+	defer otherServer.Close()
+	otherBinding, err := ChannelBinding(other)
+	require.NoError(t, err)
+	assert.NotEqual(t, clientBinding, otherBinding)
+}
+
+func TestMuxRoutesByFolderSecret(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mux := NewMux(inner)
+	defer mux.Close()
+	assert.Equal(t, inner.Addr().(*net.TCPAddr).Port, mux.Port())
+
+	routed := make(chan string, 4)
+	register := func(folderID string) {
+		require.NoError(t, mux.Register(folderID, []byte(folderID+" secret"), func(conn net.Conn) {
+			defer conn.Close()
+			routed <- folderID
+		}))
+	}
+	register("photos")
+	register("documents")
+
+	dial := func(secret string) error {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		secureConn, err := Client(conn, []byte(secret))
+		if err == nil {
+			secureConn.Close()
+		}
+		return err
+	}
+
+	require.NoError(t, dial("documents secret"))
+	assert.Equal(t, "documents", <-routed)
+	require.NoError(t, dial("photos secret"))
+	assert.Equal(t, "photos", <-routed)
+
+	// Unknown and unregistered folders are refused
+	assert.ErrorIs(t, dial("guess"), ErrPeerNotAuthorized)
+	mux.Unregister("photos")
+	assert.ErrorIs(t, dial("photos secret"), ErrPeerNotAuthorized)
+	assert.Empty(t, routed)
+
+	// A folder whose key was rotated still takes peers proving the earlier
+	// secret, and is told which one they proved
+	secrets := make(chan int, 2)
+	require.NoError(t, mux.RegisterEpochs("music", [][]byte{[]byte("music secret 2"), []byte("music secret 1")}, func(conn net.Conn, secret int) {
+		defer conn.Close()
+		secrets <- secret
+	}))
+	require.NoError(t, dial("music secret 1"))
+	assert.Equal(t, 1, <-secrets)
+	require.NoError(t, dial("music secret 2"))
+	assert.Equal(t, 0, <-secrets)
+
+	assert.ErrorIs(t, mux.Register("empty", nil, func(net.Conn) {}), ErrNoFolderSecret)
+}
+
+// flakyListener fails its first Accept with a temporary error
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestMuxKeepsAcceptingAfterTemporaryErrors(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	mux := NewMux(&flakyListener{Listener: inner})
+	defer mux.Close()
+
+	routed := make(chan struct{}, 1)
+	require.NoError(t, mux.Register("photos", []byte("photos secret"), func(conn net.Conn) {
+		conn.Close()
+		routed <- struct{}{}
+	}))
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	secureConn, err := Client(conn, []byte("photos secret"))
+	require.NoError(t, err)
+	secureConn.Close()
+	<-routed
+}
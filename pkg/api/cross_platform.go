@@ -3,8 +3,12 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/identity"
 	"github.com/Fybrk/fybrk/internal/pairing"
 	"github.com/Fybrk/fybrk/internal/protocol"
 	"github.com/Fybrk/fybrk/internal/sync"
@@ -16,11 +20,21 @@ type CrossPlatformAPI struct {
 	engine         *sync.Engine
 	protocol       *protocol.UniversalSyncProtocol
 	pairingManager *pairing.DevicePairingManager
+	folders        FolderManager
 	eventHandlers  map[string][]EventHandler
 	ctx            context.Context
 	cancel         context.CancelFunc
 }
 
+// ErrNoFolderManager is returned by folder APIs when no FolderManager is set
+var ErrNoFolderManager = errors.New("no folder manager configured")
+
+// FolderManager adds and removes sync folders. fybrk.Daemon implements it.
+type FolderManager interface {
+	AddFolder(path string) (*config.Folder, error)
+	RemoveFolder(idOrPath string) (*config.Folder, error)
+}
+
 // EventHandler handles cross-platform events
 type EventHandler func(event *Event) error
 
@@ -40,6 +54,7 @@ type DeviceInfo struct {
 	LastSeen     time.Time `json:"last_seen"`
 	SyncProgress float64   `json:"sync_progress"`
 	Capabilities []string  `json:"capabilities"`
+	TrustLevel   int       `json:"trust_level,omitempty"`
 }
 
 // SyncStats represents sync statistics for UI display
@@ -61,17 +76,26 @@ type QRCodeData struct {
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
-func NewCrossPlatformAPI(engine *sync.Engine, deviceID, deviceName, deviceType string) *CrossPlatformAPI {
+// NewCrossPlatformAPI creates the API for the device identified by id. The
+// device ID reported to peers and UIs is derived from id's public key.
+func NewCrossPlatformAPI(engine *sync.Engine, id *identity.Identity, deviceName, deviceType string) *CrossPlatformAPI {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &CrossPlatformAPI{
+	// Paired devices are remembered in the folder's metadata store
+	pairingManager := pairing.NewDevicePairingManager(id, deviceName)
+	pairingManager.SetDeviceStore(engine.MetadataStore())
+
+	api := &CrossPlatformAPI{
 		engine:         engine,
-		protocol:       protocol.NewUniversalSyncProtocol(deviceID, deviceType),
-		pairingManager: pairing.NewDevicePairingManager(deviceID, deviceName),
+		protocol:       protocol.NewUniversalSyncProtocol(id.DeviceID(), deviceType),
+		pairingManager: pairingManager,
 		eventHandlers:  make(map[string][]EventHandler),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
+	engine.OnConflict(api.conflictDetected)
+
+	return api
 }
 
 // Device Management APIs
@@ -96,6 +120,78 @@ func (api *CrossPlatformAPI) GetConnectedDevices() ([]*DeviceInfo, error) {
 	return []*DeviceInfo{}, nil
 }
 
+// ListPairedDevices returns the devices in the trusted-device registry
+func (api *CrossPlatformAPI) ListPairedDevices() ([]*DeviceInfo, error) {
+	devices, err := api.engine.MetadataStore().ListDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	connected := make(map[string]bool)
+	for _, id := range api.engine.GetConnectedDevices() {
+		connected[id] = true
+	}
+
+	infos := make([]*DeviceInfo, 0, len(devices))
+	for _, device := range devices {
+		status := "offline"
+		if device.Revoked {
+			status = "revoked"
+		} else if connected[device.ID] {
+			status = "online"
+		}
+
+		infos = append(infos, &DeviceInfo{
+			ID:           device.ID,
+			Name:         device.Name,
+			Type:         device.DeviceType,
+			Status:       status,
+			LastSeen:     device.LastSeen,
+			Capabilities: device.Capabilities,
+			TrustLevel:   device.TrustLevel,
+		})
+	}
+	return infos, nil
+}
+
+// RenameDevice changes the name a paired device is shown under
+func (api *CrossPlatformAPI) RenameDevice(deviceID, name string) error {
+	if err := api.engine.MetadataStore().RenameDevice(deviceID, name); err != nil {
+		return err
+	}
+
+	api.emitEvent("device.renamed", map[string]interface{}{
+		"device_id": deviceID,
+		"name":      name,
+	})
+	return nil
+}
+
+// RevokeDevice refuses all further connections from a paired device
+func (api *CrossPlatformAPI) RevokeDevice(deviceID string) error {
+	if err := api.engine.RevokeDevice(deviceID); err != nil {
+		return err
+	}
+
+	api.emitEvent("device.revoked", map[string]interface{}{
+		"device_id": deviceID,
+	})
+	return nil
+}
+
+// TrustDevice sets a paired device's trust level, lifting any revocation
+func (api *CrossPlatformAPI) TrustDevice(deviceID string, trustLevel int) error {
+	if err := api.engine.MetadataStore().SetDeviceTrust(deviceID, trustLevel); err != nil {
+		return err
+	}
+
+	api.emitEvent("device.trusted", map[string]interface{}{
+		"device_id":   deviceID,
+		"trust_level": trustLevel,
+	})
+	return nil
+}
+
 // Pairing APIs
 
 // GeneratePairingQR generates a QR code for device pairing
@@ -124,22 +220,52 @@ func (api *CrossPlatformAPI) PairWithQR(qrData string) (*DeviceInfo, error) {
 		return nil, err
 	}
 
-	deviceInfo := &DeviceInfo{
-		ID:           device.ID,
-		Name:         device.Name,
-		Type:         device.DeviceType,
-		Status:       "paired",
-		LastSeen:     device.LastSeen,
-		SyncProgress: 0.0,
-		Capabilities: device.Capabilities,
+	return api.devicePaired(device), nil
+}
+
+// AcceptPairing answers a device that scanned the QR code from
+// GeneratePairingQR and connected to conn
+func (api *CrossPlatformAPI) AcceptPairing(conn net.Conn) (*DeviceInfo, error) {
+	device, err := api.pairingManager.AcceptPairing(conn)
+	if err != nil {
+		return nil, err
 	}
 
+	return api.devicePaired(device), nil
+}
+
+// SetPairingConfirmation sets the function that shows the six digit code
+// both devices display during pairing and asks the user whether they match.
+// Pairing is refused until one is set.
+func (api *CrossPlatformAPI) SetPairingConfirmation(confirm func(sas string, device *DeviceInfo) (bool, error)) {
+	api.pairingManager.SetConfirmCallback(func(sas string, device *pairing.PairedDevice) (bool, error) {
+		return confirm(sas, pairedDeviceInfo(device, "pairing"))
+	})
+}
+
+// devicePaired reports a newly paired device
+func (api *CrossPlatformAPI) devicePaired(device *pairing.PairedDevice) *DeviceInfo {
+	deviceInfo := pairedDeviceInfo(device, "paired")
+
 	// Emit pairing event
 	api.emitEvent("device.paired", map[string]interface{}{
 		"device": deviceInfo,
 	})
 
-	return deviceInfo, nil
+	return deviceInfo
+}
+
+func pairedDeviceInfo(device *pairing.PairedDevice, status string) *DeviceInfo {
+	return &DeviceInfo{
+		ID:           device.ID,
+		Name:         device.Name,
+		Type:         device.DeviceType,
+		Status:       status,
+		LastSeen:     device.LastSeen,
+		SyncProgress: 0.0,
+		Capabilities: device.Capabilities,
+		TrustLevel:   device.TrustLevel,
+	}
 }
 
 // Sync APIs
@@ -156,6 +282,11 @@ func (api *CrossPlatformAPI) GetSyncStats() (*SyncStats, error) {
 		totalSize += file.Size
 	}
 
+	conflicts, err := api.engine.ListConflicts(false)
+	if err != nil {
+		return nil, err
+	}
+
 	return &SyncStats{
 		TotalFiles:       len(files),
 		SyncedFiles:      len(files),
@@ -164,7 +295,7 @@ func (api *CrossPlatformAPI) GetSyncStats() (*SyncStats, error) {
 		LastSync:         time.Now(),
 		SyncInProgress:   false,
 		ConnectedDevices: 0, // Would get from network layer
-		Conflicts:        0,
+		Conflicts:        len(conflicts),
 	}, nil
 }
 
@@ -192,11 +323,83 @@ func (api *CrossPlatformAPI) GetFileList() ([]*types.FileMetadata, error) {
 	return api.engine.GetSyncedFiles()
 }
 
+// ListConflicts returns the conflicts waiting to be resolved
+func (api *CrossPlatformAPI) ListConflicts() ([]*protocol.ConflictInfo, error) {
+	conflicts, err := api.engine.ListConflicts(false)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*protocol.ConflictInfo, len(conflicts))
+	for i, conflict := range conflicts {
+		infos[i] = protocol.NewConflictInfo(conflict)
+	}
+	return infos, nil
+}
+
+// ResolveConflict settles a conflict by keeping the current version
+// ("current"), the conflict copy ("copy") or both files ("both")
+func (api *CrossPlatformAPI) ResolveConflict(id int64, keep string) error {
+	if err := api.engine.ResolveConflict(id, keep); err != nil {
+		return err
+	}
+
+	api.emitEvent("sync.conflict_resolved", map[string]interface{}{
+		"id":   id,
+		"keep": keep,
+	})
+	return nil
+}
+
+// conflictDetected reports a conflict as a sync.conflict event carrying
+// its ConflictInfo
+func (api *CrossPlatformAPI) conflictDetected(conflict *types.Conflict) {
+	msg, err := api.protocol.CreateConflict(protocol.NewConflictInfo(conflict))
+	if err != nil {
+		return
+	}
+	api.emitEvent(protocol.MsgSyncConflict, msg.Payload)
+}
+
+// SetFolderManager lets the API add and remove sync folders, e.g. on the
+// daemon that runs them
+func (api *CrossPlatformAPI) SetFolderManager(folders FolderManager) {
+	api.folders = folders
+}
+
 // AddSyncPath adds a new path to sync
 func (api *CrossPlatformAPI) AddSyncPath(path string) error {
-	// This would add the path to the sync engine
+	if api.folders == nil {
+		return ErrNoFolderManager
+	}
+
+	folder, err := api.folders.AddFolder(path)
+	if err != nil {
+		return err
+	}
+
 	api.emitEvent("path.added", map[string]interface{}{
-		"path": path,
+		"path":      folder.Path,
+		"folder_id": folder.ID,
+	})
+	return nil
+}
+
+// RemoveSyncPath stops syncing the folder with the given ID or path. Its
+// files are left in place.
+func (api *CrossPlatformAPI) RemoveSyncPath(idOrPath string) error {
+	if api.folders == nil {
+		return ErrNoFolderManager
+	}
+
+	folder, err := api.folders.RemoveFolder(idOrPath)
+	if err != nil {
+		return err
+	}
+
+	api.emitEvent("path.removed", map[string]interface{}{
+		"path":      folder.Path,
+		"folder_id": folder.ID,
 	})
 	return nil
 }
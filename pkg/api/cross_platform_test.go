@@ -2,13 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"os"
 	"path/filepath"
 	gosync "sync"
 	"testing"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/protocol"
 	"github.com/Fybrk/fybrk/internal/storage"
 	"github.com/Fybrk/fybrk/internal/sync"
+	"github.com/Fybrk/fybrk/pkg/fybrk"
 	"github.com/Fybrk/fybrk/pkg/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,7 +21,11 @@ import (
 func createTestEngine(tempDir string) (*sync.Engine, error) {
 	key := []byte("12345678901234567890123456789012") // Exactly 32 bytes
 
-	metadataStore, err := storage.NewMetadataStore(filepath.Join(tempDir, "metadata.db"))
+	// Keep the database out of the watched folder, as the CLI does
+	if err := os.MkdirAll(filepath.Join(tempDir, ".fybrk"), 0755); err != nil {
+		return nil, err
+	}
+	metadataStore, err := storage.NewMetadataStore(filepath.Join(tempDir, ".fybrk", "metadata.db"))
 	if err != nil {
 		return nil, err
 	}
@@ -31,13 +39,19 @@ func createTestEngine(tempDir string) (*sync.Engine, error) {
 	return sync.NewEngine(metadataStore, chunker, encryptor, tempDir, "test-device")
 }
 
+func newTestIdentity(t *testing.T) *identity.Identity {
+	id, err := identity.Generate()
+	require.NoError(t, err)
+	return id
+}
+
 func TestNewCrossPlatformAPI(t *testing.T) {
 	tempDir := t.TempDir()
 	engine, err := createTestEngine(tempDir)
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	assert.NotNil(t, api)
@@ -55,11 +69,12 @@ func TestGetDeviceInfo(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	id := newTestIdentity(t)
+	api := NewCrossPlatformAPI(engine, id, "Test Device", "desktop")
 	defer api.Close()
 
 	info := api.GetDeviceInfo()
-	assert.Equal(t, "test-device", info.ID)
+	assert.Equal(t, id.DeviceID(), info.ID)
 	assert.Equal(t, "Test Device", info.Name)
 	assert.Equal(t, "desktop", info.Type)
 	assert.Equal(t, "online", info.Status)
@@ -74,7 +89,7 @@ func TestGetConnectedDevices(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	devices, err := api.GetConnectedDevices()
@@ -88,7 +103,7 @@ func TestGeneratePairingQR(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	qrData, err := api.GeneratePairingQR("192.168.1.100:8080")
@@ -105,7 +120,7 @@ func TestGetSyncStats(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	stats, err := api.GetSyncStats()
@@ -126,7 +141,7 @@ func TestStartStopSync(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	// Test start sync
@@ -144,7 +159,7 @@ func TestGetFileList(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	files, err := api.GetFileList()
@@ -161,11 +176,42 @@ func TestAddSyncPath(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
+	// Without a folder manager there is nothing to add the path to
 	err = api.AddSyncPath("/test/path")
-	assert.NoError(t, err)
+	assert.ErrorIs(t, err, ErrNoFolderManager)
+
+	daemon := fybrk.NewDaemon(fybrk.DaemonConfig{ConfigDir: t.TempDir(), Identity: newTestIdentity(t)})
+	api.SetFolderManager(daemon)
+
+	added := make(chan *Event, 1)
+	api.OnEvent("path.added", func(event *Event) error {
+		added <- event
+		return nil
+	})
+
+	syncPath := t.TempDir()
+	require.NoError(t, api.AddSyncPath(syncPath))
+
+	select {
+	case event := <-added:
+		assert.Equal(t, syncPath, event.Data["path"])
+		assert.NotEmpty(t, event.Data["folder_id"])
+	case <-time.After(time.Second):
+		t.Fatal("Expected a path.added event")
+	}
+
+	folders, err := daemon.Folders()
+	require.NoError(t, err)
+	require.Len(t, folders, 1)
+	assert.Equal(t, syncPath, folders[0].Path)
+
+	require.NoError(t, api.RemoveSyncPath(syncPath))
+	folders, err = daemon.Folders()
+	require.NoError(t, err)
+	assert.Empty(t, folders)
 }
 
 func TestEventSystem(t *testing.T) {
@@ -174,7 +220,7 @@ func TestEventSystem(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	var mu gosync.Mutex
@@ -206,13 +252,102 @@ func TestEventSystem(t *testing.T) {
 	assert.Equal(t, "data", receivedEvent.Data["test"])
 }
 
+func TestDeviceRegistry(t *testing.T) {
+	engine, err := createTestEngine(t.TempDir())
+	require.NoError(t, err)
+	defer engine.Close()
+
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
+	defer api.Close()
+
+	require.NoError(t, engine.MetadataStore().StoreDevice(&types.Device{
+		ID:         "device-1",
+		Name:       "Laptop",
+		TrustLevel: 2,
+		LastSeen:   time.Now(),
+	}))
+
+	devices, err := api.ListPairedDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, "offline", devices[0].Status)
+	assert.Equal(t, 2, devices[0].TrustLevel)
+
+	require.NoError(t, api.RenameDevice("device-1", "Work laptop"))
+	require.NoError(t, api.RevokeDevice("device-1"))
+
+	devices, err = api.ListPairedDevices()
+	require.NoError(t, err)
+	assert.Equal(t, "Work laptop", devices[0].Name)
+	assert.Equal(t, "revoked", devices[0].Status)
+
+	require.NoError(t, api.TrustDevice("device-1", 3))
+	devices, err = api.ListPairedDevices()
+	require.NoError(t, err)
+	assert.Equal(t, "offline", devices[0].Status)
+	assert.Equal(t, 3, devices[0].TrustLevel)
+
+	assert.Error(t, api.RevokeDevice("unknown"))
+}
+
+func TestConflicts(t *testing.T) {
+	engine, err := createTestEngine(t.TempDir())
+	require.NoError(t, err)
+	defer engine.Close()
+
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
+	defer api.Close()
+
+	events := make(chan *Event, 1)
+	api.OnEvent(protocol.MsgSyncConflict, func(event *Event) error {
+		events <- event
+		return nil
+	})
+
+	conflict := &types.Conflict{
+		Path:       "notes.txt",
+		CopyPath:   "notes.sync-conflict-20260101-120000-test-dev.txt",
+		DeviceID:   "laptop",
+		Resolution: protocol.ResolutionRemoteWins,
+		LocalFile:  &types.FileMetadata{Path: "notes.txt"},
+		RemoteFile: &types.FileMetadata{Path: "notes.txt"},
+		DetectedAt: time.Now(),
+	}
+	require.NoError(t, engine.MetadataStore().AddConflict(conflict))
+	api.conflictDetected(conflict)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, protocol.MsgSyncConflict, event.Type)
+		assert.Equal(t, "content", event.Data["conflict_type"])
+		assert.Equal(t, conflict.CopyPath, event.Data["copy_path"])
+		assert.Equal(t, "laptop", event.Data["device_id"])
+	case <-time.After(time.Second):
+		t.Fatal("no sync.conflict event")
+	}
+
+	conflicts, err := api.ListConflicts()
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, conflict.ID, conflicts[0].ID)
+
+	stats, err := api.GetSyncStats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Conflicts)
+
+	require.NoError(t, api.ResolveConflict(conflict.ID, sync.KeepBoth))
+	conflicts, err = api.ListConflicts()
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+}
+
 func TestGetDeviceFingerprint(t *testing.T) {
 	tempDir := t.TempDir()
 	engine, err := createTestEngine(tempDir)
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	fingerprint := api.GetDeviceFingerprint()
@@ -225,7 +360,8 @@ func TestExportImportConfig(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	id := newTestIdentity(t)
+	api := NewCrossPlatformAPI(engine, id, "Test Device", "desktop")
 	defer api.Close()
 
 	// Test export
@@ -237,7 +373,7 @@ func TestExportImportConfig(t *testing.T) {
 	var config map[string]interface{}
 	err = json.Unmarshal(configData, &config)
 	assert.NoError(t, err)
-	assert.Equal(t, "test-device", config["device_id"])
+	assert.Equal(t, id.DeviceID(), config["device_id"])
 	assert.Equal(t, "Test Device", config["device_name"])
 	assert.Equal(t, "1.0.0", config["version"])
 
@@ -252,7 +388,7 @@ func TestImportConfigInvalidJSON(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	err = api.ImportConfig([]byte("invalid json"))
@@ -265,7 +401,7 @@ func TestClose(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 
 	err = api.Close()
 	assert.NoError(t, err)
@@ -289,7 +425,7 @@ func TestMultipleEventHandlers(t *testing.T) {
 	require.NoError(t, err)
 	defer engine.Close()
 
-	api := NewCrossPlatformAPI(engine, "test-device", "Test Device", "desktop")
+	api := NewCrossPlatformAPI(engine, newTestIdentity(t), "Test Device", "desktop")
 	defer api.Close()
 
 	var mu gosync.Mutex
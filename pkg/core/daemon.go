@@ -0,0 +1,346 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/transport"
+)
+
+// Daemon syncs every folder in the folder registry from one process. Each
+// folder keeps its own key, database and peers; peers of all folders
+// connect through one listener and are routed by the folder secret they
+// prove they hold.
+type Daemon struct {
+	config DaemonConfig
+	mux    *transport.Mux
+
+	// startMu serializes starting folders, so one is never opened twice
+	startMu  sync.Mutex
+	mu       sync.Mutex
+	folders  map[string]*Fybrk
+	failures map[string]error
+}
+
+// DaemonConfig holds configuration for a Daemon
+type DaemonConfig struct {
+	// ConfigDir holds the folder registry, usually ~/.fybrk
+	ConfigDir string
+
+	// Port is the port peers connect to; 0 picks a free one
+	Port int
+
+	// Identity is the device identity shared by all folders
+	Identity *identity.Identity
+
+	// Passphrase returns the passphrase prompt for the folder at syncPath
+	Passphrase func(syncPath string) func() (string, error)
+
+	// ConfirmPairing and TrashRetention apply to every folder, as in Config
+	ConfirmPairing func(code, deviceName string) (bool, error)
+	TrashRetention time.Duration
+}
+
+// FolderStatus describes a registered folder
+type FolderStatus struct {
+	*config.Folder
+	Running bool
+	Peers   int
+	Error   error
+}
+
+// NewDaemon creates a daemon for the folders registered in config.ConfigDir
+func NewDaemon(config DaemonConfig) *Daemon {
+	return &Daemon{
+		config:   config,
+		folders:  make(map[string]*Fybrk),
+		failures: make(map[string]error),
+	}
+}
+
+// Start opens the shared listener and starts syncing every registered
+// folder that is not paused. A folder that fails to start is reported by
+// Folders and does not stop the others.
+func (d *Daemon) Start() error {
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", d.config.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for peers: %w", err)
+	}
+	d.mux = transport.NewMux(listener)
+
+	for _, folder := range folders {
+		if folder.Paused {
+			continue
+		}
+		if err := d.startFolder(folder); err != nil {
+			fmt.Printf("Error starting folder %s: %v\n", folder.Path, err)
+		}
+	}
+	return nil
+}
+
+// Port returns the port peers connect to
+func (d *Daemon) Port() int {
+	if d.mux == nil {
+		return 0
+	}
+	return d.mux.Port()
+}
+
+// AddFolder registers a directory and, if the daemon is running, starts
+// syncing it
+func (d *Daemon) AddFolder(path string) (*config.Folder, error) {
+	folder, err := config.AddFolder(d.config.ConfigDir, path)
+	if err != nil {
+		return nil, err
+	}
+	if d.mux != nil {
+		if err := d.startFolder(folder); err != nil {
+			return folder, err
+		}
+	}
+	return folder, nil
+}
+
+// RemoveFolder stops syncing a folder and removes it from the registry. Its
+// files and .fybrk data are left in place.
+func (d *Daemon) RemoveFolder(idOrPath string) (*config.Folder, error) {
+	if idOrPath == "" {
+		return nil, config.ErrFolderNotFound
+	}
+	folder, err := config.RemoveFolder(d.config.ConfigDir, idOrPath)
+	if err != nil {
+		return nil, err
+	}
+	return folder, d.stopFolder(folder.ID)
+}
+
+// Folder returns the instance syncing the folder with the given ID or path
+func (d *Daemon) Folder(idOrPath string) (*Fybrk, error) {
+	if idOrPath == "" {
+		return nil, config.ErrFolderNotFound
+	}
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+	folder := config.FindFolder(folders, idOrPath)
+	if folder == nil {
+		return nil, config.ErrFolderNotFound
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.folders[folder.ID]
+	if !ok {
+		return nil, fmt.Errorf("folder %s is not running", folder.Path)
+	}
+	return f, nil
+}
+
+// Folders returns the registered folders and whether each is syncing
+func (d *Daemon) Folders() ([]*FolderStatus, error) {
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	statuses := make([]*FolderStatus, 0, len(folders))
+	for _, folder := range folders {
+		status := &FolderStatus{Folder: folder, Error: d.failures[folder.ID]}
+		if f, ok := d.folders[folder.ID]; ok {
+			status.Running = true
+			status.Peers = f.syncEngine.PeerCount()
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Path < statuses[j].Path })
+	return statuses, nil
+}
+
+// Reload re-reads the folder registry, starting folders that were added or
+// resumed and stopping folders that were removed or paused since the daemon
+// last looked. It returns how many folders it started and stopped.
+func (d *Daemon) Reload() (started, stopped int, err error) {
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	wanted := make(map[string]*config.Folder)
+	for _, folder := range folders {
+		if !folder.Paused {
+			wanted[folder.ID] = folder
+		}
+	}
+
+	d.mu.Lock()
+	var stale []string
+	for id := range d.folders {
+		if wanted[id] == nil {
+			stale = append(stale, id)
+		}
+	}
+	for id := range d.failures {
+		if wanted[id] == nil {
+			delete(d.failures, id)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, id := range stale {
+		if err := d.stopFolder(id); err != nil {
+			fmt.Printf("Error stopping folder: %v\n", err)
+		}
+		stopped++
+	}
+	for _, folder := range folders {
+		if wanted[folder.ID] == nil || d.running(folder.ID) {
+			continue
+		}
+		if err := d.startFolder(folder); err != nil {
+			fmt.Printf("Error starting folder %s: %v\n", folder.Path, err)
+			continue
+		}
+		started++
+	}
+	return started, stopped, nil
+}
+
+// SetTrashRetention changes how long every folder, running or started
+// later, keeps files deleted by peers
+func (d *Daemon) SetTrashRetention(retention time.Duration) {
+	d.startMu.Lock()
+	defer d.startMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config.TrashRetention = retention
+	for _, f := range d.folders {
+		f.SetTrashRetention(retention)
+	}
+}
+
+func (d *Daemon) running(folderID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.folders[folderID]
+	return ok
+}
+
+// startFolder opens a folder, creating its key on first use, and joins it
+// to the shared listener. A folder that is already running is left alone.
+func (d *Daemon) startFolder(folder *config.Folder) error {
+	d.startMu.Lock()
+	defer d.startMu.Unlock()
+	if d.running(folder.ID) {
+		return nil
+	}
+
+	folderConfig := Config{
+		SyncPath:       folder.Path,
+		Identity:       d.config.Identity,
+		ConfirmPairing: d.config.ConfirmPairing,
+		TrashRetention: d.config.TrashRetention,
+		mux:            d.mux,
+		folderID:       folder.ID,
+	}
+	if d.config.Passphrase != nil {
+		folderConfig.Passphrase = d.config.Passphrase(folder.Path)
+	}
+
+	f, err := New(folderConfig)
+	if err == nil {
+		if err = f.StartSync(); err != nil {
+			f.Close()
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.failures[folder.ID] = err
+		return err
+	}
+	delete(d.failures, folder.ID)
+	d.folders[folder.ID] = f
+	return nil
+}
+
+// stopFolder stops syncing a folder, if it is running
+func (d *Daemon) stopFolder(folderID string) error {
+	d.mu.Lock()
+	f := d.folders[folderID]
+	delete(d.folders, folderID)
+	delete(d.failures, folderID)
+	d.mu.Unlock()
+
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
+
+// Shutdown stops syncing every folder as Fybrk.Shutdown does, each given up
+// to timeout to finish its transfers, and closes the shared listener. The
+// summary adds up those of all folders.
+func (d *Daemon) Shutdown(timeout time.Duration) (*ShutdownSummary, error) {
+	d.startMu.Lock()
+	defer d.startMu.Unlock()
+
+	d.mu.Lock()
+	folders := d.folders
+	d.folders = make(map[string]*Fybrk)
+	d.mu.Unlock()
+
+	if d.mux != nil {
+		// Stop taking new peers for any folder before draining
+		d.mux.Close()
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		total    = &ShutdownSummary{}
+		firstErr error
+	)
+	for _, f := range folders {
+		wg.Add(1)
+		go func(f *Fybrk) {
+			defer wg.Done()
+			summary, err := f.Shutdown(timeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			total.Peers += summary.Peers
+			total.FilesSent += summary.FilesSent
+			total.FilesReceived += summary.FilesReceived
+			total.Interrupted += summary.Interrupted
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(f)
+	}
+	wg.Wait()
+	return total, firstErr
+}
+
+// Close stops syncing every folder without waiting for transfers
+func (d *Daemon) Close() error {
+	_, err := d.Shutdown(0)
+	return err
+}
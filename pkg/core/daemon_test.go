@@ -0,0 +1,167 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+)
+
+func TestDaemon_SyncsFoldersOverOnePort(t *testing.T) {
+	configDir := t.TempDir()
+	photos, documents := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(photos, "cat.jpg"), []byte("meow"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(documents, "letter.txt"), []byte("dear"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	daemon := NewDaemon(DaemonConfig{ConfigDir: configDir})
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer daemon.Close()
+
+	photosFolder, err := daemon.AddFolder(photos)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := daemon.AddFolder(documents); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := daemon.AddFolder(filepath.Join(photos, "nested")); err == nil {
+		t.Error("Expected error for a folder inside another")
+	}
+
+	// Each folder has its own key
+	photosSync, err := daemon.Folder(photosFolder.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	documentsSync, err := daemon.Folder(documents)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if string(photosSync.GetKey()) == string(documentsSync.GetKey()) {
+		t.Fatal("Expected each folder to have its own key")
+	}
+
+	// A device holding the photos key reaches the photos folder through
+	// the daemon's port, and only that folder
+	copyDir := t.TempDir()
+	if err := adoptFolderKey(copyDir, photosSync.GetKey(), nil); err != nil {
+		t.Fatalf("Failed to store key: %v", err)
+	}
+	other, err := New(Config{SyncPath: copyDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer other.Close()
+	if err := other.StartSync(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := other.ConnectToPeer(fmt.Sprintf("localhost:%d", daemon.Port())); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	waitForFile(t, filepath.Join(copyDir, "cat.jpg"), "meow")
+	if _, err := os.Stat(filepath.Join(copyDir, "letter.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected letter.txt not to be synced, got: %v", err)
+	}
+
+	// Removing a folder stops it but keeps its data
+	if _, err := daemon.RemoveFolder(""); err == nil {
+		t.Error("Expected error for an empty folder")
+	}
+	if _, err := daemon.RemoveFolder(photosFolder.ID); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := daemon.Folder(photosFolder.ID); err != config.ErrFolderNotFound {
+		t.Errorf("Expected ErrFolderNotFound, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(photos, ".fybrk", "key")); err != nil {
+		t.Errorf("Expected the folder key to be kept, got: %v", err)
+	}
+}
+
+func TestDaemon_SetTrashRetention(t *testing.T) {
+	configDir := t.TempDir()
+	syncPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(syncPath, "report.txt"), []byte("report"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	folder, err := config.AddFolder(configDir, syncPath)
+	if err != nil {
+		t.Fatalf("Failed to add folder: %v", err)
+	}
+
+	daemon := NewDaemon(DaemonConfig{ConfigDir: configDir})
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer daemon.Close()
+	f, err := daemon.Folder(folder.ID)
+	if err != nil {
+		t.Fatalf("Expected the registered folder to be running, got: %v", err)
+	}
+	if err := f.syncEngine.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileDelete, Path: "report.txt"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// Running folders expire their trash under the new retention
+	daemon.SetTrashRetention(time.Nanosecond)
+	removed, err := f.trash.Expire()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 file expired from the trash, got %d", removed)
+	}
+	if daemon.config.TrashRetention != time.Nanosecond {
+		t.Errorf("Expected folders started later to get the new retention, got %v", daemon.config.TrashRetention)
+	}
+}
+
+func TestDaemon_ReloadsRegistry(t *testing.T) {
+	configDir := t.TempDir()
+	first, err := config.AddFolder(configDir, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to add folder: %v", err)
+	}
+
+	daemon := NewDaemon(DaemonConfig{ConfigDir: configDir})
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer daemon.Close()
+	if _, err := daemon.Folder(first.ID); err != nil {
+		t.Fatalf("Expected the registered folder to be running, got: %v", err)
+	}
+
+	// Folders added and removed from another process apply on reload
+	second, err := config.AddFolder(configDir, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to add folder: %v", err)
+	}
+	if _, err := config.RemoveFolder(configDir, first.ID); err != nil {
+		t.Fatalf("Failed to remove folder: %v", err)
+	}
+	started, stopped, err := daemon.Reload()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if started != 1 || stopped != 1 {
+		t.Errorf("Expected 1 folder started and 1 stopped, got %d and %d", started, stopped)
+	}
+
+	statuses, err := daemon.Folders()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].ID != second.ID || !statuses[0].Running {
+		t.Errorf("Expected only the second folder running, got %+v", statuses)
+	}
+}
@@ -1,15 +1,23 @@
 package core
 
 import (
+	"bytes"
 	"crypto/rand"
 	"database/sql"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/pairing"
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/internal/transport"
+	"github.com/Fybrk/fybrk/pkg/types"
 	_ "modernc.org/sqlite"
 )
 
@@ -18,19 +26,56 @@ type Fybrk struct {
 	syncPath       string
 	db             *sql.DB
 	key            []byte
+	passphrase     func() (string, error)
+	trash          *storage.Trash
 	syncEngine     *SyncEngine
 	networkManager *NetworkManager
+	identity       *identity.Identity
+	pairing        *pairing.DevicePairingManager
+
+	mu           sync.Mutex
+	pairListener net.Listener
+	shutdown     *ShutdownSummary
 }
 
 // Config holds configuration for Fybrk instance
 type Config struct {
 	SyncPath string
+
+	// Passphrase unlocks a passphrase protected key file. It is only
+	// called when .fybrk/key is sealed.
+	Passphrase func() (string, error)
+
+	// Identity is the device's signing key pair, shown to devices it pairs
+	// with. A throwaway identity is generated when it is not set.
+	Identity *identity.Identity
+
+	// ConfirmPairing asks the user whether the other device shows the same
+	// six digit code. Pairing is refused when it is not set.
+	ConfirmPairing func(code, deviceName string) (bool, error)
+
+	// TrashRetention is how long files deleted by peers are kept in
+	// .fybrk/trash. It defaults to storage.DefaultTrashRetention.
+	TrashRetention time.Duration
+
+	// A folder run by a Daemon takes its peers from the daemon's shared
+	// listener, registered under its folder ID, instead of a port of its own
+	mux      *transport.Mux
+	folderID string
 }
 
 // PairData represents pairing information
 type PairData struct {
 	URL       string
 	ExpiresAt time.Time
+
+	done chan error
+}
+
+// Wait blocks until a device has used the pair URL or it expired, and
+// reports whether pairing succeeded
+func (p *PairData) Wait() error {
+	return <-p.done
 }
 
 // New creates a new Fybrk instance with auto-initialization
@@ -45,8 +90,17 @@ func New(config Config) (*Fybrk, error) {
 		return nil, fmt.Errorf("invalid sync path: %w", err)
 	}
 
+	if config.Identity == nil {
+		if config.Identity, err = identity.Generate(); err != nil {
+			return nil, fmt.Errorf("failed to create device identity: %w", err)
+		}
+	}
+
 	f := &Fybrk{
-		syncPath: absPath,
+		syncPath:   absPath,
+		passphrase: config.Passphrase,
+		identity:   config.Identity,
+		pairing:    newPairingManager(config),
 	}
 
 	// Auto-initialize
@@ -54,6 +108,15 @@ func New(config Config) (*Fybrk, error) {
 		return nil, fmt.Errorf("initialization failed: %w", err)
 	}
 
+	retention := config.TrashRetention
+	if retention == 0 {
+		retention = storage.DefaultTrashRetention
+	}
+	if f.trash, err = storage.NewTrash(filepath.Join(absPath, ".fybrk", "trash"), retention); err != nil {
+		f.db.Close()
+		return nil, fmt.Errorf("initialization failed: %w", err)
+	}
+
 	// Initialize sync engine
 	syncEngine, err := NewSyncEngine(f)
 	if err != nil {
@@ -63,6 +126,8 @@ func New(config Config) (*Fybrk, error) {
 
 	// Initialize network manager
 	f.networkManager = NewNetworkManager(f, syncEngine)
+	f.networkManager.mux = config.mux
+	f.networkManager.folderID = config.folderID
 
 	return f, nil
 }
@@ -98,11 +163,13 @@ func (f *Fybrk) initializeKey() error {
 	keyPath := filepath.Join(f.syncPath, ".fybrk", "key")
 
 	// Try to load existing key
-	if data, err := os.ReadFile(keyPath); err == nil {
-		if len(data) == 32 {
-			f.key = data
-			return nil
-		}
+	key, _, err := storage.ReadKeyFile(keyPath, f.passphrase)
+	if err == nil {
+		f.key = key
+		return nil
+	}
+	if !os.IsNotExist(err) && !errors.Is(err, storage.ErrInvalidKeySize) {
+		return fmt.Errorf("failed to load key: %w", err)
 	}
 
 	// Generate new key
@@ -119,6 +186,16 @@ func (f *Fybrk) initializeKey() error {
 	return nil
 }
 
+// ChangePassphrase re-seals the key file under a new passphrase. An empty
+// passphrase stores the key unprotected again.
+func (f *Fybrk) ChangePassphrase(passphrase string) error {
+	keyPath := filepath.Join(f.syncPath, ".fybrk", "key")
+	if err := storage.WriteKeyFile(keyPath, f.key, passphrase); err != nil {
+		return fmt.Errorf("failed to save key: %w", err)
+	}
+	return nil
+}
+
 // initializeDatabase sets up SQLite database with robust error handling
 func (f *Fybrk) initializeDatabase() error {
 	dbPath := filepath.Join(f.syncPath, ".fybrk", "metadata.db")
@@ -130,7 +207,7 @@ func (f *Fybrk) initializeDatabase() error {
 	}
 
 	// Open database with proper settings
-	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_synchronous=NORMAL&_timeout=5000")
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
@@ -160,6 +237,7 @@ func (f *Fybrk) createTables(db *sql.DB) error {
 		size INTEGER NOT NULL,
 		modified_at INTEGER NOT NULL,
 		hash TEXT NOT NULL,
+		version_vector TEXT NOT NULL DEFAULT '{}',
 		created_at INTEGER DEFAULT (strftime('%s', 'now'))
 	);
 	
@@ -167,65 +245,227 @@ func (f *Fybrk) createTables(db *sql.DB) error {
 	CREATE INDEX IF NOT EXISTS idx_files_modified ON files(modified_at);
 	`
 
-	_, err := db.Exec(schema)
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	// Databases created before files had version vectors
+	var found int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('files') WHERE name = 'version_vector'`).Scan(&found)
+	if err != nil || found > 0 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE files ADD COLUMN version_vector TEXT NOT NULL DEFAULT '{}'`)
 	return err
 }
 
-// GeneratePairData creates pairing information for other devices
+// GeneratePairData creates a one-time pair URL for another device. This
+// instance waits for that device on a separate port until the URL expires;
+// the folder key is handed over only after the users have compared codes.
+// Generating a new URL invalidates the previous one.
 func (f *Fybrk) GeneratePairData() (*PairData, error) {
 	if f.key == nil {
 		return nil, fmt.Errorf("encryption key not initialized")
 	}
 
-	// Create pairing URL with minimal data
-	keyHex := hex.EncodeToString(f.key)
-	expiresAt := time.Now().Add(10 * time.Minute)
+	secret, expiresAt, err := f.pairing.NewPairingSecret(PairTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, done, err := f.startPairingListener(expiresAt)
+	if err != nil {
+		return nil, err
+	}
 
-	// Simple URL format - easy to copy/paste
-	url := fmt.Sprintf("fybrk://pair?key=%s&path=%s&expires=%d",
-		keyHex, f.syncPath, expiresAt.Unix())
+	token := &PairToken{
+		DeviceID:  f.identity.DeviceID(),
+		Secret:    secret,
+		Addresses: addresses,
+		ExpiresAt: expiresAt,
+	}
 
 	return &PairData{
-		URL:       url,
+		URL:       token.URL(),
 		ExpiresAt: expiresAt,
+		done:      done,
 	}, nil
 }
 
-// JoinFromPairData joins an existing sync from pairing URL
-func JoinFromPairData(pairURL string, localPath string) (*Fybrk, error) {
-	if !strings.HasPrefix(pairURL, "fybrk://pair?") {
-		return nil, fmt.Errorf("invalid pairing URL format")
+// JoinFromPairData joins the folder another device shared as pairURL. It
+// pairs with that device to receive the folder key, stores the key in
+// config.SyncPath, connects to the device and fetches everything this side
+// is missing. The returned instance is already syncing live.
+func JoinFromPairData(pairURL string, config Config) (*Fybrk, error) {
+	token, err := ParsePairURL(pairURL)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Parse URL and extract key, remote path, etc.
-	// For MVP, create local instance and return
-
-	if localPath == "" {
+	if config.SyncPath == "" {
 		// Default to current directory
-		localPath = "."
+		config.SyncPath = "."
+	}
+	if config.Identity == nil {
+		if config.Identity, err = identity.Generate(); err != nil {
+			return nil, fmt.Errorf("failed to create device identity: %w", err)
+		}
+	}
+
+	welcome, err := requestFolderKey(token, newPairingManager(config))
+	if err != nil {
+		return nil, err
+	}
+	if len(welcome.SyncAddresses) == 0 {
+		return nil, fmt.Errorf("the inviting device is not running sync")
+	}
+	if err := adoptFolderKey(config.SyncPath, welcome.Keys[0], config.Passphrase); err != nil {
+		return nil, err
+	}
+
+	f, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.StartSync(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to start sync: %w", err)
+	}
+
+	peer, err := f.connectToAny(welcome.SyncAddresses)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	fmt.Println("Fetching files...")
+	if err := peer.WaitReconciled(ReconcileTimeout); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("initial sync failed: %w", err)
+	}
+
+	return f, nil
+}
+
+// adoptFolderKey stores the key received while pairing as the folder key.
+// A folder that already belongs to a different sync is left alone.
+func adoptFolderKey(syncPath string, key []byte, passphrase func() (string, error)) error {
+	fybrDir := filepath.Join(syncPath, ".fybrk")
+	keyPath := filepath.Join(fybrDir, "key")
+
+	existing, _, err := storage.ReadKeyFile(keyPath, passphrase)
+	if err == nil {
+		if !bytes.Equal(existing, key) {
+			return fmt.Errorf("%s is already synced with a different folder", syncPath)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) && !errors.Is(err, storage.ErrInvalidKeySize) {
+		return fmt.Errorf("failed to load key: %w", err)
 	}
 
-	config := Config{SyncPath: localPath}
-	return New(config)
+	if err := os.MkdirAll(fybrDir, 0755); err != nil {
+		return fmt.Errorf("failed to create .fybrk directory: %w", err)
+	}
+	if err := storage.WriteKeyFile(keyPath, key, ""); err != nil {
+		return fmt.Errorf("failed to save key: %w", err)
+	}
+	return nil
+}
+
+// connectToAny connects to the first reachable address
+func (f *Fybrk) connectToAny(addresses []string) (*Peer, error) {
+	var lastErr error
+	for _, address := range addresses {
+		peer, err := f.networkManager.connect(address)
+		if err == nil {
+			return peer, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("could not connect to the inviting device: %w", lastErr)
+}
+
+// newPairingManager sets up pairing with the identity and confirmation
+// prompt from config
+func newPairingManager(config Config) *pairing.DevicePairingManager {
+	pm := pairing.NewDevicePairingManager(config.Identity, pairing.DefaultDeviceName())
+	if config.ConfirmPairing != nil {
+		pm.SetConfirmCallback(func(sas string, device *pairing.PairedDevice) (bool, error) {
+			return config.ConfirmPairing(sas, device.Name)
+		})
+	}
+	return pm
 }
 
 // IsValidPairURL checks if a string is a valid pairing URL
 func IsValidPairURL(s string) bool {
-	return strings.HasPrefix(s, "fybrk://pair?")
+	return pairing.IsValidPairURL(s)
 }
 
-// Close cleanly shuts down the Fybrk instance
-func (f *Fybrk) Close() error {
+// ShutdownSummary describes what happened during a sync session
+type ShutdownSummary struct {
+	Peers         int   // peers connected when shutdown began
+	FilesSent     int64 // files sent to peers
+	FilesReceived int64 // files received from peers
+	Interrupted   int   // transfers still in progress when the drain timed out
+}
+
+// Shutdown stops syncing cleanly. It stops watching for changes and
+// accepting peers and cancels any pair URL, waits up to timeout for
+// transfers in progress to finish, disconnects from peers and flushes the
+// database. Calling it again returns the first summary.
+func (f *Fybrk) Shutdown(timeout time.Duration) (*ShutdownSummary, error) {
+	f.mu.Lock()
+	if f.shutdown != nil {
+		f.mu.Unlock()
+		return f.shutdown, nil
+	}
+	summary := &ShutdownSummary{}
+	f.shutdown = summary
+	if f.pairListener != nil {
+		f.pairListener.Close()
+	}
+	f.mu.Unlock()
+
 	if f.syncEngine != nil {
+		summary.Peers = f.syncEngine.PeerCount()
 		f.syncEngine.Stop()
 	}
+	if f.networkManager != nil {
+		f.networkManager.StopAccepting()
+	}
+	if f.syncEngine != nil {
+		summary.Interrupted = f.syncEngine.Drain(timeout)
+	}
 	if f.networkManager != nil {
 		f.networkManager.Stop()
 	}
+	if f.syncEngine != nil {
+		// Let messages that arrived before the connections closed finish
+		// with the database
+		f.syncEngine.waitIdle(5 * time.Second)
+		summary.FilesSent = f.syncEngine.filesSent.Load()
+		summary.FilesReceived = f.syncEngine.filesReceived.Load()
+	}
+
 	if f.db != nil {
-		return f.db.Close()
+		// Fold the write-ahead log into the database before closing it
+		if _, err := f.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			fmt.Printf("Warning: failed to checkpoint database: %v\n", err)
+		}
+		if err := f.db.Close(); err != nil {
+			return summary, fmt.Errorf("failed to close database: %w", err)
+		}
 	}
-	return nil
+	return summary, nil
+}
+
+// Close shuts down the Fybrk instance without waiting for transfers
+func (f *Fybrk) Close() error {
+	_, err := f.Shutdown(0)
+	return err
 }
 
 // GetSyncPath returns the current sync path
@@ -238,48 +478,112 @@ func (f *Fybrk) GetKey() []byte {
 	return f.key
 }
 
-// FileRecord represents a file in the database
+// FileRecord represents a file in the database. VersionVector counts the
+// changes each device made to the file; it is empty for files recorded
+// before vectors were kept.
 type FileRecord struct {
-	ID         int64
-	Path       string
-	Size       int64
-	ModifiedAt time.Time
-	Hash       string
-	CreatedAt  time.Time
+	ID            int64
+	Path          string
+	Size          int64
+	ModifiedAt    time.Time
+	Hash          string
+	VersionVector types.VersionVector
+	CreatedAt     time.Time
 }
 
 // updateFileRecord updates or inserts a file record
-func (f *Fybrk) updateFileRecord(path string, size int64, modTime time.Time, hash string) error {
+func (f *Fybrk) updateFileRecord(path string, size int64, modTime time.Time, hash string, vector types.VersionVector) error {
+	encoded, err := json.Marshal(vector)
+	if err != nil {
+		return err
+	}
+	if vector == nil {
+		encoded = []byte("{}")
+	}
+
 	query := `
-		INSERT OR REPLACE INTO files (path, size, modified_at, hash)
-		VALUES (?, ?, ?, ?)
+		INSERT OR REPLACE INTO files (path, size, modified_at, hash, version_vector)
+		VALUES (?, ?, ?, ?, ?)
 	`
-	_, err := f.db.Exec(query, path, size, modTime.Unix(), hash)
+	_, err = f.db.Exec(query, path, size, modTime.Unix(), hash, string(encoded))
 	return err
 }
 
-// getFileRecord retrieves a file record
-func (f *Fybrk) getFileRecord(path string) (*FileRecord, error) {
-	query := `
-		SELECT id, path, size, modified_at, hash, created_at
-		FROM files WHERE path = ?
-	`
-	row := f.db.QueryRow(query, path)
+// recordLocalChange records the file at path as found on disk. If its
+// content changed, the new version descends from the one it replaced and
+// counts one more change by this device; otherwise its version is kept.
+// It returns the record and whether the content changed.
+func (f *Fybrk) recordLocalChange(path string, size int64, modTime time.Time, hash string) (*FileRecord, bool, error) {
+	var vector types.VersionVector
+	existing, err := f.getFileRecord(path)
+	switch {
+	case err == nil && existing.Hash == hash:
+		vector = existing.VersionVector
+	case err == nil:
+		vector = existing.VersionVector.Increment(f.identity.DeviceID())
+	case errors.Is(err, sql.ErrNoRows):
+		vector = types.VersionVector{}.Increment(f.identity.DeviceID())
+	default:
+		return nil, false, err
+	}
+
+	if err := f.updateFileRecord(path, size, modTime, hash, vector); err != nil {
+		return nil, false, err
+	}
+	record := &FileRecord{Path: path, Size: size, ModifiedAt: modTime, Hash: hash, VersionVector: vector}
+	return record, existing == nil || existing.Hash != hash, nil
+}
 
+const fileRecordColumns = `id, path, size, modified_at, hash, version_vector, created_at`
+
+// scanFileRecord reads a row of fileRecordColumns
+func scanFileRecord(row interface{ Scan(...any) error }) (*FileRecord, error) {
 	var record FileRecord
 	var modifiedAt, createdAt int64
+	var vector string
 
-	err := row.Scan(&record.ID, &record.Path, &record.Size, &modifiedAt, &record.Hash, &createdAt)
-	if err != nil {
+	if err := row.Scan(&record.ID, &record.Path, &record.Size, &modifiedAt, &record.Hash, &vector, &createdAt); err != nil {
 		return nil, err
 	}
+	if err := json.Unmarshal([]byte(vector), &record.VersionVector); err != nil {
+		return nil, fmt.Errorf("invalid version vector for %s: %w", record.Path, err)
+	}
+	if len(record.VersionVector) == 0 {
+		record.VersionVector = nil
+	}
 
 	record.ModifiedAt = time.Unix(modifiedAt, 0)
 	record.CreatedAt = time.Unix(createdAt, 0)
-
 	return &record, nil
 }
 
+// getFileRecord retrieves a file record
+func (f *Fybrk) getFileRecord(path string) (*FileRecord, error) {
+	query := `SELECT ` + fileRecordColumns + ` FROM files WHERE path = ?`
+	return scanFileRecord(f.db.QueryRow(query, path))
+}
+
+// listFileRecords returns every tracked file
+func (f *Fybrk) listFileRecords() ([]*FileRecord, error) {
+	query := `SELECT ` + fileRecordColumns + ` FROM files ORDER BY path`
+	rows, err := f.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*FileRecord
+	for rows.Next() {
+		record, err := scanFileRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
 // deleteFileRecord removes a file record
 func (f *Fybrk) deleteFileRecord(path string) error {
 	query := `DELETE FROM files WHERE path = ?`
@@ -1,11 +1,16 @@
 package core
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/Fybrk/fybrk/pkg/types"
 )
 
 func TestNew_ValidPath(t *testing.T) {
@@ -161,6 +166,42 @@ func TestInitialize_LoadsExistingKey(t *testing.T) {
 	}
 }
 
+func TestInitialize_PassphraseProtectedKey(t *testing.T) {
+	tempDir := t.TempDir()
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	originalKey := fybrk.GetKey()
+
+	if err := fybrk.ChangePassphrase("hunter2"); err != nil {
+		t.Fatalf("Expected no error changing passphrase, got: %v", err)
+	}
+	fybrk.Close()
+
+	// Without a passphrase the sealed key cannot be opened, and is not replaced
+	if _, err := New(Config{SyncPath: tempDir}); err == nil {
+		t.Error("Expected error opening protected key without a passphrase")
+	}
+
+	wrong := func() (string, error) { return "wrong", nil }
+	if _, err := New(Config{SyncPath: tempDir, Passphrase: wrong}); err == nil {
+		t.Error("Expected error opening protected key with wrong passphrase")
+	}
+
+	right := func() (string, error) { return "hunter2", nil }
+	fybrk, err = New(Config{SyncPath: tempDir, Passphrase: right})
+	if err != nil {
+		t.Fatalf("Expected no error with correct passphrase, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	if string(fybrk.GetKey()) != string(originalKey) {
+		t.Error("Unlocked key should match the original key")
+	}
+}
+
 func TestInitialize_CreatesDatabase(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -246,7 +287,7 @@ func TestGeneratePairData_ValidData(t *testing.T) {
 	}
 }
 
-func TestGeneratePairData_ContainsKey(t *testing.T) {
+func TestGeneratePairData_OmitsKey(t *testing.T) {
 	tempDir := t.TempDir()
 
 	config := Config{SyncPath: tempDir}
@@ -263,16 +304,18 @@ func TestGeneratePairData_ContainsKey(t *testing.T) {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
 
-	if !strings.Contains(pairData.URL, "key=") {
-		t.Error("Expected URL to contain key parameter")
+	if strings.Contains(pairData.URL, "key=") || strings.Contains(pairData.URL, hex.EncodeToString(fybrk.GetKey())) {
+		t.Error("Expected URL not to contain the folder key")
 	}
 
-	if !strings.Contains(pairData.URL, "path=") {
-		t.Error("Expected URL to contain path parameter")
+	if strings.Contains(pairData.URL, "path=") {
+		t.Error("Expected URL not to contain the sync path")
 	}
 
-	if !strings.Contains(pairData.URL, "expires=") {
-		t.Error("Expected URL to contain expires parameter")
+	for _, param := range []string{"secret=", "addr=", "expires="} {
+		if !strings.Contains(pairData.URL, param) {
+			t.Errorf("Expected URL to contain %s parameter", param)
+		}
 	}
 }
 
@@ -308,26 +351,85 @@ func TestIsValidPairURL_InvalidURL(t *testing.T) {
 }
 
 func TestJoinFromPairData_ValidURL(t *testing.T) {
-	tempDir := t.TempDir()
-	pairURL := "fybrk://pair?key=abc123&path=/remote&expires=123456"
+	inviterDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inviterDir, "shared.txt"), []byte("from inviter"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(inviterDir, "docs"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(inviterDir, "docs", "empty.txt"), nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
 
-	fybrk, err := JoinFromPairData(pairURL, tempDir)
+	inviter, err := New(Config{SyncPath: inviterDir, ConfirmPairing: acceptAll})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer inviter.Close()
+	if err := inviter.StartSync(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
 
+	pairData, err := inviter.GeneratePairData()
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
-	defer fybrk.Close()
 
-	if fybrk.GetSyncPath() != tempDir {
-		t.Errorf("Expected sync path %s, got %s", tempDir, fybrk.GetSyncPath())
+	joinerDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(joinerDir, "local.txt"), []byte("from joiner"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
 	}
+
+	joiner, err := JoinFromPairData(pairData.URL, Config{SyncPath: joinerDir, ConfirmPairing: acceptAll})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer joiner.Close()
+
+	if joiner.GetSyncPath() != joinerDir {
+		t.Errorf("Expected sync path %s, got %s", joinerDir, joiner.GetSyncPath())
+	}
+	if !bytes.Equal(joiner.GetKey(), inviter.GetKey()) {
+		t.Error("Expected the joiner to adopt the inviter's folder key")
+	}
+
+	// The initial reconciliation has completed when JoinFromPairData returns
+	content, err := os.ReadFile(filepath.Join(joinerDir, "shared.txt"))
+	if err != nil || string(content) != "from inviter" {
+		t.Errorf("Expected shared.txt to be synced, got %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(joinerDir, "docs", "empty.txt")); err != nil {
+		t.Errorf("Expected docs/empty.txt to be synced: %v", err)
+	}
+
+	// The joiner's own files reach the inviter too
+	waitForFile(t, filepath.Join(inviterDir, "local.txt"), "from joiner")
+
+	// Live sync continues afterwards
+	if err := os.WriteFile(filepath.Join(inviterDir, "later.txt"), []byte("live"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	waitForFile(t, filepath.Join(joinerDir, "later.txt"), "live")
+}
+
+func waitForFile(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if content, err := os.ReadFile(path); err == nil && string(content) == want {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("Expected %s to contain %q", path, want)
 }
 
 func TestJoinFromPairData_InvalidURL(t *testing.T) {
 	tempDir := t.TempDir()
 	invalidURL := "not-a-fybrk-url"
 
-	_, err := JoinFromPairData(invalidURL, tempDir)
+	_, err := JoinFromPairData(invalidURL, Config{SyncPath: tempDir})
 
 	if err == nil {
 		t.Fatal("Expected error for invalid URL")
@@ -338,20 +440,42 @@ func TestJoinFromPairData_InvalidURL(t *testing.T) {
 	}
 }
 
-func TestJoinFromPairData_DefaultPath(t *testing.T) {
+func TestJoinFromPairData_LegacyURL(t *testing.T) {
 	pairURL := "fybrk://pair?key=abc123&path=/remote&expires=123456"
 
-	fybrk, err := JoinFromPairData(pairURL, "")
+	_, err := JoinFromPairData(pairURL, Config{SyncPath: t.TempDir()})
 
+	if !errors.Is(err, ErrLegacyPairURL) {
+		t.Errorf("Expected ErrLegacyPairURL, got: %v", err)
+	}
+}
+
+func TestJoinFromPairData_DifferentFolder(t *testing.T) {
+	inviter, err := New(Config{SyncPath: t.TempDir(), ConfirmPairing: acceptAll})
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
-	defer fybrk.Close()
+	defer inviter.Close()
+	if err := inviter.StartSync(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	pairData, err := inviter.GeneratePairData()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// A folder already synced under another key is not taken over
+	joinerDir := t.TempDir()
+	existing, err := New(Config{SyncPath: joinerDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	existing.Close()
 
-	// Should use current directory when no path specified
-	currentDir, _ := os.Getwd()
-	if fybrk.GetSyncPath() != currentDir {
-		t.Errorf("Expected current directory %s, got %s", currentDir, fybrk.GetSyncPath())
+	_, err = JoinFromPairData(pairData.URL, Config{SyncPath: joinerDir, ConfirmPairing: acceptAll})
+	if err == nil || !strings.Contains(err.Error(), "different folder") {
+		t.Errorf("Expected error about a different folder, got: %v", err)
 	}
 }
 
@@ -382,6 +506,496 @@ func TestClose_DatabaseConnection(t *testing.T) {
 	}
 }
 
+func TestShutdown_DrainsAndFlushes(t *testing.T) {
+	inviterDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inviterDir, "shared.txt"), []byte("from inviter"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	inviter, err := New(Config{SyncPath: inviterDir, ConfirmPairing: acceptAll})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer inviter.Close()
+	if err := inviter.StartSync(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	pairData, err := inviter.GeneratePairData()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	joinerDir := t.TempDir()
+	joiner, err := JoinFromPairData(pairData.URL, Config{SyncPath: joinerDir, ConfirmPairing: acceptAll})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer joiner.Close()
+
+	summary, err := joiner.Shutdown(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if summary.Peers != 1 {
+		t.Errorf("Expected 1 peer, got %d", summary.Peers)
+	}
+	if summary.FilesReceived != 1 {
+		t.Errorf("Expected 1 file received, got %d", summary.FilesReceived)
+	}
+	if summary.Interrupted != 0 {
+		t.Errorf("Expected no interrupted transfers, got %d", summary.Interrupted)
+	}
+
+	// The write-ahead log has been folded into the database
+	if info, err := os.Stat(filepath.Join(joinerDir, ".fybrk", "metadata.db-wal")); err == nil && info.Size() > 0 {
+		t.Errorf("Expected an empty write-ahead log, got %d bytes", info.Size())
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(joinerDir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".fybrk-tmp-") {
+			t.Errorf("Unexpected temporary file %s", entry.Name())
+		}
+	}
+
+	again, err := joiner.Shutdown(5 * time.Second)
+	if err != nil || again != summary {
+		t.Errorf("Expected a second shutdown to return the first summary, got %+v (%v)", again, err)
+	}
+
+	inviterSummary, err := inviter.Shutdown(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if inviterSummary.FilesSent != 1 {
+		t.Errorf("Expected 1 file sent, got %d", inviterSummary.FilesSent)
+	}
+}
+
+func TestPeerDelete_MovesToTrash(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "report.txt"), []byte("draft"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	msg := SyncMessage{Type: MsgFileDelete, Path: "report.txt"}
+	if err := fybrk.syncEngine.HandlePeerMessage("peer_1", msg); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "report.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected report.txt to be gone, got: %v", err)
+	}
+
+	entries, err := fybrk.trash.List()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "report.txt" || entries[0].DeletedBy != "peer_1" {
+		t.Fatalf("Expected report.txt in the trash, got %+v", entries)
+	}
+	content, err := os.ReadFile(filepath.Join(tempDir, ".fybrk", "trash", entries[0].ID, "report.txt"))
+	if err != nil || string(content) != "draft" {
+		t.Errorf("Expected the trashed file to keep its content, got %q (%v)", content, err)
+	}
+
+	// Deleting a file that is already gone is not an error
+	if err := fybrk.syncEngine.HandlePeerMessage("peer_1", msg); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+	if err := fybrk.syncEngine.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileDelete, Path: "../outside.txt"}); err == nil {
+		t.Error("Expected error for a path outside the sync folder")
+	}
+}
+
+func TestPeerDelete_KeepsChangedFile(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "report.txt"), []byte("edited here"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	s := fybrk.syncEngine
+	if err := s.watcher.InitialScan(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	peer := s.AddPeer("peer_1")
+
+	// The peer deleted a version without our edit: ours is kept and sent
+	// back, descending from the deletion
+	deletion := types.VersionVector{"peer_1": 1}
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileDelete, Path: "report.txt", VersionVector: deletion}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "report.txt")); err != nil {
+		t.Fatalf("Expected report.txt to be kept, got: %v", err)
+	}
+	msg := <-peer.SendCh
+	if msg.Type != MsgFileModify || msg.Path != "report.txt" || string(msg.Content) != "edited here" {
+		t.Fatalf("Expected report.txt sent back, got %+v", msg)
+	}
+	if msg.VersionVector.Compare(deletion) != types.Newer {
+		t.Errorf("Expected the kept version to descend from the deletion, got %v", msg.VersionVector)
+	}
+
+	// A deletion of our version goes through
+	deletion = msg.VersionVector.Increment("peer_1")
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileDelete, Path: "report.txt", VersionVector: deletion}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "report.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected report.txt to be gone, got: %v", err)
+	}
+	if _, err := fybrk.getFileRecord("report.txt"); err == nil {
+		t.Error("Expected report.txt to be untracked")
+	}
+}
+
+func TestLocalMove_SentAsMove(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "draft.txt"), []byte("draft"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	s := fybrk.syncEngine
+	if err := s.watcher.InitialScan(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	peer := s.AddPeer("peer_1")
+	record, err := fybrk.getFileRecord("draft.txt")
+	if err != nil {
+		t.Fatalf("Expected draft.txt to be tracked, got: %v", err)
+	}
+
+	// The deletion is held back until the file turns up elsewhere
+	s.handleFileEvent(FileEvent{Path: "draft.txt", Type: EventDelete})
+	if len(peer.SendCh) != 0 {
+		t.Fatalf("Expected nothing sent for the deletion yet, got %d messages", len(peer.SendCh))
+	}
+	s.handleFileEvent(FileEvent{Path: "final.txt", Type: EventCreate, Hash: record.Hash, Size: record.Size})
+
+	msg := <-peer.SendCh
+	if msg.Type != MsgFileMove || msg.OldPath != "draft.txt" || msg.Path != "final.txt" || len(msg.Content) != 0 {
+		t.Fatalf("Expected a move of draft.txt to final.txt without content, got %+v", msg)
+	}
+	if _, err := fybrk.getFileRecord("draft.txt"); err == nil {
+		t.Error("Expected draft.txt to be untracked")
+	}
+	moved := msg.VersionVector
+	if _, err := fybrk.getFileRecord("final.txt"); err != nil {
+		t.Errorf("Expected final.txt to be tracked, got: %v", err)
+	}
+
+	// A file that does not turn up elsewhere was deleted
+	s.handleFileEvent(FileEvent{Path: "final.txt", Type: EventDelete})
+	s.expireRemovals(true)
+	msg = <-peer.SendCh
+	if msg.Type != MsgFileDelete || msg.Path != "final.txt" {
+		t.Fatalf("Expected a deletion of final.txt, got %+v", msg)
+	}
+	if msg.VersionVector.Compare(moved) != types.Newer {
+		t.Errorf("Expected the deletion to descend from %v, got %v", moved, msg.VersionVector)
+	}
+}
+
+func TestPeerMove_RenamesFile(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "drafts"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for name, content := range map[string]string{"report.txt": "report", "notes.txt": "notes"} {
+		if err := os.WriteFile(filepath.Join(tempDir, "drafts", name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	s := fybrk.syncEngine
+	if err := s.watcher.InitialScan(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	peer := s.AddPeer("peer_1")
+	report, err := fybrk.getFileRecord(filepath.Join("drafts", "report.txt"))
+	if err != nil {
+		t.Fatalf("Expected report.txt to be tracked, got: %v", err)
+	}
+
+	// Our copy holds the moved content, so it is renamed in place
+	msg := SyncMessage{Type: MsgFileMove, OldPath: filepath.Join("drafts", "report.txt"), Path: filepath.Join("final", "report.txt"), Hash: report.Hash, Size: report.Size}
+	if err := s.HandlePeerMessage("peer_1", msg); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(tempDir, "final", "report.txt"))
+	if err != nil || string(content) != "report" {
+		t.Errorf("Expected final/report.txt to hold the report, got %q (%v)", content, err)
+	}
+	if _, err := fybrk.getFileRecord(msg.Path); err != nil {
+		t.Errorf("Expected final/report.txt to be tracked, got: %v", err)
+	}
+	if _, err := fybrk.getFileRecord(msg.OldPath); err == nil {
+		t.Error("Expected drafts/report.txt to be untracked")
+	}
+	if len(peer.SendCh) != 0 {
+		t.Errorf("Expected nothing requested from the peer, got %d messages", len(peer.SendCh))
+	}
+
+	// A copy with other content is handled as a deletion and a new file
+	msg = SyncMessage{Type: MsgFileMove, OldPath: filepath.Join("drafts", "notes.txt"), Path: "notes.txt", Hash: "other", Size: 5}
+	if err := s.HandlePeerMessage("peer_1", msg); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if entries, err := fybrk.trash.List(); err != nil || len(entries) != 1 || entries[0].Path != msg.OldPath {
+		t.Errorf("Expected drafts/notes.txt in the trash, got %+v (%v)", entries, err)
+	}
+	request := <-peer.SendCh
+	if request.Type != MsgFileReq || request.Path != "notes.txt" {
+		t.Errorf("Expected a request for notes.txt, got %+v", request)
+	}
+
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileMove, OldPath: "notes.txt", Path: "../outside.txt"}); err == nil {
+		t.Error("Expected error for a path outside the sync folder")
+	}
+}
+
+func TestPeerChanges_NotSentBack(t *testing.T) {
+	tempDir := t.TempDir()
+	for name, content := range map[string]string{"report.txt": "report", "notes.txt": "notes"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	s := fybrk.syncEngine
+	if err := s.watcher.InitialScan(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	peer := s.AddPeer("peer_1")
+	report, err := fybrk.getFileRecord("report.txt")
+	if err != nil {
+		t.Fatalf("Expected report.txt to be tracked, got: %v", err)
+	}
+
+	move := SyncMessage{Type: MsgFileMove, OldPath: "report.txt", Path: filepath.Join("final", "report.txt"), Hash: report.Hash, Size: report.Size}
+	if err := s.HandlePeerMessage("peer_1", move); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileDelete, Path: "notes.txt"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// The watcher then sees the changes applied; none are local
+	s.handleFileEvent(FileEvent{Path: "report.txt", Type: EventDelete})
+	s.handleFileEvent(FileEvent{Path: move.Path, Type: EventCreate, Hash: report.Hash, Size: report.Size})
+	s.handleFileEvent(FileEvent{Path: "notes.txt", Type: EventDelete})
+	s.expireRemovals(true)
+	if len(peer.SendCh) != 0 {
+		t.Errorf("Expected nothing sent to peers, got %+v", <-peer.SendCh)
+	}
+}
+
+func TestReconcile_MissingFileAndTies(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "report.txt"), []byte("report"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	s := fybrk.syncEngine
+	if err := s.watcher.InitialScan(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	peer := s.AddPeer("peer_1")
+	record, err := fybrk.getFileRecord("report.txt")
+	if err != nil {
+		t.Fatalf("Expected report.txt to be tracked, got: %v", err)
+	}
+
+	// A file that is gone is answered as missing
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileReq, Path: "gone.txt"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if reply := <-peer.SendCh; reply.Type != MsgFileMissing || reply.Path != "gone.txt" {
+		t.Fatalf("Expected gone.txt to be reported missing, got %+v", reply)
+	}
+
+	// Versions from the same second are ordered by hash, and only the
+	// greater one is requested
+	lower := FileEntry{Path: "report.txt", Hash: "0", Size: 1, ModTime: record.ModifiedAt}
+	higher := FileEntry{Path: "report.txt", Hash: "z", Size: 1, ModTime: record.ModifiedAt}
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileList, Files: []FileEntry{lower}}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(peer.SendCh) != 0 {
+		t.Fatalf("Expected nothing requested for the lower hash, got %d messages", len(peer.SendCh))
+	}
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileList, Files: []FileEntry{higher}}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if request := <-peer.SendCh; request.Type != MsgFileReq || request.Path != "report.txt" {
+		t.Fatalf("Expected a request for report.txt, got %+v", request)
+	}
+
+	// The peer answering that the file is gone ends reconciliation
+	if err := s.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileMissing, Path: "report.txt"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := peer.WaitReconciled(time.Second); err != nil {
+		t.Errorf("Expected reconciliation to finish, got: %v", err)
+	}
+
+	// A sender blocked on a full queue gives up when the peer goes away
+	for len(peer.SendCh) < cap(peer.SendCh) {
+		peer.SendCh <- SyncMessage{Type: MsgFileReq}
+	}
+	done := make(chan error, 1)
+	queued := peer.queued.Load()
+	go func() { done <- s.send("peer_1", SyncMessage{Type: MsgFileReq}) }()
+	for peer.queued.Load() == queued {
+		time.Sleep(time.Millisecond)
+	}
+	s.RemovePeer("peer_1")
+	select {
+	case err := <-done:
+		if err != ErrPeerDisconnected {
+			t.Errorf("Expected ErrPeerDisconnected, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the send to give up")
+	}
+}
+
+func TestVersionVectors_FastForwardStaleAndConcurrent(t *testing.T) {
+	tempDir := t.TempDir()
+	reportPath := filepath.Join(tempDir, "report.txt")
+	if err := os.WriteFile(reportPath, []byte("v1"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	s := fybrk.syncEngine
+	if err := s.watcher.InitialScan(); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	peer := s.AddPeer("peer_1")
+	me := fybrk.identity.DeviceID()
+	record, err := fybrk.getFileRecord("report.txt")
+	if err != nil {
+		t.Fatalf("Expected report.txt to be tracked, got: %v", err)
+	}
+	if !equalVectors(record.VersionVector, types.VersionVector{me: 1}) {
+		t.Fatalf("Expected the scan to count one change here, got %v", record.VersionVector)
+	}
+	earlier, later := record.ModifiedAt.Add(-time.Hour), record.ModifiedAt.Add(time.Hour)
+	expectContent := func(want string) {
+		t.Helper()
+		if content, err := os.ReadFile(reportPath); err != nil || string(content) != want {
+			t.Errorf("Expected report.txt to hold %q, got %q (%v)", want, content, err)
+		}
+	}
+	expectVector := func(want types.VersionVector) {
+		t.Helper()
+		record, err := fybrk.getFileRecord("report.txt")
+		if err != nil || !equalVectors(record.VersionVector, want) {
+			t.Errorf("Expected version %v, got %+v (%v)", want, record, err)
+		}
+	}
+	update := func(content string, modTime time.Time, vector types.VersionVector) {
+		t.Helper()
+		msg := SyncMessage{Type: MsgFileModify, Path: "report.txt", Hash: "hash of " + content, Size: int64(len(content)), ModTime: modTime, Content: []byte(content), VersionVector: vector}
+		if err := s.HandlePeerMessage("peer_1", msg); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	// A version that descends from ours replaces it, however old its time
+	update("v2", earlier, types.VersionVector{me: 1, "peer_1": 1})
+	expectContent("v2")
+	expectVector(types.VersionVector{me: 1, "peer_1": 1})
+
+	// A version ours descends from is ignored, however new its time
+	update("v1", later, types.VersionVector{me: 1})
+	expectContent("v2")
+
+	// Edited here and on the peer at once: ours is newer, so it is kept,
+	// takes on the peer's history and is sent back
+	if err := os.WriteFile(reportPath, []byte("ours"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	s.handleFileEvent(FileEvent{Path: "report.txt", Type: EventModify, Hash: "hash of ours", Size: 4, ModTime: later})
+	if msg := <-peer.SendCh; msg.Type != MsgFileModify || !equalVectors(msg.VersionVector, types.VersionVector{me: 2, "peer_1": 1}) {
+		t.Fatalf("Expected our edit to be sent with its version, got %+v", msg)
+	}
+	update("theirs", earlier, types.VersionVector{me: 1, "peer_1": 2})
+	expectContent("ours")
+	expectVector(types.VersionVector{me: 2, "peer_1": 2})
+	if msg := <-peer.SendCh; msg.Type != MsgFileModify || string(msg.Content) != "ours" || !equalVectors(msg.VersionVector, types.VersionVector{me: 2, "peer_1": 2}) {
+		t.Errorf("Expected our version to be sent back, got %+v", msg)
+	}
+
+	// The peer's is newer: it replaces ours, which is kept as a conflict
+	// copy
+	if err := os.WriteFile(reportPath, []byte("mine"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	s.handleFileEvent(FileEvent{Path: "report.txt", Type: EventModify, Hash: "hash of mine", Size: 4, ModTime: later})
+	<-peer.SendCh
+	update("yours", later.Add(time.Hour), types.VersionVector{me: 2, "peer_1": 3})
+	expectContent("yours")
+	expectVector(types.VersionVector{me: 3, "peer_1": 3})
+	copies, _ := filepath.Glob(filepath.Join(tempDir, "report.sync-conflict-*.txt"))
+	if len(copies) != 1 {
+		t.Fatalf("Expected one conflict copy, got %v", copies)
+	}
+	if content, err := os.ReadFile(copies[0]); err != nil || string(content) != "mine" {
+		t.Errorf("Expected the conflict copy to hold our version, got %q (%v)", content, err)
+	}
+}
+
+func equalVectors(a, b types.VersionVector) bool {
+	return a.Compare(b) == types.Equal
+}
+
 func TestMultipleInstances_SameDirectory(t *testing.T) {
 	tempDir := t.TempDir()
 
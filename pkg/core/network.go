@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/Fybrk/fybrk/internal/pairing"
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/internal/transport"
 	"github.com/gorilla/websocket"
 )
 
@@ -16,6 +20,14 @@ type NetworkManager struct {
 	server     *http.Server
 	upgrader   websocket.Upgrader
 	port       int
+
+	// Shared listener of a daemon, when the folder runs in one
+	mux      *transport.Mux
+	folderID string
+
+	// Open peer connections, closed on Stop
+	mu    sync.Mutex
+	conns map[*websocket.Conn]bool
 }
 
 // NewNetworkManager creates a new network manager
@@ -26,19 +38,39 @@ func NewNetworkManager(fybrk *Fybrk, syncEngine *SyncEngine) *NetworkManager {
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
-		port: 8080, // Default port
+		port:  8080, // Default port
+		conns: make(map[*websocket.Conn]bool),
 	}
 }
 
-// StartServer starts the WebSocket server for incoming connections
+// StartServer starts the WebSocket server for incoming connections. Every
+// connection is encrypted and must prove it holds the folder secret before
+// the WebSocket upgrade is even read.
 func (n *NetworkManager) StartServer() error {
-	// Find available port
-	listener, err := net.Listen("tcp", ":0")
+	secret, err := n.folderSecret()
 	if err != nil {
-		return fmt.Errorf("failed to find available port: %w", err)
+		return err
+	}
+
+	var secureListener net.Listener
+	if n.mux != nil {
+		// The daemon's listener authenticates peers and hands over those
+		// holding this folder's secret
+		conns := newConnListener(n.mux.Port())
+		if err := n.mux.Register(n.folderID, secret, conns.deliver); err != nil {
+			return err
+		}
+		n.port = n.mux.Port()
+		secureListener = conns
+	} else {
+		// Find available port
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return fmt.Errorf("failed to find available port: %w", err)
+		}
+		n.port = listener.Addr().(*net.TCPAddr).Port
+		secureListener = transport.NewListener(listener, secret)
 	}
-	n.port = listener.Addr().(*net.TCPAddr).Port
-	listener.Close()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/sync", n.handleWebSocket)
@@ -50,7 +82,7 @@ func (n *NetworkManager) StartServer() error {
 
 	go func() {
 		fmt.Printf("Server listening on port %d\n", n.port)
-		if err := n.server.ListenAndServe(); err != http.ErrServerClosed {
+		if err := n.server.Serve(secureListener); err != http.ErrServerClosed {
 			fmt.Printf("Server error: %v\n", err)
 		}
 	}()
@@ -58,6 +90,15 @@ func (n *NetworkManager) StartServer() error {
 	return nil
 }
 
+// folderSecret derives the secret peers authenticate with from the folder key
+func (n *NetworkManager) folderSecret() ([]byte, error) {
+	keyRing, err := storage.NewKeyRing(n.fybrk.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid folder key: %w", err)
+	}
+	return keyRing.TransportSecret()
+}
+
 // handleWebSocket handles incoming WebSocket connections
 func (n *NetworkManager) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := n.upgrader.Upgrade(w, r, nil)
@@ -66,6 +107,8 @@ func (n *NetworkManager) handleWebSocket(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	defer conn.Close()
+	n.track(conn)
+	defer n.untrack(conn)
 
 	peerID := fmt.Sprintf("peer_%d", time.Now().UnixNano())
 	peer := n.syncEngine.AddPeer(peerID)
@@ -74,6 +117,11 @@ func (n *NetworkManager) handleWebSocket(w http.ResponseWriter, r *http.Request)
 	// Start message sender goroutine
 	go n.messageSender(conn, peer)
 
+	// Let the peer catch up with what we have
+	if err := n.syncEngine.SendFileList(peer); err != nil {
+		fmt.Printf("Error sending file list: %v\n", err)
+	}
+
 	// Handle incoming messages
 	for {
 		var msg SyncMessage
@@ -97,13 +145,14 @@ func (n *NetworkManager) messageSender(conn *websocket.Conn, peer *Peer) {
 
 	for {
 		select {
-		case msg, ok := <-peer.SendCh:
-			if !ok {
-				conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-peer.disconnected:
+			conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
 
-			if err := conn.WriteJSON(msg); err != nil {
+		case msg := <-peer.SendCh:
+			err := conn.WriteJSON(msg)
+			n.syncEngine.sent(peer, msg, err)
+			if err != nil {
 				fmt.Printf("Error sending message: %v\n", err)
 				return
 			}
@@ -117,27 +166,57 @@ func (n *NetworkManager) messageSender(conn *websocket.Conn, peer *Peer) {
 	}
 }
 
-// ConnectToPeer connects to a remote peer
+// ConnectToPeer connects to a remote peer. Both sides exchange file lists
+// and fetch what they are missing, then keep each other up to date.
 func (n *NetworkManager) ConnectToPeer(address string) error {
-	url := fmt.Sprintf("ws://%s/sync", address)
+	_, err := n.connect(address)
+	return err
+}
+
+// connect dials a peer and starts reconciling with it
+func (n *NetworkManager) connect(address string) (*Peer, error) {
+	secret, err := n.folderSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	// The WebSocket runs inside the authenticated channel, so the URL scheme
+	// stays ws:// even though nothing crosses the network in clear
+	dialer := websocket.Dialer{
+		HandshakeTimeout: transport.HandshakeTimeout,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.DialTimeout(network, addr, transport.HandshakeTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return transport.Client(conn, secret)
+		},
+	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	url := fmt.Sprintf("ws://%s/sync", address)
+	conn, _, err := dialer.Dial(url, nil)
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer: %w", err)
+		return nil, fmt.Errorf("failed to connect to peer: %w", err)
 	}
 
+	n.track(conn)
 	peerID := fmt.Sprintf("remote_%s", address)
 	peer := n.syncEngine.AddPeer(peerID)
 
 	go n.messageSender(conn, peer)
 	go n.messageReceiver(conn, peerID)
 
-	return nil
+	if err := n.syncEngine.SendFileList(peer); err != nil {
+		return nil, err
+	}
+
+	return peer, nil
 }
 
 // messageReceiver receives messages from remote peer
 func (n *NetworkManager) messageReceiver(conn *websocket.Conn, peerID string) {
 	defer conn.Close()
+	defer n.untrack(conn)
 	defer n.syncEngine.RemovePeer(peerID)
 
 	for {
@@ -160,10 +239,92 @@ func (n *NetworkManager) GetLocalAddress() string {
 	return fmt.Sprintf("localhost:%d", n.port)
 }
 
-// Stop stops the network manager
-func (n *NetworkManager) Stop() error {
+// Addresses returns the addresses other devices may reach the sync server
+// on, or nil when it is not running
+func (n *NetworkManager) Addresses() []string {
+	if n.server == nil {
+		return nil
+	}
+	return pairing.AddressHints(n.port)
+}
+
+func (n *NetworkManager) track(conn *websocket.Conn) {
+	n.mu.Lock()
+	n.conns[conn] = true
+	n.mu.Unlock()
+}
+
+func (n *NetworkManager) untrack(conn *websocket.Conn) {
+	n.mu.Lock()
+	delete(n.conns, conn)
+	n.mu.Unlock()
+}
+
+// StopAccepting closes the server so no new peers connect. Peers already
+// connected keep syncing.
+func (n *NetworkManager) StopAccepting() error {
+	if n.mux != nil {
+		n.mux.Unregister(n.folderID)
+	}
 	if n.server != nil {
 		return n.server.Close()
 	}
 	return nil
 }
+
+// connListener hands the connections a daemon's shared listener routes to
+// one folder to that folder's server
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(port int) *connListener {
+	return &connListener{
+		addr:  &net.TCPAddr{Port: port},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// deliver is the mux handler of the folder
+func (l *connListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Stop closes the server and disconnects every peer
+func (n *NetworkManager) Stop() error {
+	err := n.StopAccepting()
+
+	n.mu.Lock()
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.mu.Unlock()
+
+	return err
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -117,3 +119,26 @@ func TestNetworkManagerStop(t *testing.T) {
 	err = nm.Stop()
 	assert.NoError(t, err)
 }
+
+func TestNetworkManagerRequiresFolderSecret(t *testing.T) {
+	server, err := New(Config{SyncPath: t.TempDir()})
+	require.NoError(t, err)
+	defer server.Close()
+	require.NoError(t, server.networkManager.StartServer())
+
+	// A device paired with the same folder key is accepted
+	pairedDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(pairedDir, ".fybrk"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pairedDir, ".fybrk", "key"), server.GetKey(), 0600))
+
+	paired, err := New(Config{SyncPath: pairedDir})
+	require.NoError(t, err)
+	defer paired.Close()
+	assert.NoError(t, paired.ConnectToPeer(server.GetServerAddress()))
+
+	// A device with some other key cannot connect
+	stranger, err := New(Config{SyncPath: t.TempDir()})
+	require.NoError(t, err)
+	defer stranger.Close()
+	assert.Error(t, stranger.ConnectToPeer(server.GetServerAddress()))
+}
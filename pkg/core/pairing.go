@@ -0,0 +1,112 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/pairing"
+	"github.com/Fybrk/fybrk/internal/storage"
+)
+
+const (
+	// PairTokenTTL is how long a pair URL can be used
+	PairTokenTTL = 10 * time.Minute
+	// ReconcileTimeout bounds the initial sync when joining a folder
+	ReconcileTimeout = 5 * time.Minute
+)
+
+var (
+	ErrPairTokenExpired = pairing.ErrPairTokenExpired
+	ErrLegacyPairURL    = pairing.ErrLegacyPairURL
+)
+
+// PairToken is what a pair URL carries; see pairing.PairToken
+type PairToken = pairing.PairToken
+
+// ParsePairURL decodes a pair URL and checks it has not expired
+func ParsePairURL(pairURL string) (*PairToken, error) {
+	return pairing.ParsePairURL(pairURL)
+}
+
+// startPairingListener opens a one-shot listener for the device holding
+// the current pair URL and returns the addresses to advertise. Any earlier
+// invitation is cancelled.
+func (f *Fybrk) startPairingListener(expires time.Time) ([]string, chan error, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen for pairing: %w", err)
+	}
+	listener.(*net.TCPListener).SetDeadline(expires)
+
+	f.mu.Lock()
+	if f.pairListener != nil {
+		f.pairListener.Close()
+	}
+	f.pairListener = listener
+	f.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f.servePairing(listener)
+	}()
+
+	return pairing.AddressHints(listener.Addr().(*net.TCPAddr).Port), done, nil
+}
+
+// servePairing accepts a single pairing attempt. The token is spent by the
+// attempt whether it succeeds or not.
+func (f *Fybrk) servePairing(listener net.Listener) error {
+	defer listener.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return fmt.Errorf("pairing cancelled")
+		}
+		return ErrPairTokenExpired
+	}
+
+	session, err := f.pairing.Accept(conn)
+	if err != nil {
+		fmt.Printf("Pairing failed: %v\n", err)
+		return err
+	}
+	defer session.Close()
+
+	keyRing, err := storage.NewKeyRing(f.key)
+	if err != nil {
+		return fmt.Errorf("failed to send folder key: %w", err)
+	}
+	if err := session.Send(pairing.NewWelcome(keyRing, f.networkManager.Addresses())); err != nil {
+		return fmt.Errorf("failed to send folder key: %w", err)
+	}
+
+	fmt.Printf("Paired with %s\n", session.Device.Name)
+	return nil
+}
+
+// requestFolderKey runs the joining side of pairing against the addresses
+// in token and returns what the inviting device sent. Folders here keep a
+// single key, so one whose key was rotated cannot be joined.
+func requestFolderKey(token *PairToken, pm *pairing.DevicePairingManager) (*pairing.Welcome, error) {
+	session, err := pm.InitiateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var welcome pairing.Welcome
+	if err := session.Receive(&welcome); err != nil {
+		return nil, fmt.Errorf("failed to receive folder key: %w", err)
+	}
+	keyRing, err := welcome.KeyRing()
+	if err != nil {
+		return nil, err
+	}
+	if keyRing.CurrentEpoch() != 0 {
+		return nil, fmt.Errorf("the folder key has been rotated, which this version cannot follow")
+	}
+	return &welcome, nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/pairing"
+)
+
+func acceptAll(code, deviceName string) (bool, error) {
+	return true, nil
+}
+
+func newJoiner(t *testing.T) *pairing.DevicePairingManager {
+	id, err := identity.Generate()
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	pm := pairing.NewDevicePairingManager(id, "joiner")
+	pm.SetConfirmCallback(func(sas string, device *pairing.PairedDevice) (bool, error) {
+		return true, nil
+	})
+	return pm
+}
+
+func TestPairing_DeliversKeyOnce(t *testing.T) {
+	inviter, err := New(Config{SyncPath: t.TempDir(), ConfirmPairing: acceptAll})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer inviter.Close()
+
+	pairData, err := inviter.GeneratePairData()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	token, err := ParsePairURL(pairData.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	// Only the loopback hint is certain to be reachable from the test
+	token.Addresses = token.Addresses[len(token.Addresses)-1:]
+
+	welcome, err := requestFolderKey(token, newJoiner(t))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !bytes.Equal(welcome.Keys[0], inviter.GetKey()) {
+		t.Error("Expected the inviter's folder key")
+	}
+	if err := pairData.Wait(); err != nil {
+		t.Errorf("Expected pairing to succeed, got: %v", err)
+	}
+
+	// The token is spent
+	if _, err := requestFolderKey(token, newJoiner(t)); err == nil {
+		t.Error("Expected a second use of the pair URL to fail")
+	}
+}
+
+func TestPairing_WrongSecret(t *testing.T) {
+	inviter, err := New(Config{SyncPath: t.TempDir(), ConfirmPairing: acceptAll})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer inviter.Close()
+
+	pairData, err := inviter.GeneratePairData()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	token, err := ParsePairURL(pairData.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	token.Addresses = token.Addresses[len(token.Addresses)-1:]
+	token.Secret = "d3Jvbmctc2VjcmV0"
+
+	if _, err := requestFolderKey(token, newJoiner(t)); err == nil {
+		t.Fatal("Expected pairing with a wrong secret to fail")
+	}
+	if err := pairData.Wait(); err == nil {
+		t.Error("Expected the inviter to report the failed attempt")
+	}
+}
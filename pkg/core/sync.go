@@ -1,18 +1,51 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/Fybrk/fybrk/pkg/types"
 )
 
+// ErrPeerDisconnected is returned when a peer goes away before the initial
+// reconciliation with it finished
+var ErrPeerDisconnected = errors.New("peer disconnected")
+
+// moveWindow is how long a deleted file waits to be paired with a file
+// created with the same content, as a move, before its deletion is sent
+const moveWindow = 2 * time.Second
+
 // SyncEngine handles bidirectional file synchronization
 type SyncEngine struct {
 	fybrk   *Fybrk
 	watcher *Watcher
+	mu      sync.RWMutex
 	peers   map[string]*Peer
 	running bool
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// Files deleted locally that may turn out to have been moved, by path.
+	// Only touched by the sync loop.
+	removed map[string]*removedFile
+
+	// Peer messages being handled, and totals for the shutdown summary
+	inFlight      atomic.Int64
+	filesSent     atomic.Int64
+	filesReceived atomic.Int64
+}
+
+// removedFile is a deleted file held back for the move window
+type removedFile struct {
+	record    *FileRecord
+	removedAt time.Time
 }
 
 // Peer represents a connected peer
@@ -20,17 +53,40 @@ type Peer struct {
 	ID       string
 	LastSeen time.Time
 	SendCh   chan SyncMessage
+
+	// Messages queued on SendCh that have not been written yet
+	queued atomic.Int64
+
+	// Initial reconciliation: the peer's file list arrived and every file
+	// requested from it has been received
+	mu           sync.Mutex
+	listed       bool
+	pending      map[string]bool
+	reconciled   chan struct{}
+	disconnected chan struct{}
+}
+
+// FileEntry describes one file in a file list
+type FileEntry struct {
+	Path          string              `json:"path"`
+	Hash          string              `json:"hash"`
+	Size          int64               `json:"size"`
+	ModTime       time.Time           `json:"mod_time"`
+	VersionVector types.VersionVector `json:"version_vector,omitempty"`
 }
 
 // SyncMessage represents a sync message between peers
 type SyncMessage struct {
-	Type     MessageType `json:"type"`
-	Path     string      `json:"path"`
-	Hash     string      `json:"hash"`
-	Size     int64       `json:"size"`
-	ModTime  time.Time   `json:"mod_time"`
-	Content  []byte      `json:"content,omitempty"`
-	Checksum string      `json:"checksum"`
+	Type          MessageType         `json:"type"`
+	Path          string              `json:"path"`
+	Hash          string              `json:"hash"`
+	Size          int64               `json:"size"`
+	ModTime       time.Time           `json:"mod_time"`
+	VersionVector types.VersionVector `json:"version_vector,omitempty"`
+	Content       []byte              `json:"content,omitempty"`
+	Checksum      string              `json:"checksum"`
+	Files         []FileEntry         `json:"files,omitempty"`
+	OldPath       string              `json:"old_path,omitempty"` // Where a moved file was
 }
 
 // MessageType represents the type of sync message
@@ -40,8 +96,12 @@ const (
 	MsgFileCreate MessageType = "file_create"
 	MsgFileModify MessageType = "file_modify"
 	MsgFileDelete MessageType = "file_delete"
+	MsgFileMove   MessageType = "file_move"
 	MsgFileList   MessageType = "file_list"
 	MsgFileReq    MessageType = "file_request"
+	// MsgFileMissing answers a request for a file that is gone; its
+	// deletion or move reaches the requester separately
+	MsgFileMissing MessageType = "file_missing"
 )
 
 // NewSyncEngine creates a new sync engine
@@ -55,12 +115,16 @@ func NewSyncEngine(fybrk *Fybrk) (*SyncEngine, error) {
 		fybrk:   fybrk,
 		watcher: watcher,
 		peers:   make(map[string]*Peer),
+		removed: make(map[string]*removedFile),
 	}, nil
 }
 
 // Start begins the sync engine
 func (s *SyncEngine) Start() error {
-	if s.running {
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	if running {
 		return fmt.Errorf("sync engine already running")
 	}
 
@@ -69,22 +133,46 @@ func (s *SyncEngine) Start() error {
 	if err := s.watcher.InitialScan(); err != nil {
 		return fmt.Errorf("initial scan failed: %w", err)
 	}
+	if removed, err := s.fybrk.trash.Expire(); err != nil {
+		fmt.Printf("Warning: failed to expire trash: %v\n", err)
+	} else if removed > 0 {
+		fmt.Printf("Removed %d expired files from the trash\n", removed)
+	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return fmt.Errorf("sync engine already running")
+	}
 	s.running = true
-	go s.syncLoop()
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.syncLoop(s.stop, s.stopped)
 
 	fmt.Println("Sync engine started")
 	return nil
 }
 
 // syncLoop is the main sync processing loop
-func (s *SyncEngine) syncLoop() {
-	for s.running {
+func (s *SyncEngine) syncLoop(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(moveWindow / 2)
+	defer ticker.Stop()
+
+	for {
 		select {
-		case event := <-s.watcher.Events():
+		case event, ok := <-s.watcher.Events():
+			if !ok {
+				s.expireRemovals(true)
+				return
+			}
 			s.handleFileEvent(event)
-		case <-time.After(1 * time.Second):
-			// Periodic maintenance
+		case <-ticker.C:
+			s.expireRemovals(false)
+		case <-stop:
+			s.expireRemovals(true)
+			return
 		}
 	}
 }
@@ -94,25 +182,121 @@ func (s *SyncEngine) handleFileEvent(event FileEvent) {
 	fmt.Printf("File event: %s %s\n", event.Type, event.Path)
 
 	// Update local database
+	var vector types.VersionVector
 	switch event.Type {
 	case EventCreate, EventModify:
-		if err := s.fybrk.updateFileRecord(event.Path, event.Size, event.ModTime, event.Hash); err != nil {
+		if event.Type == EventCreate && s.detectMove(event) {
+			return
+		}
+		record, changed, err := s.fybrk.recordLocalChange(event.Path, event.Size, event.ModTime, event.Hash)
+		if err != nil {
 			fmt.Printf("Error updating file record: %v\n", err)
 			return
 		}
-	case EventDelete:
-		if err := s.fybrk.deleteFileRecord(event.Path); err != nil {
-			fmt.Printf("Error deleting file record: %v\n", err)
+		if !changed {
+			// Content we already have, such as a file received from a peer
 			return
 		}
+		vector = record.VersionVector
+	case EventDelete:
+		// Sent once it is clear the file was not moved. Nothing tracked
+		// there means a deletion or move a peer sent us, whose records
+		// were updated before the file was touched.
+		s.holdRemoval(event.Path)
+		return
 	}
 
 	// Broadcast to peers
-	s.broadcastEvent(event)
+	s.broadcastEvent(event, vector)
 }
 
-// broadcastEvent sends file event to all connected peers
-func (s *SyncEngine) broadcastEvent(event FileEvent) {
+// holdRemoval holds back the deletion of a tracked file, or of the tracked
+// files in a deleted directory, for the move window
+func (s *SyncEngine) holdRemoval(path string) {
+	now := time.Now()
+	if record, err := s.fybrk.getFileRecord(path); err == nil {
+		s.removed[path] = &removedFile{record: record, removedAt: now}
+		return
+	}
+
+	records, err := s.fybrk.listFileRecords()
+	if err != nil {
+		fmt.Printf("Error listing file records: %v\n", err)
+		return
+	}
+	for _, record := range records {
+		if strings.HasPrefix(record.Path, path+string(filepath.Separator)) {
+			s.removed[record.Path] = &removedFile{record: record, removedAt: now}
+		}
+	}
+}
+
+// detectMove pairs a created file with a deleted one of the same content,
+// preferring one of the same name, and sends peers the move
+func (s *SyncEngine) detectMove(event FileEvent) bool {
+	var from string
+	for path, removed := range s.removed {
+		if removed.record.Hash != event.Hash {
+			continue
+		}
+		from = path
+		if filepath.Base(path) == filepath.Base(event.Path) {
+			break
+		}
+	}
+	if from == "" {
+		return false
+	}
+	moved := s.removed[from].record
+	delete(s.removed, from)
+
+	if err := s.fybrk.deleteFileRecord(from); err != nil {
+		fmt.Printf("Error deleting file record: %v\n", err)
+		return true
+	}
+	// The move is a change this device made to the file
+	vector := moved.VersionVector.Increment(s.fybrk.identity.DeviceID())
+	if err := s.fybrk.updateFileRecord(event.Path, event.Size, event.ModTime, event.Hash, vector); err != nil {
+		fmt.Printf("Error updating file record: %v\n", err)
+		return true
+	}
+
+	fmt.Printf("File moved: %s -> %s\n", from, event.Path)
+	s.broadcast(SyncMessage{
+		Type:          MsgFileMove,
+		OldPath:       from,
+		Path:          event.Path,
+		Hash:          event.Hash,
+		Size:          event.Size,
+		ModTime:       event.ModTime,
+		VersionVector: vector,
+	})
+	return true
+}
+
+// expireRemovals sends the deletions held longer than the move window, or
+// all of them. A deletion carries the version of the file it removed, so
+// peers that changed the file since keep it.
+func (s *SyncEngine) expireRemovals(all bool) {
+	for path, removed := range s.removed {
+		if !all && time.Since(removed.removedAt) < moveWindow {
+			continue
+		}
+		delete(s.removed, path)
+
+		if err := s.fybrk.deleteFileRecord(path); err != nil {
+			fmt.Printf("Error deleting file record: %v\n", err)
+			continue
+		}
+		// The deletion is a change this device made to the file
+		vector := removed.record.VersionVector.Increment(s.fybrk.identity.DeviceID())
+		s.broadcastEvent(FileEvent{Path: path, Type: EventDelete, Timestamp: removed.removedAt}, vector)
+	}
+}
+
+// broadcastEvent sends file event to all connected peers, with the version
+// of the file it left
+func (s *SyncEngine) broadcastEvent(event FileEvent, vector types.VersionVector) {
 	var msgType MessageType
 	switch event.Type {
 	case EventCreate:
@@ -126,11 +310,12 @@ func (s *SyncEngine) broadcastEvent(event FileEvent) {
 	}
 
 	msg := SyncMessage{
-		Type:    msgType,
-		Path:    event.Path,
-		Hash:    event.Hash,
-		Size:    event.Size,
-		ModTime: event.ModTime,
+		Type:          msgType,
+		Path:          event.Path,
+		Hash:          event.Hash,
+		Size:          event.Size,
+		ModTime:       event.ModTime,
+		VersionVector: vector,
 	}
 
 	// For create/modify, include file content for small files
@@ -141,46 +326,225 @@ func (s *SyncEngine) broadcastEvent(event FileEvent) {
 		}
 	}
 
-	// Send to all peers
+	s.broadcast(msg)
+}
+
+// broadcast queues a message for every connected peer, skipping peers
+// whose queue is full
+func (s *SyncEngine) broadcast(msg SyncMessage) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for _, peer := range s.peers {
+		peer.queued.Add(1)
 		select {
 		case peer.SendCh <- msg:
 		default:
 			// Peer channel full, skip
+			peer.queued.Add(-1)
 		}
 	}
 }
 
 // readFileContent reads file content
 func (s *SyncEngine) readFileContent(relPath string) ([]byte, error) {
-	fullPath := filepath.Join(s.fybrk.syncPath, relPath)
+	fullPath, err := s.localPath(relPath)
+	if err != nil {
+		return nil, err
+	}
 	return os.ReadFile(fullPath)
 }
 
+// localPath resolves a path received from a peer inside the sync folder
+func (s *SyncEngine) localPath(relPath string) (string, error) {
+	if !filepath.IsLocal(relPath) {
+		return "", fmt.Errorf("invalid path from peer: %s", relPath)
+	}
+	return filepath.Join(s.fybrk.syncPath, relPath), nil
+}
+
 // HandlePeerMessage processes incoming messages from peers
 func (s *SyncEngine) HandlePeerMessage(peerID string, msg SyncMessage) error {
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+
 	fmt.Printf("Peer message from %s: %s %s\n", peerID, msg.Type, msg.Path)
 
 	switch msg.Type {
 	case MsgFileCreate, MsgFileModify:
-		return s.handleFileUpdate(msg)
+		return s.handleFileUpdate(peerID, msg)
 	case MsgFileDelete:
-		return s.handleFileDelete(msg)
+		return s.handleFileDelete(peerID, msg)
+	case MsgFileMove:
+		return s.handleFileMove(peerID, msg)
 	case MsgFileReq:
 		return s.handleFileRequest(peerID, msg)
+	case MsgFileList:
+		return s.handleFileList(peerID, msg)
+	case MsgFileMissing:
+		if peer := s.getPeer(peerID); peer != nil {
+			peer.received(msg.Path)
+		}
 	}
 
 	return nil
 }
 
+// SendFileList sends the peer everything we have, so it can request what
+// it is missing. Both sides do this when they connect.
+func (s *SyncEngine) SendFileList(peer *Peer) error {
+	records, err := s.fybrk.listFileRecords()
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	files := make([]FileEntry, 0, len(records))
+	for _, record := range records {
+		files = append(files, FileEntry{
+			Path:          record.Path,
+			Hash:          record.Hash,
+			Size:          record.Size,
+			ModTime:       record.ModifiedAt,
+			VersionVector: record.VersionVector,
+		})
+	}
+
+	return s.send(peer.ID, SyncMessage{Type: MsgFileList, Files: files})
+}
+
+// handleFileList requests every file the peer has that we are missing or
+// hold an older version of. Where our copy is newer, or wins over a
+// concurrent edit, the peer requests it from us when it handles our list.
+func (s *SyncEngine) handleFileList(peerID string, msg SyncMessage) error {
+	peer := s.getPeer(peerID)
+	if peer == nil {
+		return fmt.Errorf("unknown peer: %s", peerID)
+	}
+
+	var wanted []string
+	for _, entry := range msg.Files {
+		if !filepath.IsLocal(entry.Path) {
+			continue
+		}
+		existing, err := s.fybrk.getFileRecord(entry.Path)
+		if err == nil && !s.takeVersion(peerID, entry, existing) {
+			continue
+		}
+		wanted = append(wanted, entry.Path)
+	}
+
+	peer.mu.Lock()
+	for _, path := range wanted {
+		peer.pending[path] = true
+	}
+	peer.listed = true
+	peer.mu.Unlock()
+
+	for _, path := range wanted {
+		if err := s.send(peerID, SyncMessage{Type: MsgFileReq, Path: path}); err != nil {
+			return err
+		}
+	}
+
+	peer.checkReconciled()
+	return nil
+}
+
+// newerEntry reports whether a peer's version of a file replaces ours. The
+// version vectors tell a later version from an older one. Versions edited
+// concurrently, or recorded before vectors were kept, go to the later
+// modification time; times only have second precision, so versions with
+// the same time are ordered by hash for both sides to settle on the same
+// one.
+func newerEntry(entry FileEntry, existing *FileRecord) bool {
+	if entry.Hash == existing.Hash {
+		return false
+	}
+	if len(entry.VersionVector) > 0 && len(existing.VersionVector) > 0 {
+		switch entry.VersionVector.Compare(existing.VersionVector) {
+		case types.Newer:
+			return true
+		case types.Older, types.Equal:
+			return false
+		}
+	}
+	if entry.ModTime.Equal(existing.ModifiedAt) {
+		return entry.Hash > existing.Hash
+	}
+	return entry.ModTime.After(existing.ModifiedAt)
+}
+
+// concurrentEntry reports whether a peer's version of a file and ours were
+// edited independently of each other
+func concurrentEntry(entry FileEntry, existing *FileRecord) bool {
+	return entry.Hash != existing.Hash &&
+		len(entry.VersionVector) > 0 && len(existing.VersionVector) > 0 &&
+		entry.VersionVector.Compare(existing.VersionVector) == types.Concurrent
+}
+
+// takeVersion reports whether a peer's version of a file replaces ours.
+// Where it does not, our version takes on the peer's history when both
+// hold the same content, or when ours wins over a concurrent edit, so that
+// it descends from the peer's version once the peer has it too.
+func (s *SyncEngine) takeVersion(peerID string, entry FileEntry, existing *FileRecord) bool {
+	if newerEntry(entry, existing) {
+		if concurrentEntry(entry, existing) {
+			fmt.Printf("Conflict: %s was changed here and on %s; keeping theirs\n", entry.Path, peerID)
+		}
+		return true
+	}
+	if entry.Hash != existing.Hash && !concurrentEntry(entry, existing) {
+		return false // The peer's version is older
+	}
+	if entry.Hash != existing.Hash {
+		fmt.Printf("Conflict: %s was changed here and on %s; keeping ours\n", entry.Path, peerID)
+	}
+
+	merged := existing.VersionVector.Merge(entry.VersionVector)
+	if merged.Compare(existing.VersionVector) != types.Equal {
+		if err := s.fybrk.updateFileRecord(existing.Path, existing.Size, existing.ModifiedAt, existing.Hash, merged); err != nil {
+			fmt.Printf("Error updating file record: %v\n", err)
+		}
+	}
+	return false
+}
+
+// entry describes the file a message carries
+func (m SyncMessage) entry() FileEntry {
+	return FileEntry{Path: m.Path, Hash: m.Hash, Size: m.Size, ModTime: m.ModTime, VersionVector: m.VersionVector}
+}
+
 // handleFileUpdate processes file create/modify from peer
-func (s *SyncEngine) handleFileUpdate(msg SyncMessage) error {
-	fullPath := filepath.Join(s.fybrk.syncPath, msg.Path)
+func (s *SyncEngine) handleFileUpdate(peerID string, msg SyncMessage) error {
+	fullPath, err := s.localPath(msg.Path)
+	if err != nil {
+		return err
+	}
+
+	// Large files are announced without content; fetch them separately
+	existing, _ := s.fybrk.getFileRecord(msg.Path)
+	if len(msg.Content) == 0 && msg.Size > 0 {
+		if existing != nil && !s.takeUpdate(peerID, msg, existing) {
+			return nil
+		}
+		return s.send(peerID, SyncMessage{Type: MsgFileReq, Path: msg.Path})
+	}
+
+	if peer := s.getPeer(peerID); peer != nil {
+		defer peer.received(msg.Path)
+	}
 
 	// Check if we need this update
-	existing, err := s.fybrk.getFileRecord(msg.Path)
-	if err == nil && existing.Hash == msg.Hash {
-		return nil // Already have this version
+	var vector types.VersionVector
+	if existing != nil {
+		if !s.takeUpdate(peerID, msg, existing) {
+			return nil // Already have this version, or a later one
+		}
+		if concurrentEntry(msg.entry(), existing) {
+			if err := s.keepConflictCopy(existing.Path); err != nil {
+				return err
+			}
+		}
+		vector = existing.VersionVector
 	}
 
 	// Create directory if needed
@@ -188,45 +552,222 @@ func (s *SyncEngine) handleFileUpdate(msg SyncMessage) error {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// Write file content
-	if len(msg.Content) > 0 {
-		if err := os.WriteFile(fullPath, msg.Content, 0644); err != nil {
-			return fmt.Errorf("failed to write file: %w", err)
+	// The record is updated first, so the watcher finds the written file
+	// unchanged instead of taking it for a local edit
+	if err := s.fybrk.updateFileRecord(msg.Path, msg.Size, msg.ModTime, msg.Hash, vector.Merge(msg.VersionVector)); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fullPath, msg.Content, msg.ModTime); err != nil {
+		if existing != nil {
+			s.fybrk.updateFileRecord(existing.Path, existing.Size, existing.ModifiedAt, existing.Hash, existing.VersionVector)
+		} else {
+			s.fybrk.deleteFileRecord(msg.Path)
 		}
+		return err
+	}
+	s.filesReceived.Add(1)
+	return nil
+}
 
-		// Set modification time
-		if err := os.Chtimes(fullPath, msg.ModTime, msg.ModTime); err != nil {
-			fmt.Printf("Warning: failed to set file times: %v\n", err)
+// takeUpdate is takeVersion for a file a peer sent us. When our version
+// wins over a concurrent edit it is sent back, so the peer settles on it.
+func (s *SyncEngine) takeUpdate(peerID string, msg SyncMessage, existing *FileRecord) bool {
+	if s.takeVersion(peerID, msg.entry(), existing) {
+		return true
+	}
+	if concurrentEntry(msg.entry(), existing) {
+		if err := s.handleFileRequest(peerID, SyncMessage{Path: msg.Path}); err != nil {
+			fmt.Printf("Error sending %s: %v\n", msg.Path, err)
 		}
+	}
+	return false
+}
 
-		// Update database
-		return s.fybrk.updateFileRecord(msg.Path, msg.Size, msg.ModTime, msg.Hash)
+// keepConflictCopy copies our version of a file that lost to a concurrent
+// edit next to it, e.g. notes.sync-conflict-20260102-150405-3f2a9c1b.txt,
+// so no edit is lost. The copy is synced as a new file.
+func (s *SyncEngine) keepConflictCopy(relPath string) error {
+	deviceID := s.fybrk.identity.DeviceID()
+	if len(deviceID) > 8 {
+		deviceID = deviceID[:8]
 	}
+	ext := filepath.Ext(relPath)
+	if ext == filepath.Base(relPath) {
+		ext = "" // A dotfile such as .bashrc has no extension
+	}
+	copyPath := fmt.Sprintf("%s.sync-conflict-%s-%s%s", strings.TrimSuffix(relPath, ext), time.Now().Format("20060102-150405"), deviceID, ext)
 
+	src, err := os.Open(filepath.Join(s.fybrk.syncPath, relPath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to keep conflict copy: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(filepath.Join(s.fybrk.syncPath, copyPath), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to keep conflict copy: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to keep conflict copy: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to keep conflict copy: %w", err)
+	}
+	fmt.Printf("Kept our version of %s as %s\n", relPath, copyPath)
 	return nil
 }
 
-// handleFileDelete processes file delete from peer
-func (s *SyncEngine) handleFileDelete(msg SyncMessage) error {
-	fullPath := filepath.Join(s.fybrk.syncPath, msg.Path)
+// writeFileAtomic replaces the file at path with content, so an interrupted
+// write never leaves a half-written file in the sync folder. The temporary
+// file's name keeps the watcher from picking it up.
+func writeFileAtomic(path string, content []byte, modTime time.Time) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fybrk-tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	// Set modification time
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		fmt.Printf("Warning: failed to set file times: %v\n", err)
+	}
 
-	// Remove file
-	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// handleFileDelete processes file delete from peer. The file is moved to
+// the trash rather than removed, so a mistaken deletion can be undone. A
+// file changed here since the version the peer deleted is kept, and sent
+// back to the peer.
+func (s *SyncEngine) handleFileDelete(peerID string, msg SyncMessage) error {
+	if _, err := s.localPath(msg.Path); err != nil {
+		return err
+	}
+
+	existing, _ := s.fybrk.getFileRecord(msg.Path)
+	if existing != nil && !deletesVersion(msg.VersionVector, existing) {
+		fmt.Printf("Conflict: %s was deleted on %s but changed here; keeping ours\n", msg.Path, peerID)
+		// Ours descends from the deletion, so the peer takes it back
+		if err := s.fybrk.updateFileRecord(existing.Path, existing.Size, existing.ModifiedAt, existing.Hash, existing.VersionVector.Merge(msg.VersionVector)); err != nil {
+			return err
+		}
+		return s.handleFileRequest(peerID, SyncMessage{Path: msg.Path})
+	}
+
+	// The record is deleted first, so the watcher does not take the
+	// deletion for a local one and send it back out
+	if err := s.fybrk.deleteFileRecord(msg.Path); err != nil {
+		return err
+	}
+	if _, err := s.fybrk.trash.Move(s.fybrk.syncPath, msg.Path, peerID); err != nil && !os.IsNotExist(err) {
+		if existing != nil {
+			s.fybrk.updateFileRecord(existing.Path, existing.Size, existing.ModifiedAt, existing.Hash, existing.VersionVector)
+		}
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
+	return nil
+}
 
-	// Update database
-	return s.fybrk.deleteFileRecord(msg.Path)
+// deletesVersion reports whether a deletion with the given version vector
+// removes our version of a file, i.e. whether the peer deleted it after
+// seeing every change we made. Deletions and files recorded before vectors
+// were kept are taken as they come.
+func deletesVersion(vector types.VersionVector, existing *FileRecord) bool {
+	if len(vector) == 0 || len(existing.VersionVector) == 0 {
+		return true
+	}
+	switch vector.Compare(existing.VersionVector) {
+	case types.Newer, types.Equal:
+		return true
+	}
+	return false
 }
 
-// handleFileRequest processes file request from peer
-func (s *SyncEngine) handleFileRequest(peerID string, msg SyncMessage) error {
-	peer, exists := s.peers[peerID]
-	if !exists {
-		return fmt.Errorf("unknown peer: %s", peerID)
+// handleFileMove processes a file a peer moved. Our copy is renamed if it
+// holds the moved content; otherwise the move is handled as a deletion of
+// the old path and an update of the new one.
+func (s *SyncEngine) handleFileMove(peerID string, msg SyncMessage) error {
+	oldPath, err := s.localPath(msg.OldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.localPath(msg.Path)
+	if err != nil {
+		return err
+	}
+
+	// Our copy differs, or something is at the new path already, e.g.
+	// the file itself when the move is our own
+	record, err := s.fybrk.getFileRecord(msg.OldPath)
+	_, statErr := os.Lstat(newPath)
+	if err != nil || record.Hash != msg.Hash || statErr == nil {
+		if err := s.handleFileDelete(peerID, SyncMessage{Path: msg.OldPath, VersionVector: msg.VersionVector}); err != nil {
+			return err
+		}
+		update := msg
+		update.Type = MsgFileCreate
+		update.OldPath = ""
+		return s.handleFileUpdate(peerID, update)
+	}
+
+	// The records are updated first, so the watcher finds the old path
+	// untracked and the new one unchanged, rather than sending the move
+	// back out as a deletion and a new file
+	if err := s.fybrk.updateFileRecord(msg.Path, record.Size, record.ModifiedAt, record.Hash, record.VersionVector.Merge(msg.VersionVector)); err != nil {
+		return err
+	}
+	if err := s.fybrk.deleteFileRecord(msg.OldPath); err != nil {
+		s.fybrk.deleteFileRecord(msg.Path)
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(newPath), 0755)
+	if err == nil {
+		err = os.Rename(oldPath, newPath)
+	}
+	if err != nil {
+		s.fybrk.deleteFileRecord(msg.Path)
+		s.fybrk.updateFileRecord(record.Path, record.Size, record.ModifiedAt, record.Hash, record.VersionVector)
+		return fmt.Errorf("failed to move file: %w", err)
 	}
 
+	// Directories the peer moved the file out of are left empty here
+	for dir := filepath.Dir(oldPath); dir != s.fybrk.syncPath && strings.HasPrefix(dir, s.fybrk.syncPath); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// handleFileRequest processes file request from peer. A file that is gone
+// is answered as missing, so the peer does not wait for it.
+func (s *SyncEngine) handleFileRequest(peerID string, msg SyncMessage) error {
 	content, err := s.readFileContent(msg.Path)
+	if os.IsNotExist(err) {
+		return s.send(peerID, SyncMessage{Type: MsgFileMissing, Path: msg.Path})
+	}
 	if err != nil {
 		return err
 	}
@@ -234,26 +775,116 @@ func (s *SyncEngine) handleFileRequest(peerID string, msg SyncMessage) error {
 	response := SyncMessage{
 		Type:    MsgFileModify,
 		Path:    msg.Path,
+		Size:    int64(len(content)),
 		Content: content,
 	}
+	if record, err := s.fybrk.getFileRecord(msg.Path); err == nil {
+		response.Hash = record.Hash
+		response.ModTime = record.ModifiedAt
+		response.VersionVector = record.VersionVector
+	}
 
+	return s.send(peerID, response)
+}
+
+// send queues a message for a peer. It blocks while the peer's queue is
+// full, so a large reconciliation is not silently cut short.
+func (s *SyncEngine) send(peerID string, msg SyncMessage) error {
+	peer := s.getPeer(peerID)
+	if peer == nil {
+		return fmt.Errorf("unknown peer: %s", peerID)
+	}
+
+	peer.queued.Add(1)
 	select {
-	case peer.SendCh <- response:
-	default:
+	case peer.SendCh <- msg:
+		return nil
+	case <-peer.disconnected:
+		peer.queued.Add(-1)
+		return ErrPeerDisconnected
+	case <-time.After(10 * time.Second):
+		peer.queued.Add(-1)
 		return fmt.Errorf("peer channel full")
 	}
+}
 
-	return nil
+// sent records that a queued message was written to the peer, or failed
+func (s *SyncEngine) sent(peer *Peer, msg SyncMessage, err error) {
+	peer.queued.Add(-1)
+	if err == nil && msg.carriesFile() {
+		s.filesSent.Add(1)
+	}
+}
+
+// carriesFile reports whether the message delivers a file's content
+func (m SyncMessage) carriesFile() bool {
+	return (m.Type == MsgFileCreate || m.Type == MsgFileModify) && (len(m.Content) > 0 || m.Size == 0)
+}
+
+// PeerCount returns the number of connected peers
+func (s *SyncEngine) PeerCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.peers)
+}
+
+// Drain waits up to timeout for transfers in progress to finish: messages
+// queued for peers, peer messages being handled and files requested from
+// peers. It returns how many were still outstanding when it gave up.
+func (s *SyncEngine) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		outstanding := s.outstanding()
+		if outstanding == 0 || !time.Now().Before(deadline) {
+			return outstanding
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitIdle waits up to timeout for peer messages being handled to finish
+func (s *SyncEngine) waitIdle(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for s.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *SyncEngine) outstanding() int {
+	outstanding := int(s.inFlight.Load())
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, peer := range s.peers {
+		outstanding += int(peer.queued.Load())
+		peer.mu.Lock()
+		outstanding += len(peer.pending)
+		peer.mu.Unlock()
+	}
+	return outstanding
+}
+
+// getPeer returns a connected peer, or nil
+func (s *SyncEngine) getPeer(peerID string) *Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peers[peerID]
 }
 
 // AddPeer adds a new peer connection
 func (s *SyncEngine) AddPeer(peerID string) *Peer {
 	peer := &Peer{
-		ID:       peerID,
-		LastSeen: time.Now(),
-		SendCh:   make(chan SyncMessage, 100),
+		ID:           peerID,
+		LastSeen:     time.Now(),
+		SendCh:       make(chan SyncMessage, 100),
+		pending:      make(map[string]bool),
+		reconciled:   make(chan struct{}),
+		disconnected: make(chan struct{}),
 	}
+
+	s.mu.Lock()
 	s.peers[peerID] = peer
+	s.mu.Unlock()
 
 	fmt.Printf("Peer connected: %s\n", peerID)
 	return peer
@@ -261,15 +892,65 @@ func (s *SyncEngine) AddPeer(peerID string) *Peer {
 
 // RemovePeer removes a peer connection
 func (s *SyncEngine) RemovePeer(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// SendCh stays open, as senders may still be waiting on it
 	if peer, exists := s.peers[peerID]; exists {
-		close(peer.SendCh)
+		close(peer.disconnected)
 		delete(s.peers, peerID)
 		fmt.Printf("Peer disconnected: %s\n", peerID)
 	}
 }
 
-// Stop stops the sync engine
+// WaitReconciled blocks until the initial reconciliation with the peer is
+// done: its file list has been handled and every file we asked for arrived
+func (p *Peer) WaitReconciled(timeout time.Duration) error {
+	select {
+	case <-p.reconciled:
+		return nil
+	case <-p.disconnected:
+		return ErrPeerDisconnected
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out reconciling with %s", p.ID)
+	}
+}
+
+// received marks a requested file as arrived
+func (p *Peer) received(path string) {
+	p.mu.Lock()
+	delete(p.pending, path)
+	p.mu.Unlock()
+	p.checkReconciled()
+}
+
+// checkReconciled signals reconciliation once nothing is outstanding
+func (p *Peer) checkReconciled() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.listed || len(p.pending) > 0 {
+		return
+	}
+	select {
+	case <-p.reconciled:
+	default:
+		close(p.reconciled)
+	}
+}
+
+// Stop stops watching for local changes. Peers stay connected.
 func (s *SyncEngine) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return s.watcher.Close()
+	}
 	s.running = false
+	close(s.stop)
+	stopped := s.stopped
+	s.mu.Unlock()
+
+	<-stopped
 	return s.watcher.Close()
 }
@@ -0,0 +1,36 @@
+package core
+
+import (
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/storage"
+)
+
+// ListTrash returns the files deleted by peers that are kept in
+// .fybrk/trash, newest first
+func (f *Fybrk) ListTrash() ([]*storage.TrashEntry, error) {
+	return f.trash.List()
+}
+
+// RestoreFromTrash moves a trashed file or directory back to where it was.
+// The watcher picks it up as a new file, so it is synced back to the
+// devices that deleted it; if this folder is not syncing, that happens
+// when it next starts.
+func (f *Fybrk) RestoreFromTrash(id string) (*storage.TrashEntry, error) {
+	return f.trash.Restore(f.syncPath, id)
+}
+
+// EmptyTrash deletes every file in the trash for good and returns how many
+// there were
+func (f *Fybrk) EmptyTrash() (int, error) {
+	return f.trash.Empty()
+}
+
+// SetTrashRetention sets how long files deleted by peers stay in the trash.
+// Zero means storage.DefaultTrashRetention.
+func (f *Fybrk) SetTrashRetention(retention time.Duration) {
+	if retention == 0 {
+		retention = storage.DefaultTrashRetention
+	}
+	f.trash.SetRetention(retention)
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrash_ListRestoreEmpty(t *testing.T) {
+	tempDir := t.TempDir()
+	for name, content := range map[string]string{"report.txt": "report", "notes.txt": "notes"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	fybrk, err := New(Config{SyncPath: tempDir, TrashRetention: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defer fybrk.Close()
+
+	for _, name := range []string{"report.txt", "notes.txt"} {
+		if err := fybrk.syncEngine.HandlePeerMessage("peer_1", SyncMessage{Type: MsgFileDelete, Path: name}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	entries, err := fybrk.ListTrash()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 files in the trash, got %+v", entries)
+	}
+
+	var reportID string
+	for _, entry := range entries {
+		if entry.Path == "report.txt" {
+			reportID = entry.ID
+		}
+	}
+	entry, err := fybrk.RestoreFromTrash(reportID)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if entry.Path != "report.txt" {
+		t.Errorf("Expected report.txt to be restored, got %s", entry.Path)
+	}
+	content, err := os.ReadFile(filepath.Join(tempDir, "report.txt"))
+	if err != nil || string(content) != "report" {
+		t.Errorf("Expected report.txt to be back, got %q (%v)", content, err)
+	}
+	if _, err := fybrk.RestoreFromTrash(reportID); err == nil {
+		t.Error("Expected error restoring an entry twice")
+	}
+
+	count, err := fybrk.EmptyTrash()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 file deleted from the trash, got %d", count)
+	}
+	if entries, err := fybrk.ListTrash(); err != nil || len(entries) != 0 {
+		t.Errorf("Expected the trash to be empty, got %+v (%v)", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "notes.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected notes.txt to stay deleted, got: %v", err)
+	}
+}
@@ -143,7 +143,13 @@ func (w *Watcher) handleEvent(event fsnotify.Event) {
 	fileEvent.Path = relPath
 	fileEvent.Timestamp = time.Now()
 
-	if event.Op&fsnotify.Remove == fsnotify.Remove {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// A rename reports the old path, and the new one is created. A
+		// watched directory that was moved is reported under its new path
+		// too, which still exists.
+		if _, err := os.Lstat(event.Name); err == nil {
+			return
+		}
 		fileEvent.Type = EventDelete
 		w.events <- fileEvent
 		return
@@ -156,8 +162,15 @@ func (w *Watcher) handleEvent(event fsnotify.Event) {
 	}
 
 	if info.IsDir() {
-		// Add new directory to watcher
-		w.watcher.Add(event.Name)
+		// Watch the new directory. Files created or moved in with it come
+		// without events of their own.
+		w.addDirectory(event.Name)
+		filepath.Walk(event.Name, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				w.handleEvent(fsnotify.Event{Name: path, Op: fsnotify.Create})
+			}
+			return nil
+		})
 		return
 	}
 
@@ -234,7 +247,7 @@ func (w *Watcher) InitialScan() error {
 		}
 
 		// Store in database
-		if err := w.fybrk.updateFileRecord(relPath, info.Size(), info.ModTime(), hash); err != nil {
+		if _, _, err := w.fybrk.recordLocalChange(relPath, info.Size(), info.ModTime(), hash); err != nil {
 			return err
 		}
 
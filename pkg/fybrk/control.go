@@ -0,0 +1,324 @@
+package fybrk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	gosync "sync"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+)
+
+// Files the daemon keeps in its config directory while it runs
+const (
+	ControlSocketName = "daemon.sock"
+	PIDFileName       = "daemon.pid"
+)
+
+var ErrDaemonNotRunning = errors.New("fybrk daemon is not running")
+
+// DaemonStatus describes a running daemon
+type DaemonStatus struct {
+	PID       int             `json:"pid"`
+	Port      int             `json:"port"`
+	StartedAt time.Time       `json:"started_at"`
+	Folders   []*FolderStatus `json:"folders"`
+}
+
+// PendingInvitation is an invitation the daemon opened for a folder. Its URL
+// carries a one-time pairing secret, never the folder key.
+type PendingInvitation struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ControlServer serves a small REST API for a running daemon on a Unix
+// socket in its config directory, so the CLI, desktop wrappers and scripts
+// can drive it. Only the user owning the socket can connect.
+//
+//	GET    /status            daemon and folder status
+//	GET    /folders           registered folders
+//	POST   /folders           add the folder in {"path": ...}
+//	DELETE /folders?folder=   remove a folder
+//	GET    /files?folder=     files tracked in a folder
+//	POST   /pause[?folder=]   pause one folder, or all of them
+//	POST   /resume[?folder=]  resume one folder, or all of them
+//	POST   /pair?folder=      open an invitation to join a folder
+//	GET    /pair?folder=      status of the folder's invitation
+//	POST   /pair/confirm?folder=
+//	                          answer the code comparison in {"accept": ...}
+//	POST   /shutdown          stop the daemon
+//
+// Folders are named by ID or path; /pause and /resume take every folder
+// when none is named. Errors are returned as {"error": ...}.
+type ControlServer struct {
+	daemon    *Daemon
+	server    *http.Server
+	pidPath   string
+	startedAt time.Time
+
+	shutdown     chan struct{}
+	shutdownOnce gosync.Once
+}
+
+// ServeControl starts the control API for daemon and writes its pidfile. It
+// fails if another daemon is already serving from the same config directory.
+func ServeControl(daemon *Daemon) (*ControlServer, error) {
+	configDir := daemon.config.ConfigDir
+	socketPath := filepath.Join(configDir, ControlSocketName)
+
+	// A socket nobody answers on is left over from a daemon that crashed
+	if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a fybrk daemon is already running for %s", configDir)
+	}
+	os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control socket: %v", err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	pidPath := filepath.Join(configDir, PIDFileName)
+	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to write pidfile: %v", err)
+	}
+
+	s := &ControlServer{
+		daemon:    daemon,
+		pidPath:   pidPath,
+		startedAt: time.Now(),
+		shutdown:  make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("GET /folders", s.handleFolders)
+	mux.HandleFunc("POST /folders", s.handleAddFolder)
+	mux.HandleFunc("DELETE /folders", s.handleRemoveFolder)
+	mux.HandleFunc("GET /files", s.handleFiles)
+	mux.HandleFunc("POST /pause", s.handlePause)
+	mux.HandleFunc("POST /resume", s.handleResume)
+	mux.HandleFunc("POST /pair", s.handlePair)
+	mux.HandleFunc("GET /pair", s.handlePairStatus)
+	mux.HandleFunc("POST /pair/confirm", s.handlePairConfirm)
+	mux.HandleFunc("POST /shutdown", s.handleShutdown)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// ShutdownRequested is closed when a client asks the daemon to stop
+func (s *ControlServer) ShutdownRequested() <-chan struct{} {
+	return s.shutdown
+}
+
+// Close stops the control API and removes the socket and pidfile
+func (s *ControlServer) Close() error {
+	err := s.server.Close()
+	os.Remove(s.pidPath)
+	return err
+}
+
+func (s *ControlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	folders, err := s.daemon.Folders()
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, &DaemonStatus{
+		PID:       os.Getpid(),
+		Port:      s.daemon.Port(),
+		StartedAt: s.startedAt,
+		Folders:   folders,
+	})
+}
+
+func (s *ControlServer) handleFolders(w http.ResponseWriter, r *http.Request) {
+	folders, err := s.daemon.Folders()
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, folders)
+}
+
+func (s *ControlServer) handleAddFolder(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Path == "" {
+		writeControlFailure(w, http.StatusBadRequest, "a folder path is required")
+		return
+	}
+
+	folder, err := s.daemon.AddFolder(request.Path)
+	if folder == nil {
+		writeControlError(w, err)
+		return
+	}
+	// The folder is registered even if it failed to start; Folders says why
+	writeControlJSON(w, folder)
+}
+
+func (s *ControlServer) handleRemoveFolder(w http.ResponseWriter, r *http.Request) {
+	idOrPath, ok := folderQuery(w, r)
+	if !ok {
+		return
+	}
+	folder, err := s.daemon.RemoveFolder(idOrPath)
+	if folder == nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, folder)
+}
+
+func (s *ControlServer) handleFiles(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.folderClient(w, r)
+	if !ok {
+		return
+	}
+	files, err := client.GetSyncedFiles()
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, files)
+}
+
+func (s *ControlServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	if err := s.daemon.Pause(r.URL.Query().Get("folder")); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ControlServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	if err := s.daemon.Resume(r.URL.Query().Get("folder")); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePair opens an invitation that waits for the code comparison to be
+// answered through /pair/confirm
+func (s *ControlServer) handlePair(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.folderClient(w, r)
+	if !ok {
+		return
+	}
+	inv, err := client.Invite(nil)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, &PendingInvitation{URL: inv.URL, ExpiresAt: inv.ExpiresAt})
+}
+
+func (s *ControlServer) handlePairStatus(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.folderClient(w, r)
+	if !ok {
+		return
+	}
+	inv, err := client.Invitation()
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	status := inv.Status()
+	writeControlJSON(w, &status)
+}
+
+func (s *ControlServer) handlePairConfirm(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.folderClient(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Accept bool `json:"accept"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeControlFailure(w, http.StatusBadRequest, "an answer is required")
+		return
+	}
+
+	inv, err := client.Invitation()
+	if err == nil {
+		err = inv.Confirm(request.Accept)
+	}
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// folderQuery returns the folder named in the request. An empty name is
+// refused, as it would resolve to the daemon's working directory.
+func folderQuery(w http.ResponseWriter, r *http.Request) (string, bool) {
+	idOrPath := r.URL.Query().Get("folder")
+	if idOrPath == "" {
+		writeControlFailure(w, http.StatusBadRequest, "a folder is required")
+		return "", false
+	}
+	return idOrPath, true
+}
+
+// folderClient returns the client of the running folder named in the
+// request
+func (s *ControlServer) folderClient(w http.ResponseWriter, r *http.Request) (*Client, bool) {
+	idOrPath, ok := folderQuery(w, r)
+	if !ok {
+		return nil, false
+	}
+	client, err := s.daemon.Client(idOrPath)
+	if err != nil {
+		writeControlError(w, err)
+		return nil, false
+	}
+	return client, true
+}
+
+func (s *ControlServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeControlJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeControlError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, config.ErrFolderNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, config.ErrFolderExists):
+		status = http.StatusConflict
+	case errors.Is(err, ErrNoInvitation), errors.Is(err, ErrNothingToConfirm):
+		status = http.StatusPreconditionFailed
+	}
+	writeControlFailure(w, status, err.Error())
+}
+
+func writeControlFailure(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,205 @@
+package fybrk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/pkg/types"
+)
+
+// ControlClient talks to a running daemon over its control socket
+type ControlClient struct {
+	http *http.Client
+}
+
+// DialDaemon connects to the daemon serving configDir. It returns
+// ErrDaemonNotRunning if no daemon answers.
+func DialDaemon(configDir string) (*ControlClient, error) {
+	socketPath := filepath.Join(configDir, ControlSocketName)
+	client := &ControlClient{
+		http: &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+
+	if _, err := client.Status(); err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			return nil, ErrDaemonNotRunning
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// Status returns the daemon's status and that of its folders
+func (c *ControlClient) Status() (*DaemonStatus, error) {
+	var status DaemonStatus
+	if err := c.do(http.MethodGet, "/status", "", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Folders returns the folders the daemon syncs
+func (c *ControlClient) Folders() ([]*FolderStatus, error) {
+	var folders []*FolderStatus
+	if err := c.do(http.MethodGet, "/folders", "", nil, &folders); err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+// AddFolder registers a directory with the daemon and starts syncing it
+func (c *ControlClient) AddFolder(path string) (*config.Folder, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var folder config.Folder
+	request := map[string]string{"path": absPath}
+	if err := c.do(http.MethodPost, "/folders", "", request, &folder); err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// RemoveFolder stops syncing a folder and removes it from the registry
+func (c *ControlClient) RemoveFolder(idOrPath string) (*config.Folder, error) {
+	var folder config.Folder
+	if err := c.do(http.MethodDelete, "/folders", folderParam(idOrPath), nil, &folder); err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// Files returns the files tracked in a folder
+func (c *ControlClient) Files(idOrPath string) ([]*types.FileMetadata, error) {
+	var files []*types.FileMetadata
+	if err := c.do(http.MethodGet, "/files", folderParam(idOrPath), nil, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Pause stops syncing a folder, or every folder if idOrPath is empty
+func (c *ControlClient) Pause(idOrPath string) error {
+	return c.do(http.MethodPost, "/pause", folderParam(idOrPath), nil, nil)
+}
+
+// Resume restarts syncing a folder, or every folder if idOrPath is empty
+func (c *ControlClient) Resume(idOrPath string) error {
+	return c.do(http.MethodPost, "/resume", folderParam(idOrPath), nil, nil)
+}
+
+// Invite opens an invitation for another device to join a folder. The
+// daemon waits for ConfirmPairing once the devices show their codes.
+func (c *ControlClient) Invite(idOrPath string) (*PendingInvitation, error) {
+	var invitation PendingInvitation
+	if err := c.do(http.MethodPost, "/pair", folderParam(idOrPath), nil, &invitation); err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// InvitationStatus reports how far the folder's invitation got
+func (c *ControlClient) InvitationStatus(idOrPath string) (*InvitationStatus, error) {
+	var status InvitationStatus
+	if err := c.do(http.MethodGet, "/pair", folderParam(idOrPath), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ConfirmPairing answers whether the joining device shows the same code
+func (c *ControlClient) ConfirmPairing(idOrPath string, accept bool) error {
+	request := map[string]bool{"accept": accept}
+	return c.do(http.MethodPost, "/pair/confirm", folderParam(idOrPath), request, nil)
+}
+
+// Shutdown asks the daemon to stop
+func (c *ControlClient) Shutdown() error {
+	return c.do(http.MethodPost, "/shutdown", "", nil, nil)
+}
+
+// folderParam sends a folder path as an absolute path, since the daemon
+// does not share the caller's working directory
+func folderParam(idOrPath string) string {
+	if idOrPath == "" {
+		return ""
+	}
+	if _, err := os.Stat(idOrPath); err == nil {
+		if absPath, err := filepath.Abs(idOrPath); err == nil {
+			idOrPath = absPath
+		}
+	}
+	return "?folder=" + url.QueryEscape(idOrPath)
+}
+
+func (c *ControlClient) do(method, path, query string, request, response interface{}) error {
+	var body bytes.Buffer
+	if request != nil {
+		if err := json.NewEncoder(&body).Encode(request); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://fybrk"+path+query, &body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return config.ErrFolderNotFound
+		case http.StatusConflict:
+			return config.ErrFolderExists
+		case http.StatusPreconditionFailed:
+			if failure.Error == ErrNothingToConfirm.Error() {
+				return ErrNothingToConfirm
+			}
+			return ErrNoInvitation
+		}
+		if failure.Error == "" {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return errors.New(failure.Error)
+	}
+
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,132 @@
+package fybrk
+
+import (
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialDaemonNotRunning(t *testing.T) {
+	_, err := DialDaemon(t.TempDir())
+	assert.ErrorIs(t, err, ErrDaemonNotRunning)
+}
+
+func TestControlAPI(t *testing.T) {
+	daemon := newTestDaemon(t)
+	require.NoError(t, daemon.Start())
+	defer daemon.Close()
+
+	server, err := ServeControl(daemon)
+	require.NoError(t, err)
+	defer server.Close()
+
+	// Only one daemon per config directory
+	_, err = ServeControl(daemon)
+	assert.Error(t, err)
+
+	pid, err := os.ReadFile(filepath.Join(daemon.config.ConfigDir, PIDFileName))
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(pid)))
+
+	client, err := DialDaemon(daemon.config.ConfigDir)
+	require.NoError(t, err)
+
+	photos := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(photos, "cat.jpg"), []byte("meow"), 0644))
+	folder, err := client.AddFolder(photos)
+	require.NoError(t, err)
+	_, err = client.AddFolder(photos)
+	assert.ErrorIs(t, err, config.ErrFolderExists)
+
+	status, err := client.Status()
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), status.PID)
+	assert.Equal(t, daemon.Port(), status.Port)
+	require.Len(t, status.Folders, 1)
+	assert.Equal(t, folder.ID, status.Folders[0].ID)
+	assert.True(t, status.Folders[0].Running)
+
+	files, err := client.Files(photos)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "cat.jpg", files[0].Path)
+
+	// The invitation carries a one-time secret, not the folder key, and the
+	// code comparison is answered through the API
+	daemonClient, err := daemon.Client(folder.ID)
+	require.NoError(t, err)
+	_, err = client.InvitationStatus(folder.ID)
+	assert.ErrorIs(t, err, ErrNoInvitation)
+	inv, err := client.Invite(folder.ID)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(inv.URL, "fybrk://pair?"))
+	assert.NotContains(t, inv.URL, hex.EncodeToString(daemonClient.FolderKey()))
+	assert.NotContains(t, inv.URL, "encryption_key")
+	assert.NotContains(t, inv.URL, url.QueryEscape(photos))
+	assert.ErrorIs(t, client.ConfirmPairing(folder.ID, true), ErrNothingToConfirm)
+
+	joined := make(chan error, 1)
+	go func() {
+		joiner, err := JoinFolder(inv.URL, newPairingConfig(t), acceptAll)
+		if err == nil {
+			joiner.Close()
+		}
+		joined <- err
+	}()
+	require.Eventually(t, func() bool {
+		status, err := client.InvitationStatus(folder.ID)
+		return err == nil && status.State == InvitationConfirming && status.Code != ""
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, client.ConfirmPairing(folder.ID, true))
+	require.NoError(t, <-joined)
+	pairStatus, err := client.InvitationStatus(folder.ID)
+	require.NoError(t, err)
+	assert.Equal(t, InvitationPaired, pairStatus.State)
+
+	// Requests naming no folder are refused rather than taken as the
+	// daemon's working directory
+	_, err = client.Files("")
+	assert.Error(t, err)
+	_, err = client.RemoveFolder("")
+	assert.Error(t, err)
+
+	// Pausing stops the folder and is recorded in the registry
+	require.NoError(t, client.Pause(""))
+	folders, err := client.Folders()
+	require.NoError(t, err)
+	require.Len(t, folders, 1)
+	assert.True(t, folders[0].Paused)
+	assert.False(t, folders[0].Running)
+	_, err = client.Files(folder.ID)
+	assert.Error(t, err)
+
+	require.NoError(t, client.Resume(folder.ID))
+	folders, err = client.Folders()
+	require.NoError(t, err)
+	assert.False(t, folders[0].Paused)
+	assert.True(t, folders[0].Running)
+
+	assert.ErrorIs(t, client.Pause("no-such-folder"), config.ErrFolderNotFound)
+
+	removed, err := client.RemoveFolder(folder.ID)
+	require.NoError(t, err)
+	assert.Equal(t, photos, removed.Path)
+
+	require.NoError(t, client.Shutdown())
+	<-server.ShutdownRequested()
+
+	require.NoError(t, server.Close())
+	_, err = os.Stat(filepath.Join(daemon.config.ConfigDir, PIDFileName))
+	assert.True(t, os.IsNotExist(err))
+	_, err = DialDaemon(daemon.config.ConfigDir)
+	assert.ErrorIs(t, err, ErrDaemonNotRunning)
+}
@@ -0,0 +1,486 @@
+package fybrk
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/Fybrk/fybrk/internal/network"
+	"github.com/Fybrk/fybrk/internal/storage"
+	"github.com/Fybrk/fybrk/internal/transport"
+)
+
+// DefaultDaemonPort is the port the daemon accepts peers on for all folders
+const DefaultDaemonPort = 7823
+
+// Daemon syncs every folder in the folder registry from one process. Each
+// folder has its own key, database and peer set; peers of all folders
+// connect through a single listener and are routed by the folder key they
+// prove they hold.
+type Daemon struct {
+	config DaemonConfig
+	mux    *transport.Mux
+
+	// startMu serializes starting folders, so concurrent Resume, AddFolder
+	// and Reload calls never open the same folder twice
+	startMu  gosync.Mutex
+	mu       gosync.Mutex
+	clients  map[string]*Client
+	failures map[string]error
+	upnp     *network.UPnPClient
+	closed   bool
+}
+
+// DaemonConfig holds configuration for the daemon
+type DaemonConfig struct {
+	// ConfigDir holds the folder registry, usually ~/.fybrk
+	ConfigDir string
+
+	// Identity is the device identity shared by all folders
+	Identity *identity.Identity
+
+	// Port is the port peers connect to; 0 picks a free one
+	Port int
+
+	// Passphrase unlocks a folder whose key file is sealed
+	Passphrase func(syncPath string) storage.PassphraseFunc
+
+	// VersionRetention and TrashRetention apply to every folder, as in
+	// Config
+	VersionRetention *storage.VersionRetention
+	TrashRetention   time.Duration
+}
+
+// FolderStatus describes a registered folder
+type FolderStatus struct {
+	*config.Folder
+	Running          bool     `json:"running"`
+	Error            string   `json:"error,omitempty"`
+	ConnectedDevices []string `json:"connected_devices,omitempty"`
+}
+
+// NewDaemon creates a daemon for the folders registered in config.ConfigDir
+func NewDaemon(config DaemonConfig) *Daemon {
+	return &Daemon{
+		config:   config,
+		clients:  make(map[string]*Client),
+		failures: make(map[string]error),
+	}
+}
+
+// Start opens the shared listener and starts syncing every registered
+// folder. A folder that fails to open is reported by Folders and does not
+// stop the others.
+func (d *Daemon) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", d.config.Port))
+	if err != nil {
+		return err
+	}
+	d.mux = transport.NewMux(listener)
+	go d.mapPort()
+
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		d.mux.Close()
+		return err
+	}
+
+	for _, folder := range folders {
+		if folder.Paused {
+			continue
+		}
+		if err := d.startFolder(folder); err != nil {
+			fmt.Printf("Error starting folder %s: %v\n", folder.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// mapPort asks the router to forward the shared port, if it speaks UPnP
+func (d *Daemon) mapPort() {
+	upnp, err := network.NewUPnPClient()
+	if err != nil {
+		return
+	}
+	port := d.Port()
+	if err := upnp.AddPortMapping(port, port, "TCP"); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		upnp.RemovePortMapping(port, "TCP")
+		return
+	}
+	d.upnp = upnp
+	fmt.Printf("UPnP port forwarding enabled on port %d\n", port)
+}
+
+// Port returns the port peers connect to
+func (d *Daemon) Port() int {
+	if d.mux == nil {
+		return 0
+	}
+	return d.mux.Port()
+}
+
+// AddFolder registers a directory and, if the daemon is running, starts
+// syncing it
+func (d *Daemon) AddFolder(path string) (*config.Folder, error) {
+	folder, err := config.AddFolder(d.config.ConfigDir, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.mux != nil {
+		if err := d.startFolder(folder); err != nil {
+			return folder, err
+		}
+	}
+	return folder, nil
+}
+
+// RemoveFolder stops syncing a folder and removes it from the registry. Its
+// files and .fybrk data are left in place.
+func (d *Daemon) RemoveFolder(idOrPath string) (*config.Folder, error) {
+	folder, err := config.RemoveFolder(d.config.ConfigDir, idOrPath)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	client := d.clients[folder.ID]
+	delete(d.clients, folder.ID)
+	delete(d.failures, folder.ID)
+	d.mu.Unlock()
+
+	if client != nil {
+		if err := client.Close(); err != nil {
+			return folder, err
+		}
+	}
+	return folder, nil
+}
+
+// Folders returns the registered folders and whether each is syncing
+func (d *Daemon) Folders() ([]*FolderStatus, error) {
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	statuses := make([]*FolderStatus, 0, len(folders))
+	for _, folder := range folders {
+		status := &FolderStatus{Folder: folder}
+		if client, ok := d.clients[folder.ID]; ok {
+			status.Running = true
+			status.ConnectedDevices = client.GetConnectedDevices()
+		}
+		if err, ok := d.failures[folder.ID]; ok {
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Path < statuses[j].Path })
+	return statuses, nil
+}
+
+// Pause stops syncing the folder with the given ID or path until Resume.
+// An empty idOrPath pauses every folder. The pause outlasts a restart.
+func (d *Daemon) Pause(idOrPath string) error {
+	folders, err := d.selectFolders(idOrPath)
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		if _, err := config.SetFolderPaused(d.config.ConfigDir, folder.ID, true); err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		client := d.clients[folder.ID]
+		delete(d.clients, folder.ID)
+		delete(d.failures, folder.ID)
+		d.mu.Unlock()
+
+		if client != nil {
+			if err := client.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Resume restarts syncing a paused folder. An empty idOrPath resumes every
+// paused folder.
+func (d *Daemon) Resume(idOrPath string) error {
+	folders, err := d.selectFolders(idOrPath)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, folder := range folders {
+		folder, err := config.SetFolderPaused(d.config.ConfigDir, folder.ID, false)
+		if err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		_, running := d.clients[folder.ID]
+		d.mu.Unlock()
+
+		if !running && d.mux != nil {
+			if err := d.startFolder(folder); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Reload re-reads the folder registry, starting folders that were added or
+// resumed and stopping folders that were removed or paused since the daemon
+// last looked. It returns how many folders it started and stopped.
+func (d *Daemon) Reload() (started, stopped int, err error) {
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	wanted := make(map[string]*config.Folder)
+	for _, folder := range folders {
+		if !folder.Paused {
+			wanted[folder.ID] = folder
+		}
+	}
+
+	d.mu.Lock()
+	var stale []*Client
+	for id, client := range d.clients {
+		if wanted[id] == nil {
+			stale = append(stale, client)
+			delete(d.clients, id)
+		}
+	}
+	for id := range d.failures {
+		if wanted[id] == nil {
+			delete(d.failures, id)
+		}
+	}
+	var missing []*config.Folder
+	for id, folder := range wanted {
+		if _, running := d.clients[id]; !running {
+			missing = append(missing, folder)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, client := range stale {
+		if err := client.Close(); err != nil {
+			fmt.Printf("Error stopping folder: %v\n", err)
+		}
+		stopped++
+	}
+	for _, folder := range missing {
+		if err := d.startFolder(folder); err != nil {
+			fmt.Printf("Error starting folder %s: %v\n", folder.Path, err)
+			continue
+		}
+		started++
+	}
+	return started, stopped, nil
+}
+
+// SetRetention changes the version and trash retention of every folder,
+// running or started later
+func (d *Daemon) SetRetention(versions *storage.VersionRetention, trash time.Duration) {
+	d.startMu.Lock()
+	defer d.startMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config.VersionRetention = versions
+	d.config.TrashRetention = trash
+	for _, client := range d.clients {
+		client.SetRetention(versions, trash)
+	}
+}
+
+// selectFolders returns the folder with the given ID or path, or every
+// folder if idOrPath is empty
+func (d *Daemon) selectFolders(idOrPath string) ([]*config.Folder, error) {
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+	if idOrPath == "" {
+		return folders, nil
+	}
+
+	folder := config.FindFolder(folders, idOrPath)
+	if folder == nil {
+		return nil, config.ErrFolderNotFound
+	}
+	return []*config.Folder{folder}, nil
+}
+
+// Client returns the client syncing the folder with the given ID or path
+func (d *Daemon) Client(idOrPath string) (*Client, error) {
+	folders, err := config.LoadFolders(d.config.ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+	folder := config.FindFolder(folders, idOrPath)
+	if folder == nil {
+		return nil, config.ErrFolderNotFound
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	client, ok := d.clients[folder.ID]
+	if !ok && folder.Paused {
+		return nil, fmt.Errorf("folder %s is paused", folder.Path)
+	}
+	if !ok {
+		return nil, fmt.Errorf("folder %s is not running", folder.Path)
+	}
+	return client, nil
+}
+
+// startFolder opens a folder, creating its key on first use, and joins it
+// to the shared listener. A folder that is already running is left alone.
+func (d *Daemon) startFolder(folder *config.Folder) error {
+	d.startMu.Lock()
+	defer d.startMu.Unlock()
+
+	d.mu.Lock()
+	_, running := d.clients[folder.ID]
+	closed := d.closed
+	d.mu.Unlock()
+	if running {
+		return nil
+	}
+	if closed {
+		return fmt.Errorf("daemon is shutting down")
+	}
+
+	client, err := d.openFolder(folder)
+	if err == nil {
+		if err = client.ScanDirectory(); err == nil {
+			err = client.EnableSharedMultiDeviceSync(d.mux, folder.ID)
+		}
+		if err != nil {
+			client.Close()
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.failures[folder.ID] = err
+		return err
+	}
+	delete(d.failures, folder.ID)
+	d.clients[folder.ID] = client
+	return nil
+}
+
+func (d *Daemon) openFolder(folder *config.Folder) (*Client, error) {
+	fybrDir := filepath.Join(folder.Path, ".fybrk")
+	if err := os.MkdirAll(fybrDir, 0755); err != nil {
+		return nil, err
+	}
+
+	var passphrase storage.PassphraseFunc
+	if d.config.Passphrase != nil {
+		passphrase = d.config.Passphrase(folder.Path)
+	}
+
+	return NewClient(&Config{
+		SyncPath:         folder.Path,
+		DBPath:           filepath.Join(fybrDir, "metadata.db"),
+		Identity:         d.config.Identity,
+		ChunkSize:        1024 * 1024,
+		KeyDir:           fybrDir,
+		Passphrase:       passphrase,
+		ConflictPolicy:   folder.ConflictPolicy,
+		ConflictRules:    folder.ConflictRules,
+		VersionRetention: d.config.VersionRetention,
+		TrashRetention:   d.config.TrashRetention,
+	})
+}
+
+// Shutdown stops syncing all folders, each given up to timeout to finish
+// its transfers, removes the port mapping and closes the listener. The
+// summary adds up those of all folders.
+func (d *Daemon) Shutdown(timeout time.Duration) (*ShutdownSummary, error) {
+	d.startMu.Lock()
+	defer d.startMu.Unlock()
+
+	d.mu.Lock()
+	clients := d.clients
+	d.clients = make(map[string]*Client)
+	upnp := d.upnp
+	d.upnp = nil
+	d.closed = true
+	d.mu.Unlock()
+
+	if upnp != nil {
+		upnp.RemovePortMapping(d.Port(), "TCP")
+	}
+
+	// Stop taking new peers for any folder before draining
+	var firstErr error
+	if d.mux != nil {
+		if err := d.mux.Close(); err != nil {
+			firstErr = err
+		}
+	}
+
+	var (
+		wg    gosync.WaitGroup
+		mu    gosync.Mutex
+		total = &ShutdownSummary{}
+	)
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			summary, err := client.Shutdown(timeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			total.Peers += summary.Peers
+			total.FilesSent += summary.FilesSent
+			total.FilesReceived += summary.FilesReceived
+			total.Interrupted += summary.Interrupted
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(client)
+	}
+	wg.Wait()
+	return total, firstErr
+}
+
+// Close stops syncing all folders without waiting for transfers
+func (d *Daemon) Close() error {
+	_, err := d.Shutdown(0)
+	return err
+}
@@ -0,0 +1,143 @@
+package fybrk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDaemon(t *testing.T) *Daemon {
+	id, err := identity.Generate()
+	require.NoError(t, err)
+	return NewDaemon(DaemonConfig{ConfigDir: t.TempDir(), Identity: id})
+}
+
+func TestDaemonManagesFolders(t *testing.T) {
+	daemon := newTestDaemon(t)
+	require.NoError(t, daemon.Start())
+	defer daemon.Close()
+
+	photos, documents := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(photos, "cat.jpg"), []byte("meow"), 0644))
+
+	photosFolder, err := daemon.AddFolder(photos)
+	require.NoError(t, err)
+	documentsFolder, err := daemon.AddFolder(documents)
+	require.NoError(t, err)
+	assert.NotEqual(t, photosFolder.ID, documentsFolder.ID)
+
+	_, err = daemon.AddFolder(photos)
+	assert.ErrorIs(t, err, config.ErrFolderExists)
+	_, err = daemon.AddFolder(filepath.Join(photos, "nested"))
+	assert.Error(t, err)
+
+	// Each folder has its own key and database
+	photosClient, err := daemon.Client(photosFolder.ID)
+	require.NoError(t, err)
+	documentsClient, err := daemon.Client(documents)
+	require.NoError(t, err)
+	assert.NotEqual(t, photosClient.FolderKey(), documentsClient.FolderKey())
+
+	files, err := photosClient.GetSyncedFiles()
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	files, err = documentsClient.GetSyncedFiles()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	statuses, err := daemon.Folders()
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	for _, status := range statuses {
+		assert.True(t, status.Running)
+	}
+
+	// Removing a folder stops it but keeps its data
+	_, err = daemon.RemoveFolder(photosFolder.ID)
+	require.NoError(t, err)
+	_, err = daemon.Client(photosFolder.ID)
+	assert.ErrorIs(t, err, config.ErrFolderNotFound)
+	assert.FileExists(t, filepath.Join(photos, ".fybrk", "key"))
+
+	statuses, err = daemon.Folders()
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, documentsFolder.ID, statuses[0].ID)
+}
+
+func TestDaemonStartsRegisteredFolders(t *testing.T) {
+	daemon := newTestDaemon(t)
+
+	// Folders added while the daemon is stopped start with it
+	folder, err := daemon.AddFolder(t.TempDir())
+	require.NoError(t, err)
+	statuses, err := daemon.Folders()
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.False(t, statuses[0].Running)
+
+	require.NoError(t, daemon.Start())
+	defer daemon.Close()
+
+	_, err = daemon.Client(folder.ID)
+	assert.NoError(t, err)
+	assert.NotZero(t, daemon.Port())
+}
+
+func TestDaemonReload(t *testing.T) {
+	daemon := newTestDaemon(t)
+	require.NoError(t, daemon.Start())
+	defer daemon.Close()
+
+	// Registry edits made behind the daemon's back take effect on reload
+	folder, err := config.AddFolder(daemon.config.ConfigDir, t.TempDir())
+	require.NoError(t, err)
+	started, stopped, err := daemon.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, 1, started)
+	assert.Equal(t, 0, stopped)
+	_, err = daemon.Client(folder.ID)
+	assert.NoError(t, err)
+
+	_, err = config.SetFolderPaused(daemon.config.ConfigDir, folder.ID, true)
+	require.NoError(t, err)
+	started, stopped, err = daemon.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, 0, started)
+	assert.Equal(t, 1, stopped)
+	_, err = daemon.Client(folder.ID)
+	assert.Error(t, err)
+}
+
+func TestDaemonResumesFolderOnce(t *testing.T) {
+	daemon := newTestDaemon(t)
+	require.NoError(t, daemon.Start())
+	defer daemon.Close()
+
+	folder, err := daemon.AddFolder(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, daemon.Pause(folder.ID))
+
+	// Concurrent resumes share one client rather than each opening the folder
+	clients := make(chan *Client, 4)
+	start := make(chan struct{})
+	for i := 0; i < cap(clients); i++ {
+		go func() {
+			<-start
+			assert.NoError(t, daemon.Resume(folder.ID))
+			client, err := daemon.Client(folder.ID)
+			assert.NoError(t, err)
+			clients <- client
+		}()
+	}
+	close(start)
+	first := <-clients
+	for i := 1; i < cap(clients); i++ {
+		assert.Same(t, first, <-clients)
+	}
+}
@@ -1,19 +1,39 @@
 package fybrk
 
 import (
+	"fmt"
+	gosync "sync"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/config"
+	"github.com/Fybrk/fybrk/internal/identity"
 	"github.com/Fybrk/fybrk/internal/storage"
 	"github.com/Fybrk/fybrk/internal/sync"
+	"github.com/Fybrk/fybrk/internal/transport"
 	"github.com/Fybrk/fybrk/pkg/types"
 )
 
+// PairingTTL is how long a pairing URL can be used
+const PairingTTL = 10 * time.Minute
+
 // Client provides the main API for Fybrk operations
 type Client struct {
 	metadataStore *storage.MetadataStore
 	chunker       *storage.Chunker
 	encryptor     *storage.Encryptor
 	engine        *sync.Engine
+	syncPath      string
+	keyDir        string
+	identity      *identity.Identity
+
+	mu         gosync.Mutex
+	invitation *Invitation // The invitation opened last
+	shutdown   *ShutdownSummary
 }
 
+// ShutdownSummary describes what happened during a sync session
+type ShutdownSummary = sync.ShutdownSummary
+
 // Config holds configuration for Fybrk client
 type Config struct {
 	SyncPath  string
@@ -21,6 +41,42 @@ type Config struct {
 	DeviceID  string
 	ChunkSize int
 	Key       []byte
+
+	// Identity is the device's signing key pair. When set, DeviceID is
+	// derived from it and peers must prove their own identity to connect.
+	Identity *identity.Identity
+
+	// KeyDir holds the folder key ring (usually SyncPath/.fybrk). When set,
+	// keys are loaded from there instead of Key, and RotateKey can be used.
+	KeyDir string
+
+	// Passphrase unlocks a passphrase protected key file in KeyDir. It is
+	// only called when the key file is sealed.
+	Passphrase func() (string, error)
+
+	// ContentDefinedChunking cuts chunks at content-defined boundaries so
+	// small edits only change nearby chunks. ChunkSize is ignored when set.
+	ContentDefinedChunking bool
+
+	// ConvergentEncryption makes identical chunks encrypt identically so
+	// they can be deduplicated while encrypted. See storage.EncryptionMode
+	// for what this reveals.
+	ConvergentEncryption bool
+
+	// ConflictPolicy settles files edited on two devices at once (see
+	// sync.NewConflictResolver); ConflictRules override it for files
+	// matching a glob pattern. By default text files are merged and both
+	// versions of anything else are kept.
+	ConflictPolicy string
+	ConflictRules  []config.ConflictRule
+
+	// VersionRetention decides which past versions of files are kept for
+	// restoring. Nil means storage.DefaultVersionRetention.
+	VersionRetention *storage.VersionRetention
+
+	// TrashRetention is how long files deleted by peers are kept in
+	// .fybrk/trash. Zero means storage.DefaultTrashRetention.
+	TrashRetention time.Duration
 }
 
 // NewClient creates a new Fybrk client
@@ -30,30 +86,209 @@ func NewClient(config *Config) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.VersionRetention != nil {
+		metadataStore.SetVersionRetention(*config.VersionRetention)
+	}
 
 	// Create chunker
-	chunker := storage.NewChunker(config.ChunkSize)
+	var chunkerOpts []storage.ChunkerOption
+	if config.ContentDefinedChunking {
+		chunkerOpts = append(chunkerOpts, storage.WithContentDefinedChunking(
+			storage.DefaultMinChunkSize, storage.DefaultAvgChunkSize, storage.DefaultMaxChunkSize))
+	}
+	chunker := storage.NewChunker(config.ChunkSize, chunkerOpts...)
 
 	// Create encryptor
-	encryptor, err := storage.NewEncryptor(config.Key)
+	encryptionMode := storage.RandomNonceEncryption
+	if config.ConvergentEncryption {
+		encryptionMode = storage.ConvergentEncryption
+	}
+	var encryptor *storage.Encryptor
+	if config.KeyDir != "" {
+		keyRing, err := storage.LoadOrCreateKeyRing(config.KeyDir, config.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		encryptor = storage.NewEncryptorWithKeyRing(keyRing, storage.WithEncryptionMode(encryptionMode))
+	} else {
+		encryptor, err = storage.NewEncryptor(config.Key, storage.WithEncryptionMode(encryptionMode))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conflictPolicies, err := sync.NewConflictPolicies(config.ConflictPolicy, config.ConflictRules)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create sync engine
-	engine, err := sync.NewEngine(metadataStore, chunker, encryptor, config.SyncPath, config.DeviceID)
+	deviceID := config.DeviceID
+	if config.Identity != nil {
+		deviceID = config.Identity.DeviceID()
+	}
+	engine, err := sync.NewEngine(metadataStore, chunker, encryptor, config.SyncPath, deviceID)
 	if err != nil {
 		return nil, err
 	}
+	if config.Identity != nil {
+		engine.SetIdentity(config.Identity)
+	}
+	if config.KeyDir != "" {
+		engine.SetKeyDir(config.KeyDir)
+	}
+	engine.SetConflictResolver(conflictPolicies)
+	if config.TrashRetention != 0 {
+		engine.SetTrashRetention(config.TrashRetention)
+	}
 
 	return &Client{
 		metadataStore: metadataStore,
 		chunker:       chunker,
 		encryptor:     encryptor,
 		engine:        engine,
+		syncPath:      config.SyncPath,
+		keyDir:        config.KeyDir,
+		identity:      config.Identity,
 	}, nil
 }
 
+// RotateKey starts a new key epoch for the folder and re-encrypts existing
+// chunks under it before returning. If that is cut short, the rest is
+// re-encrypted the next time the folder is opened. Devices listed in revoke
+// are revoked and cannot read anything written from now on. Every other
+// paired device is handed the new key when it next connects.
+func (c *Client) RotateKey(revoke ...string) (uint32, error) {
+	if c.keyDir == "" {
+		return 0, fmt.Errorf("key rotation requires a key directory")
+	}
+
+	keyRing := c.encryptor.KeyRing()
+	epoch, err := keyRing.Rotate(revoke...)
+	if err != nil {
+		return 0, err
+	}
+	if err := keyRing.Save(c.keyDir); err != nil {
+		return 0, fmt.Errorf("failed to save key ring: %v", err)
+	}
+
+	for _, deviceID := range revoke {
+		if err := c.engine.RevokeDevice(deviceID); err != nil && err != storage.ErrDeviceNotFound {
+			return epoch, fmt.Errorf("failed to revoke %s: %v", deviceID, err)
+		}
+	}
+	if err := c.engine.DistributeKey(); err != nil {
+		return epoch, fmt.Errorf("failed to distribute key: %v", err)
+	}
+
+	if _, err := c.engine.ReencryptStaleChunks(); err != nil {
+		return epoch, fmt.Errorf("failed to re-encrypt chunks: %v", err)
+	}
+	return epoch, nil
+}
+
+// ChangePassphrase re-seals the folder key file under a new passphrase. An
+// empty passphrase removes the protection.
+func (c *Client) ChangePassphrase(passphrase string) error {
+	if c.keyDir == "" {
+		return fmt.Errorf("changing the passphrase requires a key directory")
+	}
+
+	keyRing := c.encryptor.KeyRing()
+	keyRing.SetPassphrase(passphrase)
+	return keyRing.Save(c.keyDir)
+}
+
+// FolderKey returns the folder master key of the current epoch
+func (c *Client) FolderKey() []byte {
+	return c.encryptor.KeyRing().MasterKey()
+}
+
+// KeyEpoch returns the key epoch new data is encrypted under
+func (c *Client) KeyEpoch() uint32 {
+	return c.encryptor.KeyRing().CurrentEpoch()
+}
+
+// DeviceID returns the ID of this device
+func (c *Client) DeviceID() string {
+	return c.engine.DeviceID()
+}
+
+// ListDevices returns the devices in the registry
+func (c *Client) ListDevices() ([]*types.Device, error) {
+	return c.metadataStore.ListDevices()
+}
+
+// RenameDevice changes the name a device is shown under
+func (c *Client) RenameDevice(deviceID, name string) error {
+	return c.metadataStore.RenameDevice(deviceID, name)
+}
+
+// RevokeDevice refuses all further connections from a device. It keeps
+// the folder key it already has; rotate the key to stop it reading new data.
+func (c *Client) RevokeDevice(deviceID string) error {
+	return c.engine.RevokeDevice(deviceID)
+}
+
+// TrustDevice sets a device's trust level, lifting any revocation
+func (c *Client) TrustDevice(deviceID string, trustLevel int) error {
+	return c.metadataStore.SetDeviceTrust(deviceID, trustLevel)
+}
+
+// ListConflicts returns the conflicts waiting to be resolved, or all of
+// them if includeResolved is set
+func (c *Client) ListConflicts(includeResolved bool) ([]*types.Conflict, error) {
+	return c.engine.ListConflicts(includeResolved)
+}
+
+// ResolveConflict settles a conflict by keeping the current version, the
+// conflict copy or both (sync.KeepCurrent, sync.KeepCopy or sync.KeepBoth)
+func (c *Client) ResolveConflict(id int64, keep string) error {
+	return c.engine.ResolveConflict(id, keep)
+}
+
+// FileHistory returns the past versions kept of a file, given by its path
+// in the folder, newest first
+func (c *Client) FileHistory(path string) ([]*types.FileVersion, error) {
+	return c.engine.FileHistory(path)
+}
+
+// RestoreVersion makes a past version of a file, by ID as listed by
+// FileHistory, its current version
+func (c *Client) RestoreVersion(path string, id int64) error {
+	return c.engine.RestoreVersion(path, id)
+}
+
+// ListTrash returns the files deleted by peers that are kept in the trash
+func (c *Client) ListTrash() ([]*storage.TrashEntry, error) {
+	return c.engine.ListTrash()
+}
+
+// RestoreFromTrash puts a trashed file back where it was and syncs it to
+// the other devices again
+func (c *Client) RestoreFromTrash(id string) (*storage.TrashEntry, error) {
+	return c.engine.RestoreFromTrash(id)
+}
+
+// EmptyTrash deletes the files in the trash for good
+func (c *Client) EmptyTrash() (int, error) {
+	return c.engine.EmptyTrash()
+}
+
+// SetRetention changes which past versions and deleted files are kept, as
+// Config.VersionRetention and Config.TrashRetention do when the client is
+// created
+func (c *Client) SetRetention(versions *storage.VersionRetention, trash time.Duration) {
+	if versions == nil {
+		versions = &storage.DefaultVersionRetention
+	}
+	if trash == 0 {
+		trash = storage.DefaultTrashRetention
+	}
+	c.metadataStore.SetVersionRetention(*versions)
+	c.engine.SetTrashRetention(trash)
+}
+
 // ScanDirectory scans the sync directory for changes
 func (c *Client) ScanDirectory() error {
 	return c.engine.ScanDirectory()
@@ -69,15 +304,46 @@ func (c *Client) EnableMultiDeviceSync(port int) error {
 	return c.engine.EnableMultiDeviceSync(port)
 }
 
+// EnableSharedMultiDeviceSync enables peer-to-peer synchronization over a
+// listener shared with the daemon's other folders
+func (c *Client) EnableSharedMultiDeviceSync(mux *transport.Mux, folderID string) error {
+	return c.engine.EnableSharedMultiDeviceSync(mux, folderID)
+}
+
 // GetConnectedDevices returns list of connected device IDs
 func (c *Client) GetConnectedDevices() []string {
 	return c.engine.GetConnectedDevices()
 }
 
-// Close closes the client and releases resources
-func (c *Client) Close() error {
-	if err := c.engine.Close(); err != nil {
-		return err
+// Shutdown stops syncing cleanly. It cancels any open invitation, stops
+// accepting peers, waits up to timeout for transfers in progress, then
+// disconnects and closes the database. Calling it again returns the first
+// summary.
+func (c *Client) Shutdown(timeout time.Duration) (*ShutdownSummary, error) {
+	c.mu.Lock()
+	if c.shutdown != nil {
+		c.mu.Unlock()
+		return c.shutdown, nil
+	}
+	c.shutdown = &ShutdownSummary{}
+	if c.invitation != nil {
+		c.invitation.Cancel()
 	}
-	return c.metadataStore.Close()
+	c.mu.Unlock()
+
+	summary, err := c.engine.Shutdown(timeout)
+	c.mu.Lock()
+	c.shutdown = summary
+	c.mu.Unlock()
+	if err != nil {
+		return summary, err
+	}
+	return summary, c.metadataStore.Close()
+}
+
+// Close closes the client and releases resources without waiting for
+// transfers
+func (c *Client) Close() error {
+	_, err := c.Shutdown(0)
+	return err
 }
@@ -5,7 +5,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/Fybrk/fybrk/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -174,3 +176,68 @@ func TestClientClose(t *testing.T) {
 	err = client.Close()
 	assert.NoError(t, err)
 }
+
+func TestClientShutdown(t *testing.T) {
+	tmpDir := t.TempDir()
+	syncPath := filepath.Join(tmpDir, "sync")
+	require.NoError(t, os.MkdirAll(syncPath, 0755))
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	client, err := NewClient(&Config{
+		SyncPath:  syncPath,
+		DBPath:    filepath.Join(tmpDir, "test.db"),
+		DeviceID:  "test-device",
+		ChunkSize: 1024,
+		Key:       key,
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.EnableMultiDeviceSync(0))
+
+	summary, err := client.Shutdown(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, &ShutdownSummary{}, summary)
+
+	// Shutting down again returns the same summary
+	again, err := client.Shutdown(time.Second)
+	assert.NoError(t, err)
+	assert.Same(t, summary, again)
+	assert.NoError(t, client.Close())
+}
+
+func TestClientSetRetention(t *testing.T) {
+	tmpDir := t.TempDir()
+	syncPath := filepath.Join(tmpDir, "sync")
+	require.NoError(t, os.MkdirAll(syncPath, 0755))
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	client, err := NewClient(&Config{
+		SyncPath:  syncPath,
+		DBPath:    filepath.Join(tmpDir, "test.db"),
+		DeviceID:  "test-device",
+		ChunkSize: 1024,
+		Key:       key,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	testFile := filepath.Join(syncPath, "test.txt")
+	for _, content := range []string{"one", "two", "three", "four"} {
+		require.NoError(t, os.WriteFile(testFile, []byte(content), 0644))
+		require.NoError(t, client.ScanDirectory())
+	}
+	history, err := client.FileHistory("test.txt")
+	require.NoError(t, err)
+	assert.Greater(t, len(history), 1)
+
+	// A new retention applies the next time the file changes
+	client.SetRetention(&storage.VersionRetention{KeepLast: 1}, time.Hour)
+	require.NoError(t, os.WriteFile(testFile, []byte("five"), 0644))
+	require.NoError(t, client.ScanDirectory())
+	history, err = client.FileHistory("test.txt")
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
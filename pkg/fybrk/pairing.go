@@ -0,0 +1,272 @@
+package fybrk
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/pairing"
+	"github.com/Fybrk/fybrk/internal/storage"
+)
+
+// States of an invitation
+const (
+	InvitationWaiting    = "waiting"    // No device has used the URL yet
+	InvitationConfirming = "confirming" // The users are comparing codes
+	InvitationPaired     = "paired"
+	InvitationFailed     = "failed"
+)
+
+var (
+	ErrNoInvitation       = errors.New("no pairing invitation is open")
+	ErrNothingToConfirm   = errors.New("no pairing code is waiting to be confirmed")
+	errInvitationCanceled = errors.New("pairing cancelled")
+)
+
+// ConfirmFunc asks the user whether the other device shows the same code
+type ConfirmFunc func(code, deviceName string) (bool, error)
+
+// Invitation is an open invitation for another device to join the folder.
+// Its URL carries a one-time secret and the addresses this device waits on,
+// never the folder key: the keys are sent over the pairing channel once
+// the devices have run SPAKE2 on the secret and the users have compared
+// codes. The URL is spent by the first attempt or when it expires.
+type Invitation struct {
+	URL       string
+	ExpiresAt time.Time
+
+	listener net.Listener
+	confirm  ConfirmFunc
+	answer   chan bool
+	done     chan struct{}
+	mu       gosync.Mutex
+	status   InvitationStatus
+	err      error
+}
+
+// InvitationStatus is how far an invitation got. Code and Device are set
+// while the users compare codes and once the device is paired.
+type InvitationStatus struct {
+	State  string `json:"state"`
+	Code   string `json:"code,omitempty"`
+	Device string `json:"device,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Invite opens an invitation for another device to join this folder,
+// cancelling any earlier one. confirm shows the code both devices display;
+// if it is nil the invitation waits for Confirm instead, as a daemon does.
+// The device that joins is stored as trusted in the registry.
+func (c *Client) Invite(confirm ConfirmFunc) (*Invitation, error) {
+	if c.identity == nil {
+		return nil, fmt.Errorf("pairing requires a device identity")
+	}
+
+	pm := pairing.NewDevicePairingManager(c.identity, pairing.DefaultDeviceName())
+	pm.SetDeviceStore(c.metadataStore)
+	secret, expiresAt, err := pm.NewPairingSecret(PairingTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for pairing: %v", err)
+	}
+	listener.(*net.TCPListener).SetDeadline(expiresAt)
+
+	token := &pairing.PairToken{
+		DeviceID:  c.identity.DeviceID(),
+		Secret:    secret,
+		Addresses: pairing.AddressHints(listener.Addr().(*net.TCPAddr).Port),
+		ExpiresAt: expiresAt,
+	}
+	inv := &Invitation{
+		URL:       token.URL(),
+		ExpiresAt: expiresAt,
+		listener:  listener,
+		confirm:   confirm,
+		answer:    make(chan bool, 1),
+		done:      make(chan struct{}),
+		status:    InvitationStatus{State: InvitationWaiting},
+	}
+	pm.SetConfirmCallback(inv.confirmCode)
+
+	c.mu.Lock()
+	earlier := c.invitation
+	c.invitation = inv
+	c.mu.Unlock()
+	if earlier != nil {
+		earlier.Cancel()
+	}
+
+	go inv.serve(pm, c.encryptor.KeyRing())
+	return inv, nil
+}
+
+// Invitation returns the invitation opened last, or ErrNoInvitation
+func (c *Client) Invitation() (*Invitation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invitation == nil {
+		return nil, ErrNoInvitation
+	}
+	return c.invitation, nil
+}
+
+// serve accepts a single pairing attempt and hands over the folder keys
+func (inv *Invitation) serve(pm *pairing.DevicePairingManager, keyRing *storage.KeyRing) {
+	conn, err := inv.listener.Accept()
+	inv.listener.Close()
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			inv.finish(errInvitationCanceled)
+		} else {
+			inv.finish(pairing.ErrPairTokenExpired)
+		}
+		return
+	}
+
+	session, err := pm.Accept(conn)
+	if err != nil {
+		inv.finish(err)
+		return
+	}
+	defer session.Close()
+
+	if err := session.Send(pairing.NewWelcome(keyRing, nil)); err != nil {
+		inv.finish(fmt.Errorf("failed to send folder key: %v", err))
+		return
+	}
+
+	inv.mu.Lock()
+	inv.status = InvitationStatus{State: InvitationPaired, Code: session.SAS, Device: session.Device.Name}
+	inv.mu.Unlock()
+	inv.finish(nil)
+}
+
+// confirmCode is the SAS callback of the pairing handshake
+func (inv *Invitation) confirmCode(sas string, device *pairing.PairedDevice) (bool, error) {
+	if inv.confirm != nil {
+		return inv.confirm(sas, device.Name)
+	}
+
+	inv.mu.Lock()
+	inv.status = InvitationStatus{State: InvitationConfirming, Code: sas, Device: device.Name}
+	inv.mu.Unlock()
+
+	select {
+	case accepted := <-inv.answer:
+		return accepted, nil
+	case <-time.After(pairing.ConfirmTimeout):
+		return false, nil
+	}
+}
+
+// Confirm answers the code comparison of an invitation opened without a
+// ConfirmFunc
+func (inv *Invitation) Confirm(accept bool) error {
+	inv.mu.Lock()
+	confirming := inv.status.State == InvitationConfirming
+	inv.mu.Unlock()
+	if !confirming {
+		return ErrNothingToConfirm
+	}
+
+	select {
+	case inv.answer <- accept:
+	default: // Already answered
+	}
+	return nil
+}
+
+// Status reports how far the invitation got
+func (inv *Invitation) Status() InvitationStatus {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.status
+}
+
+// Wait blocks until a device has used the invitation or it expired, and
+// reports whether pairing succeeded
+func (inv *Invitation) Wait() error {
+	<-inv.done
+	return inv.err
+}
+
+// Cancel withdraws the invitation if it has not been used yet
+func (inv *Invitation) Cancel() {
+	inv.listener.Close()
+}
+
+func (inv *Invitation) finish(err error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	select {
+	case <-inv.done:
+		return
+	default:
+	}
+	if err != nil {
+		inv.status = InvitationStatus{State: InvitationFailed, Error: err.Error()}
+	}
+	inv.err = err
+	close(inv.done)
+}
+
+// JoinFolder joins the folder another device shared as pairURL. It pairs
+// with that device, stores the folder keys it hands over in config.KeyDir
+// and returns a client for the folder, with the inviting device trusted in
+// its registry. confirm shows the code both devices display.
+func JoinFolder(pairURL string, config *Config, confirm ConfirmFunc) (*Client, error) {
+	token, err := pairing.ParsePairURL(pairURL)
+	if err != nil {
+		return nil, err
+	}
+	if config.Identity == nil || config.KeyDir == "" {
+		return nil, fmt.Errorf("joining a folder requires a device identity and a key directory")
+	}
+	if _, err := os.Stat(filepath.Join(config.KeyDir, "key")); err == nil {
+		return nil, fmt.Errorf("%s already belongs to a synced folder", config.SyncPath)
+	}
+
+	pm := pairing.NewDevicePairingManager(config.Identity, pairing.DefaultDeviceName())
+	pm.SetConfirmCallback(func(sas string, device *pairing.PairedDevice) (bool, error) {
+		return confirm(sas, device.Name)
+	})
+	session, err := pm.InitiateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var welcome pairing.Welcome
+	if err := session.Receive(&welcome); err != nil {
+		return nil, fmt.Errorf("failed to receive folder key: %v", err)
+	}
+	keyRing, err := welcome.KeyRing()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.KeyDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := keyRing.Save(config.KeyDir); err != nil {
+		return nil, fmt.Errorf("failed to save folder key: %v", err)
+	}
+
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.metadataStore.StoreDevice(session.Device.ToDevice()); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to save paired device: %v", err)
+	}
+	return client, nil
+}
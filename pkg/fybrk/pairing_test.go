@@ -0,0 +1,105 @@
+package fybrk
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Fybrk/fybrk/internal/identity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func acceptAll(code, deviceName string) (bool, error) {
+	return true, nil
+}
+
+// newPairingConfig returns the config of a folder with its own identity
+func newPairingConfig(t *testing.T) *Config {
+	id, err := identity.Generate()
+	require.NoError(t, err)
+	syncPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(syncPath, ".fybrk"), 0755))
+	return &Config{
+		SyncPath:  syncPath,
+		DBPath:    filepath.Join(syncPath, ".fybrk", "metadata.db"),
+		Identity:  id,
+		ChunkSize: 1024,
+		KeyDir:    filepath.Join(syncPath, ".fybrk"),
+	}
+}
+
+func TestInviteAndJoin(t *testing.T) {
+	inviterConfig := newPairingConfig(t)
+	inviter, err := NewClient(inviterConfig)
+	require.NoError(t, err)
+	defer inviter.Close()
+	_, err = inviter.RotateKey("old-laptop")
+	require.NoError(t, err)
+
+	inv, err := inviter.Invite(acceptAll)
+	require.NoError(t, err)
+
+	// The URL carries neither a folder key nor the local path
+	for _, key := range inviter.encryptor.KeyRing().EpochKeys() {
+		assert.NotContains(t, strings.ToLower(inv.URL), hex.EncodeToString(key))
+	}
+	assert.NotContains(t, inv.URL, "encryption_key")
+	assert.NotContains(t, inv.URL, filepath.Base(inviterConfig.SyncPath))
+
+	joinerConfig := newPairingConfig(t)
+	joiner, err := JoinFolder(inv.URL, joinerConfig, acceptAll)
+	require.NoError(t, err)
+	defer joiner.Close()
+	require.NoError(t, inv.Wait())
+	assert.Equal(t, InvitationPaired, inv.Status().State)
+
+	// The joiner has every epoch's key and knows who was revoked
+	joinerKeys := joiner.encryptor.KeyRing()
+	assert.Equal(t, inviter.encryptor.KeyRing().EpochKeys(), joinerKeys.EpochKeys())
+	assert.Equal(t, inviter.KeyEpoch(), joiner.KeyEpoch())
+	assert.True(t, joinerKeys.IsRevoked("old-laptop"))
+
+	// Each side trusts the other
+	device, err := inviter.metadataStore.GetDevice(joiner.DeviceID())
+	require.NoError(t, err)
+	assert.True(t, device.Trusted())
+	device, err = joiner.metadataStore.GetDevice(inviter.DeviceID())
+	require.NoError(t, err)
+	assert.True(t, device.Trusted())
+
+	// The URL is spent
+	_, err = JoinFolder(inv.URL, newPairingConfig(t), acceptAll)
+	assert.Error(t, err)
+}
+
+func TestInviteConfirmedLater(t *testing.T) {
+	inviter, err := NewClient(newPairingConfig(t))
+	require.NoError(t, err)
+	defer inviter.Close()
+
+	inv, err := inviter.Invite(nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, inv.Confirm(true), ErrNothingToConfirm)
+
+	joined := make(chan error, 1)
+	go func() {
+		joiner, err := JoinFolder(inv.URL, newPairingConfig(t), acceptAll)
+		if err == nil {
+			joiner.Close()
+		}
+		joined <- err
+	}()
+
+	// The code waits for an answer, as it would from a daemon's user
+	require.Eventually(t, func() bool { return inv.Status().State == InvitationConfirming }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, inv.Status().Code, 6)
+	require.NoError(t, inv.Confirm(false))
+
+	assert.Error(t, <-joined)
+	assert.Error(t, inv.Wait())
+	assert.Equal(t, InvitationFailed, inv.Status().State)
+}
@@ -13,14 +13,75 @@ type Chunk struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// FileMetadata represents file information in the sync system
+// FileMetadata represents file information in the sync system. Version
+// grows with every change; VersionVector records which devices made them.
 type FileMetadata struct {
-	Path    string     `json:"path"`
-	Hash    [32]byte   `json:"hash"`
-	Size    int64      `json:"size"`
-	ModTime time.Time  `json:"mod_time"`
-	Chunks  [][32]byte `json:"chunks"`
-	Version int64      `json:"version"`
+	Path          string        `json:"path"`
+	Hash          [32]byte      `json:"hash"`
+	Size          int64         `json:"size"`
+	ModTime       time.Time     `json:"mod_time"`
+	Chunks        [][32]byte    `json:"chunks"`
+	Version       int64         `json:"version"`
+	VersionVector VersionVector `json:"version_vector,omitempty"`
+	ModifiedBy    string        `json:"modified_by,omitempty"` // Device that made this version
+}
+
+// FileVersion is a past version of a file kept in its history. ReplacedAt
+// is when a newer version replaced it, or when the file was deleted.
+type FileVersion struct {
+	ID int64 `json:"id"`
+	FileMetadata
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// Tombstone records that a file was deleted, so the deletion reaches
+// devices that were offline instead of the file coming back from them. Its
+// version vector descends from the version that was deleted. A file that
+// was moved leaves a tombstone naming where it went.
+type Tombstone struct {
+	Path          string        `json:"path"`
+	VersionVector VersionVector `json:"version_vector"`
+	DeletedBy     string        `json:"deleted_by"`
+	DeletedAt     time.Time     `json:"deleted_at"`
+	MovedTo       string        `json:"moved_to,omitempty"`
+}
+
+// CompareVersion reports how this version of a file relates to other. Files
+// recorded before version vectors existed fall back to comparing Version.
+func (f *FileMetadata) CompareVersion(other *FileMetadata) Ordering {
+	if len(f.VersionVector) > 0 && len(other.VersionVector) > 0 {
+		return f.VersionVector.Compare(other.VersionVector)
+	}
+
+	switch {
+	case f.Version > other.Version:
+		return Newer
+	case f.Version < other.Version:
+		return Older
+	}
+	return Equal
+}
+
+// Conflict records a file that was changed on two devices at once and our
+// version lost. If both versions were kept, ours is at CopyPath until the
+// user resolves the conflict; if they were merged, CopyPath holds the merge
+// with our side of the lines both changed. Conflicts settled by a policy
+// that drops the loser are recorded as already resolved.
+type Conflict struct {
+	ID         int64         `json:"id"`
+	Path       string        `json:"path"`
+	CopyPath   string        `json:"copy_path"`
+	DeviceID   string        `json:"device_id"`  // Device whose version won
+	Resolution string        `json:"resolution"` // local_wins, remote_wins, merge, manual
+	LocalFile  *FileMetadata `json:"local_file"`
+	RemoteFile *FileMetadata `json:"remote_file"`
+	DetectedAt time.Time     `json:"detected_at"`
+	ResolvedAt time.Time     `json:"resolved_at,omitempty"`
+}
+
+// Resolved reports whether the user has resolved the conflict
+func (c *Conflict) Resolved() bool {
+	return !c.ResolvedAt.IsZero()
 }
 
 // DeviceProfile defines how a device handles data
@@ -38,6 +99,19 @@ type Device struct {
 	Name     string        `json:"name"`
 	Profile  DeviceProfile `json:"profile"`
 	LastSeen time.Time     `json:"last_seen"`
+
+	// Set once the device has been paired
+	PublicKey    string   `json:"public_key,omitempty"`
+	TrustLevel   int      `json:"trust_level,omitempty"`
+	DeviceType   string   `json:"device_type,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Revoked      bool     `json:"revoked,omitempty"`
+}
+
+// Trusted reports whether the device may connect: it has been paired with
+// a trust level and has not been revoked
+func (d *Device) Trusted() bool {
+	return d.TrustLevel > 0 && !d.Revoked
 }
 
 // SyncEvent represents a synchronization event
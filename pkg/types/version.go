@@ -0,0 +1,85 @@
+package types
+
+// VersionVector counts the changes each device has made to a file. Two
+// vectors tell whether one version descends from the other or whether both
+// were edited independently.
+type VersionVector map[string]uint64
+
+// Ordering is how one version vector relates to another
+type Ordering int
+
+const (
+	Equal      Ordering = iota // Same history
+	Newer                      // Descends from the other version
+	Older                      // The other version descends from this one
+	Concurrent                 // Changed independently on different devices
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Newer:
+		return "newer"
+	case Older:
+		return "older"
+	case Concurrent:
+		return "concurrent"
+	}
+	return "unknown"
+}
+
+// Copy returns an independent copy of the vector
+func (v VersionVector) Copy() VersionVector {
+	c := make(VersionVector, len(v))
+	for device, counter := range v {
+		c[device] = counter
+	}
+	return c
+}
+
+// Increment returns a copy of the vector recording one more change by
+// deviceID
+func (v VersionVector) Increment(deviceID string) VersionVector {
+	c := v.Copy()
+	c[deviceID]++
+	return c
+}
+
+// Merge returns a vector that descends from both v and other
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	c := v.Copy()
+	for device, counter := range other {
+		if counter > c[device] {
+			c[device] = counter
+		}
+	}
+	return c
+}
+
+// Compare reports how v relates to other
+func (v VersionVector) Compare(other VersionVector) Ordering {
+	newer, older := false, false
+	for device, counter := range v {
+		if counter > other[device] {
+			newer = true
+		} else if counter < other[device] {
+			older = true
+		}
+	}
+	for device, counter := range other {
+		if _, ok := v[device]; !ok && counter > 0 {
+			older = true
+		}
+	}
+
+	switch {
+	case newer && older:
+		return Concurrent
+	case newer:
+		return Newer
+	case older:
+		return Older
+	}
+	return Equal
+}
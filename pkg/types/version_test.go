@@ -0,0 +1,48 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionVectorCompare(t *testing.T) {
+	base := VersionVector{}.Increment("laptop")
+	assert.Equal(t, VersionVector{"laptop": 1}, base)
+
+	onLaptop := base.Increment("laptop")
+	onPhone := base.Increment("phone")
+
+	assert.Equal(t, Equal, base.Compare(base.Copy()))
+	assert.Equal(t, Newer, onLaptop.Compare(base))
+	assert.Equal(t, Older, base.Compare(onPhone))
+	assert.Equal(t, Concurrent, onLaptop.Compare(onPhone))
+	assert.Equal(t, Concurrent, onPhone.Compare(onLaptop))
+
+	// Incrementing never modifies the original
+	assert.Equal(t, VersionVector{"laptop": 1}, base)
+
+	merged := onLaptop.Merge(onPhone)
+	assert.Equal(t, VersionVector{"laptop": 2, "phone": 1}, merged)
+	assert.Equal(t, Newer, merged.Compare(onLaptop))
+	assert.Equal(t, Newer, merged.Compare(onPhone))
+
+	assert.Equal(t, Newer, base.Compare(nil))
+	assert.Equal(t, Older, VersionVector(nil).Compare(base))
+	assert.Equal(t, "concurrent", Concurrent.String())
+}
+
+func TestFileMetadataCompareVersion(t *testing.T) {
+	legacy := &FileMetadata{Version: 2}
+	older := &FileMetadata{Version: 1, VersionVector: VersionVector{"laptop": 1}}
+	newer := &FileMetadata{Version: 3, VersionVector: VersionVector{"laptop": 1, "phone": 1}}
+	other := &FileMetadata{Version: 2, VersionVector: VersionVector{"laptop": 2}}
+
+	assert.Equal(t, Newer, newer.CompareVersion(older))
+	assert.Equal(t, Concurrent, newer.CompareVersion(other))
+
+	// Without vectors on both sides only the counter is compared
+	assert.Equal(t, Newer, legacy.CompareVersion(older))
+	assert.Equal(t, Older, legacy.CompareVersion(newer))
+	assert.Equal(t, Equal, legacy.CompareVersion(other))
+}